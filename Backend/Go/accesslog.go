@@ -0,0 +1,96 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "math/rand"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+)
+
+// accessLogger writes one entry per request in JSON or Apache combined
+// format. Sampling thins out successful requests on busy deployments;
+// server errors are always logged.
+type accessLogger struct {
+    mu         sync.Mutex
+    w          io.Writer
+    format     string
+    sampleRate float64
+}
+
+type accessLogEntry struct {
+    Time          time.Time `json:"time"`
+    Method        string    `json:"method"`
+    Path          string    `json:"path"`
+    Query         string    `json:"query,omitempty"`
+    Status        int       `json:"status"`
+    Bytes         int       `json:"bytes"`
+    LatencyMS     float64   `json:"latency_ms"`
+    Client        string    `json:"client"`
+    UserAgent     string    `json:"user_agent,omitempty"`
+    Tenant        string    `json:"tenant,omitempty"`
+    Routes        int       `json:"routes,omitempty"`
+    NodesExpanded int       `json:"nodes_expanded,omitempty"`
+}
+
+// newAccessLogger returns nil when format is "off".
+func newAccessLogger(format string, sampleRate float64) *accessLogger {
+    if format == "off" {
+        return nil
+    }
+    return &accessLogger{w: os.Stdout, format: format, sampleRate: sampleRate}
+}
+
+// withAccessLog logs every request served by next.
+func withAccessLog(logger *accessLogger, next http.Handler) http.Handler {
+    if logger == nil {
+        return next
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        r, scope := withScope(r)
+        rec := newStatusRecorder(w)
+        next.ServeHTTP(rec, r)
+
+        if rec.status < 500 && rand.Float64() >= logger.sampleRate {
+            return
+        }
+        client := clientIP(r)
+        entry := accessLogEntry{
+            Time:          start,
+            Method:        r.Method,
+            Path:          r.URL.Path,
+            Query:         redactQuery(r.URL.RawQuery),
+            Status:        rec.status,
+            Bytes:         rec.bytes,
+            LatencyMS:     float64(time.Since(start).Microseconds()) / 1000,
+            Client:        client,
+            UserAgent:     r.UserAgent(),
+            Routes:        scope.routes,
+            NodesExpanded: scope.nodesExpanded,
+        }
+        if scope.tenant != nil {
+            entry.Tenant = scope.tenant.ID
+        }
+        logger.write(r, entry)
+    })
+}
+
+func (l *accessLogger) write(r *http.Request, e accessLogEntry) {
+    var line []byte
+    if l.format == "json" {
+        line, _ = json.Marshal(e)
+    } else {
+        // Apache combined, followed by latency and search effort.
+        line = []byte(fmt.Sprintf("%s - - [%s] %q %d %d %q %q %.3fms %d",
+            e.Client, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+            r.Method+" "+redactedURI(r.URL)+" "+r.Proto,
+            e.Status, e.Bytes, r.Referer(), e.UserAgent, e.LatencyMS, e.NodesExpanded))
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.w.Write(append(line, '\n'))
+}
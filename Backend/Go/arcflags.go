@@ -0,0 +1,190 @@
+package main
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "os"
+)
+
+// Arc flags file format, version 1, written by the build-arc-flags command
+// next to a road network as <network>.arcflags. All values are
+// little-endian:
+//
+//	header   arcFlagsHeader
+//	alphas   alphaCount x float64
+//	flags    alphaCount x edgeCount x uint64
+//
+// The graph's bounding box is cut into grid x grid regions. Bit r of an
+// edge's flags is set when the edge lies on a shortest path into region r
+// at that alpha, so a search towards region r skips every other edge.
+const (
+    arcFlagsMagic   = "PICTAFL1"
+    arcFlagsSuffix  = ".arcflags"
+    maxArcFlagsGrid = 8
+)
+
+type arcFlagsHeader struct {
+    Magic       [8]byte
+    Grid        uint32
+    AlphaCount  uint32
+    EdgeCount   uint64
+    Version     [16]byte
+    RiskVersion [16]byte
+}
+
+// arcFlags are the precomputed flags of one graph and risk layer.
+type arcFlags struct {
+    grid        int
+    bounds      Bounds
+    riskVersion string
+    byAlpha     map[float64][]uint64
+}
+
+// region returns the grid cell p falls in; points outside the bounds count
+// as the nearest cell.
+func (f *arcFlags) region(p Point) int {
+    cell := func(v, lo, hi float64) int {
+        if hi <= lo {
+            return 0
+        }
+        return min(max(int((v-lo)/(hi-lo)*float64(f.grid)), 0), f.grid-1)
+    }
+    return cell(p.Y, f.bounds.MinY, f.bounds.MaxY)*f.grid + cell(p.X, f.bounds.MinX, f.bounds.MaxX)
+}
+
+// forSearch returns the flags and target bit a search on layer at alpha
+// towards goal may use, or nil when the flags were not built for them.
+func (f *arcFlags) forSearch(layer *riskLayer, alpha float64, goal Point) ([]uint64, uint64) {
+    if f == nil || layer.Version != f.riskVersion {
+        return nil, 0
+    }
+    flags, ok := f.byAlpha[alpha]
+    if !ok {
+        return nil, 0
+    }
+    return flags, 1 << f.region(goal)
+}
+
+// computeArcFlags builds flags for g's current risk layer at each alpha.
+// For every node on a region's boundary it grows a shortest-path tree
+// backwards over the graph and flags the tree edges for that region;
+// edges inside a region are always flagged for it.
+func computeArcFlags(r *RiskAwareRouter, grid int, alphas []float64) *arcFlags {
+    g := r.G
+    layer := r.layers.current()
+    f := &arcFlags{grid: grid, bounds: g.DataBounds, riskVersion: layer.Version, byAlpha: make(map[float64][]uint64)}
+
+    regions := make([]int, len(g.Nodes))
+    for id, p := range g.Nodes {
+        regions[id] = f.region(p)
+    }
+    reverse := r.reverseEdges()
+    var boundary []int32
+    for id := range g.Nodes {
+        lo, hi := g.edgeRange(int32(id))
+        for e := lo; e < hi; e++ {
+            if regions[g.targets[e]] != regions[id] {
+                boundary = append(boundary, int32(id))
+                break
+            }
+        }
+    }
+
+    s := newSearchState(len(g.Nodes))
+    for _, alpha := range alphas {
+        weights := r.weightsFor(layer, alpha)
+        flags := make([]uint64, len(g.targets))
+        for id := range g.Nodes {
+            lo, hi := g.edgeRange(int32(id))
+            for e := lo; e < hi; e++ {
+                if regions[g.targets[e]] == regions[id] {
+                    flags[e] |= 1 << regions[id]
+                }
+            }
+        }
+        for _, b := range boundary {
+            bit := uint64(1) << regions[b]
+            growBackward(g, s, b, weights, reverse, nil)
+            for _, u := range s.touched {
+                if e := s.cameFrom[u]; e >= 0 {
+                    flags[e] |= bit
+                }
+            }
+            s.reset()
+        }
+        f.byAlpha[alpha] = flags
+    }
+    return f
+}
+
+func (f *arcFlags) write(w io.Writer, g *Graph, alphas []float64) error {
+    h := arcFlagsHeader{Grid: uint32(f.grid), AlphaCount: uint32(len(alphas)), EdgeCount: uint64(len(g.targets))}
+    copy(h.Magic[:], arcFlagsMagic)
+    copy(h.Version[:], g.Version)
+    copy(h.RiskVersion[:], f.riskVersion)
+
+    bw := bufio.NewWriter(w)
+    sw := &sectionWriter{w: bw}
+    sw.write(h)
+    sw.write(alphas)
+    for _, alpha := range alphas {
+        sw.write(f.byAlpha[alpha])
+    }
+    if sw.err != nil {
+        return sw.err
+    }
+    return bw.Flush()
+}
+
+// readArcFlags loads flags for g, rejecting files built for another graph.
+func readArcFlags(r io.Reader, g *Graph) (*arcFlags, error) {
+    br := bufio.NewReader(r)
+    var h arcFlagsHeader
+    if err := binary.Read(br, binary.LittleEndian, &h); err != nil {
+        return nil, err
+    }
+    if string(h.Magic[:]) != arcFlagsMagic {
+        return nil, fmt.Errorf("not an arc flags file")
+    }
+    if v := cString(h.Version[:]); v != g.Version || h.EdgeCount != uint64(len(g.targets)) {
+        return nil, fmt.Errorf("built for graph %s, serving %s", v, g.Version)
+    }
+    if h.Grid == 0 || h.Grid > maxArcFlagsGrid {
+        return nil, fmt.Errorf("invalid grid size %d", h.Grid)
+    }
+    alphas := make([]float64, h.AlphaCount)
+    if err := binary.Read(br, binary.LittleEndian, alphas); err != nil {
+        return nil, err
+    }
+    f := &arcFlags{grid: int(h.Grid), bounds: g.DataBounds, riskVersion: cString(h.RiskVersion[:]), byAlpha: make(map[float64][]uint64)}
+    for _, alpha := range alphas {
+        flags := make([]uint64, h.EdgeCount)
+        if err := binary.Read(br, binary.LittleEndian, flags); err != nil {
+            return nil, err
+        }
+        f.byAlpha[alpha] = flags
+    }
+    return f, nil
+}
+
+// loadArcFlags reads the flags stored next to the road network at path, if
+// any. Flags that do not match the graph are reported and ignored.
+func (r *RiskAwareRouter) loadArcFlags(path string) {
+    file, err := os.Open(path + arcFlagsSuffix)
+    if errors.Is(err, os.ErrNotExist) {
+        return
+    }
+    if err == nil {
+        defer file.Close()
+        r.arcFlags, err = readArcFlags(file, r.G)
+    }
+    if err != nil {
+        reportWarning(map[string]string{"dataset": path}, "ignoring arc flags for %s: %v", path, err)
+        return
+    }
+    log.Printf("Loaded %dx%d arc flags for %d alphas from %s%s", r.arcFlags.grid, r.arcFlags.grid, len(r.arcFlags.byAlpha), path, arcFlagsSuffix)
+}
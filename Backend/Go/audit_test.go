@@ -0,0 +1,132 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// writeAudit appends n records to the audit log file at path, as a
+// server started on it would.
+func writeAudit(t *testing.T, path string, n int) {
+    t.Helper()
+    a, err := newAuditLog(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer a.w.(*os.File).Close()
+    for i := 0; i < n; i++ {
+        r := httptest.NewRequest(http.MethodPost, "/admin/closures", nil)
+        r = r.WithContext(context.WithValue(r.Context(), actorContextKey{}, "ana"))
+        a.record(r, "closure.set", &auditDetails{Target: "segment", After: map[string]interface{}{"closed": i%2 == 0}}, http.StatusOK)
+    }
+}
+
+func auditLines(t *testing.T, path string) [][]byte {
+    t.Helper()
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := bytes.SplitAfter(data, []byte("\n"))
+    return lines[:len(lines)-1]
+}
+
+func TestAuditResumesChain(t *testing.T) {
+    saved := globalConfig
+    globalConfig = defaultConfig()
+    t.Cleanup(func() { globalConfig = saved })
+    path := filepath.Join(t.TempDir(), "audit.log")
+    writeAudit(t, path, 2)
+    writeAudit(t, path, 2)
+
+    lines := auditLines(t, path)
+    if len(lines) != 4 {
+        t.Fatalf("%d records, want 4", len(lines))
+    }
+    for i, line := range lines {
+        var rec auditRecord
+        if err := json.Unmarshal(line, &rec); err != nil {
+            t.Fatal(err)
+        }
+        if rec.Seq != int64(i+1) || rec.Actor != "ana" {
+            t.Errorf("record %d: seq %d actor %q", i, rec.Seq, rec.Actor)
+        }
+    }
+    if err := runVerifyAudit([]string{path}); err != nil {
+        t.Errorf("after a restart: %v", err)
+    }
+}
+
+func TestAuditDetectsTampering(t *testing.T) {
+    saved := globalConfig
+    globalConfig = defaultConfig()
+    t.Cleanup(func() { globalConfig = saved })
+    path := filepath.Join(t.TempDir(), "audit.log")
+    writeAudit(t, path, 3)
+    lines := auditLines(t, path)
+
+    cases := []struct {
+        name    string
+        edit    func(lines [][]byte) [][]byte
+        wantErr string
+    }{
+        {"edited record", func(l [][]byte) [][]byte {
+            l[1] = bytes.Replace(l[1], []byte(`"actor":"ana"`), []byte(`"actor":"bo"`), 1)
+            return l
+        }, "line 2 (seq 2): record was modified"},
+        {"dropped record", func(l [][]byte) [][]byte {
+            return append(l[:1], l[2:]...)
+        }, "line 2 (seq 3): chain broken"},
+        {"reordered records", func(l [][]byte) [][]byte {
+            l[1], l[2] = l[2], l[1]
+            return l
+        }, "line 2 (seq 3): chain broken"},
+        {"dropped first record", func(l [][]byte) [][]byte {
+            return l[1:]
+        }, "line 1 (seq 2): chain broken"},
+        {"truncated record", func(l [][]byte) [][]byte {
+            l[2] = l[2][:len(l[2])/2]
+            return l
+        }, "line 3:"},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            edited := filepath.Join(t.TempDir(), "audit.log")
+            copied := make([][]byte, len(lines))
+            for i, l := range lines {
+                copied[i] = bytes.Clone(l)
+            }
+            if err := os.WriteFile(edited, bytes.Join(c.edit(copied), nil), 0o600); err != nil {
+                t.Fatal(err)
+            }
+            err := runVerifyAudit([]string{edited})
+            if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+                t.Errorf("err = %v, want %q", err, c.wantErr)
+            }
+        })
+    }
+}
+
+// TestAuditRefusesTruncatedTail checks that a log whose last record was
+// cut short, as by a crash mid-write, is not resumed from.
+func TestAuditRefusesTruncatedTail(t *testing.T) {
+    saved := globalConfig
+    globalConfig = defaultConfig()
+    t.Cleanup(func() { globalConfig = saved })
+    path := filepath.Join(t.TempDir(), "audit.log")
+    writeAudit(t, path, 2)
+    lines := auditLines(t, path)
+    if err := os.WriteFile(path, append(lines[0], lines[1][:20]...), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := newAuditLog(path); err == nil || !strings.Contains(err.Error(), "last record") {
+        t.Errorf("err = %v, want the last record refused", err)
+    }
+}
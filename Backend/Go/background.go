@@ -0,0 +1,90 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "sync"
+)
+
+// backgroundJobs tracks the work the server starts off the request path,
+// such as hub refreshes, shadow comparisons and the event consumer, so
+// shutdown can wait for it instead of cutting it off mid-write.
+type backgroundJobs struct {
+    mu      sync.Mutex
+    closed  bool
+    running map[string]int
+    wg      sync.WaitGroup
+    stop    chan struct{}
+}
+
+var globalJobs = newBackgroundJobs()
+
+func newBackgroundJobs() *backgroundJobs {
+    return &backgroundJobs{running: make(map[string]int), stop: make(chan struct{})}
+}
+
+// goJob runs fn on its own goroutine under name, recovering from panics
+// and restarting it under policy. Once shutdown has begun it runs nothing
+// and returns false, and a panicked job is no longer restarted.
+func (j *backgroundJobs) goJob(name string, policy restartPolicy, fn func()) bool {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    if j.closed {
+        return false
+    }
+    j.running[name]++
+    j.wg.Add(1)
+    go func() {
+        defer func() {
+            j.mu.Lock()
+            if j.running[name]--; j.running[name] == 0 {
+                delete(j.running, name)
+            }
+            j.mu.Unlock()
+            j.wg.Done()
+        }()
+        policy.run(name, fn, j.stop)
+    }()
+    return true
+}
+
+// stopping is closed when shutdown begins; long-running jobs such as
+// refresh loops return when it is.
+func (j *backgroundJobs) stopping() <-chan struct{} {
+    return j.stop
+}
+
+// drain refuses new jobs and waits for the running ones until ctx is
+// done. It returns the jobs still running then, as "name" or "name (n)".
+func (j *backgroundJobs) drain(ctx context.Context) []string {
+    j.mu.Lock()
+    if !j.closed {
+        j.closed = true
+        close(j.stop)
+    }
+    j.mu.Unlock()
+
+    done := make(chan struct{})
+    go func() {
+        j.wg.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+    }
+
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    var left []string
+    for name, n := range j.running {
+        if n > 1 {
+            name = fmt.Sprintf("%s (%d)", name, n)
+        }
+        left = append(left, name)
+    }
+    sort.Strings(left)
+    return left
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "risk-router/geo"
+)
+
+// BikeShareConfig is the GBFS feed of a bike-share or scooter system's
+// docks. FeedURL is the feed's auto-discovery file, gbfs.json, which
+// tenants may replace with their own gbfs_url; Language picks the feeds of
+// a GBFS 2 system published in several, English by default.
+type BikeShareConfig struct {
+    FeedURL  string `json:"feed_url"`
+    Language string `json:"language"`
+    // RefreshSeconds is how often the docks and their availability are
+    // fetched again.
+    RefreshSeconds int `json:"refresh_seconds"`
+}
+
+func defaultBikeShareConfig() BikeShareConfig {
+    return BikeShareConfig{Language: fallbackLanguage, RefreshSeconds: 60}
+}
+
+func (c BikeShareConfig) validate() error {
+    if c.RefreshSeconds <= 0 {
+        return fmt.Errorf("bike_share.refresh_seconds must be positive, got %d", c.RefreshSeconds)
+    }
+    return nil
+}
+
+// bikeShareEnabled reports whether any tenant has a bike-share feed.
+func bikeShareEnabled(cfg Config) bool {
+    if cfg.BikeShare.FeedURL != "" {
+        return true
+    }
+    for _, t := range cfg.Tenants {
+        if t.GBFSURL != "" {
+            return true
+        }
+    }
+    return false
+}
+
+const (
+    defaultBikeShareAlpha = 0.5
+    // maxFeedBytes bounds a GBFS file read.
+    maxFeedBytes = 32 << 20
+    // maxDockCandidates bounds the docks, nearest first, whose walks are
+    // searched at either end of a trip.
+    maxDockCandidates = 8
+)
+
+var gbfsClient = &http.Client{Timeout: 10 * time.Second}
+
+// dock is a bike-share station, where vehicles are picked up and left.
+type dock struct {
+    ID       string
+    Names    map[string]string
+    Location Point
+    // hasStatus is whether the feed reports the dock's availability; the
+    // fields after it are meaningful only then.
+    hasStatus          bool
+    Vehicles, Docks    int
+    Renting, Returning bool
+}
+
+// canPickUp and canDropOff report whether a trip may start or end at d.
+// A dock whose availability is unknown is assumed to serve.
+func (d *dock) canPickUp() bool  { return !d.hasStatus || (d.Renting && d.Vehicles > 0) }
+func (d *dock) canDropOff() bool { return !d.hasStatus || (d.Returning && d.Docks > 0) }
+
+// bikeShare holds the docks of a tenant's GBFS feed as last fetched.
+type bikeShare struct {
+    url string
+
+    mu    sync.RWMutex
+    docks []dock
+    // statusAt is when the feed last reported availability, zero when it
+    // reports none.
+    statusAt time.Time
+}
+
+// gbfsName is a station name: a string in GBFS 2, and in GBFS 3 a list of
+// translations.
+type gbfsName map[string]string
+
+func (n *gbfsName) UnmarshalJSON(data []byte) error {
+    var s string
+    if err := json.Unmarshal(data, &s); err == nil {
+        *n = gbfsName{"": s}
+        return nil
+    }
+    var texts []struct {
+        Text     string `json:"text"`
+        Language string `json:"language"`
+    }
+    if err := json.Unmarshal(data, &texts); err != nil {
+        return fmt.Errorf("name must be a string or a list of translations")
+    }
+    *n = make(gbfsName, len(texts))
+    for _, t := range texts {
+        (*n)[t.Language] = t.Text
+    }
+    return nil
+}
+
+// gbfsBool is a boolean, or as in GBFS 1, 0 or 1.
+type gbfsBool bool
+
+func (b *gbfsBool) UnmarshalJSON(data []byte) error {
+    switch string(data) {
+    case "true", "1":
+        *b = true
+    case "false", "0":
+        *b = false
+    default:
+        return fmt.Errorf("want a boolean, got %s", data)
+    }
+    return nil
+}
+
+// gbfsTime is a time in POSIX seconds, or as in GBFS 3, RFC 3339.
+type gbfsTime time.Time
+
+func (t *gbfsTime) UnmarshalJSON(data []byte) error {
+    if sec, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+        *t = gbfsTime(time.Unix(sec, 0))
+        return nil
+    }
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        return fmt.Errorf("want POSIX seconds or an RFC 3339 time, got %s", data)
+    }
+    at, err := time.Parse(time.RFC3339, s)
+    if err != nil {
+        return err
+    }
+    *t = gbfsTime(at)
+    return nil
+}
+
+type gbfsFeed struct {
+    Name string `json:"name"`
+    URL  string `json:"url"`
+}
+
+type gbfsDiscovery struct {
+    // Data holds the feeds by language in GBFS 2, and directly in GBFS 3.
+    Data json.RawMessage `json:"data"`
+}
+
+type gbfsStationInformation struct {
+    Data struct {
+        Stations []struct {
+            ID   string   `json:"station_id"`
+            Name gbfsName `json:"name"`
+            Lat  float64  `json:"lat"`
+            Lon  float64  `json:"lon"`
+        } `json:"stations"`
+    } `json:"data"`
+}
+
+type gbfsStationStatus struct {
+    LastUpdated gbfsTime `json:"last_updated"`
+    Data        struct {
+        Stations []struct {
+            ID string `json:"station_id"`
+            // NumBikes is GBFS 2's count, NumVehicles GBFS 3's.
+            NumBikes    *int      `json:"num_bikes_available"`
+            NumVehicles *int      `json:"num_vehicles_available"`
+            NumDocks    *int      `json:"num_docks_available"`
+            IsRenting   *gbfsBool `json:"is_renting"`
+            IsReturning *gbfsBool `json:"is_returning"`
+        } `json:"stations"`
+    } `json:"data"`
+}
+
+func fetchGBFS(ctx context.Context, url string, v interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := gbfsClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("%s answered %s", url, resp.Status)
+    }
+    if err := json.NewDecoder(io.LimitReader(resp.Body, maxFeedBytes)).Decode(v); err != nil {
+        return fmt.Errorf("%s: %v", url, err)
+    }
+    return nil
+}
+
+// feedURLs returns the URLs of a discovery file's feeds by name, and the
+// language they are in, if the file says. A GBFS 2 file's feeds in lang
+// are taken, or else those of its first language.
+func feedURLs(d gbfsDiscovery, lang string) (map[string]string, string, error) {
+    urls := make(map[string]string)
+    var v3 struct {
+        Feeds []gbfsFeed `json:"feeds"`
+    }
+    if err := json.Unmarshal(d.Data, &v3); err == nil && v3.Feeds != nil {
+        for _, f := range v3.Feeds {
+            urls[f.Name] = f.URL
+        }
+        return urls, "", nil
+    }
+    var v2 map[string]struct {
+        Feeds []gbfsFeed `json:"feeds"`
+    }
+    if err := json.Unmarshal(d.Data, &v2); err != nil || len(v2) == 0 {
+        return nil, "", errors.New("discovery file lists no feeds")
+    }
+    if _, ok := v2[lang]; !ok {
+        langs := make([]string, 0, len(v2))
+        for l := range v2 {
+            langs = append(langs, l)
+        }
+        sort.Strings(langs)
+        lang = langs[0]
+    }
+    for _, f := range v2[lang].Feeds {
+        urls[f.Name] = f.URL
+    }
+    return urls, lang, nil
+}
+
+// refresh fetches the feed's docks and, if it publishes it, their
+// availability. The docks are kept as they were when it fails.
+func (b *bikeShare) refresh(ctx context.Context) error {
+    var discovery gbfsDiscovery
+    if err := fetchGBFS(ctx, b.url, &discovery); err != nil {
+        return err
+    }
+    urls, lang, err := feedURLs(discovery, globalConfig.BikeShare.Language)
+    if err != nil {
+        return fmt.Errorf("%s: %v", b.url, err)
+    }
+    if urls["station_information"] == "" {
+        return fmt.Errorf("%s: no station_information feed", b.url)
+    }
+    var info gbfsStationInformation
+    if err := fetchGBFS(ctx, urls["station_information"], &info); err != nil {
+        return err
+    }
+    if lang == "" {
+        lang = fallbackLanguage
+    }
+    docks := make([]dock, 0, len(info.Data.Stations))
+    byID := make(map[string]int, len(info.Data.Stations))
+    for _, s := range info.Data.Stations {
+        // A GBFS 2 name is in the language of its feeds.
+        names := map[string]string(s.Name)
+        if name, ok := names[""]; ok {
+            names = map[string]string{lang: name}
+        }
+        byID[s.ID] = len(docks)
+        docks = append(docks, dock{ID: s.ID, Names: names, Location: Point{X: s.Lon, Y: s.Lat}})
+    }
+
+    var statusAt time.Time
+    if url := urls["station_status"]; url != "" {
+        var status gbfsStationStatus
+        if err := fetchGBFS(ctx, url, &status); err != nil {
+            return err
+        }
+        statusAt = time.Time(status.LastUpdated)
+        for _, s := range status.Data.Stations {
+            i, ok := byID[s.ID]
+            if !ok {
+                continue
+            }
+            d := &docks[i]
+            d.hasStatus, d.Renting, d.Returning = true, true, true
+            if s.NumVehicles != nil {
+                d.Vehicles = *s.NumVehicles
+            } else if s.NumBikes != nil {
+                d.Vehicles = *s.NumBikes
+            }
+            if s.NumDocks != nil {
+                d.Docks = *s.NumDocks
+            }
+            if s.IsRenting != nil {
+                d.Renting = bool(*s.IsRenting)
+            }
+            if s.IsReturning != nil {
+                d.Returning = bool(*s.IsReturning)
+            }
+        }
+    }
+
+    b.mu.Lock()
+    b.docks, b.statusAt = docks, statusAt
+    b.mu.Unlock()
+    return nil
+}
+
+// snapshot returns the docks as last fetched and when their availability
+// was reported.
+func (b *bikeShare) snapshot() ([]dock, time.Time) {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    return b.docks, b.statusAt
+}
+
+// loadBikeShare fetches the docks of the GBFS feed at url, if set. A feed
+// that cannot be fetched is only warned of: the bike_share_refresh task
+// tries it again, and everything else is served meanwhile.
+func (t *Tenant) loadBikeShare(url string) {
+    if url == "" {
+        return
+    }
+    t.bikes = &bikeShare{url: url}
+    if err := t.bikes.refresh(context.Background()); err != nil {
+        reportWarning(map[string]string{"component": "bike_share", "tenant": t.ID}, "bike-share feed: %v", err)
+        return
+    }
+    docks, _ := t.bikes.snapshot()
+    log.Printf("Tenant %s: loaded %d bike-share docks", t.ID, len(docks))
+}
+
+// refreshBikeShare fetches every tenant's bike-share feed again.
+func refreshBikeShare(now time.Time) error {
+    var errs []error
+    for _, t := range globalTenants.tenants {
+        if t.bikes == nil {
+            continue
+        }
+        if err := t.bikes.refresh(context.Background()); err != nil {
+            errs = append(errs, fmt.Errorf("tenant %s: %v", t.ID, err))
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// bikeShareRequest is the body of POST /route/bike-share.
+type bikeShareRequest struct {
+    Start *Coordinate `json:"start" schema:"required"`
+    End   *Coordinate `json:"end" schema:"required"`
+    // Alpha weighs risk on the walks, and in choosing the docks.
+    Alpha *float64 `json:"alpha" schema:"minimum=0,maximum=1"`
+    // MaxWalkM bounds how far, in a straight line, the docks may be from
+    // the start and the end.
+    MaxWalkM float64 `json:"max_walk_m" schema:"minimum=0"`
+    Clamp    bool    `json:"clamp"`
+}
+
+// dockChoice is a dock a bike-share trip picks a vehicle up at, or leaves
+// it at.
+type dockChoice struct {
+    ID       string     `json:"id"`
+    Name     string     `json:"name,omitempty"`
+    Location Point      `json:"location"`
+    Snap     SnapResult `json:"snap"`
+    // VehiclesAvailable and DocksAvailable are the dock's live
+    // availability, when the feed publishes it.
+    VehiclesAvailable *int `json:"vehicles_available,omitempty"`
+    DocksAvailable    *int `json:"docks_available,omitempty"`
+    // Candidates counts the docks weighed.
+    Candidates int `json:"candidates"`
+
+    cost float64
+}
+
+// chooseDock returns the dock, among those within maxWalkM of at that ok
+// accepts and other than exclude, whose walk costs least at alpha: from
+// at to the dock when pickup, else from the dock to at. It returns nil
+// when none is within reach.
+func (r *RiskAwareRouter) chooseDock(ctx context.Context, docks []dock, at SnapResult, pickup bool, alpha, maxWalkM float64, exclude, lang string) (*dockChoice, error) {
+    type candidate struct {
+        *dock
+        straightM float64
+    }
+    var near []candidate
+    for i := range docks {
+        d := &docks[i]
+        ok := d.canDropOff()
+        if pickup {
+            ok = d.canPickUp()
+        }
+        if !ok || d.ID == exclude {
+            continue
+        }
+        if m := geo.Haversine(d.Location, at.Requested); m <= maxWalkM {
+            near = append(near, candidate{d, m})
+        }
+    }
+    sort.Slice(near, func(i, j int) bool { return near[i].straightM < near[j].straightM })
+    if len(near) > maxDockCandidates {
+        near = near[:maxDockCandidates]
+    }
+
+    var choices []*dockChoice
+    var nodes []int32
+    for _, c := range near {
+        snap, err := r.snapChecked(c.Location, "dock", false)
+        if err != nil {
+            continue
+        }
+        choice := &dockChoice{ID: c.ID, Name: localizedName(c.Names, lang), Location: c.Location, Snap: snap}
+        if c.hasStatus {
+            choice.VehiclesAvailable, choice.DocksAvailable = &c.Vehicles, &c.Docks
+        }
+        choices = append(choices, choice)
+        nodes = append(nodes, snap.node)
+    }
+    if len(choices) == 0 {
+        return nil, nil
+    }
+
+    // Walks from the start are one search; walks to the end one each.
+    var best *dockChoice
+    consider := func(choice *dockChoice, cell MatrixCell) {
+        if !cell.Found {
+            return
+        }
+        choice.cost = cell.cost
+        if best == nil || choice.cost < best.cost {
+            best = choice
+        }
+    }
+    if pickup {
+        cells, err := r.distancesFrom(ctx, at.node, nodes, alpha)
+        if err != nil {
+            return nil, err
+        }
+        for i, choice := range choices {
+            consider(choice, cells[i])
+        }
+    } else {
+        for i, choice := range choices {
+            cells, err := r.distancesFrom(ctx, nodes[i], []int32{at.node}, alpha)
+            if err != nil {
+                return nil, err
+            }
+            consider(choice, cells[0])
+        }
+    }
+    if best != nil {
+        best.Candidates = len(near)
+    }
+    return best, nil
+}
+
+// rideParams are the search parameters of a ride leg: roadParams
+// preferring protected bike lanes when road attributes are loaded.
+func rideParams() routeParams {
+    p := roadParams()
+    p.ProtectedLanes = true
+    return p
+}
+
+// handleBikeShare serves POST /route/bike-share: a walk to the dock near
+// the start with the safest walk and a vehicle to take, a ride to the dock
+// near the end with the safest walk and a free dock, then that walk. The
+// ride is the shortest by road, keeping to protected bike lanes where it
+// can. Each leg has its own risk metrics, and the docks the availability
+// the feed last reported.
+func handleBikeShare(w http.ResponseWriter, r *http.Request) {
+    var req bikeShareRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    if req.Start == nil || req.End == nil {
+        writeBadRequest(w, "start and end are required")
+        return
+    }
+    alpha := defaultBikeShareAlpha
+    if req.Alpha != nil {
+        alpha = *req.Alpha
+    }
+    if alpha < 0 || alpha > 1 {
+        writeBadRequest(w, "alpha must be within [0, 1]")
+        return
+    }
+    maxWalkM := req.MaxWalkM
+    if maxWalkM == 0 {
+        maxWalkM = defaultMaxWalkM
+    }
+    if maxWalkM < 0 || maxWalkM > maxMaxWalkM {
+        writeBadRequest(w, fmt.Sprintf("max_walk_m must be within (0, %d]", maxMaxWalkM))
+        return
+    }
+
+    ctx := r.Context()
+    tenant := tenantFromContext(ctx)
+    if tenant.bikes == nil {
+        writeAPIError(w, http.StatusNotFound, APIError{Code: "bike_share_disabled", Message: "no bike-share feed is configured"})
+        return
+    }
+    router := tenant.Router()
+    var snap SnapDiagnostics
+    var err error
+    if snap.Start, err = router.snapChecked(req.Start.point(), "start", req.Clamp); err != nil {
+        writeOutOfBounds(w, err)
+        return
+    }
+    if snap.End, err = router.snapChecked(req.End.point(), "end", req.Clamp); err != nil {
+        writeOutOfBounds(w, err)
+        return
+    }
+
+    lang := localizerFor(r).Language
+    docks, statusAt := tenant.bikes.snapshot()
+    pickup, err := router.chooseDock(ctx, docks, snap.Start, true, alpha, maxWalkM, "", lang)
+    var dropoff *dockChoice
+    if err == nil && pickup != nil {
+        dropoff, err = router.chooseDock(ctx, docks, snap.End, false, alpha, maxWalkM, pickup.ID, lang)
+    }
+    if errors.Is(err, context.Canceled) {
+        return
+    }
+    if err != nil {
+        writeAPIError(w, http.StatusGatewayTimeout, APIError{Code: "timeout", Message: "choosing the docks timed out"})
+        return
+    }
+    if pickup == nil || dropoff == nil {
+        end, what := "start", "a vehicle to take"
+        if pickup != nil {
+            end, what = "end", "a free dock"
+        }
+        writeAPIError(w, http.StatusUnprocessableEntity, APIError{
+            Code:    "no_dock",
+            Message: fmt.Sprintf("no dock within %g m of the %s with %s has a walk to it", maxWalkM, end, what),
+            Details: map[string]interface{}{"max_walk_m": maxWalkM, "at": end},
+        })
+        return
+    }
+
+    // The walks are known to connect: their costs chose the docks.
+    walkTo, err := router.legRoute(ctx, snap.Start, pickup.Snap, alpha, walkParams(), globalConfig.WalkingSpeedMPS)
+    var ride, walkFrom Route
+    if err == nil {
+        ride, err = router.legRoute(ctx, pickup.Snap, dropoff.Snap, 0, rideParams(), globalConfig.RidingSpeedMPS)
+    }
+    if err == nil {
+        walkFrom, err = router.legRoute(ctx, dropoff.Snap, snap.End, alpha, walkParams(), globalConfig.WalkingSpeedMPS)
+    }
+    switch {
+    case errors.Is(err, context.Canceled):
+        return
+    case errors.Is(err, errNotConnected):
+        writeNotConnected(w, router, SnapDiagnostics{Start: pickup.Snap, End: dropoff.Snap})
+        return
+    case err != nil:
+        writeAPIError(w, http.StatusGatewayTimeout, APIError{Code: "timeout", Message: "route search timed out"})
+        return
+    }
+    writeBikeShare(w, alpha, snap, pickup, dropoff, statusAt, [3]Route{walkTo, ride, walkFrom})
+}
+
+func writeBikeShare(w http.ResponseWriter, alpha float64, snap SnapDiagnostics, pickup, dropoff *dockChoice, statusAt time.Time, legs [3]Route) {
+    response := struct {
+        Alpha   float64         `json:"alpha"`
+        Snap    SnapDiagnostics `json:"snap"`
+        Pickup  *dockChoice     `json:"pickup"`
+        Dropoff *dockChoice     `json:"dropoff"`
+        // AvailabilityAt is when the feed reported the docks'
+        // availability, if it does.
+        AvailabilityAt *time.Time `json:"availability_at,omitempty"`
+        WalkToDock     Route      `json:"walk_to_dock"`
+        Ride           Route      `json:"ride"`
+        WalkFromDock   Route      `json:"walk_from_dock"`
+        LengthM        float64    `json:"length_m"`
+        DurationS      float64    `json:"duration_s"`
+    }{Alpha: alpha, Snap: snap, Pickup: pickup, Dropoff: dropoff, WalkToDock: legs[0], Ride: legs[1], WalkFromDock: legs[2]}
+    if !statusAt.IsZero() {
+        response.AvailabilityAt = &statusAt
+    }
+    for _, leg := range legs {
+        response.LengthM += leg.Summary.LengthM
+        response.DurationS += leg.Summary.DurationS
+    }
+    writeSignedJSON(w, response, "bike-share trip")
+}
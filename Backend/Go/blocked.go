@@ -0,0 +1,111 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+)
+
+// blockedArea is a polygon no route may pass through, however safe,
+// such as a railyard or a restricted facility. Road segments in or
+// across one are left out of the graph when it is built.
+type blockedArea struct {
+    ring   []Point
+    bounds Bounds
+}
+
+// loadBlockedAreas reads the Polygon and MultiPolygon features of a
+// GeoJSON file in degrees; each polygon's outer ring is blocked. A
+// feature's name property names it in errors.
+func loadBlockedAreas(path string) ([]blockedArea, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var collection struct {
+        Features []struct {
+            Properties map[string]interface{} `json:"properties"`
+            Geometry   struct {
+                Type        string          `json:"type"`
+                Coordinates json.RawMessage `json:"coordinates"`
+            } `json:"geometry"`
+        } `json:"features"`
+    }
+    if err := json.Unmarshal(data, &collection); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    var areas []blockedArea
+    for i, f := range collection.Features {
+        name, _ := f.Properties["name"].(string)
+        if name == "" {
+            name = fmt.Sprintf("features[%d]", i)
+        }
+        var polygons [][][][2]float64
+        switch f.Geometry.Type {
+        case "Polygon":
+            var polygon [][][2]float64
+            err = json.Unmarshal(f.Geometry.Coordinates, &polygon)
+            polygons = append(polygons, polygon)
+        case "MultiPolygon":
+            err = json.Unmarshal(f.Geometry.Coordinates, &polygons)
+        default:
+            err = fmt.Errorf("geometry must be a Polygon or a MultiPolygon, not %q", f.Geometry.Type)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+        }
+        for _, polygon := range polygons {
+            if len(polygon) == 0 || len(polygon[0]) < 3 {
+                return nil, fmt.Errorf("%s: %s: a polygon needs an outer ring of at least three positions", path, name)
+            }
+            ring := make([]Point, len(polygon[0]))
+            for j, p := range polygon[0] {
+                ring[j] = Point{X: p[0], Y: p[1]}
+            }
+            areas = append(areas, blockedArea{ring: ring, bounds: boundsOf(ring)})
+        }
+    }
+    if len(areas) == 0 {
+        return nil, fmt.Errorf("%s has no polygons", path)
+    }
+    return areas, nil
+}
+
+// blocks reports whether the segment from a to b lies in or crosses the
+// area.
+func (ba blockedArea) blocks(a, b Point) bool {
+    box := boundsOf([]Point{a, b})
+    if box.MaxX < ba.bounds.MinX || box.MinX > ba.bounds.MaxX || box.MaxY < ba.bounds.MinY || box.MinY > ba.bounds.MaxY {
+        return false
+    }
+    if pointInPolygon(a, ba.ring) || pointInPolygon(b, ba.ring) {
+        return true
+    }
+    for i, j := 0, len(ba.ring)-1; i < len(ba.ring); j, i = i, i+1 {
+        if segmentsCross(a, b, ba.ring[j], ba.ring[i]) {
+            return true
+        }
+    }
+    return false
+}
+
+// segmentsCross reports whether segments ab and cd properly intersect.
+func segmentsCross(a, b, c, d Point) bool {
+    side := func(p, q, r Point) float64 {
+        return (q.X-p.X)*(r.Y-p.Y) - (q.Y-p.Y)*(r.X-p.X)
+    }
+    d1, d2 := side(c, d, a), side(c, d, b)
+    d3, d4 := side(a, b, c), side(a, b, d)
+    return (d1 > 0) != (d2 > 0) && d1 != 0 && d2 != 0 && (d3 > 0) != (d4 > 0) && d3 != 0 && d4 != 0
+}
+
+// blockedSegment reports whether any of the graph's blocked areas blocks
+// the segment from a to b.
+func (g *Graph) blockedSegment(a, b Point) bool {
+    for _, ba := range g.blocked {
+        if ba.blocks(a, b) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "net/http"
+
+    "risk-router/geo"
+)
+
+// OutOfBoundsError reports a request point outside the serving bounds along
+// with the closest point the client could use instead.
+type OutOfBoundsError struct {
+    Field           string  `json:"field"`
+    Point           Point   `json:"point"`
+    Bounds          Bounds  `json:"bounds"`
+    NearestInBounds Point   `json:"nearest_in_bounds"`
+    DistanceM       float64 `json:"distance_m"`
+    // Swapped is the point with its coordinates exchanged, set when
+    // that lies inside the bounds: the client likely sent latitude as
+    // the longitude and vice versa.
+    Swapped *Point `json:"swapped,omitempty"`
+}
+
+func (e *OutOfBoundsError) Error() string {
+    if e.Swapped != nil {
+        return fmt.Sprintf("%s point outside bounds, but inside with its coordinates swapped: x and the first number of a [lon, lat] position are the longitude, y the latitude", e.Field)
+    }
+    return fmt.Sprintf("%s point outside bounds (%.0f m from the serving area)", e.Field, e.DistanceM)
+}
+
+// The ways a road network can be bounded; see Config.GraphBounds.
+const (
+    boundsClip = "clip"
+    boundsAll  = "all"
+    boundsData = "data"
+)
+
+// loadBox is the box the options bound the road network with, Chicago
+// unless set.
+func (o RouterOptions) loadBox() Bounds {
+    if o.LoadBounds == (Bounds{}) {
+        return chicagoBounds
+    }
+    return o.LoadBounds
+}
+
+// loadClip returns the box GeoJSON segments are clipped to while loading,
+// or nil to load them all.
+func (o RouterOptions) loadClip() *Bounds {
+    if o.BoundsMode == boundsAll || o.BoundsMode == boundsData {
+        return nil
+    }
+    box := o.loadBox()
+    return &box
+}
+
+// servingBounds is where requests may start and end: the load box in
+// "all" mode, otherwise wherever g has roads, padded either way.
+func (o RouterOptions) servingBounds(g *Graph) Bounds {
+    if o.BoundsMode == boundsAll {
+        return padBounds(o.loadBox(), o.BoundsPaddingM)
+    }
+    return padBounds(g.DataBounds, o.BoundsPaddingM)
+}
+
+func clampToBounds(p Point, b Bounds) Point {
+    return Point{
+        X: math.Max(b.MinX, math.Min(b.MaxX, p.X)),
+        Y: math.Max(b.MinY, math.Min(b.MaxY, p.Y)),
+    }
+}
+
+// checkBounds returns p unchanged when it lies inside the serving bounds.
+// Otherwise, if clamp is set and p is within the router's clamp tolerance,
+// p is moved onto the nearest point of the bounds; any other outside point
+// yields an *OutOfBoundsError, which notes when p is probably swapped.
+func (r *RiskAwareRouter) checkBounds(p Point, field string, clamp bool) (Point, error) {
+    if isInBounds(p, r.Bounds) {
+        return p, nil
+    }
+    nearest := clampToBounds(p, r.Bounds)
+    distance := geo.Haversine(p, nearest)
+    if clamp && distance <= r.clampToleranceM {
+        return nearest, nil
+    }
+    oob := &OutOfBoundsError{
+        Field:           field,
+        Point:           p,
+        Bounds:          r.Bounds,
+        NearestInBounds: nearest,
+        DistanceM:       distance,
+    }
+    if swapped := (Point{X: p.Y, Y: p.X}); isInBounds(swapped, r.Bounds) {
+        oob.Swapped = &swapped
+    }
+    return p, oob
+}
+
+// writeOutOfBounds answers a request whose point failed checkBounds or
+// snapChecked.
+func writeOutOfBounds(w http.ResponseWriter, err error) {
+    var far *NoRoadNearError
+    if errors.As(err, &far) {
+        writeAPIError(w, http.StatusBadRequest, APIError{
+            Code:    "no_road_near_point",
+            Message: far.Error(),
+            Details: far,
+        })
+        return
+    }
+    var oob *OutOfBoundsError
+    if !errors.As(err, &oob) {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    code := "out_of_bounds"
+    if oob.Swapped != nil {
+        code = "coordinates_swapped"
+    }
+    writeAPIError(w, http.StatusBadRequest, APIError{
+        Code:    code,
+        Message: oob.Error(),
+        Details: oob,
+    })
+}
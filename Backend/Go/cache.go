@@ -0,0 +1,156 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+)
+
+// managedCache is a cache operators can inspect and flush through the
+// admin API.
+type managedCache interface {
+    stats() cacheStats
+    flush()
+}
+
+type cacheStats struct {
+    Name    string  `json:"name"`
+    Entries int     `json:"entries"`
+    Bytes   int64   `json:"bytes"`
+    Hits    int64   `json:"hits"`
+    Misses  int64   `json:"misses"`
+    HitRate float64 `json:"hit_rate"`
+    // Prewarm is set on the route cache once route_prewarm has run.
+    Prewarm *prewarmStats `json:"prewarm,omitempty"`
+}
+
+// prewarmStats measure how much of what route_prewarm precomputes is
+// asked for: a low UsedRate says top_n could be smaller, and warmed hits
+// making up most of the cache's hits that it could be larger.
+type prewarmStats struct {
+    Warmed   int64   `json:"warmed"`
+    Used     int64   `json:"used"`
+    UsedRate float64 `json:"used_rate"`
+    Hits     int64   `json:"hits"`
+}
+
+func (s *cacheStats) setHits(hits, misses int64) {
+    s.Hits = hits
+    s.Misses = misses
+    if total := hits + misses; total > 0 {
+        s.HitRate = float64(hits) / float64(total)
+    }
+}
+
+// caches lists the router's managed caches by name.
+func (r *RiskAwareRouter) caches() map[string]managedCache {
+    return map[string]managedCache{
+        "weights": &r.weights,
+        "routes":  r.routes,
+    }
+}
+
+type tenantCaches struct {
+    Tenant string       `json:"tenant"`
+    Caches []cacheStats `json:"caches"`
+}
+
+// handleAdminCaches serves GET /admin/caches.
+func handleAdminCaches(w http.ResponseWriter, r *http.Request) {
+    response := struct {
+        Tenants []tenantCaches `json:"tenants"`
+    }{cacheReport()}
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode cache response: %v", err)
+    }
+}
+
+// cacheReport returns every tenant's cache statistics.
+func cacheReport() []tenantCaches {
+    var report []tenantCaches
+    for _, t := range globalTenants.tenants {
+        caches := t.Router().caches()
+        entry := tenantCaches{Tenant: t.ID}
+        for _, name := range cacheNames {
+            entry.Caches = append(entry.Caches, caches[name].stats())
+        }
+        report = append(report, entry)
+    }
+    return report
+}
+
+// cacheNames fixes the order caches are reported and flushed in.
+var cacheNames = []string{"weights", "routes"}
+
+// cacheFlushRequest is the optional body of POST /admin/caches/flush.
+type cacheFlushRequest struct {
+    Caches []string `json:"caches"`
+    Tenant string   `json:"tenant"`
+}
+
+// handleAdminCacheFlush serves POST /admin/caches/flush. The body picks the
+// caches to flush and optionally one tenant; an empty list flushes all.
+func handleAdminCacheFlush(w http.ResponseWriter, r *http.Request) {
+    var req cacheFlushRequest
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeBadRequest(w, err.Error())
+            return
+        }
+    }
+    if len(req.Caches) == 0 {
+        req.Caches = cacheNames
+    }
+    audit := auditFromContext(r.Context())
+    audit.Target = fmt.Sprintf("caches=%v tenant=%q", req.Caches, req.Tenant)
+    for _, name := range req.Caches {
+        if !knownCache(name) {
+            writeAPIError(w, http.StatusBadRequest, APIError{
+                Code:    "unknown_cache",
+                Message: fmt.Sprintf("unknown cache %q", name),
+                Details: map[string]interface{}{"caches": cacheNames},
+            })
+            return
+        }
+    }
+
+    tenants := globalTenants.tenants
+    if req.Tenant != "" {
+        t, ok := globalTenants.byID[req.Tenant]
+        if !ok {
+            writeAPIError(w, http.StatusNotFound, APIError{Code: "not_found", Message: "unknown tenant " + req.Tenant})
+            return
+        }
+        tenants = []*Tenant{t}
+    }
+
+    before := make(map[string][]cacheStats)
+    after := make(map[string][]cacheStats)
+    for _, t := range tenants {
+        caches := t.Router().caches()
+        for _, name := range req.Caches {
+            before[t.ID] = append(before[t.ID], caches[name].stats())
+            caches[name].flush()
+            after[t.ID] = append(after[t.ID], caches[name].stats())
+        }
+        log.Printf("Flushed caches %v for tenant %s", req.Caches, t.ID)
+    }
+    audit.Before, audit.After = before, after
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(map[string]interface{}{"flushed": req.Caches}); err != nil {
+        log.Printf("Failed to encode cache response: %v", err)
+    }
+}
+
+func knownCache(name string) bool {
+    for _, n := range cacheNames {
+        if n == name {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+    _ "time/tzdata" // calendar time zones on hosts without zoneinfo
+)
+
+// maxCalendarLayers bounds the layers kept for combinations of calendar
+// rules in effect.
+const maxCalendarLayers = 8
+
+// RiskCalendarRule scales the risk of the roads in an area on given days,
+// such as around a stadium on game days or downtown on New Year's Eve.
+// Route requests are scored with the rules in effect at their departure.
+type RiskCalendarRule struct {
+    Name string `json:"name"`
+    // Dates are the days the rule applies on: "2026-12-31" once, or
+    // "12-31" every year.
+    Dates []string `json:"dates"`
+    // From and Until, "HH:MM" in the calendar time zone, limit the rule
+    // to part of those days; an Until at or before From runs past
+    // midnight. Leaving both out covers the whole day.
+    From  string `json:"from"`
+    Until string `json:"until"`
+    // Area is the outer ring of the polygon whose roads the rule covers,
+    // as [lon, lat] positions.
+    Area [][2]float64 `json:"area"`
+    // Multiplier scales the risk of those roads, which stays at most 1.
+    Multiplier float64 `json:"multiplier"`
+}
+
+// calendarRule is a parsed RiskCalendarRule.
+type calendarRule struct {
+    RiskCalendarRule
+    once   map[string]bool
+    yearly map[string]bool
+    // from and until are minutes into the day; whole covers all of it.
+    from, until int
+    whole       bool
+    area        []Point
+}
+
+func parseCalendarRule(cfg RiskCalendarRule) (*calendarRule, error) {
+    rule := &calendarRule{RiskCalendarRule: cfg, once: make(map[string]bool), yearly: make(map[string]bool)}
+    if cfg.Name == "" {
+        return nil, fmt.Errorf("name must be set")
+    }
+    if len(cfg.Dates) == 0 {
+        return nil, fmt.Errorf("dates must list at least one day")
+    }
+    for _, d := range cfg.Dates {
+        if _, err := time.Parse("2006-01-02", d); err == nil {
+            rule.once[d] = true
+        } else if _, err := time.Parse("01-02", d); err == nil {
+            rule.yearly[d] = true
+        } else {
+            return nil, fmt.Errorf("dates must be YYYY-MM-DD or MM-DD, got %q", d)
+        }
+    }
+    switch {
+    case cfg.From == "" && cfg.Until == "":
+        rule.whole = true
+    case cfg.From == "" || cfg.Until == "":
+        return nil, fmt.Errorf("give both from and until, or neither")
+    default:
+        var err error
+        if rule.from, err = minuteOfDay(cfg.From); err != nil {
+            return nil, err
+        }
+        if rule.until, err = minuteOfDay(cfg.Until); err != nil {
+            return nil, err
+        }
+    }
+    if len(cfg.Area) < 3 {
+        return nil, fmt.Errorf("area needs at least three positions")
+    }
+    for _, p := range cfg.Area {
+        rule.area = append(rule.area, Point{X: p[0], Y: p[1]})
+    }
+    if cfg.Multiplier < 0 {
+        return nil, fmt.Errorf("multiplier must not be negative, got %v", cfg.Multiplier)
+    }
+    return rule, nil
+}
+
+func minuteOfDay(s string) (int, error) {
+    t, err := time.Parse("15:04", s)
+    if err != nil {
+        return 0, fmt.Errorf("times must be HH:MM, got %q", s)
+    }
+    return t.Hour()*60 + t.Minute(), nil
+}
+
+// on reports whether the rule lists the day of t.
+func (c *calendarRule) on(t time.Time) bool {
+    return c.once[t.Format("2006-01-02")] || c.yearly[t.Format("01-02")]
+}
+
+// activeAt reports whether the rule is in effect at t, a time in the
+// calendar time zone. A window past midnight is in effect on the day
+// after a listed one until it ends.
+func (c *calendarRule) activeAt(t time.Time) bool {
+    if c.whole {
+        return c.on(t)
+    }
+    minute := t.Hour()*60 + t.Minute()
+    if c.from < c.until {
+        return c.on(t) && minute >= c.from && minute < c.until
+    }
+    return c.on(t) && minute >= c.from || c.on(t.AddDate(0, 0, -1)) && minute < c.until
+}
+
+func checkRiskCalendar(timeZone string, rules []RiskCalendarRule) error {
+    if _, err := time.LoadLocation(timeZone); err != nil {
+        return fmt.Errorf("calendar_time_zone: %v", err)
+    }
+    seen := make(map[string]bool)
+    for i, cfg := range rules {
+        if _, err := parseCalendarRule(cfg); err != nil {
+            return fmt.Errorf("risk_calendar[%d]: %v", i, err)
+        }
+        if seen[cfg.Name] {
+            return fmt.Errorf("risk_calendar[%d]: duplicate name %q", i, cfg.Name)
+        }
+        seen[cfg.Name] = true
+    }
+    return nil
+}
+
+// riskCalendar holds a router's calendar rules, with the edges in each
+// rule's area, and the layers built for the rules in effect, oldest
+// first.
+type riskCalendar struct {
+    once  sync.Once
+    loc   *time.Location
+    rules []*calendarRule
+    edges [][]int32
+
+    mu     sync.Mutex
+    keys   []string
+    layers map[string]*riskLayer
+}
+
+// loadCalendar parses the configured rules and finds their roads, the first time
+// the router needs them.
+func (r *RiskAwareRouter) loadCalendar() *riskCalendar {
+    c := &r.calendar
+    c.once.Do(func() {
+        c.loc, _ = time.LoadLocation(globalConfig.CalendarTimeZone)
+        if c.loc == nil {
+            c.loc = time.UTC
+        }
+        for _, cfg := range globalConfig.RiskCalendar {
+            rule, err := parseCalendarRule(cfg)
+            if err != nil {
+                continue
+            }
+            c.rules = append(c.rules, rule)
+            c.edges = append(c.edges, r.G.edgesTouching(r.G.nodesInPolygon(rule.area)))
+        }
+    })
+    return c
+}
+
+// calendarLayer returns base with the calendar rules in effect at t
+// applied, and the names of those rules; base itself when none is.
+func (r *RiskAwareRouter) calendarLayer(base *riskLayer, t time.Time) (*riskLayer, []string) {
+    c := r.loadCalendar()
+    local := t.In(c.loc)
+    var names []string
+    var active []int
+    for i, rule := range c.rules {
+        if rule.activeAt(local) {
+            names = append(names, rule.Name)
+            active = append(active, i)
+        }
+    }
+    if len(active) == 0 {
+        return base, nil
+    }
+    key := base.Version + "|" + strings.Join(names, "|")
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if layer, ok := c.layers[key]; ok {
+        return layer, names
+    }
+    risk := make([]float64, len(base.risk))
+    copy(risk, base.risk)
+    for _, i := range active {
+        for _, e := range c.edges[i] {
+            risk[e] = min(risk[e]*c.rules[i].Multiplier, 1)
+        }
+    }
+    version := r.G.hashRisk(risk)
+    if version == base.Version {
+        // The rules cover no roads, or leave their risk as it was.
+        return base, names
+    }
+    layer := &riskLayer{
+        Version:    version,
+        Metadata:   base.Metadata,
+        LoadedAt:   time.Now().UTC(),
+        Parent:     base.Version,
+        risk:       risk,
+        normalizer: base.normalizer,
+    }
+    if c.layers == nil {
+        c.layers = make(map[string]*riskLayer)
+    }
+    c.layers[key] = layer
+    c.keys = append(c.keys, key)
+    if len(c.keys) > maxCalendarLayers {
+        oldest := c.keys[0]
+        c.keys = c.keys[1:]
+        r.weights.drop(c.layers[oldest].Version)
+        delete(c.layers, oldest)
+    }
+    return layer, names
+}
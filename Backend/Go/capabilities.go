@@ -0,0 +1,87 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+)
+
+type capabilitiesResponse struct {
+    Profiles      []string         `json:"profiles"`
+    Presets       []string         `json:"presets"`
+    Alpha         alphaCapability  `json:"alpha"`
+    Bounds        Bounds           `json:"bounds"`
+    Cities        []string         `json:"cities"`
+    OutputFormats []string         `json:"output_formats"`
+    Versions      versionInfo      `json:"versions"`
+    Limits        capabilityLimits `json:"limits"`
+    // RiskComponents lists the risk layers requests may reweight.
+    RiskComponents []riskComponent `json:"risk_components,omitempty"`
+    // CRS lists the coordinate reference systems route requests may use.
+    CRS []string `json:"crs"`
+    // RoadAttributes is set when road attributes are loaded, which route
+    // labels and main_streets requests need.
+    RoadAttributes bool `json:"road_attributes"`
+    // NetworkLayers lists the layers requests may turn on or off.
+    NetworkLayers []networkLayerInfo `json:"network_layers,omitempty"`
+    // ResponseSigning is the JWS algorithm route responses are signed
+    // with, their keys at /.well-known/jwks.json; empty when unsigned.
+    ResponseSigning string `json:"response_signing,omitempty"`
+}
+
+type alphaCapability struct {
+    Min      float64   `json:"min"`
+    Max      float64   `json:"max"`
+    Defaults []float64 `json:"defaults"`
+}
+
+type versionInfo struct {
+    Graph     string `json:"graph"`
+    RiskLayer string `json:"risk_layer"`
+}
+
+type capabilityLimits struct {
+    MaxAlternatives int `json:"max_alternatives"`
+    MaxWaypoints    int `json:"max_waypoints"`
+    MaxMatrixSize   int `json:"max_matrix_size,omitempty"`
+    MaxSafetyBatch  int `json:"max_safety_batch,omitempty"`
+    MaxStops        int `json:"max_stops,omitempty"`
+}
+
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+    tenant := tenantFromContext(r.Context())
+    router := tenant.Router()
+    response := capabilitiesResponse{
+        Profiles: routingProfiles,
+        Presets:  presetNames(globalConfig.Presets),
+        Alpha: alphaCapability{
+            Min:      0,
+            Max:      1,
+            Defaults: tenant.Alphas,
+        },
+        Bounds:        router.Bounds,
+        Cities:        []string{tenant.cityName(localizerFor(r).Language)},
+        OutputFormats: []string{"json", "ndjson"},
+        Versions: versionInfo{
+            Graph:     router.G.Version,
+            RiskLayer: router.activeLayer().Version,
+        },
+        Limits: capabilityLimits{
+            MaxAlternatives: globalConfig.Limits.MaxAlternatives,
+            MaxWaypoints:    globalConfig.Limits.MaxWaypoints,
+            MaxMatrixSize:   globalConfig.Limits.MaxMatrixSize,
+            MaxSafetyBatch:  globalConfig.Limits.MaxSafetyBatch,
+            MaxStops:        globalConfig.Limits.MaxStops,
+        },
+        RiskComponents:  router.composed.list(),
+        CRS:             supportedCRS,
+        RoadAttributes:  router.attrs != nil,
+        ResponseSigning: signingAlg(),
+        NetworkLayers:   networkLayerInfos(globalConfig.NetworkLayers),
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode capabilities: %v", err)
+    }
+}
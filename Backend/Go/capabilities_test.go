@@ -0,0 +1,50 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// TestReportedRiskVersion checks that /capabilities and the tenant info
+// report the risk version /route answers with, which normalization makes
+// differ from the road network's raw scores.
+func TestReportedRiskVersion(t *testing.T) {
+    tenant := fixtureTenant(t)
+    router, err := NewRiskAwareRouter(fixtureNetwork, &CrimeData{}, RouterOptions{
+        RiskMetadata: RiskLayerMetadata{Normalization: normalizeMinMax},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    tenant.router.Store(router)
+    if router.activeLayer().Version == router.G.RiskVersion {
+        t.Fatal("normalization left the risk version as it was")
+    }
+
+    w := httptest.NewRecorder()
+    handleRouteRequest(w, tenantRequest(tenant, http.MethodPost, "/route",
+        `{"start": {"lat": 41.87, "lon": -87.66}, "end": {"lat": 41.88286, "lon": -87.65678}}`))
+    var route struct {
+        RiskVersion string `json:"risk_version"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &route); err != nil || route.RiskVersion == "" {
+        t.Fatalf("route: status %d, body %s", w.Code, w.Body)
+    }
+
+    w = httptest.NewRecorder()
+    handleCapabilities(w, tenantRequest(tenant, http.MethodGet, "/capabilities", ""))
+    var caps struct {
+        Versions versionInfo `json:"versions"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &caps); err != nil {
+        t.Fatal(err)
+    }
+    if caps.Versions.RiskLayer != route.RiskVersion {
+        t.Errorf("/capabilities risk layer %s, /route %s", caps.Versions.RiskLayer, route.RiskVersion)
+    }
+    if info := tenant.info(); info.RiskVersion != route.RiskVersion {
+        t.Errorf("tenant risk version %s, /route %s", info.RiskVersion, route.RiskVersion)
+    }
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+    "archive/zip"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// dataSources are the files a router is built from: the configured ones,
+// or a city pack's.
+type dataSources struct {
+    RoadNetworkPath    string
+    RoadNetworkCRS     string
+    LoadBounds         Bounds
+    RiskLayers         []RiskLayerConfig
+    RoadAttributesPath string
+    BlockedAreasPath   string
+}
+
+func (c Config) dataSources() dataSources {
+    return dataSources{
+        RoadNetworkPath:    c.RoadNetworkPath,
+        RoadNetworkCRS:     c.RoadNetworkCRS,
+        LoadBounds:         c.LoadBounds,
+        RiskLayers:         c.RiskLayers,
+        RoadAttributesPath: c.RoadAttributesPath,
+        BlockedAreasPath:   c.BlockedAreasPath,
+    }
+}
+
+// cityPackManifestName is the file at the root of a city pack describing
+// it.
+const cityPackManifestName = "manifest.json"
+
+// cityPackManifest describes a city pack: a zip archive, or a directory,
+// holding a city's road network and the data served with it. File names
+// are relative to the pack's root.
+type cityPackManifest struct {
+    ID string `json:"id"`
+    // Names is the city's name by language code, such as "en" and "es".
+    Names       map[string]string `json:"names"`
+    RoadNetwork string            `json:"road_network"`
+    // CRS is the coordinate reference system of the pack's road network
+    // and POIs, "EPSG:4326" or "EPSG:3857"; when empty, each file's crs
+    // member decides.
+    CRS string `json:"crs"`
+    // Bounds is the area served, in degrees; the configured load_bounds
+    // when absent.
+    Bounds         *Bounds           `json:"bounds"`
+    RiskLayers     []RiskLayerConfig `json:"risk_layers"`
+    RoadAttributes string            `json:"road_attributes"`
+    BlockedAreas   string            `json:"blocked_areas"`
+    // POIs is a GeoJSON file of points of interest, served at /pois.
+    POIs string `json:"pois"`
+}
+
+// cityPack is a city pack found in the packs directory.
+type cityPack struct {
+    cityPackManifest
+    // source is the archive or directory the pack was found as, and root
+    // where its files are.
+    source, root string
+}
+
+// sources returns the files the pack's router is built from; what the
+// pack leaves out is taken from cfg.
+func (p *cityPack) sources(cfg Config) dataSources {
+    src := cfg.dataSources()
+    src.RoadNetworkPath = p.file(p.RoadNetwork)
+    src.RoadNetworkCRS = p.CRS
+    if p.Bounds != nil {
+        src.LoadBounds = *p.Bounds
+    }
+    src.RiskLayers = make([]RiskLayerConfig, len(p.RiskLayers))
+    for i, lc := range p.RiskLayers {
+        lc.Path = p.file(lc.Path)
+        src.RiskLayers[i] = lc
+    }
+    if p.RoadAttributes != "" {
+        src.RoadAttributesPath = p.file(p.RoadAttributes)
+    }
+    if p.BlockedAreas != "" {
+        src.BlockedAreasPath = p.file(p.BlockedAreas)
+    }
+    return src
+}
+
+func (p *cityPack) file(name string) string {
+    return filepath.Join(p.root, filepath.FromSlash(name))
+}
+
+// cityName returns the pack's name for the city in lang, else in
+// English, else in whichever language sorts first.
+func (p *cityPack) cityName(lang string) string {
+    return localizedName(p.Names, lang)
+}
+
+func localizedName(names map[string]string, lang string) string {
+    if name, ok := names[lang]; ok {
+        return name
+    }
+    if name, ok := names[fallbackLanguage]; ok {
+        return name
+    }
+    langs := make([]string, 0, len(names))
+    for l := range names {
+        langs = append(langs, l)
+    }
+    sort.Strings(langs)
+    if len(langs) == 0 {
+        return ""
+    }
+    return names[langs[0]]
+}
+
+// discoverCityPacks finds the packs in dir: zip archives, unpacked into
+// dir/.unpacked once per archive content, and directories holding a
+// manifest. An empty dir has none.
+func discoverCityPacks(dir string) ([]*cityPack, error) {
+    if dir == "" {
+        return nil, nil
+    }
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, fmt.Errorf("city_packs_dir: %v", err)
+    }
+    var packs []*cityPack
+    byID := make(map[string]string)
+    for _, e := range entries {
+        path := filepath.Join(dir, e.Name())
+        var root string
+        switch {
+        case strings.HasPrefix(e.Name(), "."):
+            continue
+        case e.IsDir():
+            if _, err := os.Stat(filepath.Join(path, cityPackManifestName)); err != nil {
+                continue
+            }
+            root = path
+        case strings.EqualFold(filepath.Ext(e.Name()), ".zip"):
+            if root, err = unpackCityPack(path, filepath.Join(dir, ".unpacked")); err != nil {
+                return nil, fmt.Errorf("city pack %s: %v", path, err)
+            }
+        default:
+            continue
+        }
+        pack, err := openCityPack(root)
+        if err != nil {
+            return nil, fmt.Errorf("city pack %s: %v", path, err)
+        }
+        pack.source = path
+        if other, ok := byID[pack.ID]; ok {
+            return nil, fmt.Errorf("city packs %s and %s are both %q", other, path, pack.ID)
+        }
+        byID[pack.ID] = path
+        packs = append(packs, pack)
+        log.Printf("Found city pack %s (%s) in %s", pack.ID, pack.cityName(fallbackLanguage), path)
+    }
+    return packs, nil
+}
+
+// openCityPack reads and checks the manifest of the pack at root.
+func openCityPack(root string) (*cityPack, error) {
+    data, err := os.ReadFile(filepath.Join(root, cityPackManifestName))
+    if err != nil {
+        return nil, err
+    }
+    pack := &cityPack{root: root}
+    if err := json.Unmarshal(data, &pack.cityPackManifest); err != nil {
+        return nil, fmt.Errorf("%s: %v", cityPackManifestName, err)
+    }
+    if pack.ID == "" {
+        return nil, fmt.Errorf("%s: id must be set", cityPackManifestName)
+    }
+    if len(pack.Names) == 0 {
+        return nil, fmt.Errorf("%s: names must name the city in at least one language", cityPackManifestName)
+    }
+    if pack.RoadNetwork == "" {
+        return nil, fmt.Errorf("%s: road_network must be set", cityPackManifestName)
+    }
+    if pack.CRS != "" {
+        if pack.CRS, err = canonicalCRS(pack.CRS); err != nil {
+            return nil, fmt.Errorf("%s: crs: %v", cityPackManifestName, err)
+        }
+    }
+    names := []string{pack.RoadNetwork, pack.RoadAttributes, pack.BlockedAreas, pack.POIs}
+    for _, lc := range pack.RiskLayers {
+        names = append(names, lc.Path)
+    }
+    for _, name := range names {
+        if name == "" {
+            continue
+        }
+        if !filepath.IsLocal(filepath.FromSlash(name)) {
+            return nil, fmt.Errorf("%s: %q is not inside the pack", cityPackManifestName, name)
+        }
+        if _, err := os.Stat(pack.file(name)); err != nil {
+            return nil, fmt.Errorf("%s: %v", cityPackManifestName, err)
+        }
+    }
+    return pack, nil
+}
+
+// unpackCityPack extracts the archive at path under into, reusing an
+// earlier extraction of the same content, and returns where it is.
+func unpackCityPack(path, into string) (string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    h := sha256.New()
+    if _, err := io.Copy(h, f); err != nil {
+        return "", err
+    }
+    name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+    root := filepath.Join(into, name+"-"+hex.EncodeToString(h.Sum(nil)[:6]))
+    if _, err := os.Stat(root); err == nil {
+        return root, nil
+    }
+
+    zr, err := zip.OpenReader(path)
+    if err != nil {
+        return "", err
+    }
+    defer zr.Close()
+    if err := os.MkdirAll(into, 0o755); err != nil {
+        return "", err
+    }
+    tmp, err := os.MkdirTemp(into, name+"-*.tmp")
+    if err != nil {
+        return "", err
+    }
+    defer os.RemoveAll(tmp)
+    for _, zf := range zr.File {
+        if err := extractZipFile(zf, tmp); err != nil {
+            return "", err
+        }
+    }
+    // Renaming the finished extraction into place keeps a crash midway
+    // from leaving a partial pack to be reused.
+    if err := os.Rename(tmp, root); err != nil {
+        return "", err
+    }
+    return root, nil
+}
+
+func extractZipFile(zf *zip.File, dir string) error {
+    if !filepath.IsLocal(filepath.FromSlash(zf.Name)) {
+        return fmt.Errorf("%q is not inside the archive", zf.Name)
+    }
+    path := filepath.Join(dir, filepath.FromSlash(zf.Name))
+    if zf.FileInfo().IsDir() {
+        return os.MkdirAll(path, 0o755)
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return err
+    }
+    src, err := zf.Open()
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+    dst, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(dst, src); err != nil {
+        dst.Close()
+        return err
+    }
+    return dst.Close()
+}
+
+// usePack has t serve pack: its data, and its city names and POIs.
+func (t *Tenant) usePack(pack *cityPack) error {
+    t.sources = pack.sources(globalConfig)
+    t.Dataset = pack.source
+    t.City = pack.cityName(fallbackLanguage)
+    t.cityNames = pack.Names
+    if pack.POIs != "" {
+        pois, err := loadPOIs(pack.file(pack.POIs), pack.CRS)
+        if err != nil {
+            return fmt.Errorf("city pack %s: pois: %v", pack.ID, err)
+        }
+        t.pois = pois
+    }
+    return nil
+}
+
+// cityName returns the name of t's city in lang, as far as its city pack
+// has it.
+func (t *Tenant) cityName(lang string) string {
+    if len(t.cityNames) == 0 {
+        return t.City
+    }
+    return localizedName(t.cityNames, lang)
+}
+
+// cityPackByID returns the pack named id.
+func cityPackByID(packs []*cityPack, id string) (*cityPack, error) {
+    for _, p := range packs {
+        if p.ID == id {
+            return p, nil
+        }
+    }
+    ids := make([]string, len(packs))
+    for i, p := range packs {
+        ids[i] = p.ID
+    }
+    return nil, fmt.Errorf("unknown city pack %q (found: %v)", id, ids)
+}
+
+// poi is a point of interest of a city pack.
+type poi struct {
+    // Names are the POI's names by language, from name and name:<lang>
+    // properties.
+    Names    map[string]string
+    Category string
+    Location Point
+}
+
+// loadPOIs reads the Point features of a GeoJSON file in declaredCRS, or
+// else the CRS the file's crs member names.
+func loadPOIs(path, declaredCRS string) ([]poi, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var raw struct {
+        CRS      interface{}   `json:"crs"`
+        Features []interface{} `json:"features"`
+    }
+    if err := json.Unmarshal(data, &raw); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    crs, err := sourceCRS(raw.CRS, raw.Features, declaredCRS)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    var collection struct {
+        Features []struct {
+            Properties map[string]interface{} `json:"properties"`
+            Geometry   struct {
+                Type        string     `json:"type"`
+                Coordinates [2]float64 `json:"coordinates"`
+            } `json:"geometry"`
+        } `json:"features"`
+    }
+    if err := json.Unmarshal(data, &collection); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    pois := make([]poi, 0, len(collection.Features))
+    for i, f := range collection.Features {
+        if f.Geometry.Type != "Point" {
+            return nil, fmt.Errorf("%s: features[%d]: geometry must be a Point, not %q", path, i, f.Geometry.Type)
+        }
+        p := poi{Names: make(map[string]string), Location: toWGS84(Point{X: f.Geometry.Coordinates[0], Y: f.Geometry.Coordinates[1]}, crs)}
+        p.Category, _ = f.Properties["category"].(string)
+        for key, v := range f.Properties {
+            name, ok := v.(string)
+            if !ok {
+                continue
+            }
+            if key == "name" {
+                p.Names[fallbackLanguage] = name
+            } else if lang, ok := strings.CutPrefix(key, "name:"); ok {
+                p.Names[lang] = name
+            }
+        }
+        pois = append(pois, p)
+    }
+    return pois, nil
+}
+
+// handlePOIs serves GET /pois, the points of interest of the tenant's
+// city pack named in the caller's language, of one category if asked.
+func handlePOIs(w http.ResponseWriter, r *http.Request) {
+    tenant := tenantFromContext(r.Context())
+    l := localizerFor(r)
+    category := r.URL.Query().Get("category")
+    type poiResponse struct {
+        Name     string `json:"name"`
+        Category string `json:"category,omitempty"`
+        Location Point  `json:"location"`
+    }
+    pois := []poiResponse{}
+    for _, p := range tenant.pois {
+        if category != "" && p.Category != category {
+            continue
+        }
+        pois = append(pois, poiResponse{Name: localizedName(p.Names, l.Language), Category: p.Category, Location: p.Location})
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Content-Language", l.Language)
+    if err := json.NewEncoder(w).Encode(map[string]interface{}{"pois": pois}); err != nil {
+        log.Printf("Failed to encode POIs: %v", err)
+    }
+}
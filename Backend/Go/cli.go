@@ -0,0 +1,245 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "time"
+)
+
+// runCommand runs the named subcommand with its arguments.
+func runCommand(name string, args []string) error {
+    switch name {
+    case "build-graph":
+        return runBuildGraph(args)
+    case "build-arc-flags":
+        return runBuildArcFlags(args)
+    case "replay":
+        return runReplay(args)
+    case "loadtest":
+        return runLoadTest(args)
+    case "verify-audit":
+        return runVerifyAudit(args)
+    case "export-graph":
+        return runExportGraph(args)
+    case "diff-graph":
+        return runDiffGraph(args)
+    case "validate":
+        return runValidate(args)
+    default:
+        return fmt.Errorf("unknown command %q (available: build-graph, build-arc-flags, replay, loadtest, verify-audit, export-graph, diff-graph, validate)", name)
+    }
+}
+
+// runBuildGraph converts a GeoJSON road network into the binary format that
+// can be memory-mapped at startup.
+func runBuildGraph(args []string) error {
+    fs := flag.NewFlagSet("build-graph", flag.ContinueOnError)
+    in := fs.String("in", "", "GeoJSON road network to convert")
+    out := fs.String("out", "", "binary graph file to write")
+    bounds := fs.String("bounds", "", `clip to minX,minY,maxX,maxY, or "all" to keep every segment (default Chicago)`)
+    duplicates := fs.String("duplicates", duplicateMinRisk, "which of two segments with the same ends to keep: min_risk, min_distance or last, or parallel to keep both")
+    crs := fs.String("crs", "", "CRS of the GeoJSON, EPSG:4326 or EPSG:3857 (default: its crs member, else EPSG:4326)")
+    blocked := fs.String("blocked", "", "GeoJSON polygons whose roads are left out, such as railyards")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if *in == "" || *out == "" {
+        return fmt.Errorf("usage: build-graph -in roads.geojson -out roads.bin [-bounds all|minX,minY,maxX,maxY] [-duplicates min_risk|min_distance|last|parallel] [-crs EPSG:4326|EPSG:3857] [-blocked areas.geojson]")
+    }
+    if err := checkDuplicatePolicy(*duplicates); err != nil {
+        return err
+    }
+    if _, err := canonicalCRS(*crs); err != nil {
+        return err
+    }
+    clip := &chicagoBounds
+    switch *bounds {
+    case "":
+    case boundsAll:
+        clip = nil
+    default:
+        b, err := parseBounds(*bounds)
+        if err != nil {
+            return err
+        }
+        clip = &b
+    }
+
+    graph := NewGraph()
+    graph.duplicatePolicy = *duplicates
+    graph.sourceCRS = *crs
+    if *blocked != "" {
+        areas, err := loadBlockedAreas(*blocked)
+        if err != nil {
+            return err
+        }
+        graph.blocked = areas
+    }
+    if err := loadRoadNetwork(*in, graph, clip); err != nil {
+        return err
+    }
+    graph.index()
+
+    f, err := os.Create(*out)
+    if err != nil {
+        return err
+    }
+    if err := graph.WriteBinary(f); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    fmt.Printf("wrote %s: %d nodes, %d edges, graph %s, risk %s\n",
+        *out, len(graph.Nodes), len(graph.targets), graph.Version, graph.RiskVersion)
+    return nil
+}
+
+// runExportGraph writes a road network, as the server would load it, to
+// GeoJSON or GraphML for analysis in QGIS or NetworkX.
+func runExportGraph(args []string) error {
+    fs := flag.NewFlagSet("export-graph", flag.ContinueOnError)
+    in := fs.String("in", "", "road network (GeoJSON or binary graph) to export")
+    out := fs.String("out", "", "file to write (default stdout)")
+    formatName := fs.String("format", "geojson", fmt.Sprintf("output format %v", graphExportFormatNames()))
+    bounds := fs.String("bounds", "", `clip to minX,minY,maxX,maxY, or "all" to keep every segment (default Chicago)`)
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if *in == "" {
+        return fmt.Errorf("usage: export-graph -in roads.bin [-format geojson|graphml] [-out graph.geojson] [-bounds all|minX,minY,maxX,maxY]")
+    }
+    format, ok := graphExportFormats[*formatName]
+    if !ok {
+        return fmt.Errorf("unknown format %q (available: %v)", *formatName, graphExportFormatNames())
+    }
+    opts := RouterOptions{}
+    switch *bounds {
+    case "":
+    case boundsAll:
+        opts.BoundsMode = boundsAll
+    default:
+        b, err := parseBounds(*bounds)
+        if err != nil {
+            return err
+        }
+        opts.LoadBounds = b
+    }
+
+    router, err := NewRiskAwareRouter(*in, &CrimeData{}, opts)
+    if err != nil {
+        return err
+    }
+    w := os.Stdout
+    if *out != "" {
+        f, err := os.Create(*out)
+        if err != nil {
+            return err
+        }
+        defer f.Close()
+        w = f
+    }
+    layer := router.layers.current()
+    if err := format.write(w, router.G, layer); err != nil {
+        return err
+    }
+    if *out != "" {
+        if err := w.Close(); err != nil {
+            return err
+        }
+        fmt.Printf("wrote %s: %d nodes, %d segments, graph %s, risk %s\n",
+            *out, len(router.G.Nodes), len(router.G.targets)/2, router.G.Version, layer.Version)
+    }
+    return nil
+}
+
+// runDiffGraph compares two versions of a road network, binary or GeoJSON,
+// so a new data drop can be checked before it is deployed.
+func runDiffGraph(args []string) error {
+    fs := flag.NewFlagSet("diff-graph", flag.ContinueOnError)
+    asJSON := fs.Bool("json", false, "print the diff as JSON")
+    bounds := fs.String("bounds", "", `clip GeoJSON to minX,minY,maxX,maxY, or "all" to keep every segment (default Chicago)`)
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if fs.NArg() != 2 {
+        return fmt.Errorf("usage: diff-graph [-json] [-bounds all|minX,minY,maxX,maxY] old.bin new.bin")
+    }
+    opts := RouterOptions{}
+    switch *bounds {
+    case "":
+    case boundsAll:
+        opts.BoundsMode = boundsAll
+    default:
+        b, err := parseBounds(*bounds)
+        if err != nil {
+            return err
+        }
+        opts.LoadBounds = b
+    }
+
+    older, err := loadGraph(fs.Arg(0), opts)
+    if err != nil {
+        return err
+    }
+    newer, err := loadGraph(fs.Arg(1), opts)
+    if err != nil {
+        return err
+    }
+    diff := diffGraphs(older, newer)
+    if *asJSON {
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "  ")
+        return enc.Encode(diff)
+    }
+    diff.writeText(os.Stdout)
+    return nil
+}
+
+// runBuildArcFlags precomputes arc flags for a road network and writes them
+// next to it, where the server picks them up at startup.
+func runBuildArcFlags(args []string) error {
+    fs := flag.NewFlagSet("build-arc-flags", flag.ContinueOnError)
+    in := fs.String("in", "", "road network (GeoJSON or binary graph) to build flags for")
+    grid := fs.Int("grid", 4, fmt.Sprintf("regions per side of the grid partition (at most %d)", maxArcFlagsGrid))
+    alphaList := fs.String("alphas", "0,0.25,0.5,0.75", "comma-separated alphas to build flags for")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if *in == "" {
+        return fmt.Errorf("usage: build-arc-flags -in roads.bin [-grid 4] [-alphas 0,0.25,0.5,0.75]")
+    }
+    if *grid < 1 || *grid > maxArcFlagsGrid {
+        return fmt.Errorf("-grid must be within [1, %d]", maxArcFlagsGrid)
+    }
+    alphas, err := parseAlphas(*alphaList)
+    if err != nil {
+        return fmt.Errorf("-alphas: %v", err)
+    }
+
+    router, err := NewRiskAwareRouter(*in, &CrimeData{}, RouterOptions{Alphas: alphas})
+    if err != nil {
+        return err
+    }
+    start := time.Now()
+    flags := computeArcFlags(router, *grid, alphas)
+
+    out := *in + arcFlagsSuffix
+    f, err := os.Create(out)
+    if err != nil {
+        return err
+    }
+    if err := flags.write(f, router.G, alphas); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    fmt.Printf("wrote %s: %dx%d regions, %d alphas, graph %s, risk %s, in %v\n",
+        out, *grid, *grid, len(alphas), router.G.Version, flags.riskVersion, time.Since(start).Round(time.Millisecond))
+    return nil
+}
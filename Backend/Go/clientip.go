@@ -0,0 +1,104 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+)
+
+// proxyTrust resolves the real client address of requests arriving
+// through trusted reverse proxies or load balancers.
+type proxyTrust struct {
+    nets []*net.IPNet
+}
+
+var globalProxies *proxyTrust
+
+// parseTrustedProxies reads CIDRs or bare addresses.
+func parseTrustedProxies(entries []string) (*proxyTrust, error) {
+    nets, err := parseNets(entries)
+    if err != nil {
+        return nil, fmt.Errorf("trusted proxy %v", err)
+    }
+    return &proxyTrust{nets: nets}, nil
+}
+
+// parseNets reads CIDRs, treating a bare address as a single-host network.
+func parseNets(entries []string) ([]*net.IPNet, error) {
+    var nets []*net.IPNet
+    for _, e := range entries {
+        e = strings.TrimSpace(e)
+        if !strings.Contains(e, "/") {
+            if ip := net.ParseIP(e); ip != nil && ip.To4() != nil {
+                e += "/32"
+            } else {
+                e += "/128"
+            }
+        }
+        _, n, err := net.ParseCIDR(e)
+        if err != nil {
+            return nil, fmt.Errorf("%q: %v", e, err)
+        }
+        nets = append(nets, n)
+    }
+    return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+    for _, n := range nets {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+func (p *proxyTrust) trusted(addr string) bool {
+    ip := net.ParseIP(addr)
+    return p != nil && ip != nil && containsIP(p.nets, ip)
+}
+
+// resolve returns the client address of r. Forwarding headers are only
+// believed when the peer is a trusted proxy: X-Forwarded-For is read from
+// the right, skipping trusted hops, and X-Real-IP is used without it.
+func (p *proxyTrust) resolve(r *http.Request) string {
+    peer, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        peer = r.RemoteAddr
+    }
+    if !p.trusted(peer) {
+        return peer
+    }
+    if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+        hops := strings.Split(strings.Join(xff, ","), ",")
+        for i := len(hops) - 1; i >= 0; i-- {
+            hop := strings.TrimSpace(hops[i])
+            if net.ParseIP(hop) == nil {
+                // A malformed entry cannot be traced further.
+                return peer
+            }
+            if !p.trusted(hop) || i == 0 {
+                return hop
+            }
+        }
+    }
+    if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+        return real
+    }
+    return peer
+}
+
+// clientIP returns the request's resolved client address, computed once
+// per request when a scope is attached.
+func clientIP(r *http.Request) string {
+    scope := scopeFromContext(r.Context())
+    if scope != nil && scope.clientIP != "" {
+        return scope.clientIP
+    }
+    ip := globalProxies.resolve(r)
+    if scope != nil {
+        scope.clientIP = ip
+    }
+    return ip
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestProxyTrustResolve(t *testing.T) {
+    proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", " 192.0.2.1 ", "2001:db8::/32"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    cases := []struct {
+        name   string
+        remote string
+        xff    []string
+        realIP string
+        want   string
+    }{
+        {"direct client", "203.0.113.7:4000", nil, "", "203.0.113.7"},
+        {"untrusted peer's headers ignored", "203.0.113.7:4000", []string{"198.51.100.1"}, "198.51.100.2", "203.0.113.7"},
+        {"one proxy", "10.0.0.1:4000", []string{"198.51.100.1"}, "", "198.51.100.1"},
+        {"proxy chain", "10.0.0.1:4000", []string{"198.51.100.1, 10.1.2.3, 192.0.2.1"}, "", "198.51.100.1"},
+        {"spoofed leading entry", "10.0.0.1:4000", []string{"127.0.0.1, 198.51.100.1, 10.1.2.3"}, "", "198.51.100.1"},
+        {"spoofed trusted-looking entry", "10.0.0.1:4000", []string{"10.9.9.9, 198.51.100.1"}, "", "198.51.100.1"},
+        {"several headers", "10.0.0.1:4000", []string{"127.0.0.1", "198.51.100.1, 10.1.2.3"}, "", "198.51.100.1"},
+        {"all trusted", "10.0.0.1:4000", []string{"10.3.3.3, 10.2.2.2"}, "", "10.3.3.3"},
+        {"malformed entry", "10.0.0.1:4000", []string{"198.51.100.1, not-an-ip, 10.1.2.3"}, "", "10.0.0.1"},
+        {"address with port", "10.0.0.1:4000", []string{"198.51.100.1:5555"}, "", "10.0.0.1"},
+        {"empty entry", "10.0.0.1:4000", []string{"198.51.100.1, "}, "", "10.0.0.1"},
+        {"IPv6 client", "[2001:db8::1]:4000", []string{"2001:db8:ffff::9, 2001:db8::2"}, "", "2001:db8:ffff::9"},
+        {"IPv6 client of an IPv4 proxy", "192.0.2.1:4000", []string{"2606:4700::1"}, "", "2606:4700::1"},
+        {"X-Real-IP", "10.0.0.1:4000", nil, " 198.51.100.3 ", "198.51.100.3"},
+        {"X-Forwarded-For over X-Real-IP", "10.0.0.1:4000", []string{"198.51.100.1"}, "198.51.100.3", "198.51.100.1"},
+        {"malformed X-Real-IP", "10.0.0.1:4000", nil, "nowhere", "10.0.0.1"},
+        {"remote address without port", "203.0.113.7", nil, "", "203.0.113.7"},
+        {"malformed remote address", "unix-socket", []string{"198.51.100.1"}, "", "unix-socket"},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodGet, "/route", nil)
+            r.RemoteAddr = c.remote
+            for _, v := range c.xff {
+                r.Header.Add("X-Forwarded-For", v)
+            }
+            if c.realIP != "" {
+                r.Header.Set("X-Real-IP", c.realIP)
+            }
+            if got := proxies.resolve(r); got != c.want {
+                t.Errorf("resolve = %q, want %q", got, c.want)
+            }
+        })
+    }
+
+    var none *proxyTrust
+    r := httptest.NewRequest(http.MethodGet, "/route", nil)
+    r.RemoteAddr = "10.0.0.1:4000"
+    r.Header.Set("X-Forwarded-For", "198.51.100.1")
+    if got := none.resolve(r); got != "10.0.0.1" {
+        t.Errorf("without trusted proxies resolve = %q, want the peer", got)
+    }
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+    for _, entry := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.1/", "::1/129"} {
+        if _, err := parseTrustedProxies([]string{entry}); err == nil {
+            t.Errorf("%q accepted", entry)
+        }
+    }
+    p, err := parseTrustedProxies([]string{"::1", "127.0.0.1"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for addr, want := range map[string]bool{"::1": true, "127.0.0.1": true, "127.0.0.2": false, "::2": false, "junk": false} {
+        if got := p.trusted(addr); got != want {
+            t.Errorf("trusted(%q) = %v, want %v", addr, got, want)
+        }
+    }
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "fmt"
+    "sort"
+    "sync"
+    "sync/atomic"
+)
+
+// closureSet is an immutable set of closed edge IDs. Searches skip closed
+// edges; version fingerprints the set so cached routes and ETags computed
+// before a closure change are not served after it.
+type closureSet struct {
+    edges map[int32]struct{}
+    hash  string
+}
+
+func (s *closureSet) closed(e int32) bool {
+    if s == nil {
+        return false
+    }
+    _, ok := s.edges[e]
+    return ok
+}
+
+func (s *closureSet) version() string {
+    if s == nil {
+        return ""
+    }
+    return s.hash
+}
+
+// closures holds a router's current closure set, replaced wholesale on
+// each change so searches read it without locking.
+type closures struct {
+    mu      sync.Mutex
+    current atomic.Pointer[closureSet]
+}
+
+func (c *closures) load() *closureSet { return c.current.Load() }
+
+// set closes or reopens edges and reports whether the set changed.
+func (c *closures) set(edges []int32, closed bool) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    old := c.current.Load()
+    next := make(map[int32]struct{})
+    if old != nil {
+        for e := range old.edges {
+            next[e] = struct{}{}
+        }
+    }
+    changed := false
+    for _, e := range edges {
+        if _, ok := next[e]; ok != closed {
+            changed = true
+            if closed {
+                next[e] = struct{}{}
+            } else {
+                delete(next, e)
+            }
+        }
+    }
+    if !changed {
+        return false
+    }
+    if len(next) == 0 {
+        c.current.Store(nil)
+        return true
+    }
+    ids := make([]int32, 0, len(next))
+    for e := range next {
+        ids = append(ids, e)
+    }
+    sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+    h := sha256.New()
+    for _, e := range ids {
+        writeFloats(h, float64(e))
+    }
+    c.current.Store(&closureSet{edges: next, hash: shortHash(h)})
+    return true
+}
+
+// segmentEdges returns the edges, in both directions, of the road segment
+// between the nodes nearest from and to.
+func (r *RiskAwareRouter) segmentEdges(from, to Point) ([]int32, error) {
+    g := r.G
+    a, b := r.findNearestNode(from), r.findNearestNode(to)
+    var edges []int32
+    for _, pair := range [][2]int32{{a, b}, {b, a}} {
+        lo, hi := g.edgeRange(pair[0])
+        for e := lo; e < hi; e++ {
+            if g.targets[e] == pair[1] {
+                edges = append(edges, e)
+            }
+        }
+    }
+    if len(edges) == 0 {
+        return nil, fmt.Errorf("no road segment joins the nodes nearest (%v, %v) and (%v, %v)", from.X, from.Y, to.X, to.Y)
+    }
+    return edges, nil
+}
+
+// restoreClosures closes tenant's stored closed segments on r, whose graph
+// may be newer than the one they were closed on; segments it no longer
+// has are reported and skipped.
+func (r *RiskAwareRouter) restoreClosures(tenant string) error {
+    stored, err := globalStorage.closures(context.Background(), tenant)
+    if err != nil {
+        return fmt.Errorf("restoring closures: %v", err)
+    }
+    var edges []int32
+    for _, c := range stored {
+        e, err := r.segmentEdges(c.From, c.To)
+        if err != nil {
+            reportWarning(map[string]string{"tenant": tenant}, "stored closure not restored: %v", err)
+            continue
+        }
+        edges = append(edges, e...)
+    }
+    r.closed.set(edges, true)
+    return nil
+}
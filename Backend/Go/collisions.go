@@ -0,0 +1,207 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "os"
+    "time"
+
+    "risk-router/geo"
+)
+
+// collisionsSource marks the risk component built from crash data.
+const collisionsSource = "collisions"
+
+// CollisionConfig ingests vehicle-pedestrian crashes as the risk
+// component whose source is "collisions". Path is an NDJSON file of
+// {"x", "y", "severity", "time"} lines, re-read by the collisions_refresh
+// task, every RefreshSeconds unless scheduled otherwise, so an external
+// job can keep it current. Each crash adds its severity weight,
+// halved every HalfLifeDays of age, to the road segment within SnapRadiusM
+// of it; segments are scored by that weight per kilometer and normalized.
+type CollisionConfig struct {
+    Path            string             `json:"path"`
+    RefreshSeconds  int                `json:"refresh_seconds"`
+    HalfLifeDays    float64            `json:"half_life_days"`
+    SnapRadiusM     float64            `json:"snap_radius_m"`
+    SeverityWeights map[string]float64 `json:"severity_weights"`
+    Normalization   string             `json:"normalization"`
+}
+
+func defaultCollisionConfig() CollisionConfig {
+    return CollisionConfig{
+        HalfLifeDays:    365,
+        SnapRadiusM:     30,
+        SeverityWeights: map[string]float64{"fatal": 10, "serious": 3, "minor": 1},
+        Normalization:   normalizePercentile,
+    }
+}
+
+func (c CollisionConfig) validate() error {
+    if c.RefreshSeconds < 0 {
+        return fmt.Errorf("collisions.refresh_seconds must not be negative, got %d", c.RefreshSeconds)
+    }
+    if c.HalfLifeDays < 0 {
+        return fmt.Errorf("collisions.half_life_days must not be negative, got %v", c.HalfLifeDays)
+    }
+    if c.SnapRadiusM <= 0 {
+        return fmt.Errorf("collisions.snap_radius_m must be positive, got %v", c.SnapRadiusM)
+    }
+    if len(c.SeverityWeights) == 0 {
+        return fmt.Errorf("collisions.severity_weights must not be empty")
+    }
+    for name, w := range c.SeverityWeights {
+        if w < 0 {
+            return fmt.Errorf("collisions.severity_weights.%s must not be negative, got %v", name, w)
+        }
+    }
+    if err := checkNormalization(c.Normalization); err != nil {
+        return fmt.Errorf("collisions: %v", err)
+    }
+    return nil
+}
+
+// collision is one crash, weighted by its severity.
+type collision struct {
+    p      Point
+    weight float64
+    at     time.Time
+}
+
+// collisionLine is one NDJSON line of the crash file.
+type collisionLine struct {
+    X        *float64 `json:"x"`
+    Y        *float64 `json:"y"`
+    Severity string   `json:"severity"`
+    Time     string   `json:"time"`
+}
+
+// loadCollisions reads the crash file. Lines that do not parse, or have
+// a severity without a weight, are counted and skipped.
+func loadCollisions(cfg CollisionConfig) ([]collision, int, error) {
+    f, err := os.Open(cfg.Path)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer f.Close()
+
+    var crashes []collision
+    skipped := 0
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+    for scanner.Scan() {
+        if len(scanner.Bytes()) == 0 {
+            continue
+        }
+        var line collisionLine
+        if err := json.Unmarshal(scanner.Bytes(), &line); err != nil || line.X == nil || line.Y == nil {
+            skipped++
+            continue
+        }
+        weight, ok := cfg.SeverityWeights[line.Severity]
+        if !ok {
+            skipped++
+            continue
+        }
+        c := collision{p: Point{X: *line.X, Y: *line.Y}, weight: weight}
+        if line.Time != "" {
+            if c.at, err = time.Parse(time.RFC3339, line.Time); err != nil {
+                skipped++
+                continue
+            }
+        }
+        crashes = append(crashes, c)
+    }
+    return crashes, skipped, scanner.Err()
+}
+
+// collisionRisk scores every edge of g from crashes as of now: the
+// decayed severity weight of the crashes snapped to its segment per km,
+// normalized into [0, 1] over the segments with crashes. Crashes without
+// a time do not decay.
+func collisionRisk(g *Graph, crashes []collision, cfg CollisionConfig, now time.Time) []float64 {
+    raw := make([]float64, len(g.targets))
+    for _, c := range crashes {
+        hits := g.segmentIndex.nearest(c.p, 1, cellSizeM(c.p.Y), func(e int32) float64 {
+            return geo.DistanceToSegment(c.p, g.Nodes[g.source(e)], g.Nodes[g.targets[e]])
+        })
+        if len(hits) == 0 || hits[0].dist > cfg.SnapRadiusM {
+            continue
+        }
+        weight := c.weight
+        if cfg.HalfLifeDays > 0 && !c.at.IsZero() {
+            ageDays := now.Sub(c.at).Hours() / 24
+            weight *= math.Pow(0.5, max(ageDays, 0)/cfg.HalfLifeDays)
+        }
+        e := hits[0].id
+        raw[e] += weight
+        if back, ok := g.twin(e); ok {
+            raw[back] += weight
+        }
+    }
+    // Segments without crashes stay at 0; fitting with one 0 keeps the
+    // least dangerous segment with crashes above them.
+    hit := []float64{0}
+    for e := range raw {
+        if g.dist[e] > 0 {
+            raw[e] /= g.dist[e] / 1000
+        }
+        if raw[e] > 0 {
+            hit = append(hit, raw[e])
+        }
+    }
+    normalizer := fitNormalizer(cfg.Normalization, hit)
+    for e, v := range raw {
+        if v > 0 {
+            raw[e] = min(normalizer.apply(v), 1)
+        }
+    }
+    return raw
+}
+
+// loadCollisionRisk reads the crash file and scores g's edges from it.
+func loadCollisionRisk(g *Graph, cfg CollisionConfig) ([]float64, error) {
+    crashes, skipped, err := loadCollisions(cfg)
+    if err != nil {
+        return nil, fmt.Errorf("collisions %s: %v", cfg.Path, err)
+    }
+    if skipped > 0 {
+        reportWarning(map[string]string{"dataset": cfg.Path}, "skipped %d crash lines in %s", skipped, cfg.Path)
+    }
+    log.Printf("Loaded %d collisions from %s", len(crashes), cfg.Path)
+    return collisionRisk(g, crashes, cfg, time.Now()), nil
+}
+
+// hasCollisionsComponent reports whether components score roads from
+// crash data.
+func hasCollisionsComponent(components []RiskComponentConfig) bool {
+    for _, c := range components {
+        if c.Source == collisionsSource {
+            return true
+        }
+    }
+    return false
+}
+
+// refreshCollisions rescores r's collisions component, so new crashes are
+// picked up and old ones keep decaying. Routers without one are left
+// alone, and report false.
+func (r *RiskAwareRouter) refreshCollisions(cfg CollisionConfig) (bool, error) {
+    found := false
+    for _, c := range r.composed.list() {
+        found = found || c.Source == collisionsSource
+    }
+    if !found {
+        return false, nil
+    }
+    risk, err := loadCollisionRisk(r.G, cfg)
+    if err != nil {
+        return false, err
+    }
+    layer := r.setComponentRisk(collisionsSource, risk)
+    log.Printf("Refreshed collisions; risk layer is now %s", layer.Version)
+    return true, nil
+}
@@ -0,0 +1,921 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// Config holds the server settings. Defaults are overridden by the JSON file
+// named in CONFIG_FILE (if any), which is in turn overridden by individual
+// environment variables.
+type Config struct {
+    Port string `json:"port"`
+    City string `json:"city"`
+
+    // TrustedProxies are the CIDRs (or addresses) of load balancers and
+    // reverse proxies whose X-Forwarded-For and X-Real-IP headers name the
+    // real client for logging and access checks.
+    TrustedProxies []string `json:"trusted_proxies"`
+
+    // IPAllow and IPDeny are CIDRs admitted and refused by client address;
+    // an empty allow list admits everyone not denied. BlockedCountries
+    // (ISO codes) refuses clients that GeoIPPath, a country database,
+    // places in them.
+    IPAllow          []string `json:"ip_allow"`
+    IPDeny           []string `json:"ip_deny"`
+    BlockedCountries []string `json:"blocked_countries"`
+    GeoIPPath        string   `json:"geoip_path"`
+    // Scraping flags, or throttles, clients asking routes across the
+    // whole city, reported at /admin/scrapers.
+    Scraping ScrapingConfig `json:"scraping"`
+
+    // AdminPort, when set, serves the /admin endpoints on a listener of
+    // their own instead of alongside the public API on Port.
+    AdminPort string `json:"admin_port"`
+
+    // RoadNetworkPath is a GeoJSON file, or a binary graph (.bin) written
+    // by the build-graph command, which is memory-mapped.
+    RoadNetworkPath string  `json:"road_network_path"`
+    GraphPreload    bool    `json:"graph_preload"`
+    BoundsPaddingM  float64 `json:"bounds_padding_m"`
+    SnapWarningM    float64 `json:"snap_warning_m"`
+    MaxSnapM        float64 `json:"max_snap_m"`
+    ClampToleranceM float64 `json:"clamp_tolerance_m"`
+
+    // GraphBounds picks how GeoJSON road networks are bounded: "clip" (the
+    // default) drops segments outside LoadBounds, "all" loads everything
+    // but serves only LoadBounds, and "data" loads everything and serves
+    // wherever there are roads. LoadBounds defaults to Chicago.
+    GraphBounds string `json:"graph_bounds"`
+    LoadBounds  Bounds `json:"load_bounds"`
+    // DuplicateEdges picks which of two GeoJSON segments with the same ends
+    // is kept: "min_risk" (the default), "min_distance" or "last"; or
+    // "parallel" keeps both, for searches to choose between.
+    DuplicateEdges string `json:"duplicate_edges"`
+    // RoadNetworkCRS is the coordinate reference system of the GeoJSON
+    // road network, "EPSG:4326" or "EPSG:3857". When empty, a file's crs
+    // member decides, and files without one must be in degrees.
+    RoadNetworkCRS string `json:"road_network_crs"`
+    // CityPacksDir is searched at startup for city packs: zip archives, or
+    // directories, of a city's road network, risk layers, POIs and bounds
+    // with a manifest.json. Tenants serve them by city_pack; without
+    // tenants, a single pack is served in place of road_network_path.
+    CityPacksDir string `json:"city_packs_dir"`
+
+    // RoadAttributesPath is a GeoJSON road network whose highway, lit and
+    // businesses properties describe the served roads, for labelling
+    // routes such as "well-lit route". Segments match by their ends.
+    RoadAttributesPath string `json:"road_attributes_path"`
+    // MainStreetsBias is how strongly main_streets requests avoid minor
+    // roads: their edges cost 1 + bias times more than primary roads',
+    // classes in between proportionally less. It defaults to 1.
+    MainStreetsBias float64 `json:"main_streets_bias"`
+    // ProtectedLanesBias is how strongly bike-share ride legs keep to
+    // protected bike lanes: other edges cost 1 + bias times more. It
+    // defaults to 1.
+    ProtectedLanesBias float64 `json:"protected_lanes_bias"`
+    // NetworkLayers are supplementary pedestrian networks stitched into
+    // a GeoJSON road network, which requests may turn on or off.
+    NetworkLayers []NetworkLayerConfig `json:"network_layers"`
+    // BlockedAreasPath is a GeoJSON file of polygons, such as railyards
+    // or restricted facilities, whose roads are left out of the graph
+    // when a GeoJSON road network is loaded; binary graphs are built
+    // without them by build-graph -blocked.
+    BlockedAreasPath string `json:"blocked_areas_path"`
+    // CRS is the default coordinate reference system of route request
+    // points and answers; requests may pick another with "crs".
+    CRS string `json:"crs"`
+
+    // DefaultAlphas is the risk-weight sweep used when neither the tenant
+    // nor the request picks one; each alpha yields one route.
+    DefaultAlphas []float64 `json:"default_alphas"`
+    Limits        Limits    `json:"limits"`
+
+    // HeuristicWeight is the weighted-A* factor for requests that do not
+    // set one; 1 (the default) finds optimal routes.
+    HeuristicWeight float64 `json:"heuristic_weight"`
+
+    // RiskAggregation is how route risk is computed from edge risk when a
+    // request does not say: "length" (the default, a length-weighted
+    // mean), "mean", "max" or "exposure" (risk-seconds walked).
+    RiskAggregation string `json:"risk_aggregation"`
+
+    // ExposureRadiusM and ExposureWindowDays define a route's
+    // incidents_per_km: incidents within the radius of the route from the
+    // last window days (0 counts all of them).
+    ExposureRadiusM    float64 `json:"exposure_radius_m"`
+    ExposureWindowDays int     `json:"exposure_window_days"`
+
+    // WalkingSpeedMPS converts route lengths to the durations in route
+    // summaries, DrivingSpeedMPS those of park-and-walk drive legs and
+    // RidingSpeedMPS those of bike-share ride legs.
+    WalkingSpeedMPS float64 `json:"walking_speed_mps"`
+    DrivingSpeedMPS float64 `json:"driving_speed_mps"`
+    RidingSpeedMPS  float64 `json:"riding_speed_mps"`
+    // ParkingPath is a GeoJSON file of parking points drivers may leave
+    // their car at, for tenants without a city pack; a pack's POIs of
+    // category "parking" serve instead.
+    ParkingPath string `json:"parking_path"`
+    // BikeShare is the GBFS feed of bike-share and scooter docks.
+    BikeShare BikeShareConfig `json:"bike_share"`
+
+    // SearchEllipseFactor bounds route searches to the ellipse around the
+    // start and end whose detour is at most that factor of their distance,
+    // e.g. 1.5; 0 (the default) searches the whole graph. A route that is
+    // not found inside the ellipse is searched for again without it.
+    SearchEllipseFactor float64 `json:"search_ellipse_factor"`
+
+    // RouteSimilarity is the share of their length two routes of
+    // neighbouring alphas must have in common to be answered as one, 0.95
+    // by default; 1 collapses only identical paths and 0 none.
+    RouteSimilarity float64 `json:"route_similarity"`
+
+    // Presets are named routing bundles selectable by the "preset" request
+    // field. Entries in the config file are merged over the defaults.
+    Presets map[string]Preset `json:"presets"`
+
+    // RouteCacheEntries bounds the per-tenant cache of encoded route
+    // responses (0 disables it); entries expire after RouteCacheTTLSeconds
+    // (0 keeps them until evicted).
+    RouteCacheEntries    int `json:"route_cache_entries"`
+    RouteCacheTTLSeconds int `json:"route_cache_ttl_seconds"`
+    // Prewarm tunes the nightly precomputation of the busiest origin and
+    // destination pairs into the route cache.
+    Prewarm PrewarmConfig `json:"prewarm"`
+    // Canaries are the routes GET /admin/selftest runs and checks.
+    Canaries []CanaryConfig `json:"canaries"`
+
+    // RecordPath receives a JSON-lines sample of RecordSamplePercent percent
+    // of route and nearest requests, for the replay command.
+    RecordPath          string  `json:"record_path"`
+    RecordSamplePercent float64 `json:"record_sample_percent"`
+
+    // RiskMetadata describes the risk scores in the road network file, and
+    // RiskLayers lists older or alternative layers requests may pin.
+    RiskMetadata RiskLayerMetadata `json:"risk_metadata"`
+    RiskLayers   []RiskLayerConfig `json:"risk_layers"`
+    // MaxRiskStalenessHours is how long the served risk layer may go
+    // without a refresh before responses carry a stale_risk_data warning
+    // and the risk_data readiness check fails; 0 never.
+    MaxRiskStalenessHours float64 `json:"max_risk_staleness_hours"`
+    // RiskComponents, when set, make the served risk layer the weighted
+    // mean of named layers (crime, lighting, collisions...), whose
+    // weights requests may adjust within the configured bounds.
+    RiskComponents []RiskComponentConfig `json:"risk_components"`
+    // RiskCalendar scales risk over areas on given days, in
+    // CalendarTimeZone (America/Chicago by default).
+    RiskCalendar     []RiskCalendarRule `json:"risk_calendar"`
+    CalendarTimeZone string             `json:"calendar_time_zone"`
+    // Collisions is the crash data behind a risk component with source
+    // "collisions".
+    Collisions CollisionConfig `json:"collisions"`
+    // Schedule overrides when background tasks such as cache cleanup and
+    // data refreshes run, by task name.
+    Schedule map[string]ScheduleConfig `json:"schedule"`
+    // SearchWorkers bounds the searches that run at once, one per CPU
+    // when 0. BatchSearchWorkers, half of them when 0, bounds those of
+    // matrix requests and background work, so the rest stay free for
+    // route requests, which are also served first.
+    SearchWorkers      int `json:"search_workers"`
+    BatchSearchWorkers int `json:"batch_search_workers"`
+    // GraphMemoryBudgetMB caps the memory each road network may take,
+    // estimated before a GeoJSON file is decoded and measured once it is
+    // indexed; datasets over it fail to load instead of exhausting memory.
+    // Binary graphs are memory-mapped and count only their heap part.
+    // 0 is no cap.
+    GraphMemoryBudgetMB int `json:"graph_memory_budget_mb"`
+
+    // ShadowTarget is the base URL of a candidate instance that receives a
+    // copy of every route and nearest request for comparison.
+    ShadowTarget string `json:"shadow_target"`
+
+    // PrivacyMode treats request coordinates as personal data: they are
+    // rounded to about 100 m wherever they are logged or reported, and
+    // routes are neither saved nor cached past the request. GET /privacy
+    // documents what is kept.
+    PrivacyMode bool `json:"privacy_mode"`
+
+    // ErrorReportingDSN sends panics and loader warnings to a
+    // Sentry-compatible service, sampling ErrorSampleRate of them (0-1).
+    // Without it they are only logged.
+    ErrorReportingDSN string  `json:"error_reporting_dsn"`
+    ErrorSampleRate   float64 `json:"error_sample_rate"`
+
+    // AccessLogFormat is "combined" (the default), "json" or "off";
+    // AccessLogSampleRate (0-1) is the share of non-error requests logged.
+    AccessLogFormat     string  `json:"access_log_format"`
+    AccessLogSampleRate float64 `json:"access_log_sample_rate"`
+
+    // EventBusURL names a message bus (nats://host:port, or file:///path
+    // for an NDJSON log) whose EventBusTopic carries incident, closure and
+    // risk-update events applied to the live graphs.
+    EventBusURL   string `json:"event_bus_url"`
+    EventBusTopic string `json:"event_bus_topic"`
+
+    // Storage keeps saved routes, closures and the scheduled tasks' run
+    // history: "memory" (the default), lost on restart; "sqlite", a file
+    // at StorageDSN (risk-router.db by default) for a single node; or
+    // "postgres", the database at StorageDSN, shared by every instance.
+    Storage    string `json:"storage"`
+    StorageDSN string `json:"storage_dsn"`
+
+    // UserJWTSecret verifies the HS256 JWTs end users send in
+    // X-User-Token; the "sub" claim names the user whose route history
+    // /me/routes serves. Without it there are no user accounts.
+    UserJWTSecret string `json:"user_jwt_secret"`
+    // WebhookHosts, when set, are the only hosts notification webhooks,
+    // such as route monitor alerts, may be sent to.
+    WebhookHosts []string `json:"webhook_hosts"`
+    // Push configures the push services users may be notified through,
+    // besides webhooks.
+    Push PushConfig `json:"push"`
+    // ResponseSigning, when given a key, signs route responses.
+    ResponseSigning ResponseSigningConfig `json:"response_signing"`
+
+    // AuditLog is where mutating admin operations are recorded: "stderr"
+    // (the default), "stdout" or a file path.
+    AuditLog string `json:"audit_log"`
+
+    // The /admin endpoints accept AdminKeys, each carrying a role, HS256
+    // JWTs signed with JWTSecret whose "role" claim names one, and the
+    // legacy AdminToken, which has the admin role. With none of them set
+    // the admin API is disabled.
+    AdminKeys  []AdminKeyConfig `json:"admin_keys"`
+    JWTSecret  string           `json:"jwt_secret"`
+    AdminToken string           `json:"admin_token"`
+    Tenants    []TenantConfig   `json:"tenants"`
+    // HMACWindowSeconds is how far a signed request's timestamp may be
+    // from the server's clock, 300 by default.
+    HMACWindowSeconds int `json:"hmac_window_seconds"`
+    // JWTAllowNoExpiry accepts admin and user JWTs without an "exp"
+    // claim, which never expire; by default they are refused.
+    JWTAllowNoExpiry bool `json:"jwt_allow_no_expiry"`
+}
+
+// Limits bound the size of requests and are advertised by /capabilities.
+type Limits struct {
+    // MaxAlternatives caps the routes one request returns, and so the
+    // length of every configured alpha sweep.
+    MaxAlternatives int `json:"max_alternatives"`
+    // MaxWaypoints is the number of points a route passes through. Routes
+    // run from one start to one end, so it is fixed at 2 for now.
+    MaxWaypoints int `json:"max_waypoints"`
+    // MaxMatrixSize caps the sources and the destinations of a matrix
+    // request.
+    MaxMatrixSize int `json:"max_matrix_size"`
+    // MaxSafetyBatch caps the polylines of a safety batch request.
+    MaxSafetyBatch int `json:"max_safety_batch"`
+    // MaxStops caps the stops of a multi-stop request, whose ordering
+    // takes time exponential in them.
+    MaxStops int `json:"max_stops"`
+}
+
+func defaultConfig() Config {
+    return Config{
+        Port:            "8080",
+        City:            "chicago",
+        RoadNetworkPath: "chicago_roads_with_risk.geojson",
+        BoundsPaddingM:  500,
+        SnapWarningM:    100,
+        MaxSnapM:        300,
+        ClampToleranceM: 250,
+        GraphBounds:     boundsClip,
+        DuplicateEdges:  duplicateMinRisk,
+        CRS:             crsWGS84,
+        LoadBounds:      chicagoBounds,
+        Presets:         defaultPresets(),
+        DefaultAlphas:   []float64{0.00, 0.25, 0.50, 0.75},
+        HeuristicWeight: 1,
+        WalkingSpeedMPS: 1.4,
+        DrivingSpeedMPS: 8.3,
+        RidingSpeedMPS:  4.2,
+        RiskAggregation: aggregateLength,
+        RouteSimilarity: 0.95,
+        MainStreetsBias: 1,
+
+        ProtectedLanesBias: 1,
+        BikeShare:          defaultBikeShareConfig(),
+
+        CalendarTimeZone: "America/Chicago",
+
+        Collisions: defaultCollisionConfig(),
+
+        ExposureRadiusM:    50,
+        ExposureWindowDays: 90,
+        Limits: Limits{
+            MaxAlternatives: 8,
+            MaxWaypoints:    2,
+            MaxMatrixSize:   100,
+            MaxSafetyBatch:  500,
+            MaxStops:        10,
+        },
+
+        ErrorSampleRate: 1,
+
+        AccessLogFormat:     "combined",
+        AccessLogSampleRate: 1,
+
+        RouteCacheEntries:    1024,
+        RouteCacheTTLSeconds: 300,
+        Prewarm:              defaultPrewarmConfig(),
+        HMACWindowSeconds:    300,
+        Scraping:             defaultScrapingConfig(),
+    }
+}
+
+func loadConfig() (Config, error) {
+    cfg := defaultConfig()
+
+    if path := os.Getenv("CONFIG_FILE"); path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return cfg, fmt.Errorf("reading config file: %v", err)
+        }
+        if err := json.Unmarshal(data, &cfg); err != nil {
+            return cfg, fmt.Errorf("parsing config file %s: %v", path, err)
+        }
+    }
+
+    if v := os.Getenv("PORT"); v != "" {
+        cfg.Port = v
+    }
+    if v := os.Getenv("ADMIN_PORT"); v != "" {
+        cfg.AdminPort = v
+    }
+    if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+        cfg.TrustedProxies = strings.Split(v, ",")
+    }
+    if v := os.Getenv("IP_ALLOW"); v != "" {
+        cfg.IPAllow = strings.Split(v, ",")
+    }
+    if v := os.Getenv("IP_DENY"); v != "" {
+        cfg.IPDeny = strings.Split(v, ",")
+    }
+    if err := envInt("SCRAPING_MAX_DISTINCT_PAIRS", &cfg.Scraping.MaxDistinctPairs); err != nil {
+        return cfg, err
+    }
+    if v := os.Getenv("SCRAPING_ACTION"); v != "" {
+        cfg.Scraping.Action = v
+    }
+    if v := os.Getenv("BLOCKED_COUNTRIES"); v != "" {
+        cfg.BlockedCountries = strings.Split(v, ",")
+    }
+    if v := os.Getenv("GEOIP_PATH"); v != "" {
+        cfg.GeoIPPath = v
+    }
+    if v := os.Getenv("CITY"); v != "" {
+        cfg.City = v
+    }
+    if v := os.Getenv("ROAD_NETWORK_PATH"); v != "" {
+        cfg.RoadNetworkPath = v
+    }
+    if v := os.Getenv("PRIVACY_MODE"); v != "" {
+        privacy, err := strconv.ParseBool(v)
+        if err != nil {
+            return cfg, fmt.Errorf("PRIVACY_MODE: %v", err)
+        }
+        cfg.PrivacyMode = privacy
+    }
+    if v := os.Getenv("GRAPH_PRELOAD"); v != "" {
+        preload, err := strconv.ParseBool(v)
+        if err != nil {
+            return cfg, fmt.Errorf("GRAPH_PRELOAD: %v", err)
+        }
+        cfg.GraphPreload = preload
+    }
+    if v := os.Getenv("SENTRY_DSN"); v != "" {
+        cfg.ErrorReportingDSN = v
+    }
+    if err := envFloat("ERROR_SAMPLE_RATE", &cfg.ErrorSampleRate); err != nil {
+        return cfg, err
+    }
+    if v := os.Getenv("ACCESS_LOG_FORMAT"); v != "" {
+        cfg.AccessLogFormat = v
+    }
+    if err := envFloat("ACCESS_LOG_SAMPLE_RATE", &cfg.AccessLogSampleRate); err != nil {
+        return cfg, err
+    }
+    if v := os.Getenv("AUDIT_LOG"); v != "" {
+        cfg.AuditLog = v
+    }
+    if v := os.Getenv("ADMIN_TOKEN"); v != "" {
+        cfg.AdminToken = v
+    }
+    if v := os.Getenv("JWT_SECRET"); v != "" {
+        cfg.JWTSecret = v
+    }
+    if v := os.Getenv("USER_JWT_SECRET"); v != "" {
+        cfg.UserJWTSecret = v
+    }
+    if v := os.Getenv("JWT_ALLOW_NO_EXPIRY"); v != "" {
+        allow, err := strconv.ParseBool(v)
+        if err != nil {
+            return cfg, fmt.Errorf("JWT_ALLOW_NO_EXPIRY: %v", err)
+        }
+        cfg.JWTAllowNoExpiry = allow
+    }
+    if v := os.Getenv("WEBHOOK_HOSTS"); v != "" {
+        cfg.WebhookHosts = strings.Split(v, ",")
+    }
+    if v := os.Getenv("RESPONSE_SIGNING_KEY_FILE"); v != "" {
+        cfg.ResponseSigning.KeyFile = v
+    }
+    if v := os.Getenv("RESPONSE_SIGNING_KEY_ID"); v != "" {
+        cfg.ResponseSigning.KeyID = v
+    }
+    if v := os.Getenv("FCM_CREDENTIALS_FILE"); v != "" {
+        cfg.Push.FCMCredentialsFile = v
+    }
+    if v := os.Getenv("APNS_KEY_FILE"); v != "" {
+        cfg.Push.APNsKeyFile = v
+    }
+    if v := os.Getenv("APNS_KEY_ID"); v != "" {
+        cfg.Push.APNsKeyID = v
+    }
+    if v := os.Getenv("APNS_TEAM_ID"); v != "" {
+        cfg.Push.APNsTeamID = v
+    }
+    if v := os.Getenv("APNS_TOPIC"); v != "" {
+        cfg.Push.APNsTopic = v
+    }
+    if v := os.Getenv("APNS_SANDBOX"); v != "" {
+        sandbox, err := strconv.ParseBool(v)
+        if err != nil {
+            return cfg, fmt.Errorf("APNS_SANDBOX: %v", err)
+        }
+        cfg.Push.APNsSandbox = sandbox
+    }
+    if v := os.Getenv("EVENT_BUS_URL"); v != "" {
+        cfg.EventBusURL = v
+    }
+    if v := os.Getenv("EVENT_BUS_TOPIC"); v != "" {
+        cfg.EventBusTopic = v
+    }
+    if v := os.Getenv("STORAGE"); v != "" {
+        cfg.Storage = v
+    }
+    if v := os.Getenv("STORAGE_DSN"); v != "" {
+        cfg.StorageDSN = v
+    }
+    if v := os.Getenv("SHADOW_TARGET"); v != "" {
+        cfg.ShadowTarget = v
+    }
+    if v := os.Getenv("SCHEDULE_DISABLED"); v != "" {
+        if cfg.Schedule == nil {
+            cfg.Schedule = make(map[string]ScheduleConfig)
+        }
+        for _, name := range strings.Split(v, ",") {
+            name = strings.TrimSpace(name)
+            s := cfg.Schedule[name]
+            s.Enabled = boolPtr(false)
+            cfg.Schedule[name] = s
+        }
+    }
+    if v := os.Getenv("RECORD_PATH"); v != "" {
+        cfg.RecordPath = v
+    }
+    if err := envFloat("RECORD_SAMPLE_PERCENT", &cfg.RecordSamplePercent); err != nil {
+        return cfg, err
+    }
+    if v := os.Getenv("DEFAULT_ALPHAS"); v != "" {
+        alphas, err := parseAlphas(v)
+        if err != nil {
+            return cfg, fmt.Errorf("DEFAULT_ALPHAS: %v", err)
+        }
+        cfg.DefaultAlphas = alphas
+    }
+    if err := envFloat("HEURISTIC_WEIGHT", &cfg.HeuristicWeight); err != nil {
+        return cfg, err
+    }
+    if err := envFloat("WALKING_SPEED_MPS", &cfg.WalkingSpeedMPS); err != nil {
+        return cfg, err
+    }
+    if err := envFloat("DRIVING_SPEED_MPS", &cfg.DrivingSpeedMPS); err != nil {
+        return cfg, err
+    }
+    if v := os.Getenv("PARKING_PATH"); v != "" {
+        cfg.ParkingPath = v
+    }
+    if err := envFloat("RIDING_SPEED_MPS", &cfg.RidingSpeedMPS); err != nil {
+        return cfg, err
+    }
+    if v := os.Getenv("BIKE_SHARE_FEED_URL"); v != "" {
+        cfg.BikeShare.FeedURL = v
+    }
+    if err := envFloat("SEARCH_ELLIPSE_FACTOR", &cfg.SearchEllipseFactor); err != nil {
+        return cfg, err
+    }
+    if err := envFloat("ROUTE_SIMILARITY", &cfg.RouteSimilarity); err != nil {
+        return cfg, err
+    }
+    if err := envFloat("MAIN_STREETS_BIAS", &cfg.MainStreetsBias); err != nil {
+        return cfg, err
+    }
+    if err := envFloat("PROTECTED_LANES_BIAS", &cfg.ProtectedLanesBias); err != nil {
+        return cfg, err
+    }
+    if err := envInt("PREWARM_TOP_N", &cfg.Prewarm.TopN); err != nil {
+        return cfg, err
+    }
+    if err := envInt("MAX_ALTERNATIVES", &cfg.Limits.MaxAlternatives); err != nil {
+        return cfg, err
+    }
+    if err := envInt("MAX_WAYPOINTS", &cfg.Limits.MaxWaypoints); err != nil {
+        return cfg, err
+    }
+    if err := envInt("MAX_MATRIX_SIZE", &cfg.Limits.MaxMatrixSize); err != nil {
+        return cfg, err
+    }
+    if err := envInt("MAX_SAFETY_BATCH", &cfg.Limits.MaxSafetyBatch); err != nil {
+        return cfg, err
+    }
+    if err := envInt("MAX_STOPS", &cfg.Limits.MaxStops); err != nil {
+        return cfg, err
+    }
+    if err := envInt("SEARCH_WORKERS", &cfg.SearchWorkers); err != nil {
+        return cfg, err
+    }
+    if err := envInt("BATCH_SEARCH_WORKERS", &cfg.BatchSearchWorkers); err != nil {
+        return cfg, err
+    }
+    if err := envInt("GRAPH_MEMORY_BUDGET_MB", &cfg.GraphMemoryBudgetMB); err != nil {
+        return cfg, err
+    }
+    if err := envFloat("BOUNDS_PADDING_M", &cfg.BoundsPaddingM); err != nil {
+        return cfg, err
+    }
+    if err := envFloat("SNAP_WARNING_M", &cfg.SnapWarningM); err != nil {
+        return cfg, err
+    }
+    if err := envFloat("MAX_SNAP_M", &cfg.MaxSnapM); err != nil {
+        return cfg, err
+    }
+    if err := envFloat("CLAMP_TOLERANCE_M", &cfg.ClampToleranceM); err != nil {
+        return cfg, err
+    }
+    if v := os.Getenv("COLLISIONS_PATH"); v != "" {
+        cfg.Collisions.Path = v
+    }
+    if err := envInt("COLLISIONS_REFRESH_SECONDS", &cfg.Collisions.RefreshSeconds); err != nil {
+        return cfg, err
+    }
+    if err := envFloat("COLLISIONS_HALF_LIFE_DAYS", &cfg.Collisions.HalfLifeDays); err != nil {
+        return cfg, err
+    }
+    if err := envFloat("MAX_RISK_STALENESS_HOURS", &cfg.MaxRiskStalenessHours); err != nil {
+        return cfg, err
+    }
+    if err := envFloat("EXPOSURE_RADIUS_M", &cfg.ExposureRadiusM); err != nil {
+        return cfg, err
+    }
+    if err := envInt("EXPOSURE_WINDOW_DAYS", &cfg.ExposureWindowDays); err != nil {
+        return cfg, err
+    }
+    if v := os.Getenv("RISK_AGGREGATION"); v != "" {
+        cfg.RiskAggregation = v
+    }
+    if v := os.Getenv("RISK_NORMALIZATION"); v != "" {
+        cfg.RiskMetadata.Normalization = v
+    }
+    if v := os.Getenv("GRAPH_BOUNDS"); v != "" {
+        cfg.GraphBounds = v
+    }
+    if v := os.Getenv("DUPLICATE_EDGES"); v != "" {
+        cfg.DuplicateEdges = v
+    }
+    if v := os.Getenv("ROAD_NETWORK_CRS"); v != "" {
+        cfg.RoadNetworkCRS = v
+    }
+    if v := os.Getenv("CALENDAR_TIME_ZONE"); v != "" {
+        cfg.CalendarTimeZone = v
+    }
+    if v := os.Getenv("BLOCKED_AREAS_PATH"); v != "" {
+        cfg.BlockedAreasPath = v
+    }
+    if v := os.Getenv("ROAD_ATTRIBUTES_PATH"); v != "" {
+        cfg.RoadAttributesPath = v
+    }
+    if v := os.Getenv("CITY_PACKS_DIR"); v != "" {
+        cfg.CityPacksDir = v
+    }
+    if v := os.Getenv("CRS"); v != "" {
+        cfg.CRS = v
+    }
+    if v := os.Getenv("LOAD_BOUNDS"); v != "" {
+        b, err := parseBounds(v)
+        if err != nil {
+            return cfg, fmt.Errorf("LOAD_BOUNDS: %v", err)
+        }
+        cfg.LoadBounds = b
+    }
+
+    return cfg, cfg.validate()
+}
+
+func (c Config) validate() error {
+    if c.RoadNetworkPath == "" {
+        return fmt.Errorf("road_network_path must be set")
+    }
+    if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+        return err
+    }
+    if _, err := parseNets(c.IPAllow); err != nil {
+        return fmt.Errorf("ip_allow %v", err)
+    }
+    if _, err := parseNets(c.IPDeny); err != nil {
+        return fmt.Errorf("ip_deny %v", err)
+    }
+    if len(c.BlockedCountries) > 0 && c.GeoIPPath == "" {
+        return fmt.Errorf("blocked_countries needs geoip_path")
+    }
+    if err := c.Scraping.validate(); err != nil {
+        return err
+    }
+    if c.AdminPort != "" && c.AdminPort == c.Port {
+        return fmt.Errorf("admin_port must differ from port, both are %s", c.Port)
+    }
+    if c.Limits.MaxAlternatives < 1 {
+        return fmt.Errorf("limits.max_alternatives must be at least 1, got %d", c.Limits.MaxAlternatives)
+    }
+    if c.Limits.MaxWaypoints != 2 {
+        return fmt.Errorf("limits.max_waypoints must be 2: routes have exactly a start and an end, got %d", c.Limits.MaxWaypoints)
+    }
+    if c.Limits.MaxMatrixSize < 1 {
+        return fmt.Errorf("limits.max_matrix_size must be at least 1, got %d", c.Limits.MaxMatrixSize)
+    }
+    if c.Limits.MaxSafetyBatch < 1 {
+        return fmt.Errorf("limits.max_safety_batch must be at least 1, got %d", c.Limits.MaxSafetyBatch)
+    }
+    if c.Limits.MaxStops < 2 || c.Limits.MaxStops > maxStopsLimit {
+        return fmt.Errorf("limits.max_stops must be within [2, %d], got %d", maxStopsLimit, c.Limits.MaxStops)
+    }
+    if err := c.Limits.checkAlphas("default_alphas", c.DefaultAlphas); err != nil {
+        return err
+    }
+    if err := checkDuplicatePolicy(c.DuplicateEdges); err != nil {
+        return err
+    }
+    if _, err := canonicalCRS(c.RoadNetworkCRS); err != nil {
+        return fmt.Errorf("road_network_crs: %v", err)
+    }
+    if _, err := canonicalCRS(c.CRS); err != nil {
+        return fmt.Errorf("crs: %v", err)
+    }
+    if err := checkRiskAggregation(c.RiskAggregation); err != nil {
+        return err
+    }
+    if err := checkSearchWorkers(c.SearchWorkers, c.BatchSearchWorkers); err != nil {
+        return err
+    }
+    if err := checkStorage(c.Storage, c.StorageDSN); err != nil {
+        return err
+    }
+    if c.GraphMemoryBudgetMB < 0 {
+        return fmt.Errorf("graph_memory_budget_mb must not be negative, got %d", c.GraphMemoryBudgetMB)
+    }
+    if c.ExposureRadiusM < 0 || c.ExposureWindowDays < 0 {
+        return fmt.Errorf("exposure_radius_m and exposure_window_days must not be negative")
+    }
+    if c.WalkingSpeedMPS <= 0 {
+        return fmt.Errorf("walking_speed_mps must be positive, got %v", c.WalkingSpeedMPS)
+    }
+    if c.DrivingSpeedMPS <= 0 {
+        return fmt.Errorf("driving_speed_mps must be positive, got %v", c.DrivingSpeedMPS)
+    }
+    if c.RidingSpeedMPS <= 0 {
+        return fmt.Errorf("riding_speed_mps must be positive, got %v", c.RidingSpeedMPS)
+    }
+    if c.HeuristicWeight < 1 || c.HeuristicWeight > maxHeuristicWeight {
+        return fmt.Errorf("heuristic_weight must be within [1, %d], got %v", maxHeuristicWeight, c.HeuristicWeight)
+    }
+    if c.SearchEllipseFactor != 0 && c.SearchEllipseFactor < 1 {
+        return fmt.Errorf("search_ellipse_factor must be 0 (off) or at least 1, got %v", c.SearchEllipseFactor)
+    }
+    if c.RouteSimilarity < 0 || c.RouteSimilarity > 1 {
+        return fmt.Errorf("route_similarity must be within [0, 1], got %v", c.RouteSimilarity)
+    }
+    if c.MainStreetsBias < 0 {
+        return fmt.Errorf("main_streets_bias must not be negative, got %v", c.MainStreetsBias)
+    }
+    if c.ProtectedLanesBias < 0 {
+        return fmt.Errorf("protected_lanes_bias must not be negative, got %v", c.ProtectedLanesBias)
+    }
+    if c.BoundsPaddingM < 0 {
+        return fmt.Errorf("bounds_padding_m must not be negative, got %v", c.BoundsPaddingM)
+    }
+    if c.MaxSnapM < 0 {
+        return fmt.Errorf("max_snap_m must not be negative, got %v", c.MaxSnapM)
+    }
+    if c.SnapWarningM < 0 {
+        return fmt.Errorf("snap_warning_m must not be negative, got %v", c.SnapWarningM)
+    }
+    switch c.GraphBounds {
+    case boundsClip, boundsAll, boundsData:
+    default:
+        return fmt.Errorf("graph_bounds must be %q, %q or %q, got %q", boundsClip, boundsAll, boundsData, c.GraphBounds)
+    }
+    if b := c.LoadBounds; b.MinX >= b.MaxX || b.MinY >= b.MaxY {
+        return fmt.Errorf("load_bounds must have min below max, got %+v", b)
+    }
+    if c.ClampToleranceM < 0 {
+        return fmt.Errorf("clamp_tolerance_m must not be negative, got %v", c.ClampToleranceM)
+    }
+    if c.RecordSamplePercent < 0 || c.RecordSamplePercent > 100 {
+        return fmt.Errorf("record_sample_percent must be within [0, 100], got %v", c.RecordSamplePercent)
+    }
+    if c.ErrorSampleRate < 0 || c.ErrorSampleRate > 1 {
+        return fmt.Errorf("error_sample_rate must be within [0, 1], got %v", c.ErrorSampleRate)
+    }
+    switch c.AccessLogFormat {
+    case "combined", "json", "off":
+    default:
+        return fmt.Errorf("access_log_format must be combined, json or off, got %q", c.AccessLogFormat)
+    }
+    if c.AccessLogSampleRate < 0 || c.AccessLogSampleRate > 1 {
+        return fmt.Errorf("access_log_sample_rate must be within [0, 1], got %v", c.AccessLogSampleRate)
+    }
+    adminKeys := make(map[string]bool)
+    for i, k := range c.AdminKeys {
+        if k.Name == "" || k.Key == "" {
+            return fmt.Errorf("admin_keys[%d]: name and key must be set", i)
+        }
+        if adminKeys[k.Key] {
+            return fmt.Errorf("admin key %s: keys must be unique", k.Name)
+        }
+        adminKeys[k.Key] = true
+        if _, err := parseRole(k.Role); err != nil {
+            return fmt.Errorf("admin key %s: %v", k.Name, err)
+        }
+    }
+    if err := checkNormalization(c.RiskMetadata.Normalization); err != nil {
+        return fmt.Errorf("risk_metadata: %v", err)
+    }
+    for i, l := range c.RiskLayers {
+        if l.Path == "" {
+            return fmt.Errorf("risk_layers[%d]: path must be set", i)
+        }
+        if err := checkNormalization(l.Normalization); err != nil {
+            return fmt.Errorf("risk_layers[%d]: %v", i, err)
+        }
+    }
+    if c.MaxRiskStalenessHours < 0 {
+        return fmt.Errorf("max_risk_staleness_hours must not be negative, got %v", c.MaxRiskStalenessHours)
+    }
+    if err := checkRiskComponents(c.RiskComponents, c.Collisions); err != nil {
+        return err
+    }
+    if err := checkNetworkLayers(c.NetworkLayers); err != nil {
+        return err
+    }
+    if err := checkRiskCalendar(c.CalendarTimeZone, c.RiskCalendar); err != nil {
+        return err
+    }
+    if err := c.Collisions.validate(); err != nil {
+        return err
+    }
+    if err := c.Push.validate(); err != nil {
+        return err
+    }
+    if err := c.ResponseSigning.validate(); err != nil {
+        return err
+    }
+    if err := checkSchedule(c); err != nil {
+        return err
+    }
+    if c.ShadowTarget != "" {
+        if u, err := url.Parse(c.ShadowTarget); err != nil || u.Scheme == "" || u.Host == "" {
+            return fmt.Errorf("shadow_target must be an absolute URL, got %q", c.ShadowTarget)
+        }
+        if c.PrivacyMode {
+            return fmt.Errorf("shadow_target cannot be used in privacy mode: it forwards exact coordinates")
+        }
+    }
+    if c.RouteCacheEntries < 0 {
+        return fmt.Errorf("route_cache_entries must not be negative, got %v", c.RouteCacheEntries)
+    }
+    if c.RouteCacheTTLSeconds < 0 {
+        return fmt.Errorf("route_cache_ttl_seconds must not be negative, got %v", c.RouteCacheTTLSeconds)
+    }
+    if c.HMACWindowSeconds <= 0 {
+        return fmt.Errorf("hmac_window_seconds must be positive, got %v", c.HMACWindowSeconds)
+    }
+    if err := c.Prewarm.validate(); err != nil {
+        return err
+    }
+    if err := c.BikeShare.validate(); err != nil {
+        return err
+    }
+    if err := checkCanaries(c.Canaries, c.Tenants); err != nil {
+        return err
+    }
+    for name, p := range c.Presets {
+        if err := p.validate(); err != nil {
+            return fmt.Errorf("preset %s: %v", name, err)
+        }
+        if len(p.Alphas) > c.Limits.MaxAlternatives {
+            return fmt.Errorf("preset %s has %d alphas, more than limits.max_alternatives (%d)", name, len(p.Alphas), c.Limits.MaxAlternatives)
+        }
+    }
+
+    ids := make(map[string]bool)
+    keys := make(map[string]bool)
+    hmacKeyIDs := make(map[string]bool)
+    for i, t := range c.Tenants {
+        if t.ID == "" {
+            return fmt.Errorf("tenants[%d]: id must be set", i)
+        }
+        if ids[t.ID] {
+            return fmt.Errorf("tenants[%d]: duplicate id %q", i, t.ID)
+        }
+        ids[t.ID] = true
+        if t.CityPack != "" && t.RoadNetworkPath != "" {
+            return fmt.Errorf("tenant %s: give either city_pack or road_network_path, not both", t.ID)
+        }
+        if len(t.APIKeys) == 0 && len(t.HMACKeys) == 0 {
+            return fmt.Errorf("tenant %s: at least one api key or hmac key is required", t.ID)
+        }
+        for _, key := range t.APIKeys {
+            if key == "" || keys[key] {
+                return fmt.Errorf("tenant %s: api keys must be non-empty and unique across tenants", t.ID)
+            }
+            keys[key] = true
+        }
+        for id, secret := range t.HMACKeys {
+            if id == "" || hmacKeyIDs[id] {
+                return fmt.Errorf("tenant %s: hmac key IDs must be non-empty and unique across tenants", t.ID)
+            }
+            hmacKeyIDs[id] = true
+            if len(secret) < minHMACSecret {
+                return fmt.Errorf("tenant %s: hmac key %s: secrets must be at least %d characters", t.ID, id, minHMACSecret)
+            }
+        }
+        if t.RequestsPerMinute < 0 {
+            return fmt.Errorf("tenant %s: requests_per_minute must not be negative", t.ID)
+        }
+        if len(t.DefaultAlphas) > 0 {
+            if err := c.Limits.checkAlphas("tenant "+t.ID+": default_alphas", t.DefaultAlphas); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// checkAlphas validates an alpha sweep against the limits.
+func (l Limits) checkAlphas(field string, alphas []float64) error {
+    if len(alphas) == 0 {
+        return fmt.Errorf("%s must not be empty", field)
+    }
+    if len(alphas) > l.MaxAlternatives {
+        return fmt.Errorf("%s has %d alphas, more than limits.max_alternatives (%d)", field, len(alphas), l.MaxAlternatives)
+    }
+    for _, alpha := range alphas {
+        if alpha < 0 || alpha > 1 {
+            return fmt.Errorf("%s: alpha %v outside [0, 1]", field, alpha)
+        }
+    }
+    return nil
+}
+
+// parseAlphas reads a comma-separated alpha list.
+func parseAlphas(s string) ([]float64, error) {
+    var alphas []float64
+    for _, field := range strings.Split(s, ",") {
+        alpha, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+        if err != nil {
+            return nil, err
+        }
+        alphas = append(alphas, alpha)
+    }
+    return alphas, nil
+}
+
+func envInt(name string, dst *int) error {
+    v := os.Getenv(name)
+    if v == "" {
+        return nil
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil {
+        return fmt.Errorf("%s: %v", name, err)
+    }
+    *dst = n
+    return nil
+}
+
+func envFloat(name string, dst *float64) error {
+    v := os.Getenv(name)
+    if v == "" {
+        return nil
+    }
+    f, err := strconv.ParseFloat(v, 64)
+    if err != nil {
+        return fmt.Errorf("%s: %v", name, err)
+    }
+    *dst = f
+    return nil
+}
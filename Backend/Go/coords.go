@@ -0,0 +1,219 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "strings"
+)
+
+// The coordinate reference systems points can be given and answered in:
+// longitude and latitude in degrees, and spherical (Web) Mercator meters.
+const (
+    crsWGS84       = "EPSG:4326"
+    crsWebMercator = "EPSG:3857"
+)
+
+// supportedCRS lists the CRS names clients may use, canonical first.
+var supportedCRS = []string{crsWGS84, crsWebMercator}
+
+// crsAliases maps the other names a CRS goes by, including the URNs of
+// GeoJSON's (pre-RFC 7946) crs member, to its canonical name.
+var crsAliases = map[string]string{
+    "WGS84":                         crsWGS84,
+    "CRS84":                         crsWGS84,
+    "OGC:CRS84":                     crsWGS84,
+    "URN:OGC:DEF:CRS:OGC:1.3:CRS84": crsWGS84,
+    "URN:OGC:DEF:CRS:EPSG::4326":    crsWGS84,
+    "EPSG:900913":                   crsWebMercator,
+    "EPSG:3785":                     crsWebMercator,
+    "URN:OGC:DEF:CRS:EPSG::3857":    crsWebMercator,
+}
+
+// canonicalCRS returns the canonical name of a supported CRS, case
+// insensitively; empty means WGS84.
+func canonicalCRS(name string) (string, error) {
+    upper := strings.ToUpper(strings.TrimSpace(name))
+    switch upper {
+    case "":
+        return crsWGS84, nil
+    case crsWGS84, crsWebMercator:
+        return upper, nil
+    }
+    if crs, ok := crsAliases[upper]; ok {
+        return crs, nil
+    }
+    return "", fmt.Errorf("unsupported CRS %q (available: %s)", name, strings.Join(supportedCRS, ", "))
+}
+
+// webMercatorRadius is the sphere EPSG:3857 projects from, and
+// webMercatorMaxLat the latitude where its square world ends.
+const (
+    webMercatorRadius = 6378137.0
+    webMercatorMaxLat = 85.05112878
+)
+
+// toWGS84 converts p from crs to longitude and latitude.
+func toWGS84(p Point, crs string) Point {
+    if crs != crsWebMercator {
+        return p
+    }
+    return Point{
+        X: p.X / webMercatorRadius * 180 / math.Pi,
+        Y: (2*math.Atan(math.Exp(p.Y/webMercatorRadius)) - math.Pi/2) * 180 / math.Pi,
+    }
+}
+
+// fromWGS84 converts p from longitude and latitude to crs. Web Mercator
+// cannot show the poles, so latitudes are capped at its edge.
+func fromWGS84(p Point, crs string) Point {
+    if crs != crsWebMercator {
+        return p
+    }
+    lat := math.Max(-webMercatorMaxLat, math.Min(webMercatorMaxLat, p.Y)) * math.Pi / 180
+    return Point{
+        X: p.X * math.Pi / 180 * webMercatorRadius,
+        Y: math.Log(math.Tan(math.Pi/4+lat/2)) * webMercatorRadius,
+    }
+}
+
+// Coordinate is a request point given either as a {"lat", "lon"} object
+// or as a GeoJSON position, [lon, lat]. Both name their axes, unlike the
+// older x/y fields, where x is the longitude. Objects are always in
+// degrees; positions, like x and y, are in the request's CRS.
+type Coordinate struct {
+    Lat float64 `json:"lat"`
+    Lon float64 `json:"lon"`
+
+    position bool
+}
+
+func (c *Coordinate) UnmarshalJSON(data []byte) error {
+    var position []float64
+    if err := json.Unmarshal(data, &position); err == nil {
+        if len(position) != 2 {
+            return fmt.Errorf("a position must be [lon, lat], got %d numbers", len(position))
+        }
+        c.Lon, c.Lat, c.position = position[0], position[1], true
+        return nil
+    }
+    var object struct {
+        Lat *float64 `json:"lat"`
+        Lon *float64 `json:"lon"`
+    }
+    if err := json.Unmarshal(data, &object); err != nil || object.Lat == nil || object.Lon == nil {
+        return fmt.Errorf(`a point must be {"lat": ..., "lon": ...} or [lon, lat]`)
+    }
+    c.Lat, c.Lon, c.position = *object.Lat, *object.Lon, false
+    return nil
+}
+
+func (c Coordinate) point() Point {
+    return Point{X: c.Lon, Y: c.Lat}
+}
+
+// jsonSchema accepts both forms: properties apply to objects only and
+// items to arrays only.
+func (Coordinate) jsonSchema() *jsonSchema {
+    two := 2
+    return &jsonSchema{
+        Type: []string{"object", "array"},
+        Properties: map[string]*jsonSchema{
+            "lat": {Type: "number"},
+            "lon": {Type: "number"},
+        },
+        Required:             []string{"lat", "lon"},
+        AdditionalProperties: false,
+        Items:                &jsonSchema{Type: "number"},
+        MinItems:             &two,
+        MaxItems:             &two,
+    }
+}
+
+// requestPoint resolves the request point called name from exactly one
+// of its forms, c or x (longitude) and y (latitude), to WGS84; x, y and
+// positions are in crs.
+func requestPoint(name string, x, y *float64, c *Coordinate, crs string) (Point, error) {
+    switch {
+    case c != nil && (x != nil || y != nil):
+        return Point{}, fmt.Errorf("give either %s or %s_x and %s_y, not both", name, name, name)
+    case c != nil && c.position:
+        return toWGS84(c.point(), crs), nil
+    case c != nil:
+        return c.point(), nil
+    case x != nil && y != nil:
+        return toWGS84(Point{X: *x, Y: *y}, crs), nil
+    }
+    return Point{}, fmt.Errorf(`%s is required, as {"lat", "lon"}, [lon, lat], or %s_x (longitude) and %s_y (latitude)`, name, name, name)
+}
+
+// inCRS returns a copy of s with its points in crs.
+func (s routeSummary) inCRS(crs string) routeSummary {
+    s.Center = fromWGS84(s.Center, crs)
+    s.StartPoint = fromWGS84(s.StartPoint, crs)
+    s.EndPoint = fromWGS84(s.EndPoint, crs)
+    s.Snap.Start = s.Snap.Start.inCRS(crs)
+    s.Snap.End = s.Snap.End.inCRS(crs)
+    return s
+}
+
+func (s SnapResult) inCRS(crs string) SnapResult {
+    s.Requested = fromWGS84(s.Requested, crs)
+    s.Snapped = fromWGS84(s.Snapped, crs)
+    if s.ClampedTo != nil {
+        clamped := fromWGS84(*s.ClampedTo, crs)
+        s.ClampedTo = &clamped
+    }
+    return s
+}
+
+// inCRS returns a copy of route with its path and bounding box in crs.
+// Distances and lengths stay as they were.
+func (route Route) inCRS(crs string) Route {
+    if crs == crsWGS84 {
+        return route
+    }
+    path := make([]Point, len(route.Path))
+    for i, p := range route.Path {
+        path[i] = fromWGS84(p, crs)
+    }
+    route.Path = path
+    b := route.Summary.BBox
+    lo := fromWGS84(Point{X: b[0], Y: b[1]}, crs)
+    hi := fromWGS84(Point{X: b[2], Y: b[3]}, crs)
+    route.Summary.BBox = [4]float64{lo.X, lo.Y, hi.X, hi.Y}
+    return route
+}
+
+// sourceCRS is the CRS of a GeoJSON road network: declared when set,
+// else the document's crs member, else WGS84. Without either, coordinates
+// that cannot be degrees are an error rather than loaded as such, since
+// they are most likely projected.
+func sourceCRS(crsMember interface{}, features []interface{}, declared string) (string, error) {
+    if declared != "" {
+        return canonicalCRS(declared)
+    }
+    if member, ok := crsMember.(map[string]interface{}); ok {
+        properties, _ := member["properties"].(map[string]interface{})
+        name, _ := properties["name"].(string)
+        return canonicalCRS(name)
+    }
+    for _, feature := range features {
+        f, _ := feature.(map[string]interface{})
+        geometry, _ := f["geometry"].(map[string]interface{})
+        coordinates, _ := geometry["coordinates"].([]interface{})
+        for _, c := range coordinates {
+            position, _ := c.([]interface{})
+            if len(position) < 2 {
+                continue
+            }
+            x, _ := position[0].(float64)
+            y, _ := position[1].(float64)
+            if math.Abs(x) > 180 || math.Abs(y) > 90 {
+                return "", fmt.Errorf("coordinate (%v, %v) is not longitude and latitude; the data looks projected, so give its CRS in a crs member or road_network_crs (available: %s)",
+                    x, y, strings.Join(supportedCRS, ", "))
+            }
+        }
+    }
+    return crsWGS84, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+
+    "risk-router/geo"
+)
+
+const (
+    defaultCorridorBufferM = 50.0
+    maxCorridorBufferM     = 500.0
+    defaultCorridorSliceM  = 100.0
+    minCorridorSliceM      = 10.0
+)
+
+// CorridorSlice is one stretch of a corridor with the length-weighted mean
+// and the maximum risk of the road it covers.
+type CorridorSlice struct {
+    FromM   float64 `json:"from_m"`
+    ToM     float64 `json:"to_m"`
+    Risk    float64 `json:"risk"`
+    MaxRisk float64 `json:"max_risk"`
+    Polygon []Point `json:"polygon,omitempty"`
+}
+
+// pathPiece is a straight part of a path with the risk of its road.
+type pathPiece struct {
+    a, b    Point
+    fromM   float64
+    lengthM float64
+    risk    float64
+}
+
+// pathPieces resolves each step of path to the road segment it follows
+// and reads that segment's risk from layer.
+func (r *RiskAwareRouter) pathPieces(path []Point, layer *riskLayer) ([]pathPiece, error) {
+    pieces := make([]pathPiece, 0, len(path)-1)
+    at := 0.0
+    for i := 0; i+1 < len(path); i++ {
+        edges, err := r.segmentEdges(path[i], path[i+1])
+        if err != nil {
+            return nil, fmt.Errorf("path step %d: %v", i, err)
+        }
+        length := geo.Haversine(path[i], path[i+1])
+        pieces = append(pieces, pathPiece{a: path[i], b: path[i+1], fromM: at, lengthM: length, risk: layer.risk[edges[0]]})
+        at += length
+    }
+    return pieces, nil
+}
+
+// corridorSlices cuts pieces into slices of sliceM meters.
+func corridorSlices(pieces []pathPiece, sliceM, bufferM float64) []CorridorSlice {
+    if len(pieces) == 0 {
+        return nil
+    }
+    last := pieces[len(pieces)-1]
+    total := last.fromM + last.lengthM
+    var slices []CorridorSlice
+    for from := 0.0; from < total; from += sliceM {
+        to := min(from+sliceM, total)
+        var pts []Point
+        weighted, covered, maxRisk := 0.0, 0.0, 0.0
+        for _, p := range pieces {
+            lo, hi := max(from, p.fromM), min(to, p.fromM+p.lengthM)
+            if hi <= lo {
+                continue
+            }
+            weighted += p.risk * (hi - lo)
+            covered += hi - lo
+            maxRisk = max(maxRisk, p.risk)
+            start := lerp(p.a, p.b, (lo-p.fromM)/p.lengthM)
+            end := lerp(p.a, p.b, (hi-p.fromM)/p.lengthM)
+            if len(pts) == 0 {
+                pts = append(pts, start)
+            }
+            pts = append(pts, end)
+        }
+        slice := CorridorSlice{FromM: from, ToM: to, MaxRisk: maxRisk, Polygon: geo.Buffer(pts, bufferM)}
+        if covered > 0 {
+            slice.Risk = weighted / covered
+        }
+        slices = append(slices, slice)
+    }
+    return slices
+}
+
+func lerp(a, b Point, t float64) Point {
+    return Point{X: a.X + t*(b.X-a.X), Y: a.Y + t*(b.Y-a.Y)}
+}
+
+// corridorRequest is the body of POST /corridor.
+type corridorRequest struct {
+    RouteID string       `json:"route_id"`
+    Alpha   *float64     `json:"alpha" schema:"minimum=0,maximum=1"`
+    Path    [][2]float64 `json:"path"`
+    BufferM float64      `json:"buffer_m" schema:"minimum=0"`
+    SliceM  float64      `json:"slice_m" schema:"minimum=0"`
+}
+
+// handleCorridor serves POST /corridor: the buffered corridor around a
+// saved route (route_id, picking the route for alpha, the first by
+// default) or an explicit path, with risk per slice for a "risk ribbon".
+func handleCorridor(w http.ResponseWriter, r *http.Request) {
+    var req corridorRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    if req.BufferM == 0 {
+        req.BufferM = defaultCorridorBufferM
+    }
+    if req.SliceM == 0 {
+        req.SliceM = defaultCorridorSliceM
+    }
+    if req.BufferM < 0 || req.BufferM > maxCorridorBufferM {
+        writeBadRequest(w, fmt.Sprintf("buffer_m must be within (0, %g]", maxCorridorBufferM))
+        return
+    }
+    if req.SliceM < minCorridorSliceM {
+        writeBadRequest(w, fmt.Sprintf("slice_m must be at least %g", minCorridorSliceM))
+        return
+    }
+
+    tenant := tenantFromContext(r.Context())
+    router := tenant.Router()
+    layer := router.activeLayer()
+    var path []Point
+    switch {
+    case req.RouteID != "" && req.Path != nil:
+        writeBadRequest(w, "give either route_id or path, not both")
+        return
+    case req.RouteID != "":
+        saved, ok := loadSavedRoute(w, r, req.RouteID, tenant.ID)
+        if !ok {
+            return
+        }
+        route := saved.Routes[0]
+        if req.Alpha != nil {
+            found := false
+            for _, rt := range saved.Routes {
+                if rt.Alpha == *req.Alpha {
+                    route, found = rt, true
+                }
+            }
+            if !found {
+                writeBadRequest(w, fmt.Sprintf("route %s has no route for alpha %v", req.RouteID, *req.Alpha))
+                return
+            }
+        }
+        path = route.Path
+        if l, ok := router.layers.get(saved.RiskVersion); ok {
+            layer = l
+        }
+    default:
+        for _, p := range req.Path {
+            path = append(path, Point{X: p[0], Y: p[1]})
+        }
+    }
+    if len(path) < 2 {
+        writeBadRequest(w, "a corridor needs a path of at least two points")
+        return
+    }
+
+    pieces, err := router.pathPieces(path, layer)
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    slices := corridorSlices(pieces, req.SliceM, req.BufferM)
+    response := struct {
+        BufferM     float64         `json:"buffer_m"`
+        SliceM      float64         `json:"slice_m"`
+        LengthM     float64         `json:"length_m"`
+        RiskVersion string          `json:"risk_version"`
+        Polygon     []Point         `json:"polygon"`
+        Slices      []CorridorSlice `json:"slices"`
+    }{req.BufferM, req.SliceM, pathLengthM(pieces), layer.Version, geo.Buffer(path, req.BufferM), slices}
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode corridor: %v", err)
+    }
+}
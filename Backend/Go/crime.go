@@ -0,0 +1,64 @@
+package main
+
+import (
+    "time"
+
+    "risk-router/geo"
+)
+
+// Add records an incident, at is zero when its time is unknown, and
+// invalidates the spatial index.
+func (c *CrimeData) Add(p Point, severity float64, at time.Time) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.Points = append(c.Points, p)
+    c.Severity = append(c.Severity, severity)
+    c.Times = append(c.Times, at)
+    c.index = nil
+}
+
+// incidentsPerKm is the route exposure clients can read without knowing
+// the risk model: incidents since since (or of unknown time) within
+// radiusM of path, per kilometer of its lengthM.
+func (c *CrimeData) incidentsPerKm(path []Point, lengthM, radiusM float64, since time.Time) float64 {
+    if radiusM <= 0 || lengthM <= 0 {
+        return 0
+    }
+    near := c.incidentsNear(path, radiusM)
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    count := 0
+    for _, id := range near {
+        if int(id) >= len(c.Times) || c.Times[id].IsZero() || !c.Times[id].Before(since) {
+            count++
+        }
+    }
+    return float64(count) / (lengthM / 1000)
+}
+
+// exposureSince is the start of the exposure window, zero when every
+// incident counts.
+func exposureSince() time.Time {
+    if days := globalConfig.ExposureWindowDays; days > 0 {
+        return time.Now().AddDate(0, 0, -days)
+    }
+    return time.Time{}
+}
+
+// incidentsNear returns the indexes of incidents within radiusM of path.
+// The spatial index is rebuilt lazily after incidents are added.
+func (c *CrimeData) incidentsNear(path []Point, radiusM float64) []int32 {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.index == nil {
+        builder := newSpatialBuilder()
+        for i, p := range c.Points {
+            builder.insertPoint(int32(i), p)
+        }
+        c.index = builder.build()
+    }
+    return c.index.nearPath(path, radiusM, func(id int32, a, b Point) float64 {
+        return geo.DistanceToSegment(c.Points[id], a, b)
+    })
+}
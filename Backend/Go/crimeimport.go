@@ -0,0 +1,130 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "time"
+)
+
+// maxImportErrors caps the per-line errors returned by a crime import; the
+// count of rejected lines is always complete.
+const maxImportErrors = 100
+
+// incidentLine is one NDJSON line of a crime import.
+type incidentLine struct {
+    X        *float64 `json:"x"`
+    Y        *float64 `json:"y"`
+    Severity *float64 `json:"severity"`
+    Time     string   `json:"time"`
+}
+
+type importError struct {
+    Line    int    `json:"line"`
+    Message string `json:"message"`
+}
+
+// validate checks an incident against the router's bounds and returns its
+// location and severity (1 when omitted).
+func (in incidentLine) validate(r *RiskAwareRouter) (Point, float64, error) {
+    if in.X == nil || in.Y == nil {
+        return Point{}, 0, fmt.Errorf("x and y are required")
+    }
+    p := Point{X: *in.X, Y: *in.Y}
+    if !isInBounds(p, r.Bounds) {
+        return Point{}, 0, fmt.Errorf("point (%v, %v) is outside the serving bounds", p.X, p.Y)
+    }
+    severity := 1.0
+    if in.Severity != nil {
+        severity = *in.Severity
+    }
+    if severity < 0 {
+        return Point{}, 0, fmt.Errorf("severity must not be negative")
+    }
+    if in.Time != "" {
+        if _, err := time.Parse(time.RFC3339, in.Time); err != nil {
+            return Point{}, 0, fmt.Errorf("time must be RFC 3339: %v", err)
+        }
+    }
+    return p, severity, nil
+}
+
+// at is the incident's time, zero when it has none; validate has checked
+// it parses.
+func (in incidentLine) at() time.Time {
+    t, _ := time.Parse(time.RFC3339, in.Time)
+    return t
+}
+
+// handleCrimeImport serves POST /admin/crime/import. The body is streamed
+// NDJSON, one incident per line; valid lines are added to the tenant's
+// crime index, invalid ones are reported by line number, and the current
+// risk layer is marked dirty until it is rebuilt.
+func handleCrimeImport(w http.ResponseWriter, r *http.Request) {
+    tenant, err := tenantByID(r.URL.Query().Get("tenant"))
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    router := tenant.Router()
+    audit := auditFromContext(r.Context())
+    audit.Target = "tenant=" + tenant.ID
+
+    var (
+        accepted, rejected int
+        errs               []importError
+    )
+    reject := func(line int, msg string) {
+        rejected++
+        if len(errs) < maxImportErrors {
+            errs = append(errs, importError{Line: line, Message: msg})
+        }
+    }
+
+    scanner := bufio.NewScanner(r.Body)
+    scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+    line := 0
+    for scanner.Scan() {
+        line++
+        if len(scanner.Bytes()) == 0 {
+            continue
+        }
+        var in incidentLine
+        if err := json.Unmarshal(scanner.Bytes(), &in); err != nil {
+            reject(line, err.Error())
+            continue
+        }
+        p, severity, err := in.validate(router)
+        if err != nil {
+            reject(line, err.Error())
+            continue
+        }
+        router.CrimeData.Add(p, severity, in.at())
+        accepted++
+    }
+    if err := scanner.Err(); err != nil {
+        reject(line+1, err.Error())
+    }
+    if accepted > 0 {
+        router.layers.markDirty(accepted)
+    }
+    log.Printf("Imported %d incidents for tenant %s (%d rejected)", accepted, tenant.ID, rejected)
+    if accepted > 0 {
+        notifyJobDone(tenant.ID, "crime_import", fmt.Sprintf("%d new incidents now inform route risk.", accepted))
+    }
+
+    response := struct {
+        Accepted  int           `json:"accepted"`
+        Rejected  int           `json:"rejected"`
+        Errors    []importError `json:"errors,omitempty"`
+        Truncated bool          `json:"errors_truncated,omitempty"`
+    }{accepted, rejected, errs, rejected > len(errs)}
+    audit.After = map[string]int{"accepted": accepted, "rejected": rejected}
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode import response: %v", err)
+    }
+}
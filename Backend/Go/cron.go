@@ -0,0 +1,150 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// cronSchedule is a parsed cron expression: five fields, minute hour
+// day-of-month month day-of-week, each *, a value, a range a-b or a list
+// of them, optionally with a /step; or one of @hourly, @daily, @weekly,
+// @monthly and @every <duration>. Times are in the server's time zone.
+type cronSchedule struct {
+    every                        time.Duration
+    minute, hour, dom, month     uint64
+    dow                          uint64
+    domRestricted, dowRestricted bool
+}
+
+var cronDescriptors = map[string]string{
+    "@hourly":   "0 * * * *",
+    "@daily":    "0 0 * * *",
+    "@midnight": "0 0 * * *",
+    "@weekly":   "0 0 * * 0",
+    "@monthly":  "0 0 1 * *",
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+    expr = strings.TrimSpace(expr)
+    if rest, ok := strings.CutPrefix(expr, "@every "); ok {
+        d, err := time.ParseDuration(strings.TrimSpace(rest))
+        if err != nil || d < time.Second {
+            return nil, fmt.Errorf("cron %q: @every needs a duration of at least 1s", expr)
+        }
+        return &cronSchedule{every: d}, nil
+    }
+    if std, ok := cronDescriptors[expr]; ok {
+        expr = std
+    }
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("cron %q: want 5 fields (minute hour day month weekday), got %d", expr, len(fields))
+    }
+    c := &cronSchedule{}
+    var err error
+    for i, f := range []struct {
+        bits   *uint64
+        lo, hi int
+    }{
+        {&c.minute, 0, 59},
+        {&c.hour, 0, 23},
+        {&c.dom, 1, 31},
+        {&c.month, 1, 12},
+        {&c.dow, 0, 7},
+    } {
+        if *f.bits, err = parseCronField(fields[i], f.lo, f.hi); err != nil {
+            return nil, fmt.Errorf("cron %q: %v", expr, err)
+        }
+    }
+    // Sunday is 0 or 7.
+    if c.dow&(1<<7) != 0 {
+        c.dow |= 1
+    }
+    c.domRestricted = fields[2] != "*"
+    c.dowRestricted = fields[4] != "*"
+    return c, nil
+}
+
+// parseCronField returns the values field allows, as bits.
+func parseCronField(field string, lo, hi int) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(field, ",") {
+        rng, step := part, 1
+        if r, s, ok := strings.Cut(part, "/"); ok {
+            n, err := strconv.Atoi(s)
+            if err != nil || n <= 0 {
+                return 0, fmt.Errorf("bad step in %q", part)
+            }
+            rng, step = r, n
+        }
+        from, to := lo, hi
+        if rng != "*" {
+            a, b, isRange := strings.Cut(rng, "-")
+            var err error
+            if from, err = strconv.Atoi(a); err != nil {
+                return 0, fmt.Errorf("bad value in %q", part)
+            }
+            to = from
+            if isRange {
+                if to, err = strconv.Atoi(b); err != nil {
+                    return 0, fmt.Errorf("bad value in %q", part)
+                }
+            } else if step > 1 {
+                to = hi
+            }
+        }
+        if from < lo || to > hi || from > to {
+            return 0, fmt.Errorf("%q is outside %d-%d", part, lo, hi)
+        }
+        for v := from; v <= to; v += step {
+            bits |= 1 << v
+        }
+    }
+    return bits, nil
+}
+
+// dayMatches applies cron's rule that when both the day of the month and
+// the day of the week are restricted, either one matching is enough.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+    dom := c.dom&(1<<t.Day()) != 0
+    dow := c.dow&(1<<int(t.Weekday())) != 0
+    if c.domRestricted && c.dowRestricted {
+        return dom || dow
+    }
+    return dom && dow
+}
+
+// next returns the first time after t the schedule fires, or the zero
+// time if it never does within five years.
+func (c *cronSchedule) next(t time.Time) time.Time {
+    if c.every > 0 {
+        return t.Add(c.every)
+    }
+    t = t.Truncate(time.Minute).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+    for t.Before(limit) {
+        var step time.Time
+        switch {
+        case c.month&(1<<int(t.Month())) == 0:
+            step = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+        case !c.dayMatches(t):
+            step = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+        case c.hour&(1<<t.Hour()) == 0:
+            step = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+        case c.minute&(1<<t.Minute()) == 0:
+            step = t.Add(time.Minute)
+        default:
+            return t
+        }
+        // When clocks go forward, the hour, day or month time.Date names
+        // may not exist and fall back to before t; go on to the next hour
+        // on the clock instead.
+        if !step.After(t) {
+            step = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+        }
+        t = step
+    }
+    return time.Time{}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestCronNext(t *testing.T) {
+    // 1 January 2026 is a Thursday.
+    at := func(month time.Month, day, hour, minute int) time.Time {
+        return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+    }
+    newYear := at(time.January, 1, 0, 0)
+    cases := []struct {
+        expr string
+        from time.Time
+        want time.Time
+    }{
+        {"* * * * *", newYear, at(time.January, 1, 0, 1)},
+        {"* * * * *", newYear.Add(30 * time.Second), at(time.January, 1, 0, 1)},
+        {"0 * * * *", newYear, at(time.January, 1, 1, 0)},
+        {"30 9 * * *", newYear, at(time.January, 1, 9, 30)},
+        {"30 9 * * *", at(time.January, 1, 9, 30), at(time.January, 2, 9, 30)},
+        {"15,45 8-9 * * 1-5", newYear, at(time.January, 1, 8, 15)},
+        {"15,45 8-9 * * 1-5", at(time.January, 1, 9, 50), at(time.January, 2, 8, 15)},
+        {"15,45 8-9 * * 1-5", at(time.January, 2, 9, 45), at(time.January, 5, 8, 15)},
+        {"*/20 * * * *", at(time.January, 1, 0, 41), at(time.January, 1, 1, 0)},
+        {"10-30/10 * * * *", at(time.January, 1, 0, 25), at(time.January, 1, 0, 30)},
+        {"5/20 * * * *", at(time.January, 1, 0, 26), at(time.January, 1, 0, 45)},
+        {"0 0 * 3 *", newYear, at(time.March, 1, 0, 0)},
+        {"0 0 31 * *", at(time.January, 31, 0, 0), at(time.March, 31, 0, 0)},
+        {"0 0 1 1 *", newYear, time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC)},
+        {"0 0 29 2 *", newYear, time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+        {"0 0 31 4 *", newYear, time.Time{}},
+        {"@hourly", at(time.January, 1, 0, 59), at(time.January, 1, 1, 0)},
+        {"@daily", newYear, at(time.January, 2, 0, 0)},
+        {"@midnight", at(time.January, 1, 23, 59), at(time.January, 2, 0, 0)},
+        {"@weekly", newYear, at(time.January, 4, 0, 0)},
+        {"@monthly", newYear, at(time.February, 1, 0, 0)},
+        {"@every 90s", newYear.Add(10 * time.Second), newYear.Add(100 * time.Second)},
+
+        // Sunday is 0 or 7.
+        {"0 12 * * 0", newYear, at(time.January, 4, 12, 0)},
+        {"0 12 * * 7", newYear, at(time.January, 4, 12, 0)},
+        {"0 12 * * 5-7", at(time.January, 3, 12, 0), at(time.January, 4, 12, 0)},
+
+        // With only one of day of month and day of week restricted, it
+        // alone decides.
+        {"0 0 13 * *", newYear, at(time.January, 13, 0, 0)},
+        {"0 0 * * 5", newYear, at(time.January, 2, 0, 0)},
+        {"0 0 * * */3", newYear, at(time.January, 3, 0, 0)},
+        {"0 0 */10 * *", at(time.January, 2, 0, 0), at(time.January, 11, 0, 0)},
+        // With both restricted, either matching is enough: the 13th or
+        // any Friday.
+        {"0 0 13 * 5", newYear, at(time.January, 2, 0, 0)},
+        {"0 0 13 * 5", at(time.January, 9, 0, 0), at(time.January, 13, 0, 0)},
+        {"0 0 1-7 * 1", at(time.January, 8, 0, 0), at(time.January, 12, 0, 0)},
+        {"0 0 1-7 * 1", at(time.January, 26, 0, 0), at(time.February, 1, 0, 0)},
+        // */n restricts its field too: the 1st, 11th, 21st and 31st or
+        // any Monday, not only Mondays that fall on those days (11 May).
+        {"0 0 */10 * 1", newYear, at(time.January, 5, 0, 0)},
+        {"0 0 */10 * 1", at(time.January, 5, 0, 0), at(time.January, 11, 0, 0)},
+        {"0 0 13 * */7", newYear, at(time.January, 4, 0, 0)},
+        {"0 0 1,15 * 0", newYear, at(time.January, 4, 0, 0)},
+        {"0 0 1,15 * 0", at(time.January, 11, 0, 0), at(time.January, 15, 0, 0)},
+        // A month restriction applies to both days.
+        {"0 0 13 2 5", newYear, at(time.February, 6, 0, 0)},
+    }
+    for _, c := range cases {
+        s, err := parseCron(c.expr)
+        if err != nil {
+            t.Errorf("parseCron(%q): %v", c.expr, err)
+            continue
+        }
+        if got := s.next(c.from); !got.Equal(c.want) {
+            t.Errorf("%q after %s: next = %s, want %s", c.expr, c.from.Format(time.RFC3339), got.Format(time.RFC3339), c.want.Format(time.RFC3339))
+        }
+    }
+}
+
+// TestCronNextLocal steps over clocks going forward, which skips the
+// hour of 2:00 in Chicago and midnight in Santiago.
+func TestCronNextLocal(t *testing.T) {
+    cases := []struct {
+        zone       string
+        expr       string
+        from, want [4]int
+    }{
+        // 2:30 does not exist on 8 March 2026.
+        {"America/Chicago", "30 2 * * *", [4]int{3, 7, 3, 0}, [4]int{3, 9, 2, 30}},
+        {"America/Chicago", "0 3 * * *", [4]int{3, 8, 0, 0}, [4]int{3, 8, 3, 0}},
+        {"America/Chicago", "*/30 * * * *", [4]int{3, 8, 1, 45}, [4]int{3, 8, 3, 0}},
+        // Nor does midnight on 6 September 2026.
+        {"America/Santiago", "0 12 6 9 *", [4]int{9, 5, 12, 0}, [4]int{9, 6, 12, 0}},
+        {"America/Santiago", "0 * * * *", [4]int{9, 5, 23, 0}, [4]int{9, 6, 1, 0}},
+    }
+    for _, c := range cases {
+        loc, err := time.LoadLocation(c.zone)
+        if err != nil {
+            t.Skip(err)
+        }
+        s, err := parseCron(c.expr)
+        if err != nil {
+            t.Fatal(err)
+        }
+        from := time.Date(2026, time.Month(c.from[0]), c.from[1], c.from[2], c.from[3], 0, 0, loc)
+        want := time.Date(2026, time.Month(c.want[0]), c.want[1], c.want[2], c.want[3], 0, 0, loc)
+        if got := s.next(from); !got.Equal(want) {
+            t.Errorf("%s %q after %s: next = %s, want %s", c.zone, c.expr, from, got, want)
+        }
+    }
+}
+
+func TestParseCronRejects(t *testing.T) {
+    for _, expr := range []string{
+        "",
+        "* * * *",
+        "* * * * * *",
+        "60 * * * *",
+        "* 24 * * *",
+        "* * 0 * *",
+        "* * 32 * *",
+        "* * * 0 *",
+        "* * * 13 *",
+        "* * * * 8",
+        "5-1 * * * *",
+        "*/0 * * * *",
+        "*/x * * * *",
+        "a * * * *",
+        "1-x * * * *",
+        "1,,2 * * * *",
+        "@yearly",
+        "@every 500ms",
+        "@every soon",
+    } {
+        if _, err := parseCron(expr); err == nil {
+            t.Errorf("parseCron(%q) accepted", expr)
+        }
+    }
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+    "bytes"
+    "cmp"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "slices"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// opsWindowSeconds is how far back, one bucket per second, the dashboard
+// sees; requests older than that have been overwritten.
+const opsWindowSeconds = 300
+
+// maxBucketErrors bounds the distinct error messages a bucket keeps; the
+// rest are counted under one "other" message.
+const maxBucketErrors = 32
+
+// maxErrorBody is how much of an error response is kept to read its code
+// and message from.
+const maxErrorBody = 2048
+
+// latencyBoundsMS are the upper bounds of the latency histogram buckets,
+// growing by a quarter from a tenth of a millisecond to two minutes, so a
+// percentile is off by at most a quarter. A last bucket takes the rest.
+var latencyBoundsMS = func() []float64 {
+    var bounds []float64
+    for b := 0.1; b < 120000; b *= 1.25 {
+        bounds = append(bounds, b)
+    }
+    return bounds
+}()
+
+// opsErrorKey is an error response by its API error code and message.
+type opsErrorKey struct {
+    Code    string
+    Message string
+}
+
+// opsBucket counts the requests finished within one second.
+type opsBucket struct {
+    second   int64
+    requests int
+    latency  []int
+    statuses map[int]int
+    errors   map[opsErrorKey]int
+}
+
+func (b *opsBucket) reset(second int64) {
+    b.second = second
+    b.requests = 0
+    if b.latency == nil {
+        b.latency = make([]int, len(latencyBoundsMS)+1)
+    }
+    clear(b.latency)
+    b.statuses = nil
+    b.errors = nil
+}
+
+// opsStats keeps the last opsWindowSeconds of traffic in a ring of
+// one-second buckets, for the operator dashboard.
+type opsStats struct {
+    mu      sync.Mutex
+    buckets [opsWindowSeconds]opsBucket
+}
+
+var globalOps = &opsStats{}
+
+// record counts a finished request: its latency, and for errors its
+// status and, when the body said, its error code and message.
+func (s *opsStats) record(at time.Time, latency time.Duration, status int, apiErr *APIError) {
+    second := at.Unix()
+    ms := float64(latency.Microseconds()) / 1000
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    b := &s.buckets[second%opsWindowSeconds]
+    if b.second != second {
+        b.reset(second)
+    }
+    b.requests++
+    i, _ := slices.BinarySearch(latencyBoundsMS, ms)
+    b.latency[i]++
+    if status < 400 {
+        return
+    }
+    if b.statuses == nil {
+        b.statuses = make(map[int]int)
+        b.errors = make(map[opsErrorKey]int)
+    }
+    b.statuses[status]++
+    key := opsErrorKey{Code: http.StatusText(status)}
+    if apiErr != nil {
+        key = opsErrorKey{Code: apiErr.Code, Message: apiErr.Message}
+    }
+    if _, ok := b.errors[key]; !ok && len(b.errors) >= maxBucketErrors {
+        key.Message = "other"
+    }
+    b.errors[key]++
+}
+
+// opsTotals sums buckets.
+type opsTotals struct {
+    requests int
+    latency  []int
+    statuses map[int]int
+    errors   map[opsErrorKey]int
+}
+
+func newOpsTotals() *opsTotals {
+    return &opsTotals{latency: make([]int, len(latencyBoundsMS)+1), statuses: make(map[int]int), errors: make(map[opsErrorKey]int)}
+}
+
+func (t *opsTotals) add(b *opsBucket) {
+    t.requests += b.requests
+    for i, n := range b.latency {
+        t.latency[i] += n
+    }
+    for status, n := range b.statuses {
+        t.statuses[status] += n
+    }
+    for key, n := range b.errors {
+        t.errors[key] += n
+    }
+}
+
+// percentile estimates the q quantile of the latencies, in milliseconds,
+// interpolating within its histogram bucket.
+func (t *opsTotals) percentile(q float64) float64 {
+    if t.requests == 0 {
+        return 0
+    }
+    rank := q * float64(t.requests)
+    seen := 0.0
+    for i, n := range t.latency {
+        if n == 0 || seen+float64(n) < rank {
+            seen += float64(n)
+            continue
+        }
+        lower := 0.0
+        if i > 0 {
+            lower = latencyBoundsMS[i-1]
+        }
+        if i == len(latencyBoundsMS) {
+            return lower
+        }
+        return lower + (latencyBoundsMS[i]-lower)*(rank-seen)/float64(n)
+    }
+    return latencyBoundsMS[len(latencyBoundsMS)-1]
+}
+
+func (t *opsTotals) errorCount() int {
+    n := 0
+    for _, count := range t.statuses {
+        n += count
+    }
+    return n
+}
+
+// sum totals the buckets of the window seconds before now, in steps of
+// step seconds, oldest first.
+func (s *opsStats) sum(now time.Time, window, step int) []*opsTotals {
+    last := now.Unix()
+    steps := make([]*opsTotals, (window+step-1)/step)
+    for i := range steps {
+        steps[i] = newOpsTotals()
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for ago := 0; ago < window; ago++ {
+        second := last - int64(ago)
+        b := &s.buckets[second%opsWindowSeconds]
+        if b.second != second {
+            continue
+        }
+        steps[len(steps)-1-ago/step].add(b)
+    }
+    return steps
+}
+
+type latencySummary struct {
+    P50 float64 `json:"p50"`
+    P95 float64 `json:"p95"`
+    P99 float64 `json:"p99"`
+}
+
+func (t *opsTotals) latencies() latencySummary {
+    return latencySummary{P50: t.percentile(0.50), P95: t.percentile(0.95), P99: t.percentile(0.99)}
+}
+
+type topError struct {
+    Code    string `json:"code"`
+    Message string `json:"message,omitempty"`
+    Count   int    `json:"count"`
+}
+
+// trafficSummary is the dashboard's view of requests over its window.
+type trafficSummary struct {
+    WindowS   int            `json:"window_s"`
+    Requests  int            `json:"requests"`
+    QPS       float64        `json:"qps"`
+    LatencyMS latencySummary `json:"latency_ms"`
+    Errors    int            `json:"errors"`
+    ErrorRate float64        `json:"error_rate"`
+    // ErrorsByStatus and ErrorsByCode break errors down by HTTP status
+    // and by API error code.
+    ErrorsByStatus map[string]int `json:"errors_by_status"`
+    ErrorsByCode   map[string]int `json:"errors_by_code"`
+    TopErrors      []topError     `json:"top_errors"`
+}
+
+func summarizeTraffic(t *opsTotals, window, topN int) trafficSummary {
+    s := trafficSummary{
+        WindowS:        window,
+        Requests:       t.requests,
+        QPS:            float64(t.requests) / float64(window),
+        LatencyMS:      t.latencies(),
+        Errors:         t.errorCount(),
+        ErrorsByStatus: make(map[string]int),
+        ErrorsByCode:   make(map[string]int),
+        TopErrors:      []topError{},
+    }
+    if t.requests > 0 {
+        s.ErrorRate = float64(s.Errors) / float64(t.requests)
+    }
+    for status, n := range t.statuses {
+        s.ErrorsByStatus[strconv.Itoa(status)] = n
+    }
+    for key, n := range t.errors {
+        s.ErrorsByCode[key.Code] += n
+        s.TopErrors = append(s.TopErrors, topError{Code: key.Code, Message: key.Message, Count: n})
+    }
+    slices.SortFunc(s.TopErrors, func(a, b topError) int {
+        if a.Count != b.Count {
+            return b.Count - a.Count
+        }
+        return cmp.Or(cmp.Compare(a.Code, b.Code), cmp.Compare(a.Message, b.Message))
+    })
+    if len(s.TopErrors) > topN {
+        s.TopErrors = s.TopErrors[:topN]
+    }
+    return s
+}
+
+// opsRecorder keeps the start of an error response's body, to read its
+// API error from.
+type opsRecorder struct {
+    *statusRecorder
+    body bytes.Buffer
+}
+
+func (o *opsRecorder) Write(b []byte) (int, error) {
+    if o.status >= 400 && o.body.Len() < maxErrorBody {
+        o.body.Write(b[:min(len(b), maxErrorBody-o.body.Len())])
+    }
+    return o.statusRecorder.Write(b)
+}
+
+func (o *opsRecorder) apiError() *APIError {
+    var body struct {
+        Error *APIError `json:"error"`
+    }
+    if json.Unmarshal(o.body.Bytes(), &body) != nil {
+        return nil
+    }
+    return body.Error
+}
+
+// withOpsStats counts every request served by next for the dashboard.
+func withOpsStats(stats *opsStats, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        rec := &opsRecorder{statusRecorder: newStatusRecorder(w)}
+        next.ServeHTTP(rec, r)
+        var apiErr *APIError
+        if rec.status >= 400 {
+            apiErr = rec.apiError()
+        }
+        stats.record(time.Now(), time.Since(start), rec.status, apiErr)
+    })
+}
+
+// dataFreshness is how old a tenant's data is.
+type dataFreshness struct {
+    Tenant        string    `json:"tenant"`
+    GraphVersion  string    `json:"graph_version"`
+    GraphLoadedAt time.Time `json:"graph_loaded_at"`
+    GraphAgeS     float64   `json:"graph_age_s"`
+    RiskVersion   string    `json:"risk_version"`
+    RiskLoadedAt  time.Time `json:"risk_loaded_at"`
+    RiskAgeS      float64   `json:"risk_age_s"`
+    // PendingIncidents are imported but not yet in the risk layer.
+    PendingIncidents int `json:"pending_incidents"`
+    // RiskStale is set when the risk layer has gone longer than
+    // max_risk_staleness_hours without a refresh.
+    RiskStale bool `json:"risk_stale"`
+}
+
+// taskFreshness is when a scheduled task last ran.
+type taskFreshness struct {
+    Name      string     `json:"name"`
+    LastRun   *time.Time `json:"last_run,omitempty"`
+    AgeS      *float64   `json:"age_s,omitempty"`
+    LastError string     `json:"last_error,omitempty"`
+}
+
+func freshnessReport(now time.Time) ([]dataFreshness, []taskFreshness) {
+    var tenants []dataFreshness
+    for _, t := range globalTenants.tenants {
+        router := t.Router()
+        layer := router.activeLayer()
+        router.layers.mu.RLock()
+        pending := router.layers.pending
+        router.layers.mu.RUnlock()
+        tenants = append(tenants, dataFreshness{
+            Tenant:           t.ID,
+            GraphVersion:     router.G.Version,
+            GraphLoadedAt:    router.loadedAt,
+            GraphAgeS:        now.Sub(router.loadedAt).Seconds(),
+            RiskVersion:      layer.Version,
+            RiskLoadedAt:     layer.LoadedAt,
+            RiskAgeS:         now.Sub(layer.LoadedAt).Seconds(),
+            PendingIncidents: pending,
+            RiskStale:        t.riskStaleness(now) != nil,
+        })
+    }
+    tasks := []taskFreshness{}
+    if globalScheduler != nil {
+        for _, ts := range globalScheduler.list() {
+            if !ts.Enabled {
+                continue
+            }
+            tf := taskFreshness{Name: ts.Name, LastRun: ts.LastRun, LastError: ts.LastError}
+            if ts.LastRun != nil {
+                age := now.Sub(*ts.LastRun).Seconds()
+                tf.AgeS = &age
+            }
+            tasks = append(tasks, tf)
+        }
+    }
+    return tenants, tasks
+}
+
+// dashboardWindow reads ?window=, in seconds, up to opsWindowSeconds.
+func dashboardWindow(r *http.Request, fallback int) (int, error) {
+    v := r.URL.Query().Get("window")
+    if v == "" {
+        return fallback, nil
+    }
+    window, err := strconv.Atoi(v)
+    if err != nil || window < 1 || window > opsWindowSeconds {
+        return 0, fmt.Errorf("window must be a number of seconds within [1, %d]", opsWindowSeconds)
+    }
+    return window, nil
+}
+
+// handleAdminDashboard serves GET /admin/dashboard: traffic over the last
+// ?window= seconds (60 by default), how fresh each tenant's data is, and
+// the caches.
+func handleAdminDashboard(w http.ResponseWriter, r *http.Request) {
+    window, err := dashboardWindow(r, 60)
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    now := time.Now()
+    traffic := globalOps.sum(now, window, window)[0]
+    response := struct {
+        Time      time.Time      `json:"time"`
+        Traffic   trafficSummary `json:"traffic"`
+        Freshness struct {
+            Tenants []dataFreshness      `json:"tenants"`
+            Tasks   []taskFreshness      `json:"tasks"`
+            Events  *eventConsumerStatus `json:"events,omitempty"`
+        } `json:"freshness"`
+        Caches []tenantCaches `json:"caches"`
+    }{Time: now.UTC(), Traffic: summarizeTraffic(traffic, window, 10), Caches: cacheReport()}
+    response.Freshness.Tenants, response.Freshness.Tasks = freshnessReport(now)
+    if globalEvents != nil {
+        status := globalEvents.status()
+        response.Freshness.Events = &status
+    }
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode dashboard: %v", err)
+    }
+}
+
+// seriesPoint is one step of the dashboard's traffic series, at its last
+// second.
+type seriesPoint struct {
+    Time      time.Time      `json:"time"`
+    QPS       float64        `json:"qps"`
+    LatencyMS latencySummary `json:"latency_ms"`
+    ErrorRate float64        `json:"error_rate"`
+}
+
+// handleAdminDashboardSeries serves GET /admin/dashboard/series, traffic
+// over the last ?window= seconds (all kept by default) in steps of ?step=
+// seconds (10 by default), oldest first, for charts.
+func handleAdminDashboardSeries(w http.ResponseWriter, r *http.Request) {
+    window, err := dashboardWindow(r, opsWindowSeconds)
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    step := 10
+    if v := r.URL.Query().Get("step"); v != "" {
+        if step, err = strconv.Atoi(v); err != nil || step < 1 || step > window {
+            writeBadRequest(w, fmt.Sprintf("step must be a number of seconds within [1, %d]", window))
+            return
+        }
+    }
+    now := time.Now().Truncate(time.Second)
+    steps := globalOps.sum(now, window, step)
+    response := struct {
+        StepS  int           `json:"step_s"`
+        Points []seriesPoint `json:"points"`
+    }{StepS: step, Points: make([]seriesPoint, len(steps))}
+    for i, t := range steps {
+        // The oldest step may be short when step does not divide window.
+        seconds := min(step, window-(len(steps)-1-i)*step)
+        p := seriesPoint{
+            Time:      now.Add(-time.Duration((len(steps)-1-i)*step) * time.Second).UTC(),
+            QPS:       float64(t.requests) / float64(seconds),
+            LatencyMS: t.latencies(),
+        }
+        if t.requests > 0 {
+            p.ErrorRate = float64(t.errorCount()) / float64(t.requests)
+        }
+        response.Points[i] = p
+    }
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode dashboard series: %v", err)
+    }
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// grpcTimeoutUnits are the units of a grpc-timeout header.
+var grpcTimeoutUnits = map[byte]time.Duration{
+    'H': time.Hour,
+    'M': time.Minute,
+    'S': time.Second,
+    'm': time.Millisecond,
+    'u': time.Microsecond,
+    'n': time.Nanosecond,
+}
+
+// callerDeadline returns the deadline a gateway passed on, if any: an
+// X-Request-Deadline of an RFC 3339 time or Unix milliseconds, or else a
+// grpc-timeout of up to 8 digits and a unit, such as "250m", counted from
+// now.
+func callerDeadline(r *http.Request, now time.Time) (time.Time, bool, error) {
+    if v := r.Header.Get("X-Request-Deadline"); v != "" {
+        if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+            return t, true, nil
+        }
+        ms, err := strconv.ParseInt(v, 10, 64)
+        if err != nil || ms <= 0 {
+            return time.Time{}, false, fmt.Errorf("X-Request-Deadline must be an RFC 3339 time or Unix milliseconds, got %q", v)
+        }
+        return time.UnixMilli(ms), true, nil
+    }
+    if v := r.Header.Get("Grpc-Timeout"); v != "" {
+        unit, ok := grpcTimeoutUnits[v[len(v)-1]]
+        n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+        if !ok || err != nil || n < 0 || len(v) > 9 {
+            return time.Time{}, false, fmt.Errorf("grpc-timeout must be up to 8 digits and a unit (H, M, S, m, u or n), got %q", v)
+        }
+        return now.Add(time.Duration(n) * unit), true, nil
+    }
+    return time.Time{}, false, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import "time"
+
+// searchStats are the diagnostics of one route search, returned per route
+// to requests with "debug": true.
+type searchStats struct {
+    NodesExpanded int `json:"nodes_expanded"`
+    // HeapPeak is the largest the search frontier grew.
+    HeapPeak int `json:"heap_peak"`
+    // HubTree is set when a precomputed hub tree answered without a
+    // search; WeightsCached when the alpha's edge weights were held.
+    HubTree       bool `json:"hub_tree"`
+    WeightsCached bool `json:"weights_cached"`
+    ArcFlags      bool `json:"arc_flags"`
+    // Reruns counts searches repeated without pruning after the ellipse
+    // or arc flags cut off every path.
+    Reruns int `json:"reruns"`
+    // PenaltyRounds counts searches repeated with penalties for finding
+    // a route too alike an earlier one.
+    PenaltyRounds int     `json:"penalty_rounds"`
+    SearchMS      float64 `json:"search_ms"`
+    SummaryMS     float64 `json:"summary_ms"`
+}
+
+// requestDebug times the phases of a debug route request.
+type requestDebug struct {
+    SnapMS   float64 `json:"snap_ms"`
+    SearchMS float64 `json:"search_ms"`
+    // ResponseCached reports whether the response cache held this answer;
+    // debug requests bypass it.
+    ResponseCached bool `json:"response_cached"`
+}
+
+func msSince(start time.Time) float64 {
+    return float64(time.Since(start).Microseconds()) / 1000
+}
@@ -0,0 +1,46 @@
+package main
+
+import "risk-router/geo"
+
+// pathSimilarity is the fraction of the longer of two paths that both
+// share, by length: 1 for paths along the same edges, 0 for paths with no
+// edge in common.
+func pathSimilarity(a, b []Point) float64 {
+    edges := pathEdgeSet(a)
+    var shared float64
+    for i := 0; i+1 < len(b); i++ {
+        if edges[[2]Point{b[i], b[i+1]}] {
+            shared += geo.Haversine(b[i], b[i+1])
+        }
+    }
+    longest := max(geo.PolylineLength(a), geo.PolylineLength(b))
+    if longest == 0 {
+        return 1
+    }
+    return shared / longest
+}
+
+// pathEdgeSet holds the consecutive point pairs of path.
+func pathEdgeSet(path []Point) map[[2]Point]bool {
+    edges := make(map[[2]Point]bool, len(path))
+    for i := 0; i+1 < len(path); i++ {
+        edges[[2]Point{path[i], path[i+1]}] = true
+    }
+    return edges
+}
+
+// collapseRoutes merges runs of routes, in alpha order, whose paths are at
+// least similarity alike into the run's first route, which is answered
+// with the range of alphas it stands for.
+func collapseRoutes(routes []Route, similarity float64) []Route {
+    var out []Route
+    for _, rt := range routes {
+        if n := len(out); n > 0 && pathSimilarity(out[n-1].Path, rt.Path) >= similarity {
+            out[n-1].AlphaRange[1] = rt.Alpha
+            continue
+        }
+        rt.AlphaRange = &[2]float64{rt.Alpha, rt.Alpha}
+        out = append(out, rt)
+    }
+    return out
+}
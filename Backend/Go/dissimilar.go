@@ -0,0 +1,63 @@
+package main
+
+import (
+    "context"
+    "errors"
+)
+
+// A route too alike the ones answered before it is searched for again
+// with the edges it shares with them made penaltyFactor costlier each
+// round, for at most penaltyRounds rounds.
+const (
+    penaltyRounds = 5
+    penaltyFactor = 1.5
+)
+
+// errTooSimilar is a search that found no route dissimilar enough from
+// the ones before it.
+var errTooSimilar = errors.New("no route dissimilar enough")
+
+// findDistinct is findPath for a route that differs from each of taken, by
+// shared length, in at least p.MinDissimilarity of the longer path. A path
+// too alike one of them has its shared edges penalized and the search is
+// rerun, which yields the best route off the penalized edges rather than
+// the best route overall; distance and risk stay unpenalized.
+func (r *RiskAwareRouter) findDistinct(ctx context.Context, startID, endID int32, alpha float64, p routeParams, taken [][]Point) ([]Point, []int32, float64, float64, error) {
+    if p.MinDissimilarity <= 0 || len(taken) == 0 {
+        return r.findPath(ctx, startID, endID, alpha, p)
+    }
+    p.penalties = make(map[int32]float64)
+    for round := 0; ; round++ {
+        path, edges, distance, risk, err := r.findPath(ctx, startID, endID, alpha, p)
+        if err != nil {
+            return nil, nil, 0, 0, err
+        }
+        alike := alikePath(path, taken, 1-p.MinDissimilarity)
+        if alike == nil {
+            return path, edges, distance, risk, nil
+        }
+        if round == penaltyRounds {
+            return nil, nil, 0, 0, errTooSimilar
+        }
+        if p.stats != nil {
+            p.stats.PenaltyRounds++
+        }
+        shared := pathEdgeSet(alike)
+        for i, e := range edges {
+            if shared[[2]Point{path[i], path[i+1]}] {
+                p.penalties[e] = max(p.penalties[e], 1) * penaltyFactor
+            }
+        }
+    }
+}
+
+// alikePath returns the first of taken that path shares more than
+// similarity of its length with, or nil.
+func alikePath(path []Point, taken [][]Point, similarity float64) []Point {
+    for _, other := range taken {
+        if pathSimilarity(path, other) > similarity {
+            return other
+        }
+    }
+    return nil
+}
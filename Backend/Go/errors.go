@@ -0,0 +1,34 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+)
+
+// APIError is the JSON error body returned by every handler. Code is a
+// stable machine-readable identifier; Message is meant for people.
+type APIError struct {
+    Code    string      `json:"code"`
+    Message string      `json:"message"`
+    Details interface{} `json:"details,omitempty"`
+}
+
+func writeAPIError(w http.ResponseWriter, status int, apiErr APIError) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    body := struct {
+        Error APIError `json:"error"`
+    }{apiErr}
+    if err := json.NewEncoder(w).Encode(body); err != nil {
+        log.Printf("Failed to encode error response: %v", err)
+    }
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter) {
+    writeAPIError(w, http.StatusMethodNotAllowed, APIError{Code: "method_not_allowed", Message: "Method not allowed"})
+}
+
+func writeBadRequest(w http.ResponseWriter, message string) {
+    writeAPIError(w, http.StatusBadRequest, APIError{Code: "invalid_request", Message: message})
+}
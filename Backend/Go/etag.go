@@ -0,0 +1,44 @@
+package main
+
+import (
+    "crypto/sha256"
+    "net/http"
+    "strings"
+)
+
+// routeETag derives a strong validator for a route response from the
+// request inputs and the graph and risk versions that answered it, so the
+// same request against unchanged data always yields the same tag.
+func routeETag(g *Graph, riskVersion string, alphas []float64, inputs ...float64) string {
+    h := sha256.New()
+    h.Write([]byte(g.Version))
+    h.Write([]byte(riskVersion))
+    writeFloats(h, inputs...)
+    writeFloats(h, alphas...)
+    return `"` + shortHash(h) + `"`
+}
+
+// etagMatches reports whether the request's If-None-Match header lists
+// etag. Weak tags compare equal to their strong form.
+func etagMatches(r *http.Request, etag string) bool {
+    header := r.Header.Get("If-None-Match")
+    if header == "" {
+        return false
+    }
+    for _, tag := range strings.Split(header, ",") {
+        tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+        if tag == "*" || tag == etag {
+            return true
+        }
+    }
+    return false
+}
+
+// writeNotModified answers a conditional request whose tag still matches.
+// Route requests are POSTs, where RFC 9110 would call for 412, but clients
+// re-fetching a route on reconnect treat it as a cacheable read.
+func writeNotModified(w http.ResponseWriter, etag string) {
+    w.Header().Set("ETag", etag)
+    w.Header().Set("Cache-Control", "private, no-cache")
+    w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// maxSeenEvents bounds how many event IDs the consumer remembers to drop
+// redeliveries.
+const maxSeenEvents = 100000
+
+// busMessage is one message read from an event source. Offset is the
+// source's position after the message, from which reading resumes.
+type busMessage struct {
+    Offset int64
+    Data   []byte
+}
+
+// eventSource reads messages from a topic in order.
+type eventSource interface {
+    next(ctx context.Context) (busMessage, error)
+    close() error
+}
+
+// openEventSource connects to the bus named by rawURL, resuming after
+// offset where the bus supports it:
+//
+//	nats://host:port   core NATS subscription to topic
+//	file:///path       an NDJSON file, tailed as it grows
+//
+// Only file offsets are positions; a NATS source starts from the live
+// stream whatever offset it is given.
+//
+// Kafka needs a client library this build does not include.
+func openEventSource(rawURL, topic string, offset int64) (eventSource, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, fmt.Errorf("event bus URL: %v", err)
+    }
+    switch u.Scheme {
+    case "nats":
+        if topic == "" {
+            return nil, fmt.Errorf("event bus topic must be set for NATS")
+        }
+        return dialNATS(u.Host, topic, offset)
+    case "file":
+        return openFileSource(u.Path, offset)
+    case "kafka":
+        return nil, fmt.Errorf("kafka event buses are not supported in this build")
+    default:
+        return nil, fmt.Errorf("unsupported event bus scheme %q", u.Scheme)
+    }
+}
+
+// fileSource tails an NDJSON file; offsets are byte positions.
+type fileSource struct {
+    f      *os.File
+    r      *bufio.Reader
+    offset int64
+    line   []byte
+}
+
+func openFileSource(path string, offset int64) (*fileSource, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := f.Seek(offset, io.SeekStart); err != nil {
+        f.Close()
+        return nil, err
+    }
+    return &fileSource{f: f, r: bufio.NewReader(f), offset: offset}, nil
+}
+
+func (s *fileSource) next(ctx context.Context) (busMessage, error) {
+    for {
+        chunk, err := s.r.ReadBytes('\n')
+        s.line = append(s.line, chunk...)
+        if err == nil {
+            data := s.line
+            s.offset += int64(len(data))
+            s.line = nil
+            return busMessage{Offset: s.offset, Data: data}, nil
+        }
+        if err != io.EOF {
+            return busMessage{}, err
+        }
+        // A partial line is kept until its writer finishes it.
+        select {
+        case <-ctx.Done():
+            return busMessage{}, ctx.Err()
+        case <-time.After(time.Second):
+        }
+    }
+}
+
+func (s *fileSource) close() error { return s.f.Close() }
+
+// defaultNATSMaxPayload is the server's payload limit when its INFO does
+// not state one.
+const defaultNATSMaxPayload = 1 << 20
+
+// natsSource is a core NATS subscription. Core NATS keeps no history and
+// has no positions to resume from: its offsets are a local count of the
+// messages received, carried on across reconnects for the status report,
+// and messages published while disconnected are lost.
+type natsSource struct {
+    conn       net.Conn
+    r          *bufio.Reader
+    offset     int64
+    maxPayload int
+}
+
+func dialNATS(addr, subject string, offset int64) (*natsSource, error) {
+    if !strings.Contains(addr, ":") {
+        addr += ":4222"
+    }
+    conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+    if err != nil {
+        return nil, err
+    }
+    s := &natsSource{conn: conn, r: bufio.NewReader(conn), offset: offset, maxPayload: defaultNATSMaxPayload}
+    conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+    info, err := s.r.ReadString('\n')
+    if err != nil || !strings.HasPrefix(info, "INFO ") {
+        conn.Close()
+        return nil, fmt.Errorf("NATS handshake with %s failed: %q %v", addr, info, err)
+    }
+    var server struct {
+        MaxPayload int `json:"max_payload"`
+    }
+    if err := json.Unmarshal([]byte(strings.TrimPrefix(info, "INFO ")), &server); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("NATS handshake with %s failed: INFO: %v", addr, err)
+    }
+    if server.MaxPayload > 0 {
+        s.maxPayload = server.MaxPayload
+    }
+    conn.SetReadDeadline(time.Time{})
+    if _, err := fmt.Fprintf(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"headers\":true,\"name\":\"risk-router\"}\r\nSUB %s 1\r\n", subject); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return s, nil
+}
+
+func (s *natsSource) next(ctx context.Context) (busMessage, error) {
+    stop := context.AfterFunc(ctx, func() { s.conn.SetReadDeadline(time.Now()) })
+    defer stop()
+    for {
+        line, err := s.r.ReadString('\n')
+        if err != nil {
+            if ctx.Err() != nil {
+                return busMessage{}, ctx.Err()
+            }
+            return busMessage{}, err
+        }
+        line = strings.TrimRight(line, "\r\n")
+        switch {
+        case line == "PING":
+            if _, err := io.WriteString(s.conn, "PONG\r\n"); err != nil {
+                return busMessage{}, err
+            }
+        case strings.HasPrefix(line, "-ERR"):
+            return busMessage{}, fmt.Errorf("NATS: %s", line)
+        case strings.HasPrefix(line, "MSG "), strings.HasPrefix(line, "HMSG "):
+            headers, size, err := s.frameSizes(line)
+            if err != nil {
+                return busMessage{}, err
+            }
+            data := make([]byte, size+2)
+            if _, err := io.ReadFull(s.r, data); err != nil {
+                return busMessage{}, err
+            }
+            s.offset++
+            return busMessage{Offset: s.offset, Data: data[headers:size]}, nil
+        }
+    }
+}
+
+// frameSizes reads the header and total sizes off a message frame's
+// control line:
+//
+//	MSG <subject> <sid> [reply-to] <#bytes>
+//	HMSG <subject> <sid> [reply-to] <#header bytes> <#total bytes>
+//
+// The payload proper follows the headers, which events do not use.
+func (s *natsSource) frameSizes(line string) (headers, total int, err error) {
+    fields := strings.Fields(line)
+    sizes := 1
+    if fields[0] == "HMSG" {
+        sizes = 2
+    }
+    if n := len(fields) - 1 - sizes; n != 2 && n != 3 {
+        return 0, 0, fmt.Errorf("NATS: malformed %q", line)
+    }
+    if total, err = strconv.Atoi(fields[len(fields)-1]); err != nil || total < 0 || total > s.maxPayload {
+        return 0, 0, fmt.Errorf("NATS: malformed %q: size must be 0 to %d", line, s.maxPayload)
+    }
+    if sizes == 2 {
+        if headers, err = strconv.Atoi(fields[len(fields)-2]); err != nil || headers < 0 || headers > total {
+            return 0, 0, fmt.Errorf("NATS: malformed %q: header size must be 0 to %d", line, total)
+        }
+    }
+    return headers, total, nil
+}
+
+func (s *natsSource) close() error { return s.conn.Close() }
+
+// busEvent is an event applied to a tenant's live graph:
+//
+//	incident     adds x, y, severity to the crime index
+//	closure      closes the segment between from and to
+//	reopen       reopens it
+//	risk_update  sets the segment's risk to risk on a new risk layer
+//
+// Events carry an ID so a redelivered event is applied once.
+type busEvent struct {
+    ID     string      `json:"id"`
+    Type   string      `json:"type"`
+    Tenant string      `json:"tenant"`
+    From   *[2]float64 `json:"from"`
+    To     *[2]float64 `json:"to"`
+    Risk   *float64    `json:"risk"`
+    incidentLine
+}
+
+// eventConsumer applies events from the configured bus, reconnecting with
+// backoff and resuming from the last applied offset.
+type eventConsumer struct {
+    url   string
+    topic string
+
+    mu         sync.Mutex
+    offset     int64
+    applied    int64
+    duplicates int64
+    failed     int64
+    lastError  string
+    lastEvent  time.Time
+    connected  bool
+    seen       map[string]struct{}
+    seenOrder  []string
+}
+
+var globalEvents *eventConsumer
+
+// newEventConsumer checks the bus URL; it returns nil when none is set.
+func newEventConsumer(rawURL, topic string) (*eventConsumer, error) {
+    if rawURL == "" {
+        return nil, nil
+    }
+    if _, err := url.Parse(rawURL); err != nil {
+        return nil, fmt.Errorf("event bus URL: %v", err)
+    }
+    return &eventConsumer{url: rawURL, topic: topic, seen: make(map[string]struct{})}, nil
+}
+
+// run consumes until ctx is done.
+func (c *eventConsumer) run(ctx context.Context) {
+    backoff := time.Second
+    for ctx.Err() == nil {
+        c.mu.Lock()
+        offset := c.offset
+        c.mu.Unlock()
+
+        source, err := openEventSource(c.url, c.topic, offset)
+        if err != nil {
+            c.setError(err)
+            log.Printf("Event bus: %v; retrying in %v", err, backoff)
+            select {
+            case <-ctx.Done():
+                return
+            case <-time.After(backoff):
+            }
+            backoff = min(backoff*2, time.Minute)
+            continue
+        }
+        backoff = time.Second
+        c.setConnected(true)
+        log.Printf("Event bus: consuming %s from offset %d", c.url, offset)
+        for {
+            msg, err := source.next(ctx)
+            if err != nil {
+                if ctx.Err() == nil {
+                    c.setError(err)
+                    log.Printf("Event bus: %v; reconnecting", err)
+                }
+                break
+            }
+            c.handle(msg)
+        }
+        c.setConnected(false)
+        source.close()
+    }
+}
+
+// handle applies one message and advances the offset past it, whether or
+// not it applied; a malformed event is reported rather than retried.
+func (c *eventConsumer) handle(msg busMessage) {
+    defer func() {
+        c.mu.Lock()
+        c.offset = msg.Offset
+        c.mu.Unlock()
+    }()
+    if len(strings.TrimSpace(string(msg.Data))) == 0 {
+        return
+    }
+    var ev busEvent
+    if err := json.Unmarshal(msg.Data, &ev); err != nil {
+        c.fail(msg.Offset, err)
+        return
+    }
+    if ev.ID == "" {
+        c.fail(msg.Offset, fmt.Errorf("event has no id"))
+        return
+    }
+    c.mu.Lock()
+    _, dup := c.seen[ev.ID]
+    if dup {
+        c.duplicates++
+    }
+    c.mu.Unlock()
+    if dup {
+        return
+    }
+    if err := applyEvent(ev); err != nil {
+        c.fail(msg.Offset, fmt.Errorf("event %s: %v", ev.ID, err))
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.applied++
+    c.lastEvent = time.Now().UTC()
+    c.seen[ev.ID] = struct{}{}
+    c.seenOrder = append(c.seenOrder, ev.ID)
+    if len(c.seenOrder) > maxSeenEvents {
+        delete(c.seen, c.seenOrder[0])
+        c.seenOrder = c.seenOrder[1:]
+    }
+}
+
+func (c *eventConsumer) fail(offset int64, err error) {
+    c.mu.Lock()
+    c.failed++
+    c.mu.Unlock()
+    c.setError(err)
+    reportWarning(map[string]string{"component": "event_bus"}, "event at offset %d rejected: %v", offset, err)
+}
+
+func (c *eventConsumer) setError(err error) {
+    c.mu.Lock()
+    c.lastError = err.Error()
+    c.mu.Unlock()
+}
+
+func (c *eventConsumer) setConnected(v bool) {
+    c.mu.Lock()
+    c.connected = v
+    c.mu.Unlock()
+}
+
+// applyEvent applies ev to its tenant's router.
+func applyEvent(ev busEvent) error {
+    tenant, err := tenantByID(ev.Tenant)
+    if err != nil {
+        return err
+    }
+    router := tenant.Router()
+    switch ev.Type {
+    case "incident":
+        p, severity, err := ev.incidentLine.validate(router)
+        if err != nil {
+            return err
+        }
+        router.CrimeData.Add(p, severity, ev.incidentLine.at())
+        router.layers.markDirty(1)
+        notifyIncident(tenant.ID, p, severity)
+    case "closure", "reopen", "risk_update":
+        if ev.From == nil || ev.To == nil {
+            return fmt.Errorf("%s events need from and to", ev.Type)
+        }
+        from, to := Point{X: ev.From[0], Y: ev.From[1]}, Point{X: ev.To[0], Y: ev.To[1]}
+        edges, err := router.segmentEdges(from, to)
+        if err != nil {
+            return err
+        }
+        switch ev.Type {
+        case "closure", "reopen":
+            closure := newClosureRecord(tenant.ID, from, to, ev.Type == "closure")
+            if err := globalStorage.setClosure(context.Background(), closure); err != nil {
+                return fmt.Errorf("storing %s: %v", ev.Type, err)
+            }
+            if router.closed.set(edges, closure.Closed) {
+                dataChanged(router)
+            }
+        case "risk_update":
+            if ev.Risk == nil || *ev.Risk < 0 || *ev.Risk > 1 {
+                return fmt.Errorf("risk_update events need a risk within [0, 1]")
+            }
+            layer := router.updateRisk(edges, *ev.Risk)
+            dataChanged(router)
+            log.Printf("Event %s: tenant %s risk layer is now %s", ev.ID, tenant.ID, layer.Version)
+        }
+    default:
+        return fmt.Errorf("unknown event type %q", ev.Type)
+    }
+    return nil
+}
+
+type eventConsumerStatus struct {
+    Source     string    `json:"source"`
+    Topic      string    `json:"topic,omitempty"`
+    Connected  bool      `json:"connected"`
+    Offset     int64     `json:"offset"`
+    Applied    int64     `json:"applied"`
+    Duplicates int64     `json:"duplicates"`
+    Failed     int64     `json:"failed"`
+    LastEvent  time.Time `json:"last_event,omitempty"`
+    LastError  string    `json:"last_error,omitempty"`
+}
+
+func (c *eventConsumer) status() eventConsumerStatus {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    source := c.url
+    if u, err := url.Parse(c.url); err == nil {
+        u.User = nil
+        source = u.String()
+    }
+    return eventConsumerStatus{
+        Source:     source,
+        Topic:      c.topic,
+        Connected:  c.connected,
+        Offset:     c.offset,
+        Applied:    c.applied,
+        Duplicates: c.duplicates,
+        Failed:     c.failed,
+        LastEvent:  c.lastEvent,
+        LastError:  c.lastError,
+    }
+}
+
+// handleAdminEvents serves GET /admin/events, the consumer's progress and
+// each tenant's closed edge count.
+func handleAdminEvents(w http.ResponseWriter, r *http.Request) {
+    if globalEvents == nil {
+        writeAPIError(w, http.StatusNotFound, APIError{Code: "event_bus_disabled", Message: "no event bus is configured"})
+        return
+    }
+    closed := make(map[string]int)
+    for id, t := range globalTenants.byID {
+        if set := t.Router().closed.load(); set != nil {
+            closed[id] = len(set.edges)
+        }
+    }
+    response := struct {
+        eventConsumerStatus
+        ClosedEdges map[string]int `json:"closed_edges"`
+    }{globalEvents.status(), closed}
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode event bus status: %v", err)
+    }
+}
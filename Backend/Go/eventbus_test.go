@@ -0,0 +1,108 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "io"
+    "net"
+    "strings"
+    "testing"
+)
+
+// fakeNATS accepts one client, reads its CONNECT and SUB, then writes
+// frames; the returned channel yields what the client sent.
+func fakeNATS(t *testing.T, info, frames string) (string, <-chan string) {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    sent := make(chan string, 1)
+    go func() {
+        conn, err := ln.Accept()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        io.WriteString(conn, "INFO "+info+"\r\n")
+        r := bufio.NewReader(conn)
+        connect, _ := r.ReadString('\n')
+        sub, _ := r.ReadString('\n')
+        sent <- connect + sub
+        io.WriteString(conn, frames)
+        io.Copy(io.Discard, r)
+    }()
+    return ln.Addr().String(), sent
+}
+
+func TestNATSSource(t *testing.T) {
+    frames := "PING\r\n" +
+        "MSG events 1 5\r\nfirst\r\n" +
+        "MSG events 1 _INBOX.x 6\r\nsecond\r\n" +
+        "HMSG events 1 24 29\r\nNATS/1.0\r\nNats-Id: a\r\n\r\nthird\r\n" +
+        "HMSG events 1 _INBOX.y 12 12\r\nNATS/1.0\r\n\r\n\r\n"
+    addr, sent := fakeNATS(t, `{"server_id":"test","max_payload":1024}`, frames)
+    s, err := dialNATS(addr, "events", 40)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.close()
+    if s.maxPayload != 1024 {
+        t.Errorf("maxPayload = %d, want the server's 1024", s.maxPayload)
+    }
+    for i, want := range []string{"first", "second", "third", ""} {
+        msg, err := s.next(context.Background())
+        if err != nil {
+            t.Fatalf("message %d: %v", i, err)
+        }
+        if string(msg.Data) != want || msg.Offset != int64(41+i) {
+            t.Errorf("message %d = %q at %d, want %q at %d", i, msg.Data, msg.Offset, want, 41+i)
+        }
+    }
+    if hello := <-sent; !strings.Contains(hello, `"headers":true`) || !strings.HasSuffix(hello, "SUB events 1\r\n") {
+        t.Errorf("client sent %q", hello)
+    }
+}
+
+func TestNATSFrameSizes(t *testing.T) {
+    s := &natsSource{maxPayload: 100}
+    cases := []struct {
+        line           string
+        headers, total int
+        ok             bool
+    }{
+        {"MSG a 1 5", 0, 5, true},
+        {"MSG a 1 reply 0", 0, 0, true},
+        {"MSG a 1 100", 0, 100, true},
+        {"MSG a 1 101", 0, 0, false},
+        {"MSG a 1 -1", 0, 0, false},
+        {"MSG a 1 five", 0, 0, false},
+        {"MSG a", 0, 0, false},
+        {"MSG a 1 r x 5", 0, 0, false},
+        {"HMSG a 1 12 20", 12, 20, true},
+        {"HMSG a 1 reply 12 12", 12, 12, true},
+        {"HMSG a 1 21 20", 0, 0, false},
+        {"HMSG a 1 -1 20", 0, 0, false},
+        {"HMSG a 1 12 101", 0, 0, false},
+        {"HMSG a 1 20", 0, 0, false},
+    }
+    for _, c := range cases {
+        headers, total, err := s.frameSizes(c.line)
+        if c.ok != (err == nil) || headers != c.headers || total != c.total {
+            t.Errorf("frameSizes(%q) = %d, %d, %v", c.line, headers, total, err)
+        }
+    }
+}
+
+func TestNATSOversizedFrame(t *testing.T) {
+    addr, _ := fakeNATS(t, `{"max_payload":8}`, "MSG events 1 9\r\n123456789\r\n")
+    s, err := dialNATS(addr, "events", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.close()
+    if _, err := s.next(context.Background()); err == nil || !strings.Contains(err.Error(), "size must be 0 to 8") {
+        t.Errorf("err = %v, want the size refused", err)
+    }
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+    "bytes"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+
+    "risk-router/geo"
+)
+
+// riskNamespace qualifies the per-point risk extension in GPX exports.
+const riskNamespace = "https://github.com/meeheer123/PICT/risk/v1"
+
+// exportTrack is one route of a saved route prepared for export.
+type exportTrack struct {
+    Name    string
+    Summary string
+    Route   Route
+    Pieces  []pathPiece
+}
+
+type gpxDoc struct {
+    XMLName   xml.Name   `xml:"gpx"`
+    Version   string     `xml:"version,attr"`
+    Creator   string     `xml:"creator,attr"`
+    XMLNS     string     `xml:"xmlns,attr"`
+    XMLNSRisk string     `xml:"xmlns:risk,attr"`
+    Waypoints []gpxPoint `xml:"wpt"`
+    Tracks    []gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+    Name    string     `xml:"name"`
+    Desc    string     `xml:"desc,omitempty"`
+    Segment []gpxPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxPoint struct {
+    Lat        float64        `xml:"lat,attr"`
+    Lon        float64        `xml:"lon,attr"`
+    Name       string         `xml:"name,omitempty"`
+    Desc       string         `xml:"desc,omitempty"`
+    Extensions *gpxExtensions `xml:"extensions,omitempty"`
+}
+
+// gpxExtensions carries the risk of the segment starting at a track point.
+type gpxExtensions struct {
+    Risk float64 `xml:"risk:risk"`
+}
+
+func writeGPX(w io.Writer, l localizer, saved *savedRoute, waypoints []gpxPoint, tracks []exportTrack) error {
+    doc := gpxDoc{Version: "1.1", Creator: "risk-router", XMLNS: "http://www.topografix.com/GPX/1/1", XMLNSRisk: riskNamespace, Waypoints: waypoints}
+    for _, t := range tracks {
+        trk := gpxTrack{Name: t.Name, Desc: t.Summary}
+        for i, p := range t.Route.Path {
+            pt := gpxPoint{Lat: p.Y, Lon: p.X}
+            if i < len(t.Pieces) {
+                pt.Extensions = &gpxExtensions{Risk: t.Pieces[i].risk}
+            }
+            trk.Segment = append(trk.Segment, pt)
+        }
+        doc.Tracks = append(doc.Tracks, trk)
+    }
+    return encodeXML(w, doc)
+}
+
+type kmlDoc struct {
+    XMLName  xml.Name       `xml:"kml"`
+    XMLNS    string         `xml:"xmlns,attr"`
+    Name     string         `xml:"Document>name"`
+    Children []kmlPlacemark `xml:"Document>Placemark"`
+    Folders  []kmlFolder    `xml:"Document>Folder"`
+}
+
+type kmlFolder struct {
+    Name       string         `xml:"name"`
+    Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+    Name        string           `xml:"name"`
+    Description string           `xml:"description,omitempty"`
+    Data        *kmlExtendedData `xml:"ExtendedData,omitempty"`
+    Point       *kmlCoords       `xml:"Point,omitempty"`
+    LineString  *kmlCoords       `xml:"LineString,omitempty"`
+}
+
+type kmlExtendedData struct {
+    Data []kmlData `xml:"Data"`
+}
+
+type kmlData struct {
+    Name  string `xml:"name,attr"`
+    Value string `xml:"value"`
+}
+
+type kmlCoords struct {
+    Coordinates string `xml:"coordinates"`
+}
+
+func kmlCoordinates(pts ...Point) *kmlCoords {
+    var b []byte
+    for i, p := range pts {
+        if i > 0 {
+            b = append(b, ' ')
+        }
+        b = strconv.AppendFloat(b, p.X, 'f', -1, 64)
+        b = append(b, ',')
+        b = strconv.AppendFloat(b, p.Y, 'f', -1, 64)
+    }
+    return &kmlCoords{Coordinates: string(b)}
+}
+
+func formatRisk(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+
+// writeKML writes the waypoints as points and each route as a folder
+// holding the whole line and one placemark per segment with its risk.
+func writeKML(w io.Writer, l localizer, saved *savedRoute, waypoints []gpxPoint, tracks []exportTrack) error {
+    doc := kmlDoc{XMLNS: "http://www.opengis.net/kml/2.2", Name: l.T("document.name", "id", saved.ID)}
+    for _, wp := range waypoints {
+        doc.Children = append(doc.Children, kmlPlacemark{Name: wp.Name, Description: wp.Desc, Point: kmlCoordinates(Point{X: wp.Lon, Y: wp.Lat})})
+    }
+    for _, t := range tracks {
+        folder := kmlFolder{Name: t.Name}
+        folder.Placemarks = append(folder.Placemarks, kmlPlacemark{
+            Name:        t.Name,
+            Description: t.Summary,
+            Data:        &kmlExtendedData{[]kmlData{{Name: "alpha", Value: strconv.FormatFloat(t.Route.Alpha, 'f', -1, 64)}, {Name: "risk", Value: formatRisk(t.Route.Risk)}}},
+            LineString:  kmlCoordinates(t.Route.Path...),
+        })
+        for i, p := range t.Pieces {
+            folder.Placemarks = append(folder.Placemarks, kmlPlacemark{
+                Name:       l.T("segment.name", "n", i+1),
+                Data:       &kmlExtendedData{[]kmlData{{Name: "risk", Value: formatRisk(p.risk)}}},
+                LineString: kmlCoordinates(p.a, p.b),
+            })
+        }
+        doc.Folders = append(doc.Folders, folder)
+    }
+    return encodeXML(w, doc)
+}
+
+func encodeXML(w io.Writer, doc interface{}) error {
+    if _, err := io.WriteString(w, xml.Header); err != nil {
+        return err
+    }
+    enc := xml.NewEncoder(w)
+    enc.Indent("", "  ")
+    if err := enc.Encode(doc); err != nil {
+        return err
+    }
+    _, err := io.WriteString(w, "\n")
+    return err
+}
+
+func pathLengthM(pieces []pathPiece) float64 {
+    if len(pieces) == 0 {
+        return 0
+    }
+    last := pieces[len(pieces)-1]
+    return last.fromM + last.lengthM
+}
+
+var exportFormats = map[string]struct {
+    contentType string
+    write       func(io.Writer, localizer, *savedRoute, []gpxPoint, []exportTrack) error
+}{
+    "gpx": {"application/gpx+xml", writeGPX},
+    "kml": {"application/vnd.google-earth.kml+xml", writeKML},
+}
+
+// handleExportRoute serves GET /routes/{id}/export?format=gpx|kml, a saved
+// route as a download for GPS devices and Google Earth: waypoints at the
+// snapped start and end, one track per alpha (or only ?alpha=), and the
+// risk of every segment. Text follows Accept-Language and ?units=.
+func handleExportRoute(w http.ResponseWriter, r *http.Request) {
+    tenant := tenantFromContext(r.Context())
+    saved, ok := loadSavedRoute(w, r, r.PathValue("id"), tenant.ID)
+    if !ok {
+        return
+    }
+    formatName := r.URL.Query().Get("format")
+    format, ok := exportFormats[formatName]
+    if !ok {
+        writeBadRequest(w, "format must be gpx or kml")
+        return
+    }
+    routes := saved.Routes
+    if v := r.URL.Query().Get("alpha"); v != "" {
+        alpha, err := strconv.ParseFloat(v, 64)
+        if err != nil {
+            writeBadRequest(w, "alpha: "+err.Error())
+            return
+        }
+        routes = nil
+        for _, rt := range saved.Routes {
+            if rt.Alpha == alpha {
+                routes = append(routes, rt)
+            }
+        }
+        if len(routes) == 0 {
+            writeBadRequest(w, fmt.Sprintf("route %s has no route for alpha %v", saved.ID, alpha))
+            return
+        }
+    }
+
+    l := localizerFor(r)
+    router := tenant.Router()
+    layer, ok := router.layers.get(saved.RiskVersion)
+    if !ok {
+        layer = router.layers.current()
+    }
+    var tracks []exportTrack
+    for _, rt := range routes {
+        pieces, err := router.pathPieces(rt.Path, layer)
+        if err != nil {
+            writeAPIError(w, http.StatusConflict, APIError{Code: "graph_changed", Message: err.Error()})
+            return
+        }
+        tracks = append(tracks, exportTrack{
+            Name:    l.T("track.name", "alpha", rt.Alpha),
+            Summary: l.T("track.summary", "distance", l.Distance(pathLengthM(pieces)), "risk", l.Number(rt.Risk, 3)),
+            Route:   rt,
+            Pieces:  pieces,
+        })
+    }
+    first := routes[0].Path
+    waypoints := []gpxPoint{
+        snappedWaypoint(l, "waypoint.start", saved.Start, first[0]),
+        snappedWaypoint(l, "waypoint.end", saved.End, first[len(first)-1]),
+    }
+
+    var body bytes.Buffer
+    if err := format.write(&body, l, saved, waypoints, tracks); err != nil {
+        log.Printf("Failed to export route %s: %v", saved.ID, err)
+        writeAPIError(w, http.StatusInternalServerError, APIError{Code: "internal", Message: "failed to export route"})
+        return
+    }
+    w.Header().Set("Content-Type", format.contentType)
+    w.Header().Set("Content-Language", l.Language)
+    w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="route-%s.%s"`, saved.ID, formatName))
+    signResponse(w, body.Bytes())
+    w.Write(body.Bytes())
+}
+
+func snappedWaypoint(l localizer, nameKey string, requested, snapped Point) gpxPoint {
+    return gpxPoint{
+        Lat:  snapped.Y,
+        Lon:  snapped.X,
+        Name: l.T(nameKey),
+        Desc: l.T("waypoint.snapped", "distance", l.Distance(geo.Haversine(requested, snapped)), "lat", requested.Y, "lon", requested.X),
+    }
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "reflect"
+    "slices"
+    "strings"
+)
+
+// routeField is one field of a route's JSON: its name and where it sits
+// in Route.
+type routeField struct {
+    name      string
+    index     int
+    omitEmpty bool
+}
+
+// routeFields lists a route's JSON fields in the order they are written.
+var routeFields = jsonFields(reflect.TypeOf(Route{}))
+
+func jsonFields(t reflect.Type) []routeField {
+    var fields []routeField
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+        if !f.IsExported() || name == "-" {
+            continue
+        }
+        if name == "" {
+            name = f.Name
+        }
+        fields = append(fields, routeField{name: name, index: i, omitEmpty: opts == "omitempty"})
+    }
+    return fields
+}
+
+func routeFieldNames() []string {
+    names := make([]string, len(routeFields))
+    for i, f := range routeFields {
+        names[i] = f.name
+    }
+    return names
+}
+
+// parseRouteFields parses a fields parameter, a comma-separated list of
+// route fields such as "distance,risk,alpha". Empty means every field.
+func parseRouteFields(list string) ([]string, error) {
+    if strings.TrimSpace(list) == "" {
+        return nil, nil
+    }
+    var fields []string
+    for _, name := range strings.Split(list, ",") {
+        name = strings.TrimSpace(name)
+        if !slices.Contains(routeFieldNames(), name) {
+            return nil, fmt.Errorf("unknown route field %q", name)
+        }
+        fields = append(fields, name)
+    }
+    return fields, nil
+}
+
+// requestFields returns the route fields a request chose, from its body's
+// fields or else the ?fields= query parameter.
+func requestFields(r *http.Request, body string) ([]string, error) {
+    if body == "" {
+        body = r.URL.Query().Get("fields")
+    }
+    return parseRouteFields(body)
+}
+
+func writeUnknownField(w http.ResponseWriter, err error) {
+    writeAPIError(w, http.StatusBadRequest, APIError{
+        Code:    "unknown_field",
+        Message: err.Error(),
+        Details: map[string]interface{}{"fields": routeFieldNames()},
+    })
+}
+
+// fieldedRoute is a route as answered: only the chosen fields, in their
+// usual order, or all of them when none were chosen. Leaving out the path
+// spares clients that only compare metrics the bulk of the response.
+type fieldedRoute struct {
+    Route
+    fields []string
+}
+
+func selectFields(routes []Route, fields []string) []fieldedRoute {
+    selected := make([]fieldedRoute, len(routes))
+    for i, route := range routes {
+        selected[i] = fieldedRoute{route, fields}
+    }
+    return selected
+}
+
+func (r fieldedRoute) MarshalJSON() ([]byte, error) {
+    if r.fields == nil {
+        return json.Marshal(r.Route)
+    }
+    v := reflect.ValueOf(r.Route)
+    var b bytes.Buffer
+    b.WriteByte('{')
+    for _, f := range routeFields {
+        value := v.Field(f.index)
+        if !slices.Contains(r.fields, f.name) || f.omitEmpty && value.IsZero() {
+            continue
+        }
+        encoded, err := json.Marshal(value.Interface())
+        if err != nil {
+            return nil, err
+        }
+        if b.Len() > 1 {
+            b.WriteByte(',')
+        }
+        fmt.Fprintf(&b, "%q:", f.name)
+        b.Write(encoded)
+    }
+    b.WriteByte('}')
+    return b.Bytes(), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "time"
+)
+
+// staleRiskData flags a response computed on a risk layer that has gone
+// longer than max_risk_staleness_hours without a refresh: a safety
+// decision may rest on crime data that no longer holds.
+type staleRiskData struct {
+    RiskVersion       string    `json:"risk_version"`
+    RiskLoadedAt      time.Time `json:"risk_loaded_at"`
+    AgeHours          float64   `json:"age_hours"`
+    MaxStalenessHours float64   `json:"max_staleness_hours"`
+}
+
+// riskStaleness returns how stale t's risk data is at now, nil while it
+// is fresh or no staleness limit is configured. The data is as fresh as
+// its current layer: loaded from a file, updated live or rescored.
+// Overlays only adjust a layer, so they do not refresh it. Going stale is
+// reported as a warning, and becoming fresh again logged.
+func (t *Tenant) riskStaleness(now time.Time) *staleRiskData {
+    limit := globalConfig.MaxRiskStalenessHours
+    if limit <= 0 {
+        return nil
+    }
+    layer := t.Router().layers.current()
+    age := now.Sub(layer.LoadedAt)
+    stale := age > time.Duration(limit*float64(time.Hour))
+    if t.riskStale.Swap(stale) != stale {
+        if stale {
+            reportWarning(map[string]string{"component": "freshness", "tenant": t.ID},
+                "risk layer %s of tenant %s was loaded %.1f h ago, more than max_risk_staleness_hours (%v); responses are flagged stale",
+                layer.Version, t.ID, age.Hours(), limit)
+        } else {
+            log.Printf("Risk data of tenant %s is fresh again: layer %s", t.ID, layer.Version)
+        }
+    }
+    if !stale {
+        return nil
+    }
+    return &staleRiskData{
+        RiskVersion:       layer.Version,
+        RiskLoadedAt:      layer.LoadedAt,
+        AgeHours:          age.Hours(),
+        MaxStalenessHours: limit,
+    }
+}
+
+// checkRiskFreshness checks every tenant's risk data, so going stale is
+// reported even when no requests come in.
+func checkRiskFreshness(now time.Time) error {
+    for _, t := range globalTenants.tenants {
+        t.riskStaleness(now)
+    }
+    return nil
+}
+
+// readinessCheck is one of the conditions GET /ready reports.
+type readinessCheck struct {
+    OK      bool   `json:"ok"`
+    Message string `json:"message,omitempty"`
+}
+
+// handleReady serves GET /ready for load balancers and orchestrators. The
+// server only listens once every tenant is loaded, so it is always ready;
+// failed checks make it "degraded" rather than unready, since every
+// replica shares the same data and taking them all out of rotation would
+// help nobody.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+    now := time.Now()
+    stale := 0
+    for _, t := range globalTenants.tenants {
+        if t.riskStaleness(now) != nil {
+            stale++
+        }
+    }
+    riskData := readinessCheck{OK: stale == 0}
+    if stale > 0 {
+        riskData.Message = fmt.Sprintf("%d of %d tenants have risk data older than max_risk_staleness_hours", stale, len(globalTenants.tenants))
+    }
+    response := struct {
+        Status string                    `json:"status"`
+        Checks map[string]readinessCheck `json:"checks"`
+    }{"ready", map[string]readinessCheck{"risk_data": riskData}}
+    if !riskData.OK {
+        response.Status = "degraded"
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode readiness: %v", err)
+    }
+}
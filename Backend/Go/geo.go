@@ -0,0 +1,49 @@
+package main
+
+import (
+    "math"
+
+    "risk-router/geo"
+)
+
+// padBounds grows b by the given number of meters on every side. Longitude
+// padding is scaled by the bounds' mid latitude.
+func padBounds(b Bounds, meters float64) Bounds {
+    dLat := meters / geo.MetersPerDegreeLat
+    midLat := (b.MinY + b.MaxY) / 2
+    dLon := meters / (geo.MetersPerDegreeLat * math.Cos(midLat*math.Pi/180))
+    return Bounds{
+        MinX: b.MinX - dLon,
+        MinY: b.MinY - dLat,
+        MaxX: b.MaxX + dLon,
+        MaxY: b.MaxY + dLat,
+    }
+}
+
+// boundsOf returns the bounding box of pts.
+func boundsOf(pts []Point) Bounds {
+    if len(pts) == 0 {
+        return Bounds{}
+    }
+    b := Bounds{MinX: pts[0].X, MinY: pts[0].Y, MaxX: pts[0].X, MaxY: pts[0].Y}
+    for _, p := range pts[1:] {
+        b.MinX = math.Min(b.MinX, p.X)
+        b.MinY = math.Min(b.MinY, p.Y)
+        b.MaxX = math.Max(b.MaxX, p.X)
+        b.MaxY = math.Max(b.MaxY, p.Y)
+    }
+    return b
+}
+
+// pointInPolygon reports whether p lies inside the ring poly (even-odd rule).
+// The ring may or may not repeat its first vertex.
+func pointInPolygon(p Point, poly []Point) bool {
+    inside := false
+    for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+        a, b := poly[i], poly[j]
+        if (a.Y > p.Y) != (b.Y > p.Y) && p.X < (b.X-a.X)*(p.Y-a.Y)/(b.Y-a.Y)+a.X {
+            inside = !inside
+        }
+    }
+    return inside
+}
@@ -0,0 +1,159 @@
+// Package geo is the geodesic math of risk-router: distances, bearings,
+// projections onto segments, polyline lengths and buffers, on longitude
+// and latitude in degrees. The router, the risk pipeline and other
+// services share it so they agree to the meter on what a route measures.
+//
+// The API is stable: functions may be added, but existing ones keep their
+// signatures and results.
+package geo
+
+import "math"
+
+// Point is a position in degrees: X is the longitude and Y the latitude.
+type Point struct {
+    X, Y float64
+}
+
+// EarthRadiusM is the mean radius of the Earth in meters.
+const EarthRadiusM = 6371008.8
+
+// MetersPerDegreeLat is the length in meters of a degree of latitude, and
+// of a degree of longitude at the equator.
+const MetersPerDegreeLat = 111320.0
+
+func radians(deg float64) float64 {
+    return deg * math.Pi / 180
+}
+
+// Haversine returns the great-circle distance between a and b in meters.
+func Haversine(a, b Point) float64 {
+    lat1 := radians(a.Y)
+    lat2 := radians(b.Y)
+    dLat := lat2 - lat1
+    dLon := radians(b.X - a.X)
+    h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+    return 2 * EarthRadiusM * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Bearing returns the initial bearing of the great circle from a to b in
+// degrees clockwise from north, within [0, 360). It is 0 when a and b
+// coincide.
+func Bearing(a, b Point) float64 {
+    lat1 := radians(a.Y)
+    lat2 := radians(b.Y)
+    dLon := radians(b.X - a.X)
+    y := math.Sin(dLon) * math.Cos(lat2)
+    x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+    deg := math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+    if deg == 360 {
+        return 0
+    }
+    return deg
+}
+
+// ProjectOnSegment returns the point on segment a-b closest to p. The
+// segment is treated as straight in a local equirectangular projection,
+// which is accurate at street scale.
+func ProjectOnSegment(p, a, b Point) Point {
+    scale := math.Cos(radians(p.Y))
+    ax, ay := (a.X-p.X)*scale, a.Y-p.Y
+    bx, by := (b.X-p.X)*scale, b.Y-p.Y
+    dx, dy := bx-ax, by-ay
+    lenSq := dx*dx + dy*dy
+    if lenSq == 0 {
+        return a
+    }
+    t := -(ax*dx + ay*dy) / lenSq
+    t = math.Max(0, math.Min(1, t))
+    return Point{X: a.X + t*(b.X-a.X), Y: a.Y + t*(b.Y-a.Y)}
+}
+
+// DistanceToSegment returns the distance in meters from p to segment a-b.
+func DistanceToSegment(p, a, b Point) float64 {
+    return Haversine(p, ProjectOnSegment(p, a, b))
+}
+
+// PolylineLength returns the length of the polyline pts in meters.
+func PolylineLength(pts []Point) float64 {
+    length := 0.0
+    for i := 1; i < len(pts); i++ {
+        length += Haversine(pts[i-1], pts[i])
+    }
+    return length
+}
+
+// CumulativeLengths returns, for each vertex of the polyline pts, how far
+// along the polyline it lies in meters; the last is PolylineLength(pts).
+func CumulativeLengths(pts []Point) []float64 {
+    if len(pts) == 0 {
+        return nil
+    }
+    at := make([]float64, len(pts))
+    for i := 1; i < len(pts); i++ {
+        at[i] = at[i-1] + Haversine(pts[i-1], pts[i])
+    }
+    return at
+}
+
+// Buffer returns a ring enclosing every point within meters of the
+// polyline pts, with flat ends and mitred joins (capped at twice the
+// width on sharp turns), or nil for fewer than two points. It works in a
+// local equirectangular projection, like ProjectOnSegment.
+func Buffer(pts []Point, meters float64) []Point {
+    if len(pts) < 2 {
+        return nil
+    }
+    lat0 := pts[0].Y
+    scale := math.Cos(radians(lat0))
+    toM := func(p Point) (float64, float64) {
+        return (p.X - pts[0].X) * scale * MetersPerDegreeLat, (p.Y - lat0) * MetersPerDegreeLat
+    }
+    fromM := func(x, y float64) Point {
+        return Point{X: pts[0].X + x/(scale*MetersPerDegreeLat), Y: lat0 + y/MetersPerDegreeLat}
+    }
+    // normal returns the unit left normal of segment i.
+    normal := func(i int) (float64, float64) {
+        ax, ay := toM(pts[i])
+        bx, by := toM(pts[i+1])
+        dx, dy := bx-ax, by-ay
+        l := math.Hypot(dx, dy)
+        if l == 0 {
+            return 0, 0
+        }
+        return -dy / l, dx / l
+    }
+
+    left := make([]Point, len(pts))
+    right := make([]Point, len(pts))
+    for i := range pts {
+        var nx, ny float64
+        switch {
+        case i == 0:
+            nx, ny = normal(0)
+        case i == len(pts)-1:
+            nx, ny = normal(i - 1)
+        default:
+            ax, ay := normal(i - 1)
+            bx, by := normal(i)
+            nx, ny = ax+bx, ay+by
+            if l := math.Hypot(nx, ny); l > 0 {
+                // Scale the bisector so the offset edges stay meters away.
+                cos := (ax*nx + ay*ny) / l
+                miter := 1 / math.Max(cos, 0.5)
+                nx, ny = nx/l*miter, ny/l*miter
+            } else {
+                nx, ny = ax, ay
+            }
+        }
+        x, y := toM(pts[i])
+        left[i] = fromM(x+nx*meters, y+ny*meters)
+        right[i] = fromM(x-nx*meters, y-ny*meters)
+    }
+
+    ring := make([]Point, 0, 2*len(pts)+1)
+    ring = append(ring, left...)
+    for i := len(right) - 1; i >= 0; i-- {
+        ring = append(ring, right[i])
+    }
+    return append(ring, left[0])
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "flag"
+    "math"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// The golden-route harness pins the output of the search for a small fixture
+// network. Any change that alters a path, distance or risk fails here; rerun
+// with -update after an intentional routing change and review the diff.
+var updateGolden = flag.Bool("update", false, "rewrite testdata/golden from the current search results")
+
+const (
+    fixtureNetwork  = "testdata/fixture_roads.geojson"
+    routeCorpus     = "testdata/route_corpus.json"
+    goldenDir       = "testdata/golden"
+    goldenTolerance = 1e-9
+)
+
+type goldenCase struct {
+    Name   string    `json:"name"`
+    Start  Point     `json:"start"`
+    End    Point     `json:"end"`
+    Alphas []float64 `json:"alphas"`
+}
+
+type goldenResult struct {
+    Routes []Route `json:"routes,omitempty"`
+    Error  string  `json:"error,omitempty"`
+}
+
+func TestGoldenRoutes(t *testing.T) {
+    // The corpus runs against the GeoJSON loader and against the same
+    // network round-tripped through the binary format, which must agree.
+    router, err := NewRiskAwareRouter(fixtureNetwork, &CrimeData{}, RouterOptions{})
+    if err != nil {
+        t.Fatalf("loading fixture network: %v", err)
+    }
+    binaryRouter, err := NewRiskAwareRouter(writeFixtureBinary(t), &CrimeData{}, RouterOptions{})
+    if err != nil {
+        t.Fatalf("loading binary fixture network: %v", err)
+    }
+
+    data, err := os.ReadFile(routeCorpus)
+    if err != nil {
+        t.Fatalf("reading corpus: %v", err)
+    }
+    var cases []goldenCase
+    if err := json.Unmarshal(data, &cases); err != nil {
+        t.Fatalf("parsing corpus: %v", err)
+    }
+
+    for _, c := range cases {
+        t.Run(c.Name, func(t *testing.T) {
+            got := runGoldenCase(router, c)
+            path := filepath.Join(goldenDir, c.Name+".json")
+
+            if *updateGolden {
+                out, err := json.MarshalIndent(got, "", "  ")
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if err := os.WriteFile(path, append(out, '\n'), 0o644); err != nil {
+                    t.Fatal(err)
+                }
+                return
+            }
+
+            data, err := os.ReadFile(path)
+            if err != nil {
+                t.Fatalf("reading golden file (run with -update to create it): %v", err)
+            }
+            var want goldenResult
+            if err := json.Unmarshal(data, &want); err != nil {
+                t.Fatalf("parsing golden file: %v", err)
+            }
+            compareGolden(t, want, got)
+            compareGolden(t, want, runGoldenCase(binaryRouter, c))
+
+            // Repeating the search in-process shakes out unstable
+            // tie-breaks and state leaking from one search into the next.
+            for i := 0; i < 5; i++ {
+                compareGolden(t, got, runGoldenCase(router, c))
+            }
+        })
+    }
+}
+
+// writeFixtureBinary converts the fixture network to the binary graph
+// format in a temporary directory and returns the file's path.
+func writeFixtureBinary(tb testing.TB) string {
+    tb.Helper()
+    graph := NewGraph()
+    if err := loadRoadNetwork(fixtureNetwork, graph, &chicagoBounds); err != nil {
+        tb.Fatal(err)
+    }
+    graph.index()
+
+    path := filepath.Join(tb.TempDir(), "fixture.bin")
+    f, err := os.Create(path)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    defer f.Close()
+    if err := graph.WriteBinary(f); err != nil {
+        tb.Fatal(err)
+    }
+    return path
+}
+
+// fixtureTenant serves the fixture network as the default tenant, with
+// the default configuration for the test's duration, for handler tests.
+func fixtureTenant(t *testing.T) *Tenant {
+    t.Helper()
+    saved := globalConfig
+    globalConfig = defaultConfig()
+    t.Cleanup(func() { globalConfig = saved })
+    router, err := NewRiskAwareRouter(fixtureNetwork, &CrimeData{}, RouterOptions{})
+    if err != nil {
+        t.Fatalf("loading fixture network: %v", err)
+    }
+    tenant := &Tenant{ID: defaultTenantID, Alphas: globalConfig.DefaultAlphas}
+    tenant.router.Store(router)
+    return tenant
+}
+
+// tenantRequest is a request made as tenant, as withTenant would pass it
+// on.
+func tenantRequest(tenant *Tenant, method, target, body string) *http.Request {
+    r := httptest.NewRequest(method, target, strings.NewReader(body))
+    return r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant))
+}
+
+func runGoldenCase(router *RiskAwareRouter, c goldenCase) goldenResult {
+    routes, err := router.calculateRoutes(context.Background(), c.Start, c.End, c.Alphas)
+    if err != nil {
+        return goldenResult{Error: err.Error()}
+    }
+    return goldenResult{Routes: routes}
+}
+
+func compareGolden(t *testing.T, want, got goldenResult) {
+    t.Helper()
+    if want.Error != got.Error {
+        t.Fatalf("error = %q, want %q", got.Error, want.Error)
+    }
+    if len(want.Routes) != len(got.Routes) {
+        t.Fatalf("got %d routes, want %d", len(got.Routes), len(want.Routes))
+    }
+    for i, w := range want.Routes {
+        g := got.Routes[i]
+        if g.Alpha != w.Alpha {
+            t.Errorf("route %d: alpha = %v, want %v", i, g.Alpha, w.Alpha)
+            continue
+        }
+        if !closeEnough(g.Distance, w.Distance) {
+            t.Errorf("alpha %.2f: distance = %.12f, want %.12f", w.Alpha, g.Distance, w.Distance)
+        }
+        if !closeEnough(g.Risk, w.Risk) {
+            t.Errorf("alpha %.2f: risk = %.12f, want %.12f", w.Alpha, g.Risk, w.Risk)
+        }
+        if len(g.Path) != len(w.Path) {
+            t.Errorf("alpha %.2f: path has %d points, want %d", w.Alpha, len(g.Path), len(w.Path))
+            continue
+        }
+        for j := range w.Path {
+            if !closeEnough(g.Path[j].X, w.Path[j].X) || !closeEnough(g.Path[j].Y, w.Path[j].Y) {
+                t.Errorf("alpha %.2f: path[%d] = %v, want %v", w.Alpha, j, g.Path[j], w.Path[j])
+                break
+            }
+        }
+    }
+}
+
+func closeEnough(a, b float64) bool {
+    return math.Abs(a-b) <= goldenTolerance*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+)
+
+// Ways to merge two segments with the same ends, selected by the
+// duplicate_edges config: keep the one with the lower risk, the shorter
+// one, or the one loaded last; or keep both as parallel edges, such as a
+// lit footpath and a dark alley, for searches to choose between.
+const (
+    duplicateMinRisk     = "min_risk"
+    duplicateMinDistance = "min_distance"
+    duplicateLast        = "last"
+    duplicateParallel    = "parallel"
+)
+
+func checkDuplicatePolicy(policy string) error {
+    switch policy {
+    case duplicateMinRisk, duplicateMinDistance, duplicateLast, duplicateParallel:
+        return nil
+    }
+    return fmt.Errorf("duplicate_edges must be %q, %q, %q or %q, got %q", duplicateMinRisk, duplicateMinDistance, duplicateLast, duplicateParallel, policy)
+}
+
+// replacesDuplicate reports whether a segment of distance and risk
+// replaces old, which has the same ends, under policy.
+func replacesDuplicate(policy string, old Edge, distance, risk float64) bool {
+    switch policy {
+    case duplicateMinDistance:
+        return distance < old.Distance
+    case duplicateLast:
+        return true
+    default:
+        return risk < old.RiskScore
+    }
+}
+
+// index freezes the graph built up by AddEdge into its searchable form:
+// node IDs ordered by (X, Y), a CSR adjacency whose neighbor lists are
+// sorted by target ID, and the spatial indexes. The builder map is released
+// afterwards. It must be called once loading is finished and before the
+// graph is searched.
+func (g *Graph) index() {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    g.Nodes = make([]Point, 0, len(g.Edges))
+    for p := range g.Edges {
+        g.Nodes = append(g.Nodes, p)
+    }
+    sort.Slice(g.Nodes, func(i, j int) bool { return pointLess(g.Nodes[i], g.Nodes[j]) })
+
+    nodeIDs := make(map[Point]int32, len(g.Nodes))
+    for id, p := range g.Nodes {
+        nodeIDs[p] = int32(id)
+    }
+
+    names := newNameTable()
+    g.offsets = make([]int32, 0, len(g.Nodes)+1)
+    for _, p := range g.Nodes {
+        g.offsets = append(g.offsets, int32(len(g.targets)))
+        neighbors := make([]Edge, 0, len(g.Edges[p]))
+        for _, edges := range g.Edges[p] {
+            neighbors = append(neighbors, edges...)
+        }
+        // Parallel edges keep the order they were added in, which is the
+        // same in both directions; twin relies on it.
+        sort.SliceStable(neighbors, func(i, j int) bool {
+            return nodeIDs[neighbors[i].End] < nodeIDs[neighbors[j].End]
+        })
+        for _, edge := range neighbors {
+            g.targets = append(g.targets, nodeIDs[edge.End])
+            g.dist = append(g.dist, edge.Distance)
+            g.risk = append(g.risk, edge.RiskScore)
+            g.nameIdx = append(g.nameIdx, names.intern(edge.Name))
+            if g.layers > 0 {
+                g.layer = append(g.layer, edge.Layer)
+            }
+        }
+    }
+    g.offsets = append(g.offsets, int32(len(g.targets)))
+    g.nameOff, g.nameData = names.offsets, names.data
+    g.Edges = nil
+
+    g.DataBounds = boundsOf(g.Nodes)
+    g.buildSpatialIndexes()
+    g.computeVersions()
+}
+
+func (g *Graph) buildSpatialIndexes() {
+    nodes := newSpatialBuilder()
+    segments := newSpatialBuilder()
+    for id, p := range g.Nodes {
+        nodes.insertPoint(int32(id), p)
+        lo, hi := g.edgeRange(int32(id))
+        for e := lo; e < hi; e++ {
+            // Each road segment is indexed once, from its lower-ID end.
+            if g.targets[e] > int32(id) {
+                segments.insertBox(e, boundsOf([]Point{p, g.Nodes[g.targets[e]]}))
+            }
+        }
+    }
+    g.nodeIndex = nodes.build()
+    g.segmentIndex = segments.build()
+}
+
+func pointLess(a, b Point) bool {
+    if a.X != b.X {
+        return a.X < b.X
+    }
+    return a.Y < b.Y
+}
+
+// edgeRange returns the IDs [lo, hi) of the edges leaving node n.
+func (g *Graph) edgeRange(n int32) (lo, hi int32) {
+    return g.offsets[n], g.offsets[n+1]
+}
+
+func (g *Graph) degree(n int32) int {
+    lo, hi := g.edgeRange(n)
+    return int(hi - lo)
+}
+
+// labelComponents numbers the connected components of the graph. Every
+// segment is stored in both directions, so one flood fill per unlabelled
+// node finds them.
+func (g *Graph) labelComponents() {
+    g.component = make([]int32, len(g.Nodes))
+    for i := range g.component {
+        g.component[i] = -1
+    }
+    var next int32
+    var stack []int32
+    for n := range g.Nodes {
+        if g.component[n] >= 0 {
+            continue
+        }
+        g.component[n] = next
+        stack = append(stack[:0], int32(n))
+        for len(stack) > 0 {
+            cur := stack[len(stack)-1]
+            stack = stack[:len(stack)-1]
+            lo, hi := g.edgeRange(cur)
+            for e := lo; e < hi; e++ {
+                if t := g.targets[e]; g.component[t] < 0 {
+                    g.component[t] = next
+                    stack = append(stack, t)
+                }
+            }
+        }
+        next++
+    }
+}
+
+// connected reports whether a path joins nodes a and b.
+func (g *Graph) connected(a, b int32) bool {
+    return g.component == nil || g.component[a] == g.component[b]
+}
+
+// source returns the node edge e leaves from.
+func (g *Graph) source(e int32) int32 {
+    return int32(sort.Search(len(g.Nodes), func(n int) bool { return g.offsets[n+1] > e }))
+}
+
+func (g *Graph) name(e int32) string {
+    i := g.nameIdx[e]
+    return string(g.nameData[g.nameOff[i]:g.nameOff[i+1]])
+}
+
+// edge materializes edge e leaving node from.
+func (g *Graph) edge(from, e int32) Edge {
+    return Edge{
+        Start:     g.Nodes[from],
+        End:       g.Nodes[g.targets[e]],
+        Distance:  g.dist[e],
+        RiskScore: g.risk[e],
+        Name:      g.name(e),
+    }
+}
+
+// nameTable interns street names into one byte blob addressed by offsets.
+type nameTable struct {
+    ids     map[string]int32
+    offsets []uint32
+    data    []byte
+}
+
+func newNameTable() *nameTable {
+    return &nameTable{ids: make(map[string]int32), offsets: []uint32{0}}
+}
+
+func (t *nameTable) intern(name string) int32 {
+    if id, ok := t.ids[name]; ok {
+        return id
+    }
+    id := int32(len(t.offsets) - 1)
+    t.ids[name] = id
+    t.data = append(t.data, name...)
+    t.offsets = append(t.offsets, uint32(len(t.data)))
+    return id
+}
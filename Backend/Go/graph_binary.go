@@ -0,0 +1,241 @@
+package main
+
+import (
+    "bufio"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "math"
+    "os"
+    "unsafe"
+)
+
+// Binary graph format, version 1. All integers and floats are
+// little-endian. A fixed 256-byte header is followed by the graph's flat
+// arrays, each starting on an 8-byte boundary so that a memory-mapped file
+// can be used in place without copying:
+//
+//	nodes           nodeCount  x {X, Y float64}
+//	offsets         nodeCount+1 x int32
+//	targets         edgeCount  x int32
+//	dist            edgeCount  x float64
+//	risk            edgeCount  x float64
+//	nameIdx         edgeCount  x int32
+//	nameOff         nameCount+1 x uint32
+//	nameData        nameBytes  x byte
+//	node index      keys (uint64), starts (int32), items (int32)
+//	segment index   keys (uint64), starts (int32), items (int32)
+const (
+    graphMagic         = "PICTGRF1"
+    graphHeaderSize    = 256
+    graphFormatVersion = 1
+)
+
+type graphHeader struct {
+    Magic         [8]byte
+    FormatVersion uint32
+    _             uint32
+    NodeCount     uint64
+    EdgeCount     uint64
+    NameCount     uint64
+    NameBytes     uint64
+    MaxDist       float64
+    Bounds        [4]float64
+    Version       [16]byte
+    RiskVersion   [16]byte
+    NodeIndex     indexHeader
+    SegmentIndex  indexHeader
+}
+
+type indexHeader struct {
+    Keys   uint64
+    Items  uint64
+    Extent [4]int64
+}
+
+// WriteBinary stores an indexed graph in the binary format.
+func (g *Graph) WriteBinary(w io.Writer) error {
+    h := graphHeader{
+        FormatVersion: graphFormatVersion,
+        NodeCount:     uint64(len(g.Nodes)),
+        EdgeCount:     uint64(len(g.targets)),
+        NameCount:     uint64(len(g.nameOff) - 1),
+        NameBytes:     uint64(len(g.nameData)),
+        MaxDist:       g.maxDist,
+        Bounds:        [4]float64{g.DataBounds.MinX, g.DataBounds.MinY, g.DataBounds.MaxX, g.DataBounds.MaxY},
+        NodeIndex:     indexHeader{uint64(len(g.nodeIndex.keys)), uint64(len(g.nodeIndex.items)), g.nodeIndex.extent},
+        SegmentIndex:  indexHeader{uint64(len(g.segmentIndex.keys)), uint64(len(g.segmentIndex.items)), g.segmentIndex.extent},
+    }
+    copy(h.Magic[:], graphMagic)
+    copy(h.Version[:], g.Version)
+    copy(h.RiskVersion[:], g.RiskVersion)
+
+    bw := bufio.NewWriter(w)
+    sw := &sectionWriter{w: bw}
+    sw.write(h)
+    sw.pad(graphHeaderSize)
+    for _, section := range []interface{}{
+        g.Nodes, g.offsets, g.targets, g.dist, g.risk, g.nameIdx, g.nameOff, g.nameData,
+        g.nodeIndex.keys, g.nodeIndex.starts, g.nodeIndex.items,
+        g.segmentIndex.keys, g.segmentIndex.starts, g.segmentIndex.items,
+    } {
+        sw.write(section)
+        sw.pad(8)
+    }
+    if sw.err != nil {
+        return sw.err
+    }
+    return bw.Flush()
+}
+
+type sectionWriter struct {
+    w   io.Writer
+    n   int64
+    err error
+}
+
+func (sw *sectionWriter) write(v interface{}) {
+    if sw.err != nil {
+        return
+    }
+    sw.err = binary.Write(sw.w, binary.LittleEndian, v)
+    sw.n += int64(binary.Size(v))
+}
+
+// pad writes zero bytes up to the next multiple of align.
+func (sw *sectionWriter) pad(align int64) {
+    if sw.err != nil || sw.n%align == 0 {
+        return
+    }
+    n := align - sw.n%align
+    _, sw.err = sw.w.Write(make([]byte, n))
+    sw.n += n
+}
+
+// loadGraphBinary maps a binary graph file into memory. The arrays are used
+// in place, so processes serving the same file share its pages and startup
+// cost does not grow with the graph. With preload set, every page is faulted
+// in up front so the first requests don't pay for disk reads.
+func loadGraphBinary(path string, preload bool) (*Graph, error) {
+    if !hostIsLittleEndian() {
+        return nil, fmt.Errorf("binary graphs require a little-endian host")
+    }
+    data, err := mapFile(path)
+    if err != nil {
+        return nil, err
+    }
+    g, err := decodeGraph(data)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    if preload {
+        preloadMapping(data)
+    }
+    return g, nil
+}
+
+func decodeGraph(data []byte) (*Graph, error) {
+    if len(data) < graphHeaderSize || string(data[:8]) != graphMagic {
+        return nil, fmt.Errorf("not a binary graph file")
+    }
+    var h graphHeader
+    if _, err := binary.Decode(data, binary.LittleEndian, &h); err != nil {
+        return nil, err
+    }
+    if h.FormatVersion != graphFormatVersion {
+        return nil, fmt.Errorf("unsupported graph format version %d", h.FormatVersion)
+    }
+
+    r := &sectionReader{data: data, off: graphHeaderSize}
+    g := &Graph{
+        maxDist:     h.MaxDist,
+        DataBounds:  Bounds{MinX: h.Bounds[0], MinY: h.Bounds[1], MaxX: h.Bounds[2], MaxY: h.Bounds[3]},
+        Version:     cString(h.Version[:]),
+        RiskVersion: cString(h.RiskVersion[:]),
+        mapping:     data,
+    }
+    g.Nodes = section[Point](r, h.NodeCount)
+    g.offsets = section[int32](r, h.NodeCount+1)
+    g.targets = section[int32](r, h.EdgeCount)
+    g.dist = section[float64](r, h.EdgeCount)
+    g.risk = section[float64](r, h.EdgeCount)
+    g.nameIdx = section[int32](r, h.EdgeCount)
+    g.nameOff = section[uint32](r, h.NameCount+1)
+    g.nameData = section[byte](r, h.NameBytes)
+    g.nodeIndex = readIndex(r, h.NodeIndex)
+    g.segmentIndex = readIndex(r, h.SegmentIndex)
+    if r.err != nil {
+        return nil, r.err
+    }
+    if len(g.offsets) > 0 && int(g.offsets[len(g.offsets)-1]) != len(g.targets) {
+        return nil, fmt.Errorf("corrupt adjacency offsets")
+    }
+    return g, nil
+}
+
+func readIndex(r *sectionReader, h indexHeader) *spatialIndex {
+    return &spatialIndex{
+        keys:   section[uint64](r, h.Keys),
+        starts: section[int32](r, h.Keys+1),
+        items:  section[int32](r, h.Items),
+        extent: h.Extent,
+    }
+}
+
+type sectionReader struct {
+    data []byte
+    off  uint64
+    err  error
+}
+
+// section returns the next n elements of type T as a slice aliasing the
+// underlying buffer, then advances to the next 8-byte boundary.
+func section[T any](r *sectionReader, n uint64) []T {
+    if r.err != nil {
+        return nil
+    }
+    var zero T
+    size := n * uint64(unsafe.Sizeof(zero))
+    if r.off+size > uint64(len(r.data)) || size/uint64(max(1, unsafe.Sizeof(zero))) != n {
+        r.err = fmt.Errorf("truncated graph file")
+        return nil
+    }
+    var s []T
+    if n > 0 {
+        s = unsafe.Slice((*T)(unsafe.Pointer(&r.data[r.off])), n)
+    }
+    r.off += (size + 7) &^ 7
+    return s
+}
+
+func cString(b []byte) string {
+    for i, c := range b {
+        if c == 0 {
+            return string(b[:i])
+        }
+    }
+    return string(b)
+}
+
+func hostIsLittleEndian() bool {
+    x := uint16(1)
+    return *(*byte)(unsafe.Pointer(&x)) == 1
+}
+
+// preloadMapping touches one byte per page so the whole file is resident.
+func preloadMapping(data []byte) {
+    var sink byte
+    for i := 0; i < len(data); i += os.Getpagesize() {
+        sink ^= data[i]
+    }
+    _ = sink
+    _ = math.MaxInt
+}
+
+// Close releases the file mapping behind a graph loaded with
+// loadGraphBinary. The graph must not be used afterwards.
+func (g *Graph) Close() error {
+    data := g.mapping
+    g.mapping = nil
+    return unmapFile(data)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+    "context"
+    "testing"
+)
+
+// The load benchmarks compare startup paths: parsing GeoJSON, mapping the
+// binary graph and touching pages lazily on the first route (cold), and
+// mapping it with every page preloaded.
+
+func BenchmarkLoadGeoJSON(b *testing.B) {
+    for i := 0; i < b.N; i++ {
+        if _, err := NewRiskAwareRouter(fixtureNetwork, &CrimeData{}, RouterOptions{}); err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+func BenchmarkLoadBinaryColdRoute(b *testing.B) {
+    benchmarkBinaryFirstRoute(b, false)
+}
+
+func BenchmarkLoadBinaryPreloadedRoute(b *testing.B) {
+    benchmarkBinaryFirstRoute(b, true)
+}
+
+func benchmarkBinaryFirstRoute(b *testing.B, preload bool) {
+    path := writeFixtureBinary(b)
+    start := Point{X: -87.66, Y: 41.87}
+    end := Point{X: -87.645, Y: 41.88277}
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        router, err := NewRiskAwareRouter(path, &CrimeData{}, RouterOptions{Preload: preload})
+        if err != nil {
+            b.Fatal(err)
+        }
+        if _, _, _, err := router.FindRoute(context.Background(), start, end, 0.5); err != nil {
+            b.Fatal(err)
+        }
+        router.G.Close()
+    }
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "net/http"
+    "sort"
+
+    "risk-router/geo"
+)
+
+// maxDiffExamples caps the segments each list of a graph diff names.
+const maxDiffExamples = 10
+
+// riskDeltaBuckets bound the histogram of risk changes between graphs;
+// the middle bucket holds the segments whose risk barely moved.
+var riskDeltaBuckets = []float64{-1, -0.5, -0.25, -0.1, -0.01, 0.01, 0.1, 0.25, 0.5, 1}
+
+// graphDiff compares two versions of a road network. Segments are matched
+// by their end coordinates, so a segment that moved counts as removed and
+// added; risk is the base score each graph was built with.
+type graphDiff struct {
+    Old          graphSummary     `json:"old"`
+    New          graphSummary     `json:"new"`
+    Segments     segmentDiff      `json:"segments"`
+    Risk         riskDiff         `json:"risk"`
+    Connectivity connectivityDiff `json:"connectivity"`
+}
+
+type graphSummary struct {
+    GraphVersion     string  `json:"graph_version"`
+    RiskVersion      string  `json:"risk_version"`
+    Nodes            int     `json:"nodes"`
+    Segments         int     `json:"segments"`
+    LengthKm         float64 `json:"length_km"`
+    Components       int     `json:"components"`
+    LargestComponent int     `json:"largest_component_nodes"`
+}
+
+type segmentDiff struct {
+    Added           int          `json:"added"`
+    Removed         int          `json:"removed"`
+    Common          int          `json:"common"`
+    Renamed         int          `json:"renamed"`
+    AddedKm         float64      `json:"added_km"`
+    RemovedKm       float64      `json:"removed_km"`
+    AddedExamples   []segmentRef `json:"added_examples,omitempty"`
+    RemovedExamples []segmentRef `json:"removed_examples,omitempty"`
+}
+
+// segmentRef names a segment in a diff.
+type segmentRef struct {
+    Name       string   `json:"name,omitempty"`
+    From       Point    `json:"from"`
+    To         Point    `json:"to"`
+    RiskBefore *float64 `json:"risk_before,omitempty"`
+    RiskAfter  *float64 `json:"risk_after,omitempty"`
+}
+
+type riskDiff struct {
+    Changed        int                `json:"changed"`
+    Increased      int                `json:"increased"`
+    Decreased      int                `json:"decreased"`
+    MeanDelta      float64            `json:"mean_delta"`
+    MeanAbsDelta   float64            `json:"mean_abs_delta"`
+    Percentiles    map[string]float64 `json:"percentiles"`
+    Histogram      []riskBucket       `json:"histogram"`
+    LargestChanges []segmentRef       `json:"largest_changes,omitempty"`
+}
+
+// riskBucket counts the common segments whose risk changed by at least
+// Min and less than Max; the outer buckets also take what lies beyond.
+type riskBucket struct {
+    Min   float64 `json:"min"`
+    Max   float64 `json:"max"`
+    Count int     `json:"count"`
+}
+
+// connectivityDiff follows the nodes both graphs share: Disconnected were
+// in the old graph's largest component but are not in the new one's, and
+// Connected the other way round.
+type connectivityDiff struct {
+    SharedNodes  int `json:"shared_nodes"`
+    Disconnected int `json:"disconnected"`
+    Connected    int `json:"connected"`
+}
+
+type segmentKey [2]Point
+
+// segmentsOf returns the segments of g by key, as their canonical edges.
+func segmentsOf(g *Graph) map[segmentKey]int32 {
+    segs := make(map[segmentKey]int32, len(g.targets)/2)
+    g.eachSegment(func(from, e int32) error {
+        segs[segmentKey{g.Nodes[from], g.Nodes[g.targets[e]]}] = e
+        return nil
+    })
+    return segs
+}
+
+// largestComponent returns the ID and node count of g's largest component,
+// and how many components it has.
+func largestComponent(g *Graph) (int32, int, int) {
+    if g.component == nil {
+        g.labelComponents()
+    }
+    sizes := make(map[int32]int)
+    for _, c := range g.component {
+        sizes[c]++
+    }
+    largest, size := int32(-1), 0
+    for c, n := range sizes {
+        if n > size || n == size && c < largest {
+            largest, size = c, n
+        }
+    }
+    return largest, size, len(sizes)
+}
+
+func summarizeGraph(g *Graph, segs map[segmentKey]int32) graphSummary {
+    _, largest, components := largestComponent(g)
+    length := 0.0
+    for key := range segs {
+        length += geo.Haversine(key[0], key[1])
+    }
+    return graphSummary{
+        GraphVersion:     g.Version,
+        RiskVersion:      g.RiskVersion,
+        Nodes:            len(g.Nodes),
+        Segments:         len(segs),
+        LengthKm:         length / 1000,
+        Components:       components,
+        LargestComponent: largest,
+    }
+}
+
+// diffGraphs compares older with newer.
+func diffGraphs(older, newer *Graph) graphDiff {
+    oldSegs, newSegs := segmentsOf(older), segmentsOf(newer)
+    d := graphDiff{Old: summarizeGraph(older, oldSegs), New: summarizeGraph(newer, newSegs)}
+
+    var deltas []float64
+    var changes []segmentRef
+    for key, oe := range oldSegs {
+        ne, ok := newSegs[key]
+        if !ok {
+            d.Segments.Removed++
+            d.Segments.RemovedKm += geo.Haversine(key[0], key[1]) / 1000
+            d.Segments.RemovedExamples = append(d.Segments.RemovedExamples, segmentRef{Name: older.name(oe), From: key[0], To: key[1]})
+            continue
+        }
+        d.Segments.Common++
+        if older.name(oe) != newer.name(ne) {
+            d.Segments.Renamed++
+        }
+        before, after := older.risk[oe], newer.risk[ne]
+        delta := after - before
+        deltas = append(deltas, delta)
+        if delta != 0 {
+            changes = append(changes, segmentRef{Name: newer.name(ne), From: key[0], To: key[1], RiskBefore: &before, RiskAfter: &after})
+        }
+    }
+    for key, ne := range newSegs {
+        if _, ok := oldSegs[key]; !ok {
+            d.Segments.Added++
+            d.Segments.AddedKm += geo.Haversine(key[0], key[1]) / 1000
+            d.Segments.AddedExamples = append(d.Segments.AddedExamples, segmentRef{Name: newer.name(ne), From: key[0], To: key[1]})
+        }
+    }
+    d.Segments.AddedExamples = firstSegments(d.Segments.AddedExamples)
+    d.Segments.RemovedExamples = firstSegments(d.Segments.RemovedExamples)
+    d.Risk = summarizeRiskDeltas(deltas, changes)
+    d.Connectivity = diffConnectivity(older, newer)
+    return d
+}
+
+// firstSegments orders refs by position and keeps the first few, so a
+// diff reads the same every time.
+func firstSegments(refs []segmentRef) []segmentRef {
+    sort.Slice(refs, func(i, j int) bool {
+        if refs[i].From != refs[j].From {
+            return pointLess(refs[i].From, refs[j].From)
+        }
+        return pointLess(refs[i].To, refs[j].To)
+    })
+    return refs[:min(len(refs), maxDiffExamples)]
+}
+
+func summarizeRiskDeltas(deltas []float64, changes []segmentRef) riskDiff {
+    rd := riskDiff{Changed: len(changes), Percentiles: map[string]float64{}}
+    for i := 0; i+1 < len(riskDeltaBuckets); i++ {
+        rd.Histogram = append(rd.Histogram, riskBucket{Min: riskDeltaBuckets[i], Max: riskDeltaBuckets[i+1]})
+    }
+    if len(deltas) == 0 {
+        return rd
+    }
+    sum, abs := 0.0, 0.0
+    for _, delta := range deltas {
+        sum += delta
+        abs += math.Abs(delta)
+        switch {
+        case delta > 0:
+            rd.Increased++
+        case delta < 0:
+            rd.Decreased++
+        }
+        i := sort.SearchFloat64s(riskDeltaBuckets[1:len(riskDeltaBuckets)-1], delta)
+        if i < len(riskDeltaBuckets)-2 && riskDeltaBuckets[i+1] == delta {
+            i++
+        }
+        rd.Histogram[i].Count++
+    }
+    rd.MeanDelta = sum / float64(len(deltas))
+    rd.MeanAbsDelta = abs / float64(len(deltas))
+    sorted := append([]float64(nil), deltas...)
+    sort.Float64s(sorted)
+    for _, p := range []int{0, 5, 25, 50, 75, 95, 100} {
+        rd.Percentiles[fmt.Sprintf("p%d", p)] = sorted[(len(sorted)-1)*p/100]
+    }
+
+    sort.Slice(changes, func(i, j int) bool {
+        di := math.Abs(*changes[i].RiskAfter - *changes[i].RiskBefore)
+        dj := math.Abs(*changes[j].RiskAfter - *changes[j].RiskBefore)
+        if di != dj {
+            return di > dj
+        }
+        return pointLess(changes[i].From, changes[j].From)
+    })
+    rd.LargestChanges = changes[:min(len(changes), maxDiffExamples)]
+    return rd
+}
+
+func diffConnectivity(older, newer *Graph) connectivityDiff {
+    oldLargest, _, _ := largestComponent(older)
+    newLargest, _, _ := largestComponent(newer)
+    var cd connectivityDiff
+    for n, p := range older.Nodes {
+        m, ok := newer.nodeAt(p)
+        if !ok {
+            continue
+        }
+        cd.SharedNodes++
+        wasIn, isIn := older.component[n] == oldLargest, newer.component[m] == newLargest
+        switch {
+        case wasIn && !isIn:
+            cd.Disconnected++
+        case !wasIn && isIn:
+            cd.Connected++
+        }
+    }
+    return cd
+}
+
+// writeText prints the diff for a person to read.
+func (d graphDiff) writeText(w io.Writer) {
+    fmt.Fprintf(w, "old: graph %s, risk %s: %d nodes, %d segments, %.1f km, %d components (largest %d nodes)\n",
+        d.Old.GraphVersion, d.Old.RiskVersion, d.Old.Nodes, d.Old.Segments, d.Old.LengthKm, d.Old.Components, d.Old.LargestComponent)
+    fmt.Fprintf(w, "new: graph %s, risk %s: %d nodes, %d segments, %.1f km, %d components (largest %d nodes)\n",
+        d.New.GraphVersion, d.New.RiskVersion, d.New.Nodes, d.New.Segments, d.New.LengthKm, d.New.Components, d.New.LargestComponent)
+    s := d.Segments
+    fmt.Fprintf(w, "segments: %d added (%.1f km), %d removed (%.1f km), %d common, %d renamed\n",
+        s.Added, s.AddedKm, s.Removed, s.RemovedKm, s.Common, s.Renamed)
+    for _, ref := range s.AddedExamples {
+        fmt.Fprintf(w, "  + %s\n", ref)
+    }
+    for _, ref := range s.RemovedExamples {
+        fmt.Fprintf(w, "  - %s\n", ref)
+    }
+    r := d.Risk
+    fmt.Fprintf(w, "risk: %d of %d common segments changed (%d up, %d down), mean %+.4f, mean |change| %.4f\n",
+        r.Changed, s.Common, r.Increased, r.Decreased, r.MeanDelta, r.MeanAbsDelta)
+    if s.Common > 0 {
+        fmt.Fprintf(w, "  percentiles: p5 %+.4f, p25 %+.4f, p50 %+.4f, p75 %+.4f, p95 %+.4f\n",
+            r.Percentiles["p5"], r.Percentiles["p25"], r.Percentiles["p50"], r.Percentiles["p75"], r.Percentiles["p95"])
+        for _, b := range r.Histogram {
+            fmt.Fprintf(w, "  [%+.2f, %+.2f) %d\n", b.Min, b.Max, b.Count)
+        }
+    }
+    for _, ref := range r.LargestChanges {
+        fmt.Fprintf(w, "  ~ %s: %.4f -> %.4f\n", ref, *ref.RiskBefore, *ref.RiskAfter)
+    }
+    c := d.Connectivity
+    fmt.Fprintf(w, "connectivity: %d shared nodes, %d left the largest component, %d joined it\n",
+        c.SharedNodes, c.Disconnected, c.Connected)
+}
+
+func (ref segmentRef) String() string {
+    name := ref.Name
+    if name == "" {
+        name = "(unnamed)"
+    }
+    return fmt.Sprintf("%s (%.6f,%.6f)-(%.6f,%.6f)", name, ref.From.X, ref.From.Y, ref.To.X, ref.To.Y)
+}
+
+// handleAdminGraphDiff serves POST /admin/graph/diff, comparing a tenant's
+// loaded road network with the candidate in the body: a binary graph, or a
+// GeoJSON road network clipped to the configured load bounds.
+func handleAdminGraphDiff(w http.ResponseWriter, r *http.Request) {
+    tenant, err := tenantByID(r.URL.Query().Get("tenant"))
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    data, err := io.ReadAll(r.Body)
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    var candidate *Graph
+    if bytes.HasPrefix(data, []byte(graphMagic)) {
+        candidate, err = decodeGraph(data)
+    } else {
+        candidate = NewGraph()
+        candidate.duplicatePolicy = globalConfig.DuplicateEdges
+        candidate.sourceCRS = globalConfig.RoadNetworkCRS
+        candidate.memoryBudget = globalConfig.graphMemoryBudget()
+        opts := RouterOptions{BoundsMode: globalConfig.GraphBounds, LoadBounds: globalConfig.LoadBounds}
+        if err = addRoadNetwork(data, "candidate graph", candidate, opts.loadClip()); err == nil {
+            candidate.index()
+        }
+    }
+    if err == nil && len(candidate.Nodes) == 0 {
+        err = fmt.Errorf("no road segments in the candidate graph")
+    }
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(diffGraphs(tenant.Router().G, candidate)); err != nil {
+        log.Printf("Failed to encode graph diff: %v", err)
+    }
+}
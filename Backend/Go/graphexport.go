@@ -0,0 +1,179 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "sort"
+)
+
+// graphExportFormats are the formats the loaded graph can be exported to,
+// by name, with their content type and file extension.
+var graphExportFormats = map[string]struct {
+    contentType string
+    ext         string
+    write       func(io.Writer, *Graph, *riskLayer) error
+}{
+    "geojson": {"application/geo+json", "geojson", writeGraphGeoJSON},
+    "graphml": {"application/graphml+xml", "graphml", writeGraphML},
+}
+
+func graphExportFormatNames() []string {
+    names := make([]string, 0, len(graphExportFormats))
+    for name := range graphExportFormats {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// eachSegment calls fn with every road segment once, as its edge leaving
+// the lower-ID end, in edge ID order.
+func (g *Graph) eachSegment(fn func(from, e int32) error) error {
+    for n := range g.Nodes {
+        lo, hi := g.edgeRange(int32(n))
+        for e := lo; e < hi; e++ {
+            if int32(n) < g.targets[e] {
+                if err := fn(int32(n), e); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    return nil
+}
+
+// writeGraphGeoJSON writes g as a FeatureCollection with one LineString
+// per road segment. Properties use the names the loader reads (name,
+// risk_score, with risk from layer), so the export loads back into the
+// same graph; base_risk is the score the graph was built with.
+func writeGraphGeoJSON(w io.Writer, g *Graph, layer *riskLayer) error {
+    bw := bufio.NewWriter(w)
+    header, err := json.Marshal(map[string]interface{}{
+        "graph_version": g.Version,
+        "risk_version":  layer.Version,
+        "nodes":         len(g.Nodes),
+        "segments":      len(g.targets) / 2,
+    })
+    if err != nil {
+        return err
+    }
+    fmt.Fprintf(bw, `{"type":"FeatureCollection","metadata":%s,"features":[`, header)
+    first := true
+    err = g.eachSegment(func(from, e int32) error {
+        to := g.targets[e]
+        feature, err := json.Marshal(map[string]interface{}{
+            "type": "Feature",
+            "id":   e,
+            "properties": map[string]interface{}{
+                "name":       g.name(e),
+                "risk_score": layer.risk[e],
+                "base_risk":  g.risk[e],
+                "distance_m": g.dist[e],
+                "from":       from,
+                "to":         to,
+            },
+            "geometry": map[string]interface{}{
+                "type": "LineString",
+                "coordinates": [][2]float64{
+                    {g.Nodes[from].X, g.Nodes[from].Y},
+                    {g.Nodes[to].X, g.Nodes[to].Y},
+                },
+            },
+        })
+        if err != nil {
+            return err
+        }
+        if !first {
+            bw.WriteByte(',')
+        }
+        first = false
+        bw.WriteByte('\n')
+        _, err = bw.Write(feature)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    bw.WriteString("\n]}\n")
+    return bw.Flush()
+}
+
+// writeGraphML writes g as an undirected GraphML graph, which NetworkX
+// reads with read_graphml: nodes carry x and y, edges name, distance_m,
+// risk_score and base_risk.
+func writeGraphML(w io.Writer, g *Graph, layer *riskLayer) error {
+    bw := bufio.NewWriter(w)
+    bw.WriteString(xml.Header)
+    bw.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+    for _, key := range []struct{ id, target, name, kind string }{
+        {"x", "node", "x", "double"},
+        {"y", "node", "y", "double"},
+        {"name", "edge", "name", "string"},
+        {"distance_m", "edge", "distance_m", "double"},
+        {"risk_score", "edge", "risk_score", "double"},
+        {"base_risk", "edge", "base_risk", "double"},
+        {"graph_version", "graph", "graph_version", "string"},
+        {"risk_version", "graph", "risk_version", "string"},
+    } {
+        fmt.Fprintf(bw, "  <key id=%q for=%q attr.name=%q attr.type=%q/>\n", key.id, key.target, key.name, key.kind)
+    }
+    bw.WriteString(`  <graph id="roads" edgedefault="undirected">` + "\n")
+    fmt.Fprintf(bw, "    <data key=\"graph_version\">%s</data>\n", g.Version)
+    fmt.Fprintf(bw, "    <data key=\"risk_version\">%s</data>\n", layer.Version)
+    for n, p := range g.Nodes {
+        fmt.Fprintf(bw, "    <node id=\"n%d\"><data key=\"x\">%v</data><data key=\"y\">%v</data></node>\n", n, p.X, p.Y)
+    }
+    err := g.eachSegment(func(from, e int32) error {
+        fmt.Fprintf(bw, "    <edge id=\"e%d\" source=\"n%d\" target=\"n%d\"><data key=\"name\">", e, from, g.targets[e])
+        if err := xml.EscapeText(bw, []byte(g.name(e))); err != nil {
+            return err
+        }
+        _, err := fmt.Fprintf(bw, "</data><data key=\"distance_m\">%v</data><data key=\"risk_score\">%v</data><data key=\"base_risk\">%v</data></edge>\n",
+            g.dist[e], layer.risk[e], g.risk[e])
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    bw.WriteString("  </graph>\n</graphml>\n")
+    return bw.Flush()
+}
+
+// handleAdminGraphExport serves GET /admin/graph/export?format=geojson|graphml,
+// a tenant's loaded road network with the risk of the current layer, or of
+// ?risk_version=, as a download.
+func handleAdminGraphExport(w http.ResponseWriter, r *http.Request) {
+    tenant, err := tenantByID(r.URL.Query().Get("tenant"))
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    name := r.URL.Query().Get("format")
+    if name == "" {
+        name = "geojson"
+    }
+    format, ok := graphExportFormats[name]
+    if !ok {
+        writeBadRequest(w, fmt.Sprintf("unknown format %q (available: %v)", name, graphExportFormatNames()))
+        return
+    }
+    router := tenant.Router()
+    layer := router.layers.current()
+    if v := r.URL.Query().Get("risk_version"); v != "" {
+        if layer, ok = router.layers.get(v); !ok {
+            writeAPIError(w, http.StatusNotFound, APIError{Code: "not_found", Message: "unknown risk version " + v})
+            return
+        }
+    }
+
+    w.Header().Set("Content-Type", format.contentType)
+    w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="graph-%s-%s.%s"`, router.G.Version, layer.Version, format.ext))
+    if err := format.write(w, router.G, layer); err != nil {
+        log.Printf("Failed to export graph: %v", err)
+    }
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "encoding/json"
+    "math"
+    "runtime"
+    "sync"
+    "sync/atomic"
+)
+
+// loadChunkSize is how many GeoJSON features a loader worker takes at a
+// time.
+const loadChunkSize = 1024
+
+// eachChunk calls fn with consecutive ranges [lo, hi) covering n items,
+// at most loadChunkSize long, from GOMAXPROCS workers, and returns once
+// every range is done.
+func eachChunk(n int, fn func(chunk, lo, hi int)) {
+    chunks := (n + loadChunkSize - 1) / loadChunkSize
+    workers := min(runtime.GOMAXPROCS(0), chunks)
+    var next atomic.Int64
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for c := int(next.Add(1) - 1); c < chunks; c = int(next.Add(1) - 1) {
+                fn(c, c*loadChunkSize, min((c+1)*loadChunkSize, n))
+            }
+        }()
+    }
+    wg.Wait()
+}
+
+// parseFeatures decodes raw GeoJSON features in parallel.
+func parseFeatures(raw []json.RawMessage) ([]interface{}, error) {
+    features := make([]interface{}, len(raw))
+    errs := make([]error, (len(raw)+loadChunkSize-1)/loadChunkSize)
+    eachChunk(len(raw), func(chunk, lo, hi int) {
+        for i := lo; i < hi; i++ {
+            if err := json.Unmarshal(raw[i], &features[i]); err != nil {
+                errs[chunk] = err
+                return
+            }
+        }
+    })
+    for _, err := range errs {
+        if err != nil {
+            return nil, err
+        }
+    }
+    return features, nil
+}
+
+// featureChunk is what a loader worker made of one chunk of features:
+// their segments, split by the shard that owns them, and why features
+// were skipped or segments blocked.
+type featureChunk struct {
+    shards  [][]Edge
+    skipped map[string]int
+    blocked int
+}
+
+// shardOf picks the shard of a segment from its lower end, so a segment
+// and its duplicates, in either direction, always meet in one shard.
+func shardOf(a, b Point, shards int) int {
+    if pointLess(b, a) {
+        a = b
+    }
+    h := math.Float64bits(a.X)*0x9e3779b97f4a7c15 ^ math.Float64bits(a.Y)
+    h ^= h >> 29
+    return int(h % uint64(shards))
+}
+
+// addFeatures adds the segments of features, in crs, to graph, which
+// must have no edges yet, and counts why features were skipped. Workers
+// turn chunks of features into segments, then each shard of segments is
+// added to a graph of its own, in feature order so duplicates resolve as
+// they would one by one, and the shards are merged into graph. Shards
+// own disjoint segments, so merging only moves them.
+func addFeatures(graph *Graph, features []interface{}, clip *Bounds, crs string) map[string]int {
+    shards := runtime.GOMAXPROCS(0)
+    chunks := make([]featureChunk, (len(features)+loadChunkSize-1)/loadChunkSize)
+    eachChunk(len(features), func(chunk, lo, hi int) {
+        c := featureChunk{shards: make([][]Edge, shards), skipped: make(map[string]int)}
+        for i := lo; i < hi; i++ {
+            segments, reason := featureSegments(features[i], clip, crs)
+            if reason != "" {
+                c.skipped[reason]++
+            }
+            for _, s := range segments {
+                if graph.blockedSegment(s.Start, s.End) {
+                    c.blocked++
+                    continue
+                }
+                shard := shardOf(s.Start, s.End, shards)
+                c.shards[shard] = append(c.shards[shard], s)
+            }
+        }
+        chunks[chunk] = c
+    })
+
+    built := make([]*Graph, shards)
+    var wg sync.WaitGroup
+    for s := range built {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            shard := NewGraph()
+            shard.duplicatePolicy = graph.duplicatePolicy
+            for _, c := range chunks {
+                for _, e := range c.shards[s] {
+                    shard.AddEdge(e.Start, e.End, e.Distance, e.RiskScore, e.Name)
+                }
+            }
+            built[s] = shard
+        }()
+    }
+    wg.Wait()
+
+    for _, shard := range built {
+        for p, edges := range shard.Edges {
+            if graph.Edges[p] == nil {
+                graph.Edges[p] = edges
+                continue
+            }
+            for q, parallel := range edges {
+                graph.Edges[p][q] = parallel
+            }
+        }
+        graph.duplicates += shard.duplicates
+        graph.parallel += shard.parallel
+        graph.zeroLength += shard.zeroLength
+        graph.maxDist = max(graph.maxDist, shard.maxDist)
+    }
+
+    skipped := make(map[string]int)
+    for _, c := range chunks {
+        for reason, n := range c.skipped {
+            skipped[reason] += n
+        }
+        graph.blockedSegments += c.blocked
+    }
+    return skipped
+}
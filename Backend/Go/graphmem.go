@@ -0,0 +1,114 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "runtime"
+    "unsafe"
+)
+
+// geojsonLoadFactor is roughly how many bytes of heap loading a GeoJSON
+// road network peaks at per byte of the file: the decoded documents and
+// the edge maps dwarf the indexed graph, which ends up near twice the
+// file's size.
+const geojsonLoadFactor = 30
+
+// graphMemoryBudget is GraphMemoryBudgetMB in bytes.
+func (c Config) graphMemoryBudget() int64 {
+    return int64(c.GraphMemoryBudgetMB) << 20
+}
+
+// checkLoadBudget refuses to decode size bytes of GeoJSON, read from the
+// named dataset, when doing so would likely take more than budget bytes;
+// a budget of 0 admits anything. Loading past the budget would more
+// likely end in the process being killed than in an error.
+func checkLoadBudget(path string, size, budget int64) error {
+    need := size * geojsonLoadFactor
+    if budget <= 0 || need <= budget {
+        return nil
+    }
+    return fmt.Errorf("loading %s (%d MB of GeoJSON) needs about %d MB, over the graph memory budget of %d MB; convert it with build-graph to a binary graph, which is memory-mapped and paged in as needed",
+        path, size>>20, need>>20, budget>>20)
+}
+
+// graphMemory is the size of a graph's parts in bytes. Mapped is how much
+// of Total is served from an mmap'd file rather than the heap.
+type graphMemory struct {
+    Nodes          int64 `json:"nodes"`
+    Adjacency      int64 `json:"adjacency"`
+    Names          int64 `json:"names"`
+    SpatialIndexes int64 `json:"spatial_indexes"`
+    Components     int64 `json:"components"`
+    Total          int64 `json:"total"`
+    Mapped         int64 `json:"mapped"`
+    Heap           int64 `json:"heap"`
+}
+
+func sliceBytes[T any](s []T) int64 {
+    var zero T
+    return int64(len(s)) * int64(unsafe.Sizeof(zero))
+}
+
+func (ix *spatialIndex) bytes() int64 {
+    if ix == nil {
+        return 0
+    }
+    return sliceBytes(ix.keys) + sliceBytes(ix.starts) + sliceBytes(ix.items)
+}
+
+// memory measures g once it is indexed.
+func (g *Graph) memory() graphMemory {
+    m := graphMemory{
+        Nodes:          sliceBytes(g.Nodes),
+        Adjacency:      sliceBytes(g.offsets) + sliceBytes(g.targets) + sliceBytes(g.dist) + sliceBytes(g.risk) + sliceBytes(g.nameIdx) + sliceBytes(g.layer),
+        Names:          sliceBytes(g.nameOff) + sliceBytes(g.nameData),
+        SpatialIndexes: g.nodeIndex.bytes() + g.segmentIndex.bytes(),
+        Components:     sliceBytes(g.component),
+        Mapped:         int64(len(g.mapping)),
+    }
+    m.Total = m.Nodes + m.Adjacency + m.Names + m.SpatialIndexes + m.Components
+    m.Heap = max(m.Total-m.Mapped, 0)
+    return m
+}
+
+// handleAdminGraph serves GET /admin/graph, the size of a tenant's loaded
+// graph against the memory budget, and the process's memory use.
+func handleAdminGraph(w http.ResponseWriter, r *http.Request) {
+    tenant, err := tenantByID(r.URL.Query().Get("tenant"))
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    g := tenant.Router().G
+    var stats runtime.MemStats
+    runtime.ReadMemStats(&stats)
+    response := struct {
+        Tenant       string      `json:"tenant"`
+        GraphVersion string      `json:"graph_version"`
+        Nodes        int         `json:"nodes"`
+        Edges        int         `json:"edges"`
+        Memory       graphMemory `json:"memory"`
+        BudgetMB     int         `json:"budget_mb"`
+        Process      struct {
+            HeapAllocMB uint64 `json:"heap_alloc_mb"`
+            HeapSysMB   uint64 `json:"heap_sys_mb"`
+            SysMB       uint64 `json:"sys_mb"`
+        } `json:"process"`
+    }{
+        Tenant:       tenant.ID,
+        GraphVersion: g.Version,
+        Nodes:        len(g.Nodes),
+        Edges:        len(g.targets),
+        Memory:       g.memory(),
+        BudgetMB:     globalConfig.GraphMemoryBudgetMB,
+    }
+    response.Process.HeapAllocMB = stats.HeapAlloc >> 20
+    response.Process.HeapSysMB = stats.HeapSys >> 20
+    response.Process.SysMB = stats.Sys >> 20
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode graph memory: %v", err)
+    }
+}
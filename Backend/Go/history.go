@@ -0,0 +1,187 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// maxHistoryRoutes is how many routes a user's history keeps, evicting
+// the oldest first.
+const maxHistoryRoutes = 1000
+
+// Pages of /me/routes hold defaultHistoryPage routes unless ?limit= asks
+// for up to maxHistoryPage.
+const (
+    defaultHistoryPage = 20
+    maxHistoryPage     = 100
+)
+
+// historyFields are the route fields /me/routes answers with unless
+// ?fields= picks others: enough to tell routes apart and repeat one,
+// without their paths.
+var historyFields = []string{"distance", "risk", "alpha", "summary"}
+
+// historyCursor is where a page of history starts: routes saved before
+// CreatedNS, or at CreatedNS with a lesser ID. The zero cursor starts at
+// the newest route.
+type historyCursor struct {
+    CreatedNS int64
+    ID        string
+}
+
+func (c historyCursor) String() string {
+    return strconv.FormatInt(c.CreatedNS, 10) + "_" + c.ID
+}
+
+func (c historyCursor) isZero() bool {
+    return c == historyCursor{}
+}
+
+// orMax returns c, or for the zero cursor one before every route.
+func (c historyCursor) orMax() historyCursor {
+    if c.isZero() {
+        return historyCursor{CreatedNS: math.MaxInt64}
+    }
+    return c
+}
+
+// after reports whether r comes after the cursor, newest first.
+func (c historyCursor) after(r *savedRoute) bool {
+    c = c.orMax()
+    ns := r.CreatedAt.UnixNano()
+    return ns < c.CreatedNS || ns == c.CreatedNS && r.ID < c.ID
+}
+
+func parseHistoryCursor(s string) (historyCursor, error) {
+    if s == "" {
+        return historyCursor{}, nil
+    }
+    ns, id, ok := strings.Cut(s, "_")
+    created, err := strconv.ParseInt(ns, 10, 64)
+    if !ok || err != nil || id == "" {
+        return historyCursor{}, fmt.Errorf("invalid cursor %q", s)
+    }
+    return historyCursor{CreatedNS: created, ID: id}, nil
+}
+
+func cursorOf(r *savedRoute) historyCursor {
+    return historyCursor{CreatedNS: r.CreatedAt.UnixNano(), ID: r.ID}
+}
+
+type userContextKey struct{}
+
+// userFromRequest returns the user an X-User-Token names. It reports false
+// without a token and fails on one that does not verify.
+func userFromRequest(r *http.Request) (string, bool, error) {
+    token := r.Header.Get("X-User-Token")
+    if token == "" {
+        return "", false, nil
+    }
+    if globalConfig.UserJWTSecret == "" {
+        return "", false, errors.New("user accounts are not enabled")
+    }
+    claims, ok := parseJWT(token, []byte(globalConfig.UserJWTSecret), time.Now(), globalConfig.JWTAllowNoExpiry)
+    if !ok {
+        return "", false, errors.New("invalid or expired user token")
+    }
+    return claims.Sub, true, nil
+}
+
+func userFromContext(r *http.Request) string {
+    user, _ := r.Context().Value(userContextKey{}).(string)
+    return user
+}
+
+// withUser admits only requests with a valid X-User-Token and passes on
+// its user.
+func withUser(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        user, ok, err := userFromRequest(r)
+        if err == nil && !ok {
+            err = errors.New("an X-User-Token is required")
+        }
+        if err != nil {
+            writeAPIError(w, http.StatusUnauthorized, APIError{Code: "unauthorized", Message: err.Error()})
+            return
+        }
+        handler(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+    }
+}
+
+// historyItem is a route in a history listing, with its routes cut to the
+// listing's fields.
+type historyItem struct {
+    *savedRoute
+    Routes []fieldedRoute `json:"routes"`
+}
+
+// handleMyRoutes serves GET /me/routes, the caller's route history, newest
+// first, a page at a time: ?limit= routes from ?cursor=, and the cursor of
+// the next page while there is one.
+func handleMyRoutes(w http.ResponseWriter, r *http.Request) {
+    tenant := tenantFromContext(r.Context())
+    query := r.URL.Query()
+    limit := defaultHistoryPage
+    if v := query.Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 || n > maxHistoryPage {
+            writeBadRequest(w, fmt.Sprintf("limit must be within [1, %d]", maxHistoryPage))
+            return
+        }
+        limit = n
+    }
+    cursor, err := parseHistoryCursor(query.Get("cursor"))
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    fields := historyFields
+    if query.Get("fields") != "" {
+        if fields, err = parseRouteFields(query.Get("fields")); err != nil {
+            writeUnknownField(w, err)
+            return
+        }
+    }
+
+    // One route more than the page tells whether another page follows.
+    routes, err := globalStorage.history(r.Context(), tenant.ID, userFromContext(r), cursor, limit+1)
+    if err != nil {
+        writeAPIError(w, http.StatusInternalServerError, APIError{Code: "storage", Message: err.Error()})
+        return
+    }
+    response := struct {
+        Routes []historyItem `json:"routes"`
+        Next   string        `json:"next,omitempty"`
+    }{Routes: []historyItem{}}
+    if len(routes) > limit {
+        routes = routes[:limit]
+        response.Next = cursorOf(routes[limit-1]).String()
+    }
+    for _, saved := range routes {
+        response.Routes = append(response.Routes, historyItem{saved, selectFields(saved.Routes, fields)})
+    }
+    writeSignedJSON(w, response, "route history")
+}
+
+// handleDeleteMyRoute serves DELETE /me/routes/{id}, which removes a route
+// from the caller's history.
+func handleDeleteMyRoute(w http.ResponseWriter, r *http.Request) {
+    tenant := tenantFromContext(r.Context())
+    id := r.PathValue("id")
+    err := globalStorage.deleteHistory(r.Context(), tenant.ID, userFromContext(r), id)
+    if errors.Is(err, errNotFound) {
+        writeAPIError(w, http.StatusNotFound, APIError{Code: "not_found", Message: "no route " + id + " in your history"})
+        return
+    }
+    if err != nil {
+        writeAPIError(w, http.StatusInternalServerError, APIError{Code: "storage", Message: err.Error()})
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
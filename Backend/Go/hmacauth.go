@@ -0,0 +1,140 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Server-to-server callers that cannot use OAuth may sign their requests
+// instead of sending an API key. They send the ID of one of their
+// tenant's HMAC keys, the Unix time in seconds, a nonce used once, and
+// the hex HMAC-SHA256, under the key's secret, of
+//
+//	METHOD "\n" request URI "\n" timestamp "\n" nonce "\n" hex SHA-256 of the body
+//
+// A request is refused when its timestamp is more than the replay window
+// away from the server's clock, or its nonce was already used within it.
+const (
+    hmacKeyIDHeader     = "X-Key-Id"
+    hmacTimestampHeader = "X-Timestamp"
+    hmacNonceHeader     = "X-Nonce"
+    hmacSignatureHeader = "X-Signature"
+)
+
+// maxSignedBody bounds the body of a signed request, which is read whole
+// before its signature can be checked.
+const maxSignedBody = 8 << 20
+
+// minHMACSecret is the shortest secret an HMAC key may have.
+const minHMACSecret = 32
+
+// maxNonces bounds the nonces remembered; requests beyond it are refused
+// until older nonces leave the replay window.
+const maxNonces = 200000
+
+// errNonceStoreFull refuses a signed request whose nonce cannot be
+// remembered, rather than accept one that could be replayed.
+var errNonceStoreFull = errors.New("too many signed requests in the replay window")
+
+// hmacKey is an HMAC key of a tenant.
+type hmacKey struct {
+    tenant *Tenant
+    secret []byte
+}
+
+// nonceCache remembers the nonces seen within the replay window.
+type nonceCache struct {
+    mu   sync.Mutex
+    seen map[string]time.Time
+}
+
+// use records nonce as used at now and reports whether it was new; nonces
+// older than window are forgotten.
+func (c *nonceCache) use(nonce string, now time.Time, window time.Duration) (bool, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.seen == nil {
+        c.seen = make(map[string]time.Time)
+    }
+    if at, ok := c.seen[nonce]; ok && now.Sub(at) <= window {
+        return false, nil
+    }
+    if len(c.seen) >= maxNonces {
+        for n, at := range c.seen {
+            if now.Sub(at) > window {
+                delete(c.seen, n)
+            }
+        }
+        if len(c.seen) >= maxNonces {
+            return false, errNonceStoreFull
+        }
+    }
+    c.seen[nonce] = now
+    return true, nil
+}
+
+// signedRequest reports whether r authenticates with an HMAC signature.
+func signedRequest(r *http.Request) bool {
+    return r.Header.Get(hmacSignatureHeader) != ""
+}
+
+// hmacSignature is the hex signature of a request under secret.
+func hmacSignature(secret []byte, method, uri, timestamp, nonce string, body []byte) string {
+    digest := sha256.Sum256(body)
+    mac := hmac.New(sha256.New, secret)
+    fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, uri, timestamp, nonce, hex.EncodeToString(digest[:]))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySigned resolves the tenant of a signed request. It reads the body,
+// up to maxSignedBody, to check its digest and puts it back for the
+// handler.
+func (reg *TenantRegistry) verifySigned(w http.ResponseWriter, r *http.Request, now time.Time) (*Tenant, error) {
+    keyID := r.Header.Get(hmacKeyIDHeader)
+    key, ok := reg.byHMACKey[keyID]
+    if !ok {
+        return nil, fmt.Errorf("unknown %s %q", hmacKeyIDHeader, keyID)
+    }
+    ts := r.Header.Get(hmacTimestampHeader)
+    sec, err := strconv.ParseInt(ts, 10, 64)
+    if err != nil {
+        return nil, fmt.Errorf("%s must be Unix seconds, got %q", hmacTimestampHeader, ts)
+    }
+    window := time.Duration(globalConfig.HMACWindowSeconds) * time.Second
+    if skew := now.Sub(time.Unix(sec, 0)); skew > window || skew < -window {
+        return nil, fmt.Errorf("%s is more than %d s from the server's clock", hmacTimestampHeader, globalConfig.HMACWindowSeconds)
+    }
+    nonce := r.Header.Get(hmacNonceHeader)
+    if nonce == "" {
+        return nil, fmt.Errorf("%s is required", hmacNonceHeader)
+    }
+
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBody))
+    if err != nil {
+        return nil, err
+    }
+    r.Body = io.NopCloser(bytes.NewReader(body))
+    want := hmacSignature(key.secret, r.Method, r.URL.RequestURI(), ts, nonce, body)
+    if !hmac.Equal([]byte(want), []byte(r.Header.Get(hmacSignatureHeader))) {
+        return nil, errors.New("signature does not match the request")
+    }
+    // Only a valid signature spends its nonce, so forged requests cannot
+    // use up a caller's.
+    fresh, err := reg.nonces.use(keyID+"\x00"+nonce, now, 2*window)
+    if err != nil {
+        return nil, err
+    }
+    if !fresh {
+        return nil, fmt.Errorf("%s was already used", hmacNonceHeader)
+    }
+    return key.tenant, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// signedRegistry has one tenant that signs with key "k1".
+func signedRegistry(t *testing.T) (*TenantRegistry, []byte) {
+    t.Helper()
+    saved := globalConfig
+    globalConfig = defaultConfig()
+    t.Cleanup(func() { globalConfig = saved })
+    secret := []byte(strings.Repeat("s", minHMACSecret))
+    reg := &TenantRegistry{
+        byKey:     make(map[string]*Tenant),
+        byID:      make(map[string]*Tenant),
+        byHMACKey: make(map[string]hmacKey),
+    }
+    reg.add(&Tenant{ID: "acme"}, nil, map[string]string{"k1": string(secret)})
+    return reg, secret
+}
+
+// signed is a POST of body to /route signed with secret at signedAt.
+func signed(secret []byte, signedAt time.Time, nonce, body string) *http.Request {
+    r := httptest.NewRequest(http.MethodPost, "/route?alpha=0.5", strings.NewReader(body))
+    ts := strconv.FormatInt(signedAt.Unix(), 10)
+    r.Header.Set(hmacKeyIDHeader, "k1")
+    r.Header.Set(hmacTimestampHeader, ts)
+    r.Header.Set(hmacNonceHeader, nonce)
+    r.Header.Set(hmacSignatureHeader, hmacSignature(secret, r.Method, r.URL.RequestURI(), ts, nonce, []byte(body)))
+    return r
+}
+
+func TestVerifySigned(t *testing.T) {
+    reg, secret := signedRegistry(t)
+    now := time.Unix(1767225600, 0)
+    window := time.Duration(globalConfig.HMACWindowSeconds) * time.Second
+    body := `{"start": {"lat": 41.87, "lon": -87.66}}`
+
+    cases := []struct {
+        name    string
+        request func() *http.Request
+        wantErr string
+    }{
+        {"valid", func() *http.Request { return signed(secret, now, "n-valid", body) }, ""},
+        {"within skew", func() *http.Request { return signed(secret, now.Add(-window), "n-early", body) }, ""},
+        {"bad signature", func() *http.Request {
+            r := signed(secret, now, "n-bad", body)
+            r.Header.Set(hmacSignatureHeader, strings.Repeat("0", 64))
+            return r
+        }, "does not match"},
+        {"wrong secret", func() *http.Request {
+            return signed([]byte(strings.Repeat("x", minHMACSecret)), now, "n-secret", body)
+        }, "does not match"},
+        {"changed body", func() *http.Request {
+            r := signed(secret, now, "n-body", body)
+            r.Body = http.NoBody
+            return r
+        }, "does not match"},
+        {"unknown key", func() *http.Request {
+            r := signed(secret, now, "n-key", body)
+            r.Header.Set(hmacKeyIDHeader, "k2")
+            return r
+        }, "unknown"},
+        {"clock behind", func() *http.Request { return signed(secret, now.Add(-window-time.Second), "n-old", body) }, "server's clock"},
+        {"clock ahead", func() *http.Request { return signed(secret, now.Add(window+time.Second), "n-new", body) }, "server's clock"},
+        {"bad timestamp", func() *http.Request {
+            r := signed(secret, now, "n-ts", body)
+            r.Header.Set(hmacTimestampHeader, "yesterday")
+            return r
+        }, "Unix seconds"},
+        {"no nonce", func() *http.Request { return signed(secret, now, "", body) }, "required"},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            r := c.request()
+            tenant, err := reg.verifySigned(httptest.NewRecorder(), r, now)
+            if c.wantErr == "" {
+                if err != nil || tenant == nil || tenant.ID != "acme" {
+                    t.Fatalf("verifySigned = %v, %v; want tenant acme", tenant, err)
+                }
+                return
+            }
+            if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+                t.Errorf("err = %v, want one containing %q", err, c.wantErr)
+            }
+        })
+    }
+}
+
+func TestVerifySignedNonceReplay(t *testing.T) {
+    reg, secret := signedRegistry(t)
+    now := time.Unix(1767225600, 0)
+    body := `{}`
+
+    // A forged request does not spend the nonce.
+    forged := signed(secret, now, "once", body)
+    forged.Header.Set(hmacSignatureHeader, strings.Repeat("0", 64))
+    if _, err := reg.verifySigned(httptest.NewRecorder(), forged, now); err == nil {
+        t.Fatal("forged request accepted")
+    }
+    if _, err := reg.verifySigned(httptest.NewRecorder(), signed(secret, now, "once", body), now); err != nil {
+        t.Fatalf("first use: %v", err)
+    }
+    _, err := reg.verifySigned(httptest.NewRecorder(), signed(secret, now, "once", body), now.Add(time.Second))
+    if err == nil || !strings.Contains(err.Error(), "already used") {
+        t.Errorf("replay: err = %v, want already used", err)
+    }
+    // Once the timestamp is outside the window, the skew check refuses
+    // the replay before the nonce is forgotten.
+    window := time.Duration(globalConfig.HMACWindowSeconds) * time.Second
+    if _, err := reg.verifySigned(httptest.NewRecorder(), signed(secret, now, "once", body), now.Add(window+time.Second)); err == nil {
+        t.Error("late replay accepted")
+    }
+}
+
+func TestSignedBodyTooLarge(t *testing.T) {
+    reg, secret := signedRegistry(t)
+    saved := globalTenants
+    globalTenants = reg
+    t.Cleanup(func() { globalTenants = saved })
+
+    called := false
+    handler := withTenant(func(w http.ResponseWriter, r *http.Request) { called = true })
+    w := httptest.NewRecorder()
+    handler(w, signed(secret, time.Now(), "big", strings.Repeat(" ", maxSignedBody+1)))
+    if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "body_too_large") || called {
+        t.Errorf("status = %d, body %s, handler called %v; want 413 body_too_large", w.Code, w.Body, called)
+    }
+
+    w = httptest.NewRecorder()
+    handler(w, signed(secret, time.Now(), "small", `{}`))
+    if !called {
+        t.Errorf("valid signed request refused: %d %s", w.Code, w.Body)
+    }
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+)
+
+// maxHubs caps the hubs registered per tenant; each holds one tree of
+// nodeCount entries per alpha.
+const maxHubs = 32
+
+// hub is a popular destination, such as a transit hub or campus gate,
+// for which shortest-path trees are kept so routes ending there are read
+// off the tree instead of searched for.
+type hub struct {
+    Name         string    `json:"name"`
+    Point        Point     `json:"point"`
+    Node         Point     `json:"node"`
+    RegisteredAt time.Time `json:"registered_at"`
+    node         int32
+}
+
+// hubTree is a reverse shortest-path tree into a hub: next holds each
+// node's first edge towards it, -1 where the hub is unreachable. It is
+// valid for the risk layer and closures it was grown on.
+type hubTree struct {
+    riskVersion   string
+    closedVersion string
+    next          []int32
+}
+
+type hubTreeKey struct {
+    node  int32
+    alpha float64
+}
+
+// hubSet is a router's hubs and their trees.
+type hubSet struct {
+    // refreshing serializes rebuilds, so the last one to finish saw the
+    // latest data.
+    refreshing sync.Mutex
+    mu         sync.RWMutex
+    hubs       map[string]*hub
+    trees      map[hubTreeKey]*hubTree
+    // builds counts tree rebuilds, for the admin listing.
+    builds int
+}
+
+// tree returns a current tree into node at alpha, or nil.
+func (h *hubSet) tree(node int32, alpha float64, layer *riskLayer, closed *closureSet) *hubTree {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    t := h.trees[hubTreeKey{node, alpha}]
+    if t == nil || t.riskVersion != layer.Version || t.closedVersion != closed.version() {
+        return nil
+    }
+    return t
+}
+
+// refreshHubs regrows every hub's trees on the active layer and closures,
+// at the alphas whose weights the router keeps. If ctx ends while it
+// waits for a search worker, the trees are left as they were.
+func (r *RiskAwareRouter) refreshHubs(ctx context.Context) error {
+    r.hubs.refreshing.Lock()
+    defer r.hubs.refreshing.Unlock()
+    layer := r.activeLayer()
+    alphas := r.weights.alphasFor(layer.Version)
+    r.hubs.mu.RLock()
+    nodes := make([]int32, 0, len(r.hubs.hubs))
+    for _, h := range r.hubs.hubs {
+        nodes = append(nodes, h.node)
+    }
+    // Alphas served before, say, a weights flush keep their trees.
+    for key := range r.hubs.trees {
+        alphas = append(alphas, key.alpha)
+    }
+    r.hubs.mu.RUnlock()
+    if len(nodes) == 0 {
+        return nil
+    }
+
+    closed := r.closed.load()
+    trees := make(map[hubTreeKey]*hubTree)
+    batch := withSearchClass(ctx, classBatch)
+    s := r.searches.get()
+    defer r.searches.put(s)
+    for _, alpha := range alphas {
+        weights := r.weightsFor(layer, alpha)
+        for _, node := range nodes {
+            key := hubTreeKey{node, alpha}
+            if _, ok := trees[key]; ok {
+                continue
+            }
+            release, err := globalSearchWorkers.acquire(batch)
+            if err != nil {
+                return err
+            }
+            growBackward(r.G, s, node, weights, r.reverseEdges(), closed)
+            release()
+            next := make([]int32, len(r.G.Nodes))
+            for i := range next {
+                next[i] = -1
+            }
+            for _, u := range s.touched {
+                next[u] = s.cameFrom[u]
+            }
+            s.reset()
+            trees[key] = &hubTree{riskVersion: layer.Version, closedVersion: closed.version(), next: next}
+        }
+    }
+
+    r.hubs.mu.Lock()
+    r.hubs.trees = trees
+    r.hubs.builds++
+    r.hubs.mu.Unlock()
+    return nil
+}
+
+// followTree reads the route from start to the tree's hub.
+func (r *RiskAwareRouter) followTree(t *hubTree, start, end int32, risk []float64) ([]Point, []int32, float64, float64, error) {
+    g := r.G
+    path := []Point{g.Nodes[start]}
+    var edges []int32
+    totalDist, totalRisk := 0.0, 0.0
+    for current := start; current != end; {
+        e := t.next[current]
+        if e < 0 {
+            return nil, nil, 0, 0, fmt.Errorf("no path found")
+        }
+        current = g.targets[e]
+        path = append(path, g.Nodes[current])
+        edges = append(edges, e)
+        totalDist += g.dist[e]
+        totalRisk += risk[e] * g.dist[e]
+    }
+    avgRisk := 0.0
+    if totalDist > 0 {
+        avgRisk = totalRisk / totalDist
+    }
+    return path, edges, totalDist, avgRisk, nil
+}
+
+type hubInfo struct {
+    *hub
+    Trees int `json:"trees"`
+}
+
+func (h *hubSet) list(layer *riskLayer, closed *closureSet) []hubInfo {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    infos := make([]hubInfo, 0, len(h.hubs))
+    for _, hb := range h.hubs {
+        info := hubInfo{hub: hb}
+        for key, t := range h.trees {
+            if key.node == hb.node && t.riskVersion == layer.Version && t.closedVersion == closed.version() {
+                info.Trees++
+            }
+        }
+        infos = append(infos, info)
+    }
+    sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+    return infos
+}
+
+// stale reports whether any hub lacks a tree for layer and closed that it
+// had for an earlier layer, so a refresh would rebuild it.
+func (h *hubSet) stale(layer *riskLayer, closed *closureSet) bool {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    for _, t := range h.trees {
+        if t.riskVersion != layer.Version || t.closedVersion != closed.version() {
+            return true
+        }
+    }
+    return false
+}
+
+// handleAdminHubs serves GET /admin/hubs, the tenant's hubs and how many
+// current trees each has.
+func handleAdminHubs(w http.ResponseWriter, r *http.Request) {
+    tenant, err := tenantByID(r.URL.Query().Get("tenant"))
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    router := tenant.Router()
+    writeHubs(w, router.hubs.list(router.activeLayer(), router.closed.load()))
+}
+
+// hubRequest is the body of PUT /admin/hubs/{name}.
+type hubRequest struct {
+    X float64 `json:"x" schema:"required"`
+    Y float64 `json:"y" schema:"required"`
+}
+
+// handleHub serves /admin/hubs/{name}: PUT registers or moves the hub,
+// growing its trees before answering, and DELETE removes it.
+func handleHub(w http.ResponseWriter, r *http.Request) {
+    tenant, err := tenantByID(r.URL.Query().Get("tenant"))
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    name := r.PathValue("name")
+    audit := auditFromContext(r.Context())
+    audit.Target = fmt.Sprintf("%s tenant=%s hub=%s", r.Method, tenant.ID, name)
+    if r.Method == http.MethodDelete {
+        deleteHub(w, tenant, name, audit)
+        return
+    }
+
+    var req hubRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    router := tenant.Router()
+    p := Point{X: req.X, Y: req.Y}
+    if !isInBounds(p, router.Bounds) {
+        writeBadRequest(w, fmt.Sprintf("hub (%v, %v) is outside the serving bounds", p.X, p.Y))
+        return
+    }
+    snap := router.snap(p, "hub")
+
+    router.hubs.mu.Lock()
+    if router.hubs.hubs == nil {
+        router.hubs.hubs = make(map[string]*hub)
+    }
+    if old, ok := router.hubs.hubs[name]; ok {
+        audit.Before = old
+    } else if len(router.hubs.hubs) >= maxHubs {
+        router.hubs.mu.Unlock()
+        writeBadRequest(w, fmt.Sprintf("at most %d hubs may be registered", maxHubs))
+        return
+    }
+    hb := &hub{Name: name, Point: p, Node: snap.Snapped, RegisteredAt: time.Now().UTC(), node: snap.node}
+    router.hubs.hubs[name] = hb
+    router.hubs.mu.Unlock()
+    audit.After = hb
+
+    start := time.Now()
+    if err := router.refreshHubs(r.Context()); err != nil {
+        // The hub stays registered; searches go without its trees until
+        // they are grown.
+        log.Printf("Registered hub %s for tenant %s; growing its trees stopped: %v", name, tenant.ID, err)
+        if errors.Is(err, context.DeadlineExceeded) {
+            writeAPIError(w, http.StatusGatewayTimeout, APIError{Code: "timeout", Message: "the hub is registered, but growing its trees timed out"})
+        }
+        return
+    }
+    log.Printf("Registered hub %s for tenant %s; trees grown in %v", name, tenant.ID, time.Since(start).Round(time.Millisecond))
+    writeHubs(w, router.hubs.list(router.activeLayer(), router.closed.load()))
+}
+
+func deleteHub(w http.ResponseWriter, tenant *Tenant, name string, audit *auditDetails) {
+    router := tenant.Router()
+
+    router.hubs.mu.Lock()
+    hb, ok := router.hubs.hubs[name]
+    if ok {
+        delete(router.hubs.hubs, name)
+        shared := false
+        for _, other := range router.hubs.hubs {
+            shared = shared || other.node == hb.node
+        }
+        for key := range router.hubs.trees {
+            if key.node == hb.node && !shared {
+                delete(router.hubs.trees, key)
+            }
+        }
+    }
+    router.hubs.mu.Unlock()
+    if !ok {
+        writeAPIError(w, http.StatusNotFound, APIError{Code: "not_found", Message: "unknown hub " + name})
+        return
+    }
+    audit.Before = hb
+    writeHubs(w, router.hubs.list(router.activeLayer(), router.closed.load()))
+}
+
+func writeHubs(w http.ResponseWriter, hubs []hubInfo) {
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(map[string]interface{}{"hubs": hubs}); err != nil {
+        log.Printf("Failed to encode hubs: %v", err)
+    }
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "embed"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Translation bundles are locales/<language>.json files of message keys to
+// templates with {name} placeholders. English is the fallback for
+// languages and keys a bundle lacks.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+const fallbackLanguage = "en"
+
+var bundles = loadBundles()
+
+func loadBundles() map[string]map[string]string {
+    entries, err := localeFiles.ReadDir("locales")
+    if err != nil {
+        log.Fatalf("Reading embedded locales: %v", err)
+    }
+    bundles := make(map[string]map[string]string)
+    for _, e := range entries {
+        data, err := localeFiles.ReadFile("locales/" + e.Name())
+        if err != nil {
+            log.Fatalf("Reading locale %s: %v", e.Name(), err)
+        }
+        messages := make(map[string]string)
+        if err := json.Unmarshal(data, &messages); err != nil {
+            log.Fatalf("Parsing locale %s: %v", e.Name(), err)
+        }
+        bundles[strings.TrimSuffix(e.Name(), path.Ext(e.Name()))] = messages
+    }
+    return bundles
+}
+
+// unitSystem selects how distances are written.
+type unitSystem string
+
+const (
+    metricUnits   unitSystem = "metric"
+    imperialUnits unitSystem = "imperial"
+)
+
+// imperialRegions use miles and feet.
+var imperialRegions = map[string]bool{"us": true, "lr": true, "mm": true}
+
+// localizer renders user-facing text in one language and unit system.
+type localizer struct {
+    Language string
+    Units    unitSystem
+}
+
+// localizerFor negotiates the language from Accept-Language and the units
+// from ?units=, falling back to the region of the chosen language tag.
+func localizerFor(r *http.Request) localizer {
+    l := localizer{Language: fallbackLanguage, Units: metricUnits}
+    for _, tag := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+        lang, region, _ := strings.Cut(strings.ToLower(tag), "-")
+        if _, ok := bundles[lang]; ok {
+            l.Language = lang
+            if imperialRegions[region] {
+                l.Units = imperialUnits
+            }
+            break
+        }
+    }
+    switch units := unitSystem(r.URL.Query().Get("units")); units {
+    case metricUnits, imperialUnits:
+        l.Units = units
+    }
+    return l
+}
+
+// parseAcceptLanguage returns the tags of an Accept-Language header, most
+// preferred first.
+func parseAcceptLanguage(header string) []string {
+    type weighted struct {
+        tag string
+        q   float64
+    }
+    var tags []weighted
+    for _, part := range strings.Split(header, ",") {
+        tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+        if tag == "" || tag == "*" {
+            continue
+        }
+        q := 1.0
+        if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+            if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+                q = parsed
+            }
+        }
+        if q > 0 {
+            tags = append(tags, weighted{tag, q})
+        }
+    }
+    sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+    out := make([]string, len(tags))
+    for i, t := range tags {
+        out[i] = t.tag
+    }
+    return out
+}
+
+// T renders the message key with args given as name, value pairs.
+func (l localizer) T(key string, args ...interface{}) string {
+    msg, ok := bundles[l.Language][key]
+    if !ok {
+        if msg, ok = bundles[fallbackLanguage][key]; !ok {
+            return key
+        }
+    }
+    for i := 0; i+1 < len(args); i += 2 {
+        msg = strings.ReplaceAll(msg, "{"+fmt.Sprint(args[i])+"}", fmt.Sprint(args[i+1]))
+    }
+    return msg
+}
+
+// Distance writes meters in the localizer's units: meters or kilometers,
+// feet or miles.
+func (l localizer) Distance(meters float64) string {
+    var s string
+    switch feet := meters / 0.3048; {
+    case l.Units == imperialUnits && feet < 1000:
+        s = fmt.Sprintf("%.0f ft", feet)
+    case l.Units == imperialUnits:
+        s = fmt.Sprintf("%.1f mi", meters/1609.344)
+    case meters < 1000:
+        s = fmt.Sprintf("%.0f m", meters)
+    default:
+        s = fmt.Sprintf("%.1f km", meters/1000)
+    }
+    return strings.Replace(s, ".", l.T("number.decimal"), 1)
+}
+
+// Number writes v with prec decimals and the language's decimal mark.
+func (l localizer) Number(v float64, prec int) string {
+    return strings.Replace(strconv.FormatFloat(v, 'f', prec, 64), ".", l.T("number.decimal"), 1)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "net"
+    "net/http"
+    "net/netip"
+    "os"
+    "sort"
+    "strings"
+)
+
+// countryDB maps client addresses to ISO 3166 country codes, as MaxMind's
+// GeoIP2/GeoLite2 Country databases do.
+type countryDB interface {
+    Country(ip net.IP) (string, bool)
+}
+
+// ipFilter admits requests by client address: deny entries always win,
+// a non-empty allow list admits only its networks, and addresses located
+// in a blocked country are refused.
+type ipFilter struct {
+    allow   []*net.IPNet
+    deny    []*net.IPNet
+    blocked map[string]bool
+    geo     countryDB
+}
+
+// newIPFilter builds the filter for cfg, or nil when it has no rules.
+func newIPFilter(cfg Config) (*ipFilter, error) {
+    if len(cfg.IPAllow) == 0 && len(cfg.IPDeny) == 0 && len(cfg.BlockedCountries) == 0 {
+        return nil, nil
+    }
+    f := &ipFilter{blocked: map[string]bool{}}
+    var err error
+    if f.allow, err = parseNets(cfg.IPAllow); err != nil {
+        return nil, fmt.Errorf("ip_allow %v", err)
+    }
+    if f.deny, err = parseNets(cfg.IPDeny); err != nil {
+        return nil, fmt.Errorf("ip_deny %v", err)
+    }
+    for _, c := range cfg.BlockedCountries {
+        f.blocked[strings.ToUpper(strings.TrimSpace(c))] = true
+    }
+    if len(f.blocked) > 0 {
+        if cfg.GeoIPPath == "" {
+            return nil, fmt.Errorf("blocked_countries needs geoip_path")
+        }
+        if f.geo, err = openCountryDB(cfg.GeoIPPath); err != nil {
+            return nil, err
+        }
+    }
+    return f, nil
+}
+
+// admit reports whether addr may use the API and, if not, why.
+func (f *ipFilter) admit(addr string) (bool, string) {
+    ip := net.ParseIP(addr)
+    if ip == nil {
+        return false, "unparseable client address"
+    }
+    if containsIP(f.deny, ip) {
+        return false, "address denied"
+    }
+    if len(f.allow) > 0 && !containsIP(f.allow, ip) {
+        return false, "address not allowed"
+    }
+    if f.geo != nil {
+        if country, ok := f.geo.Country(ip); ok && f.blocked[country] {
+            return false, "country " + country + " blocked"
+        }
+    }
+    return true, ""
+}
+
+// withIPFilter refuses requests from clients the filter does not admit.
+func withIPFilter(f *ipFilter, next http.Handler) http.Handler {
+    if f == nil {
+        return next
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        r, _ = withScope(r)
+        if ok, reason := f.admit(clientIP(r)); !ok {
+            writeAPIError(w, http.StatusForbidden, APIError{
+                Code:    "forbidden",
+                Message: "Access from this address is not permitted",
+                Details: map[string]interface{}{"reason": reason},
+            })
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// mmdbMetadataMarker starts the metadata section of every MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// openCountryDB loads a country database. Binary .mmdb files need a
+// MaxMind reader this module does not vendor, so the database is read as
+// CSV lines of "network,iso_code", e.g. exported from GeoLite2 Country.
+func openCountryDB(path string) (countryDB, error) {
+    unsupported := fmt.Errorf("geoip_path %s: .mmdb is not supported, export it as network,iso_code CSV", path)
+    if strings.HasSuffix(strings.ToLower(path), ".mmdb") {
+        return nil, unsupported
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("geoip_path: %v", err)
+    }
+    if bytes.Contains(data, mmdbMetadataMarker) {
+        return nil, unsupported
+    }
+
+    db := &csvCountryDB{}
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for line := 1; scanner.Scan(); line++ {
+        network, code, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ",")
+        if !ok || strings.HasPrefix(network, "#") {
+            continue
+        }
+        prefix, err := netip.ParsePrefix(strings.TrimSpace(network))
+        if err != nil {
+            if line == 1 {
+                continue // header
+            }
+            return nil, fmt.Errorf("geoip_path %s line %d: %v", path, line, err)
+        }
+        db.ranges = append(db.ranges, countryRange{
+            prefix:  prefix.Masked(),
+            country: strings.ToUpper(strings.TrimSpace(code)),
+        })
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("geoip_path %s: %v", path, err)
+    }
+    if len(db.ranges) == 0 {
+        return nil, fmt.Errorf("geoip_path %s: no network,iso_code lines", path)
+    }
+    sort.Slice(db.ranges, func(i, j int) bool {
+        return db.ranges[i].prefix.Addr().Less(db.ranges[j].prefix.Addr())
+    })
+    return db, nil
+}
+
+type countryRange struct {
+    prefix  netip.Prefix
+    country string
+}
+
+// csvCountryDB holds non-overlapping networks sorted by first address.
+type csvCountryDB struct {
+    ranges []countryRange
+}
+
+func (db *csvCountryDB) Country(ip net.IP) (string, bool) {
+    addr, ok := netip.AddrFromSlice(ip)
+    if !ok {
+        return "", false
+    }
+    addr = addr.Unmap()
+    i := sort.Search(len(db.ranges), func(i int) bool {
+        return addr.Less(db.ranges[i].prefix.Addr())
+    })
+    if i == 0 || !db.ranges[i-1].prefix.Contains(addr) {
+        return "", false
+    }
+    return db.ranges[i-1].country, true
+}
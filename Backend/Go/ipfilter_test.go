@@ -0,0 +1,172 @@
+package main
+
+import (
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+const testCountryCSV = `network,country_iso_code
+# GeoLite2 Country export
+203.0.113.0/24,FR
+198.51.100.7/24, de
+2001:db8:1::/48,NL
+192.0.2.0/25,US
+`
+
+func writeCountryDB(t *testing.T, name, content string) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), name)
+    if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestIPFilterAdmit(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.IPAllow = []string{"203.0.113.0/24", "198.51.100.0/24", "2001:db8::/32"}
+    cfg.IPDeny = []string{"203.0.113.66", "2001:db8:1:2::/64"}
+    cfg.BlockedCountries = []string{" de "}
+    cfg.GeoIPPath = writeCountryDB(t, "countries.csv", testCountryCSV)
+    f, err := newIPFilter(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cases := []struct {
+        addr   string
+        admit  bool
+        reason string
+    }{
+        {"203.0.113.5", true, ""},
+        {"203.0.113.66", false, "address denied"},
+        {"192.0.2.1", false, "address not allowed"},
+        {"198.51.100.9", false, "country DE blocked"},
+        {"::ffff:198.51.100.9", false, "country DE blocked"},
+        {"2001:db8:1:1::1", true, ""},
+        {"2001:db8:1:2::1", false, "address denied"},
+        {"2001:db9::1", false, "address not allowed"},
+        {"not-an-ip", false, "unparseable client address"},
+    }
+    for _, c := range cases {
+        admit, reason := f.admit(c.addr)
+        if admit != c.admit || reason != c.reason {
+            t.Errorf("admit(%s) = %v, %q; want %v, %q", c.addr, admit, reason, c.admit, c.reason)
+        }
+    }
+}
+
+func TestIPFilterDenyOnly(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.IPDeny = []string{"10.0.0.0/8"}
+    f, err := newIPFilter(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for addr, want := range map[string]bool{"10.1.2.3": false, "192.0.2.1": true, "::1": true} {
+        if admit, _ := f.admit(addr); admit != want {
+            t.Errorf("admit(%s) = %v, want %v", addr, admit, want)
+        }
+    }
+}
+
+func TestNewIPFilter(t *testing.T) {
+    if f, err := newIPFilter(defaultConfig()); f != nil || err != nil {
+        t.Errorf("no rules: %v, %v; want no filter", f, err)
+    }
+    cases := []struct {
+        name    string
+        edit    func(*Config)
+        wantErr string
+    }{
+        {"bad allow", func(c *Config) { c.IPAllow = []string{"10.0.0.0/40"} }, "ip_allow"},
+        {"bad deny", func(c *Config) { c.IPDeny = []string{"nowhere"} }, "ip_deny"},
+        {"countries without database", func(c *Config) { c.BlockedCountries = []string{"DE"} }, "needs geoip_path"},
+    }
+    for _, c := range cases {
+        cfg := defaultConfig()
+        c.edit(&cfg)
+        if _, err := newIPFilter(cfg); err == nil || !strings.Contains(err.Error(), c.wantErr) {
+            t.Errorf("%s: err = %v, want %q", c.name, err, c.wantErr)
+        }
+    }
+}
+
+func TestCSVCountryDB(t *testing.T) {
+    db, err := openCountryDB(writeCountryDB(t, "countries.csv", testCountryCSV))
+    if err != nil {
+        t.Fatal(err)
+    }
+    cases := []struct {
+        addr    string
+        country string
+    }{
+        {"203.0.113.0", "FR"},
+        {"203.0.113.255", "FR"},
+        {"203.0.114.0", ""},
+        // 198.51.100.7/24 is read as the network it is in.
+        {"198.51.100.1", "DE"},
+        {"192.0.2.127", "US"},
+        {"192.0.2.128", ""},
+        {"2001:db8:1:ffff::1", "NL"},
+        {"2001:db8:2::1", ""},
+        {"0.0.0.0", ""},
+    }
+    for _, c := range cases {
+        country, ok := db.Country(net.ParseIP(c.addr))
+        if country != c.country || ok != (c.country != "") {
+            t.Errorf("Country(%s) = %q, %v; want %q", c.addr, country, ok, c.country)
+        }
+    }
+}
+
+func TestOpenCountryDBRejects(t *testing.T) {
+    mmdb := "\x00\x01binary tree\x00" + string(mmdbMetadataMarker) + "\xe9metadata"
+    cases := []struct {
+        name, file, content, wantErr string
+    }{
+        {"mmdb", "GeoLite2-Country.mmdb", testCountryCSV, ".mmdb is not supported"},
+        {"upper case mmdb", "GEOIP.MMDB", testCountryCSV, ".mmdb is not supported"},
+        {"renamed mmdb", "countries.dat", mmdb, ".mmdb is not supported"},
+        {"bad network", "countries.csv", "network,iso\n203.0.113.0/24,FR\n203.0.113.0/33,FR\n", "line 3"},
+        {"no networks", "countries.csv", "network,country_iso_code\n# nothing\n", "no network,iso_code lines"},
+        {"empty", "countries.csv", "", "no network,iso_code lines"},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            _, err := openCountryDB(writeCountryDB(t, c.file, c.content))
+            if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+                t.Errorf("err = %v, want %q", err, c.wantErr)
+            }
+        })
+    }
+    if _, err := openCountryDB(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+        t.Error("a missing file opened")
+    }
+}
+
+func TestWithIPFilter(t *testing.T) {
+    saved := globalProxies
+    globalProxies = nil
+    t.Cleanup(func() { globalProxies = saved })
+    cfg := defaultConfig()
+    cfg.IPDeny = []string{"192.0.2.0/24"}
+    f, err := newIPFilter(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    handler := withIPFilter(f, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    for addr, want := range map[string]int{"192.0.2.9:1234": http.StatusForbidden, "198.51.100.1:1234": http.StatusOK} {
+        r := httptest.NewRequest(http.MethodGet, "/route", nil)
+        r.RemoteAddr = addr
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        if w.Code != want || want == http.StatusForbidden && !strings.Contains(w.Body.String(), "address denied") {
+            t.Errorf("%s: status = %d, body %s; want %d", addr, w.Code, w.Body, want)
+        }
+    }
+}
@@ -0,0 +1,74 @@
+package main
+
+// Route labels name what sets an alternative apart, so clients can offer
+// "the well-lit route" rather than "alpha 0.75". Their text is in the
+// locales under "label.<key>".
+const (
+    labelShortest    = "shortest"
+    labelLowestRisk  = "lowest_risk"
+    labelMainStreets = "main_streets"
+    labelWellLit     = "well_lit"
+    labelBusinesses  = "past_businesses"
+)
+
+// A route earns a mix label when at least the label's share of its length
+// has the attribute and no alternative has more of it by over
+// labelMarginPct points.
+const (
+    mainStreetsPct = 50
+    wellLitPct     = 75
+    businessesPct  = 40
+    labelMarginPct = 5
+)
+
+type routeLabel struct {
+    Key  string `json:"key"`
+    Text string `json:"text"`
+}
+
+// labelRoutes labels each of the alternatives answered together, in the
+// localizer's language.
+func labelRoutes(routes []Route, l localizer) {
+    if len(routes) == 0 {
+        return
+    }
+    shortest, safest := routes[0].Distance, routes[0].Risk
+    var best RouteMix
+    for _, rt := range routes {
+        shortest = min(shortest, rt.Distance)
+        safest = min(safest, rt.Risk)
+        if rt.Mix != nil {
+            best.ArterialPct = max(best.ArterialPct, rt.Mix.ArterialPct)
+            best.LitPct = max(best.LitPct, rt.Mix.LitPct)
+            best.BusinessesPct = max(best.BusinessesPct, rt.Mix.BusinessesPct)
+        }
+    }
+    for i := range routes {
+        rt := &routes[i]
+        rt.Labels = nil
+        add := func(key string) {
+            rt.Labels = append(rt.Labels, routeLabel{Key: key, Text: l.T("label." + key)})
+        }
+        if rt.Distance <= shortest*(1+1e-9) {
+            add(labelShortest)
+        }
+        if rt.Risk <= safest+1e-9 {
+            add(labelLowestRisk)
+        }
+        if m := rt.Mix; m != nil {
+            if earnsLabel(m.ArterialPct, best.ArterialPct, mainStreetsPct) {
+                add(labelMainStreets)
+            }
+            if earnsLabel(m.LitPct, best.LitPct, wellLitPct) {
+                add(labelWellLit)
+            }
+            if earnsLabel(m.BusinessesPct, best.BusinessesPct, businessesPct) {
+                add(labelBusinesses)
+            }
+        }
+    }
+}
+
+func earnsLabel(pct, best, threshold float64) bool {
+    return pct >= threshold && pct >= best-labelMarginPct
+}
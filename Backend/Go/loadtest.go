@@ -0,0 +1,177 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "math/rand"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// runLoadTest sends random in-bounds route requests to a server at a fixed
+// rate and reports latency percentiles and error rates. Requests are
+// issued open-loop, so a slow server sees the configured rate rather than
+// one throttled by its own latency.
+func runLoadTest(args []string) error {
+    fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+    target := fs.String("target", "http://localhost:8080", "server to load")
+    qps := fs.Float64("qps", 10, "requests per second")
+    duration := fs.Duration("duration", 30*time.Second, "how long to send requests for")
+    boundsFlag := fs.String("bounds", "", "minX,minY,maxX,maxY to draw points from (default: the server's advertised bounds)")
+    apiKey := fs.String("api-key", "", "API key sent with every request")
+    seed := fs.Int64("seed", 1, "random seed for the origin/destination pairs")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if *qps <= 0 || *duration <= 0 {
+        return fmt.Errorf("-qps and -duration must be positive")
+    }
+
+    client := &http.Client{Timeout: 60 * time.Second}
+    var bounds Bounds
+    var err error
+    if *boundsFlag != "" {
+        bounds, err = parseBounds(*boundsFlag)
+    } else {
+        bounds, err = fetchBounds(client, *target, *apiKey)
+    }
+    if err != nil {
+        return err
+    }
+
+    rng := rand.New(rand.NewSource(*seed))
+    randomPoint := func() Point {
+        return Point{
+            X: bounds.MinX + rng.Float64()*(bounds.MaxX-bounds.MinX),
+            Y: bounds.MinY + rng.Float64()*(bounds.MaxY-bounds.MinY),
+        }
+    }
+
+    var (
+        mu        sync.Mutex
+        wg        sync.WaitGroup
+        latencies []time.Duration
+        statuses  = make(map[int]int)
+        failures  int
+    )
+    fmt.Printf("loading %s at %.1f qps for %v within %+v\n", *target, *qps, *duration, bounds)
+
+    ticker := time.NewTicker(time.Duration(float64(time.Second) / *qps))
+    defer ticker.Stop()
+    deadline := time.After(*duration)
+    sent := 0
+loop:
+    for {
+        select {
+        case <-deadline:
+            break loop
+        case <-ticker.C:
+            start, end := randomPoint(), randomPoint()
+            body, _ := json.Marshal(map[string]float64{
+                "start_x": start.X, "start_y": start.Y,
+                "end_x": end.X, "end_y": end.Y,
+            })
+            sent++
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                status, latency, err := sendLoadRequest(client, *target, *apiKey, body)
+                mu.Lock()
+                defer mu.Unlock()
+                if err != nil {
+                    failures++
+                    return
+                }
+                statuses[status]++
+                latencies = append(latencies, latency)
+            }()
+        }
+    }
+    wg.Wait()
+
+    errCount := failures
+    codes := make([]int, 0, len(statuses))
+    for status, n := range statuses {
+        if status >= 400 {
+            errCount += n
+        }
+        codes = append(codes, status)
+    }
+    sort.Ints(codes)
+    fmt.Printf("sent %d requests: %d transport failures, error rate %.2f%%\n",
+        sent, failures, 100*float64(errCount)/float64(max(sent, 1)))
+    for _, status := range codes {
+        fmt.Printf("  %d: %d\n", status, statuses[status])
+    }
+    printLatencies(latencies)
+    return nil
+}
+
+func sendLoadRequest(client *http.Client, target, apiKey string, body []byte) (int, time.Duration, error) {
+    req, err := http.NewRequest(http.MethodPost, target+"/route", bytes.NewReader(body))
+    if err != nil {
+        return 0, 0, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if apiKey != "" {
+        req.Header.Set("X-API-Key", apiKey)
+    }
+    start := time.Now()
+    resp, err := client.Do(req)
+    if err != nil {
+        return 0, 0, err
+    }
+    io.Copy(io.Discard, resp.Body)
+    resp.Body.Close()
+    return resp.StatusCode, time.Since(start), nil
+}
+
+func parseBounds(s string) (Bounds, error) {
+    parts := strings.Split(s, ",")
+    if len(parts) != 4 {
+        return Bounds{}, fmt.Errorf("bounds must be minX,minY,maxX,maxY")
+    }
+    var v [4]float64
+    for i, p := range parts {
+        f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+        if err != nil {
+            return Bounds{}, fmt.Errorf("bounds: %v", err)
+        }
+        v[i] = f
+    }
+    if v[0] >= v[2] || v[1] >= v[3] {
+        return Bounds{}, fmt.Errorf("bounds: minimum must be below maximum")
+    }
+    return Bounds{MinX: v[0], MinY: v[1], MaxX: v[2], MaxY: v[3]}, nil
+}
+
+// fetchBounds reads the serving bounds from the target's capabilities.
+func fetchBounds(client *http.Client, target, apiKey string) (Bounds, error) {
+    req, err := http.NewRequest(http.MethodGet, target+"/capabilities", nil)
+    if err != nil {
+        return Bounds{}, err
+    }
+    if apiKey != "" {
+        req.Header.Set("X-API-Key", apiKey)
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return Bounds{}, fmt.Errorf("fetching bounds: %v", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return Bounds{}, fmt.Errorf("fetching bounds: %s", resp.Status)
+    }
+    var caps capabilitiesResponse
+    if err := json.NewDecoder(resp.Body).Decode(&caps); err != nil {
+        return Bounds{}, fmt.Errorf("fetching bounds: %v", err)
+    }
+    return caps.Bounds, nil
+}
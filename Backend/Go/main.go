@@ -1,86 +1,352 @@
 package main
 
 import (
-    "container/heap"
+    "bytes"
     "encoding/json"
+    "errors"
     "fmt"
     "context"
     "log"
     "math"
     "net/http"
     "os"
+    "os/signal"
+    "sort"
+    "strings"
     "sync"
+    "syscall"
     "time"
+
+    "risk-router/geo"
 )
 
-// Global router instance
+// Global router instance and the configuration it was built from
 var globalRouter *RiskAwareRouter
+var globalConfig Config
 
 // Initialize function to set up the router once
-func initializeRouter() error {
-    crimeData := &CrimeData{}
+func initializeRouter(src dataSources) error {
     var err error
-    globalRouter, err = NewRiskAwareRouter("chicago_roads_with_risk.geojson", crimeData)
+    globalRouter, err = buildRouter(src, globalConfig.DefaultAlphas)
     if err != nil {
         return fmt.Errorf("failed to initialize router: %v", err)
     }
     return nil
 }
 
+// buildRouter loads a road network and the data served with it from src,
+// with the globally configured options, precomputing edge weights for the
+// given alphas.
+func buildRouter(src dataSources, alphas []float64) (*RiskAwareRouter, error) {
+    path := src.RoadNetworkPath
+    crimeData := &CrimeData{}
+    opts := RouterOptions{
+        BoundsPaddingM: globalConfig.BoundsPaddingM,
+        SnapWarningM:   globalConfig.SnapWarningM,
+        MaxSnapM:       globalConfig.MaxSnapM,
+        ClampToleranceM: globalConfig.ClampToleranceM,
+        BoundsMode:      globalConfig.GraphBounds,
+        LoadBounds:      src.LoadBounds,
+        Preload:         globalConfig.GraphPreload,
+        Alphas:             alphas,
+        RouteCacheEntries: globalConfig.RouteCacheEntries,
+        RouteCacheTTL:     time.Duration(globalConfig.RouteCacheTTLSeconds) * time.Second,
+        RiskMetadata:      globalConfig.RiskMetadata,
+        DuplicateEdges:    globalConfig.DuplicateEdges,
+        SourceCRS:         src.RoadNetworkCRS,
+        MemoryBudget:      globalConfig.graphMemoryBudget(),
+        NetworkLayers:     globalConfig.NetworkLayers,
+    }
+    if areas := src.BlockedAreasPath; areas != "" {
+        var err error
+        if opts.BlockedAreas, err = loadBlockedAreas(areas); err != nil {
+            return nil, fmt.Errorf("blocked areas: %v", err)
+        }
+    }
+    router, err := NewRiskAwareRouter(path, crimeData, opts)
+    if err != nil {
+        return nil, err
+    }
+    for _, lc := range src.RiskLayers {
+        layer, err := loadRiskLayer(router.G, router.layers.current(), lc)
+        if err != nil {
+            return nil, fmt.Errorf("risk layer %s: %v", lc.Path, err)
+        }
+        router.layers.add(layer)
+        log.Printf("Loaded risk layer %s from %s", layer.Version, lc.Path)
+    }
+    if len(globalConfig.RiskComponents) > 0 {
+        if err := router.loadRiskComponents(globalConfig.RiskComponents, globalConfig.Collisions); err != nil {
+            return nil, err
+        }
+        log.Printf("Composed risk layer %s from %d components", router.layers.current().Version, len(globalConfig.RiskComponents))
+    }
+    if attrsPath := src.RoadAttributesPath; attrsPath != "" {
+        if router.attrs, err = loadRoadAttributes(router.G, attrsPath, src.RoadNetworkCRS); err != nil {
+            return nil, fmt.Errorf("road attributes: %v", err)
+        }
+        log.Printf("Loaded road attributes from %s", attrsPath)
+    }
+    router.precomputeWeights(presetAlphas(globalConfig.Presets))
+    router.loadArcFlags(path)
+    return router, nil
+}
+
 type Bounds struct {
    MinX, MinY, MaxX, MaxY float64
 }
 
-type Point struct {
-   X, Y float64
+// Point is a position in degrees, X the longitude and Y the latitude.
+type Point = geo.Point
+
+// routeParams selects how a search weighs edges: an optional cap on
+// per-edge risk and the risk layer to score with (nil for the current one).
+type routeParams struct {
+   MaxEdgeRisk float64
+   Layer       *riskLayer
+   // HeuristicWeight inflates the A* heuristic (weighted A*): routes are
+   // found faster but may cost up to that factor more than the best one.
+   // Values below 1 search exactly.
+   HeuristicWeight float64
+   // EllipseFactor, when at least 1, skips nodes whose detour through
+   // them is longer than that factor of the straight start-end distance.
+   // A search that finds nothing inside the ellipse is rerun without it.
+   EllipseFactor float64
+   // ArcFlags lets the search use the router's arc flags when they were
+   // built for its layer and alpha. They are not used alongside closures
+   // or a risk cap, which remove edges the flags may rely on.
+   ArcFlags bool
+   // RiskAggregation is how each route's Risk is computed from its
+   // edges; empty or "length" keeps the length-weighted mean.
+   RiskAggregation string
+   // Debug attaches search diagnostics to every route, which findPath
+   // collects into stats.
+   Debug bool
+   stats *searchStats
+   // MinDissimilarity, when positive, keeps each route of a request at
+   // least that share of its length apart from the routes before it; see
+   // findDistinct.
+   MinDissimilarity float64
+   // penalties multiplies the weights of edges by their factor, steering
+   // the search off paths already taken. Hub trees and arc flags are not
+   // used alongside them.
+   penalties map[int32]float64
+   // MainStreets prefers higher-class roads, weighing each edge by
+   // mainStreetFactor; the router must have road attributes.
+   MainStreets bool
+   // LayersOff marks the network layers, by tag, whose edges the search
+   // skips; nil searches them all.
+   LayersOff []bool
+   // ProtectedLanes prefers protected bike lanes, weighing each edge by
+   // protectedLaneFactor; without road attributes it changes nothing.
+   ProtectedLanes bool
+}
+
+// customCost reports whether p changes edge costs, or drops edges, from
+// the plain weights hub trees and arc flags are built on.
+func (p routeParams) customCost() bool {
+   return p.penalties != nil || p.MainStreets || p.ProtectedLanes || p.LayersOff != nil
 }
 
+// maxHeuristicWeight caps the heuristic weight a request may ask for.
+const maxHeuristicWeight = 5
+
 type Route struct {
    Path      []Point   `json:"path"`
    Distance  float64   `json:"distance"` 
    Risk      float64   `json:"risk"`
    Alpha     float64   `json:"alpha"`
+   Summary   RouteSummary `json:"summary"`
+   Debug     *searchStats `json:"debug,omitempty"`
+   // IncidentsPerKm counts recent incidents near the route per kilometer.
+   IncidentsPerKm float64 `json:"incidents_per_km"`
+   // DetourPct and RiskReductionPct compare the route with the shortest
+   // one (alpha 0): how much longer and how much less risky it is.
+   DetourPct        float64 `json:"detour_pct"`
+   RiskReductionPct float64 `json:"risk_reduction_pct"`
+   // AlphaRange is the lowest and highest alpha whose paths were collapsed
+   // into this route for being alike.
+   AlphaRange *[2]float64 `json:"alpha_range,omitempty"`
+   // Mix is how much of the route runs on main streets, on lit streets,
+   // past businesses and on protected bike lanes, when road attributes
+   // are loaded; Labels name what sets it apart from the alternatives
+   // answered with it, and are left out of streamed answers.
+   Mix    *RouteMix    `json:"mix,omitempty"`
+   Labels []routeLabel `json:"labels,omitempty"`
 }
 
 type Edge struct {
    Start, End Point
    Distance   float64
    RiskScore  float64
+   Name       string
+   // Layer is the network layer the segment was loaded from, 0 for the
+   // road network; see NetworkLayerConfig.
+   Layer      uint8
 }
 
 type Graph struct {
-   Edges   map[Point]map[Point]Edge
-   mu      sync.RWMutex
+   // Edges collects segments while the graph is being built, several
+   // between the same ends when they are kept as parallel edges; index()
+   // converts it to the flat form below and releases it.
+   Edges   map[Point]map[Point][]Edge
+   // mu guards building. Once index() has run the graph is read-only,
+   // and searches read it without locking; a new road network is a new
+   // graph, swapped in with its router (see Tenant.Router()).
+   mu      sync.Mutex
    maxDist float64
+   // duplicatePolicy picks which of two segments with the same ends
+   // AddEdge keeps, or keeps both; duplicates, parallel and zeroLength
+   // count what it merged, kept alongside and dropped, for the load
+   // report.
+   duplicatePolicy string
+   duplicates      int
+   parallel        int
+   zeroLength      int
+   // sourceCRS is the CRS GeoJSON is loaded from, when known ahead;
+   // otherwise each file's own crs member decides, see sourceCRS.
+   sourceCRS string
+   // memoryBudget caps the bytes loading GeoJSON into the graph may
+   // take, 0 for no cap; see checkLoadBudget.
+   memoryBudget int64
+   // loadingLayer tags the segments AddEdge adds with the network layer
+   // being loaded; layers counts the layers loaded besides the roads.
+   loadingLayer uint8
+   layers       int
+   // blocked are the areas whose segments loading leaves out, counted
+   // by blockedSegments.
+   blocked         []blockedArea
+   blockedSegments int
+
+   // Nodes lists every node ordered by (X, Y); a node's index is its ID.
+   // IDs give the search a stable order to break ties on, so identical
+   // requests always produce identical paths.
+   Nodes   []Point
+
+   // Adjacency in compressed sparse row form: the edges leaving node n have
+   // IDs offsets[n] to offsets[n+1]-1 and are sorted by target ID. Every
+   // road segment appears once in each direction. These flat arrays are
+   // exactly what the binary graph format stores, so they can be served
+   // straight from an mmap'd file.
+   offsets  []int32
+   targets  []int32
+   dist     []float64
+   risk     []float64
+   nameIdx  []int32
+   nameOff  []uint32
+   nameData []byte
+   // layer is each edge's network layer, nil when the graph has none but
+   // the road network.
+   layer []uint8
+
+   // DataBounds is the bounding box of all loaded nodes.
+   DataBounds Bounds
+
+   // nodeIndex maps geohash cells to node IDs; segmentIndex maps them to
+   // the ID of each segment's edge leaving its lower-ID end.
+   nodeIndex    *spatialIndex
+   segmentIndex *spatialIndex
+
+   // Version and RiskVersion fingerprint the road topology and the risk
+   // scores respectively.
+   Version     string
+   RiskVersion string
+
+   // component labels each node with its connected component, so searches
+   // between islands of the network fail without exploring them.
+   component []int32
+
+   // mapping is the mmap'd binary graph file backing the arrays, if any.
+   mapping []byte
 }
 
 type RiskAwareRouter struct {
    G           *Graph
    CrimeData   *CrimeData
-   weightCache sync.Map
+   weights     edgeWeights
    nodeCache   sync.Map
+
+   // Bounds is the region requests may start and end in: the data bounds
+   // grown by the configured padding.
+   Bounds Bounds
+
+   snapWarningM    float64
+   maxSnapM        float64
+   clampToleranceM float64
+
+   searches *searchPool
+   routes   *routeCache
+   layers   riskLayers
+   overlays riskOverlays
+   composed composedLayers
+   closed   closures
+   arcFlags *arcFlags
+   hubs     hubSet
+   // attrs holds each edge's road attributes, nil when none are loaded.
+   attrs    []edgeAttrs
+   calendar riskCalendar
+   // loadedAt is when the road network was loaded.
+   loadedAt time.Time
+
+   reverseOnce sync.Once
+   reverse     []int32
+}
+
+// RouterOptions tunes how a router is built from its source data.
+type RouterOptions struct {
+   BoundsPaddingM  float64
+   SnapWarningM    float64
+   // MaxSnapM rejects request points farther than this from any road
+   // node; 0 snaps from any distance.
+   MaxSnapM        float64
+   ClampToleranceM float64
+   // BoundsMode and LoadBounds bound the road network as
+   // Config.GraphBounds and Config.LoadBounds describe.
+   BoundsMode string
+   LoadBounds Bounds
+   // Preload faults an mmap'd binary graph into memory at startup instead
+   // of paging it in on first access.
+   Preload bool
+   // Alphas are the risk weights to precompute edge weights for.
+   Alphas []float64
+   // RouteCacheEntries and RouteCacheTTL size the route response cache;
+   // zero entries disables it.
+   RouteCacheEntries int
+   RouteCacheTTL     time.Duration
+   // RiskMetadata describes the risk scores shipped with the road network.
+   RiskMetadata RiskLayerMetadata
+   // DuplicateEdges is the policy for GeoJSON segments loaded twice, as
+   // Config.DuplicateEdges describes; empty keeps the lower risk.
+   DuplicateEdges string
+   // SourceCRS is the CRS of a GeoJSON road network, as
+   // Config.RoadNetworkCRS describes.
+   SourceCRS string
+   // MemoryBudget caps the memory a graph may take, in bytes, as
+   // Config.GraphMemoryBudgetMB describes; 0 is no cap.
+   MemoryBudget int64
+   // NetworkLayers are loaded into a GeoJSON road network's graph, as
+   // Config.NetworkLayers describes.
+   NetworkLayers []NetworkLayerConfig
+   // BlockedAreas are left out of a GeoJSON road network and its layers,
+   // as Config.BlockedAreasPath describes.
+   BlockedAreas []blockedArea
 }
 
 type CrimeData struct {
    Points   []Point
    Severity []float64
+   Times    []time.Time
    mu       sync.RWMutex
+   index    *spatialIndex
 }
 
-type Item struct {
-   point    Point
-   priority float64
-   index    int
-}
-
-type PriorityQueue []*Item
-
 func enableCors(handler http.HandlerFunc) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         // Set CORS headers
         w.Header().Set("Access-Control-Allow-Origin", "*")
-        w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-User-Token, If-None-Match, X-Risk-Version, X-Request-Deadline, Grpc-Timeout, X-Key-Id, X-Timestamp, X-Nonce, X-Signature")
+        w.Header().Set("Access-Control-Expose-Headers", "ETag, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Retry-After, X-JWS-Signature")
 
         // Handle preflight requests
         if r.Method == "OPTIONS" {
@@ -92,29 +358,6 @@ func enableCors(handler http.HandlerFunc) http.HandlerFunc {
     }
 }
 
-func (pq PriorityQueue) Len() int { return len(pq) }
-func (pq PriorityQueue) Less(i, j int) bool { return pq[i].priority < pq[j].priority }
-func (pq PriorityQueue) Swap(i, j int) {
-   pq[i], pq[j] = pq[j], pq[i]
-   pq[i].index = i
-   pq[j].index = j
-}
-func (pq *PriorityQueue) Push(x interface{}) {
-   n := len(*pq)
-   item := x.(*Item)
-   item.index = n
-   *pq = append(*pq, item)
-}
-func (pq *PriorityQueue) Pop() interface{} {
-   old := *pq
-   n := len(old)
-   item := old[n-1]
-   old[n-1] = nil
-   item.index = -1
-   *pq = old[0 : n-1]
-   return item
-}
-
 var chicagoBounds = Bounds{
    MinX: -87.94011,
    MinY: 41.64454,
@@ -124,32 +367,68 @@ var chicagoBounds = Bounds{
 
 func NewGraph() *Graph {
    return &Graph{
-       Edges: make(map[Point]map[Point]Edge),
+       Edges: make(map[Point]map[Point][]Edge),
+       duplicatePolicy: duplicateMinRisk,
    }
 }
 
-func (g *Graph) AddEdge(start, end Point, distance, riskScore float64) {
+// AddEdge adds a segment in both directions. Zero-length segments are
+// dropped, and a segment with the same ends as one already added is
+// merged with it, or kept as a parallel edge, by the graph's duplicate
+// policy.
+func (g *Graph) AddEdge(start, end Point, distance, riskScore float64, name string) {
    g.mu.Lock()
    defer g.mu.Unlock()
 
-   if g.Edges[start] == nil {
-       g.Edges[start] = make(map[Point]Edge)
+   if start == end {
+       g.zeroLength++
+       return
    }
-   g.Edges[start][end] = Edge{
+   edge := Edge{
        Start: start,
        End: end,
        Distance: distance,
        RiskScore: riskScore,
+       Name: name,
+       Layer: g.loadingLayer,
    }
-
-   if g.Edges[end] == nil {
-       g.Edges[end] = make(map[Point]Edge)
-   }
-   g.Edges[end][start] = Edge{
+   back := Edge{
        Start: end,
        End: start,
        Distance: distance,
        RiskScore: riskScore,
+       Name: name,
+       Layer: g.loadingLayer,
+   }
+
+   if g.Edges[start] == nil {
+       g.Edges[start] = make(map[Point][]Edge)
+   }
+   if g.Edges[end] == nil {
+       g.Edges[end] = make(map[Point][]Edge)
+   }
+   existing := g.Edges[start][end]
+   switch {
+   case len(existing) == 0:
+       g.Edges[start][end] = []Edge{edge}
+       g.Edges[end][start] = []Edge{back}
+   case g.duplicatePolicy == duplicateParallel:
+       for _, old := range existing {
+           if old == edge {
+               g.duplicates++
+               return
+           }
+       }
+       g.parallel++
+       g.Edges[start][end] = append(existing, edge)
+       g.Edges[end][start] = append(g.Edges[end][start], back)
+   default:
+       g.duplicates++
+       if !replacesDuplicate(g.duplicatePolicy, existing[0], distance, riskScore) {
+           return
+       }
+       g.Edges[start][end] = []Edge{edge}
+       g.Edges[end][start] = []Edge{back}
    }
 
    if distance > g.maxDist {
@@ -157,89 +436,195 @@ func (g *Graph) AddEdge(start, end Point, distance, riskScore float64) {
    }
 }
 
-func (r *RiskAwareRouter) validatePoints(start, end Point) error {
-   if !isInBounds(start, chicagoBounds) {
-       return fmt.Errorf("start point outside bounds")
+func (r *RiskAwareRouter) findNearestNode(p Point) int32 {
+   // Snapping measures planar distance in degrees, as it always has;
+   // equidistant nodes resolve to the lowest ID.
+   hits := r.G.nodeIndex.nearest(p, 1, planarCellSize, func(id int32) float64 {
+       node := r.G.Nodes[id]
+       return math.Hypot(node.X-p.X, node.Y-p.Y)
+   })
+   return hits[0].id
+}
+
+// NewRiskAwareRouter loads a road network from GeoJSON, or from the binary
+// format written by build-graph when the path ends in .bin.
+func NewRiskAwareRouter(graphPath string, crimeData *CrimeData, opts RouterOptions) (*RiskAwareRouter, error) {
+   graph, err := loadGraph(graphPath, opts)
+   if err != nil {
+       return nil, err
+   }
+   router := &RiskAwareRouter{
+       G: graph,
+       CrimeData: crimeData,
+       Bounds: opts.servingBounds(graph),
+       snapWarningM: opts.SnapWarningM,
+       maxSnapM: opts.MaxSnapM,
+       clampToleranceM: opts.ClampToleranceM,
+       searches: newSearchPool(len(graph.Nodes)),
+       routes: newRouteCache(opts.RouteCacheEntries, opts.RouteCacheTTL),
+       loadedAt: time.Now().UTC(),
    }
-   if !isInBounds(end, chicagoBounds) {
-       return fmt.Errorf("end point outside bounds")
+   base := &riskLayer{
+       Version: graph.RiskVersion,
+       Metadata: opts.RiskMetadata,
+       LoadedAt: time.Now().UTC(),
+       risk: graph.risk,
    }
-   return nil
+   if n := fitNormalizer(opts.RiskMetadata.Normalization, graph.risk); n != nil {
+       base.risk = n.applyAll(graph.risk)
+       base.Version = graph.hashRisk(base.risk)
+       base.Metadata.NormalizationParams = n.params()
+       base.normalizer = n
+   }
+   router.layers.add(base)
+   router.precomputeWeights(opts.Alphas)
+   return router, nil
 }
 
-func (r *RiskAwareRouter) findNearestPoint(p Point) Point {
-   r.G.mu.RLock()
-   defer r.G.mu.RUnlock()
-
-   minDist := math.MaxFloat64
-   var nearest Point
-
-   for node := range r.G.Edges {
-       dist := math.Sqrt(math.Pow(node.X-p.X, 2) + math.Pow(node.Y-p.Y, 2))
-       if dist < minDist {
-           minDist = dist
-           nearest = node
+// loadGraph reads a binary graph, or a GeoJSON road network clipped to the
+// load bounds in opts, and labels its components.
+func loadGraph(graphPath string, opts RouterOptions) (*Graph, error) {
+   var graph *Graph
+   if strings.HasSuffix(graphPath, ".bin") {
+       if len(opts.NetworkLayers) > 0 {
+           return nil, fmt.Errorf("%s: network layers load into a GeoJSON road network, not a binary graph", graphPath)
+       }
+       if len(opts.BlockedAreas) > 0 {
+           log.Printf("Blocked areas are not applied to the binary graph %s; build it with build-graph -blocked", graphPath)
+       }
+       var err error
+       if graph, err = loadGraphBinary(graphPath, opts.Preload); err != nil {
+           return nil, err
+       }
+   } else {
+       graph = NewGraph()
+       if opts.DuplicateEdges != "" {
+           graph.duplicatePolicy = opts.DuplicateEdges
        }
+       graph.sourceCRS = opts.SourceCRS
+       graph.memoryBudget = opts.MemoryBudget
+       graph.blocked = opts.BlockedAreas
+       if err := loadRoadNetwork(graphPath, graph, opts.loadClip()); err != nil {
+           return nil, err
+       }
+       if err := addNetworkLayers(graph, opts.NetworkLayers, opts.loadClip()); err != nil {
+           return nil, err
+       }
+       graph.index()
    }
-   return nearest
-}
-
-func NewRiskAwareRouter(geojsonPath string, crimeData *CrimeData) (*RiskAwareRouter, error) {
-   graph := NewGraph()
-   if err := loadRoadNetwork(geojsonPath, graph); err != nil {
-       return nil, err
+   if len(graph.Nodes) == 0 {
+       return nil, fmt.Errorf("no road segments loaded from %s", graphPath)
    }
-   return &RiskAwareRouter{
-       G: graph,
-       CrimeData: crimeData,
-   }, nil
+   graph.labelComponents()
+   if mem := graph.memory(); opts.MemoryBudget > 0 && mem.Heap > opts.MemoryBudget {
+       return nil, fmt.Errorf("%s takes %d MB of heap, over the graph memory budget of %d MB", graphPath, mem.Heap>>20, opts.MemoryBudget>>20)
+   }
+   return graph, nil
 }
 
-func loadRoadNetwork(path string, graph *Graph) error {
+// loadRoadNetwork adds the LineString features of a GeoJSON file to graph,
+// dropping segments outside clip unless it is nil.
+func loadRoadNetwork(path string, graph *Graph, clip *Bounds) error {
    file, err := os.ReadFile(path)
    if err != nil {
        return err
    }
+   return addRoadNetwork(file, path, graph, clip)
+}
 
-   var geojsonData map[string]interface{}
+// addRoadNetwork adds the features of GeoJSON data, read from the named
+// dataset, to graph, which must have no edges yet. Features are decoded
+// and added by parallel workers; see addFeatures.
+func addRoadNetwork(file []byte, path string, graph *Graph, clip *Bounds) error {
+   if len(graph.Edges) > 0 {
+       return fmt.Errorf("%s: road networks load into an empty graph", path)
+   }
+   if err := checkLoadBudget(path, int64(len(file)), graph.memoryBudget); err != nil {
+       return err
+   }
+   var geojsonData struct {
+       CRS      interface{}       `json:"crs"`
+       Features []json.RawMessage `json:"features"`
+   }
    if err := json.Unmarshal(file, &geojsonData); err != nil {
        return err
    }
-
-   features, ok := geojsonData["features"].([]interface{})
-   if !ok {
+   if geojsonData.Features == nil {
        return fmt.Errorf("invalid GeoJSON")
    }
+   features, err := parseFeatures(geojsonData.Features)
+   if err != nil {
+       return err
+   }
+   crs, err := sourceCRS(geojsonData.CRS, features, graph.sourceCRS)
+   if err != nil {
+       return fmt.Errorf("%s: %v", path, err)
+   }
+   if crs != crsWGS84 {
+       log.Printf("Reprojecting %s from %s", path, crs)
+   }
 
-   for _, feature := range features {
-       processFeature(feature, graph)
+   skipped := addFeatures(graph, features, clip, crs)
+   reasons := make([]string, 0, len(skipped))
+   for reason := range skipped {
+       reasons = append(reasons, reason)
+   }
+   sort.Strings(reasons)
+   for _, reason := range reasons {
+       reportWarning(map[string]string{"dataset": path}, "skipped %d features in %s: %s", skipped[reason], path, reason)
+   }
+   if graph.blockedSegments > 0 {
+       log.Printf("Left out %d segments in blocked areas from %s", graph.blockedSegments, path)
+   }
+   if graph.zeroLength > 0 {
+       reportWarning(map[string]string{"dataset": path}, "dropped %d zero-length segments in %s", graph.zeroLength, path)
+   }
+   if graph.duplicates > 0 {
+       reportWarning(map[string]string{"dataset": path}, "merged %d duplicate segments in %s, keeping by %s", graph.duplicates, path, graph.duplicatePolicy)
+   }
+   if graph.parallel > 0 {
+       log.Printf("Kept %d parallel segments in %s", graph.parallel, path)
    }
    return nil
 }
 
-func processFeature(feature interface{}, graph *Graph) {
+// featureSegments returns a LineString feature's segments, in crs, that
+// lie inside clip (all of them when clip is nil), converted to WGS84. It
+// also returns why the feature was skipped, or "" if it was used. Every
+// vertex becomes a node and every pair of consecutive vertices an edge,
+// so edges are straight and a path through the nodes follows the street's
+// full shape. Edges are never merged: the risk term of an edge's weight
+// does not scale with its length, so merging would change which routes
+// win as well as drop the vertices between.
+func featureSegments(feature interface{}, clip *Bounds, crs string) ([]Edge, string) {
    f, ok := feature.(map[string]interface{})
    if !ok {
-       return
+       return nil, "feature is not an object"
    }
 
    geometry, ok := f["geometry"].(map[string]interface{})
-   if !ok || geometry["type"].(string) != "LineString" {
-       return
+   if !ok {
+       return nil, "missing geometry"
+   }
+   if kind, _ := geometry["type"].(string); kind != "LineString" {
+       return nil, "geometry is not a LineString"
    }
 
    coordinates, ok := geometry["coordinates"].([]interface{})
    if !ok || len(coordinates) < 2 {
-       return
+       return nil, "LineString has fewer than two coordinates"
    }
 
    riskScore := 0.5
+   name := ""
    if properties, ok := f["properties"].(map[string]interface{}); ok {
        if risk, exists := properties["risk_score"]; exists {
            riskScore, _ = risk.(float64)
        }
+       name, _ = properties["name"].(string)
    }
 
+   var segments []Edge
    for i := 0; i < len(coordinates)-1; i++ {
        coord1, ok1 := coordinates[i].([]interface{})
        coord2, ok2 := coordinates[i+1].([]interface{})
@@ -248,14 +633,18 @@ func processFeature(feature interface{}, graph *Graph) {
            continue
        }
 
-       start := Point{X: coord1[0].(float64), Y: coord1[1].(float64)}
-       end := Point{X: coord2[0].(float64), Y: coord2[1].(float64)}
+       start := toWGS84(Point{X: coord1[0].(float64), Y: coord1[1].(float64)}, crs)
+       end := toWGS84(Point{X: coord2[0].(float64), Y: coord2[1].(float64)}, crs)
 
-       if isInBounds(start, chicagoBounds) && isInBounds(end, chicagoBounds) {
+       if clip == nil || isInBounds(start, *clip) && isInBounds(end, *clip) {
            distance := math.Sqrt(math.Pow(end.X-start.X, 2) + math.Pow(end.Y-start.Y, 2))
-           graph.AddEdge(start, end, distance, riskScore)
+           segments = append(segments, Edge{Start: start, End: end, Distance: distance, RiskScore: riskScore, Name: name})
        }
    }
+   if len(segments) == 0 {
+       return nil, "no segment inside the load bounds"
+   }
+   return segments, ""
 }
 
 func isInBounds(p Point, bounds Bounds) bool {
@@ -263,82 +652,293 @@ func isInBounds(p Point, bounds Bounds) bool {
           p.Y >= bounds.MinY && p.Y <= bounds.MaxY
 }
 
-func (r *RiskAwareRouter) FindRoute(start, end Point, alpha float64) ([]Point, float64, float64, error) {
-   nearestStart := r.findNearestPoint(start)
-   nearestEnd := r.findNearestPoint(end)
+func (r *RiskAwareRouter) FindRoute(ctx context.Context, start, end Point, alpha float64) ([]Point, float64, float64, error) {
+   path, _, distance, risk, err := r.findPath(ctx, r.findNearestNode(start), r.findNearestNode(end), alpha, routeParams{})
+   return path, distance, risk, err
+}
+
+// findPath runs an A* search between two node IDs, scoring edges with the
+// risk layer in p and skipping edges whose risk exceeds p.MaxEdgeRisk when
+// it is positive. The search gives up with the context's error once ctx is
+// done, checking every cancelCheckInterval expansions. It returns the
+// path's points and the edges between them, which tell apart parallel
+// edges the points cannot.
+func (r *RiskAwareRouter) findPath(ctx context.Context, startID, endID int32, alpha float64, p routeParams) ([]Point, []int32, float64, float64, error) {
+   layer := p.Layer
+   if layer == nil {
+       layer = r.activeLayer()
+   }
+   closed := r.closed.load()
+   if p.MaxEdgeRisk == 0 && !p.customCost() {
+       if tree := r.hubs.tree(endID, alpha, layer, closed); tree != nil {
+           if p.stats != nil {
+               p.stats.HubTree = true
+           }
+           return r.followTree(tree, startID, endID, layer.risk)
+       }
+   }
+   if p.stats != nil {
+       p.stats.WeightsCached = r.weights.held(layer.Version, alpha)
+   }
+   weights := r.weightsFor(layer, alpha)
+   if p.MainStreets {
+       weights = r.mainStreetWeights(layer, alpha)
+   }
+   if p.ProtectedLanes {
+       weights = r.protectedLaneWeights(layer, alpha)
+   }
+   release, err := globalSearchWorkers.acquire(ctx)
+   if err != nil {
+       return nil, nil, 0, 0, err
+   }
+   defer release()
+   // A search the ellipse or arc flags pruned is rerun without them on the
+   // same worker; asking for another while holding this one would wait
+   // forever on a pool of one.
+   for {
+       path, edges, dist, risk, pruned, err := r.search(ctx, startID, endID, alpha, p, layer, closed, weights)
+       if !pruned {
+           return path, edges, dist, risk, err
+       }
+       if p.stats != nil {
+           p.stats.Reruns++
+       }
+       p.EllipseFactor = 0
+       p.ArcFlags = false
+   }
+}
+
+// search runs one A* search from startID to endID; pruned reports a
+// failed search that left out edges, which may have hidden the path.
+func (r *RiskAwareRouter) search(ctx context.Context, startID, endID int32, alpha float64, p routeParams, layer *riskLayer, closed *closureSet, weights []float64) (path []Point, edges []int32, dist, risk float64, pruned bool, err error) {
+   g := r.G
+   goal := g.Nodes[endID]
+   s := r.searches.get()
+   defer r.searches.put(s)
+
+   // Straight-line distance bounds the distance term of the remaining
+   // cost, which is weighted by 1-alpha; risk adds nothing to the bound.
+   hWeight := (1 - alpha) * max(p.HeuristicWeight, 1)
+
+   origin := g.Nodes[startID]
+   ellipse := 0.0
+   if p.EllipseFactor >= 1 {
+       ellipse = p.EllipseFactor * r.heuristic(origin, goal)
+   }
 
-   frontier := &PriorityQueue{}
-   heap.Init(frontier)
-   heap.Push(frontier, &Item{point: nearestStart, priority: r.heuristic(nearestStart, nearestEnd)})
+   var flags []uint64
+   var targetBit uint64
+   if p.ArcFlags && p.MaxEdgeRisk == 0 && closed == nil && !p.customCost() {
+       flags, targetBit = r.arcFlags.forSearch(layer, alpha, goal)
+   }
 
-   costSoFar := map[Point]float64{nearestStart: 0}
-   cameFrom := make(map[Point]Point)
+   s.relax(startID, 0, -1)
+   s.frontier.push(startID, hWeight*r.heuristic(g.Nodes[startID], goal))
 
-   for frontier.Len() > 0 {
-       current := heap.Pop(frontier).(*Item).point
+   expanded := 0
+   if scope := scopeFromContext(ctx); scope != nil {
+       defer func() { scope.nodesExpanded += expanded }()
+   }
+   if p.stats != nil {
+       p.stats.ArcFlags = flags != nil
+       defer func() { p.stats.NodesExpanded += expanded }()
+   }
+   for s.frontier.Len() > 0 {
+       if p.stats != nil {
+           p.stats.HeapPeak = max(p.stats.HeapPeak, s.frontier.Len())
+       }
+       if expanded%cancelCheckInterval == 0 {
+           if err := ctx.Err(); err != nil {
+               return nil, nil, 0, 0, false, err
+           }
+       }
+       current := s.frontier.pop()
+       expanded++
 
-       if current == nearestEnd {
-           return r.reconstructPath(cameFrom, current)
+       if current == endID {
+           path, edges, dist, risk, err = r.reconstructPath(s, current, layer.risk)
+           return path, edges, dist, risk, false, err
        }
 
-       r.G.mu.RLock()
-       neighbors := r.G.Edges[current]
-       r.G.mu.RUnlock()
+       lo, hi := g.edgeRange(current)
 
-       for nextPoint, edge := range neighbors {
-           newCost := costSoFar[current] + r.calculateEdgeWeight(edge, alpha)
+       for e := lo; e < hi; e++ {
+           if p.MaxEdgeRisk > 0 && layer.risk[e] > p.MaxEdgeRisk || closed.closed(e) {
+               continue
+           }
+           if p.LayersOff != nil && g.layer != nil && p.LayersOff[g.layer[e]] {
+               continue
+           }
+           if flags != nil && flags[e]&targetBit == 0 {
+               pruned = true
+               continue
+           }
+           next := g.targets[e]
+           weight := weights[e]
+           if p.penalties != nil {
+               if f, ok := p.penalties[e]; ok {
+                   weight *= f
+               }
+           }
+           newCost := s.cost[current] + weight
+           if ellipse > 0 && newCost < s.cost[next] {
+               if at := g.Nodes[next]; r.heuristic(origin, at)+r.heuristic(at, goal) > ellipse {
+                   pruned = true
+                   continue
+               }
+           }
 
-           if cost, exists := costSoFar[nextPoint]; !exists || newCost < cost {
-               costSoFar[nextPoint] = newCost
-               priority := newCost + r.heuristic(nextPoint, nearestEnd)
-               heap.Push(frontier, &Item{point: nextPoint, priority: priority})
-               cameFrom[nextPoint] = current
+           if newCost < s.cost[next] {
+               s.relax(next, newCost, e)
+               s.frontier.push(next, newCost+hWeight*r.heuristic(g.Nodes[next], goal))
            }
        }
    }
 
-   return nil, 0, 0, fmt.Errorf("no path found")
+   if pruned {
+       return nil, nil, 0, 0, true, nil
+   }
+   return nil, nil, 0, 0, false, fmt.Errorf("no path found")
+}
+
+func (r *RiskAwareRouter) calculateRoutes(ctx context.Context, start, end Point, alphas []float64) ([]Route, error) {
+   routes, _, err := r.routesBetween(ctx, r.snap(start, "start"), r.snap(end, "end"), alphas, routeParams{})
+   return routes, err
 }
 
-func (r *RiskAwareRouter) calculateRoutes(start, end Point, alphas []float64) ([]Route, error) {
+// routeBudgetReserve is the share of a request's remaining time kept back
+// from its searches for encoding and writing the response.
+const routeBudgetReserve = 0.1
+
+// routesBetween computes one route per alpha between already snapped points.
+// When ctx has a deadline, each search gets an equal share of the time left
+// for the alphas still to run, so time a fast search leaves over goes to
+// the ones after it. Alphas whose search runs out of its share are dropped
+// and reported as truncated; only when none found a route is the deadline
+// an error. A cancelled ctx stops the searches and returns its error.
+func (r *RiskAwareRouter) routesBetween(ctx context.Context, start, end SnapResult, alphas []float64, p routeParams) ([]Route, bool, error) {
    var routes []Route
+   truncated, err := r.eachRoute(ctx, start, end, alphas, p, func(route Route) {
+       routes = append(routes, route)
+   })
+   if err != nil {
+       return nil, truncated, err
+   }
+   return routes, truncated, nil
+}
+
+// eachRoute is routesBetween handing each route to emit as soon as its
+// search finishes, in the order of alphas. Routes found after the alpha 0
+// one are compared with it. With p.MinDissimilarity, alphas that find no
+// route far enough from the ones before are left out.
+func (r *RiskAwareRouter) eachRoute(ctx context.Context, start, end SnapResult, alphas []float64, p routeParams, emit func(Route)) (bool, error) {
+   if !r.G.connected(start.node, end.node) {
+       return false, errNotConnected
+   }
+   found := 0
+   truncated := false
+   var reference *Route
+   var taken [][]Point
+   deadline, budgeted := ctx.Deadline()
+   if budgeted {
+       deadline = deadline.Add(-time.Duration(routeBudgetReserve * float64(time.Until(deadline))))
+   }
    
-   for _, alpha := range alphas {
-       path, distance, risk, err := r.FindRoute(start, end, alpha)
+   for i, alpha := range alphas {
+       searchCtx, cancel := ctx, context.CancelFunc(func() {})
+       if budgeted {
+           share := time.Until(deadline) / time.Duration(len(alphas)-i)
+           searchCtx, cancel = context.WithTimeout(ctx, share)
+       }
+       searchParams := p
+       if p.Debug {
+           searchParams.stats = &searchStats{}
+       }
+       began := time.Now()
+       path, edges, distance, risk, err := r.findDistinct(searchCtx, start.node, end.node, alpha, searchParams, taken)
+       cancel()
+       if errors.Is(err, errTooSimilar) {
+           continue
+       }
        if err != nil {
+           if errors.Is(ctx.Err(), context.Canceled) {
+               return false, ctx.Err()
+           }
+           if searchCtx.Err() != nil {
+               truncated = true
+           }
            continue
        }
        
-       routes = append(routes, Route{
+       found++
+       taken = append(taken, path)
+       stats := searchParams.stats
+       if stats != nil {
+           stats.SearchMS = msSince(began)
+           began = time.Now()
+       }
+       route := Route{
            Path: path,
            Distance: distance,
            Risk: risk,
            Alpha: alpha,
-       })
+           Summary: r.summarize(path, globalConfig.WalkingSpeedMPS),
+           Debug: stats,
+       }
+       route.Mix = r.routeMix(edges)
+       if r.CrimeData != nil {
+           route.IncidentsPerKm = r.CrimeData.incidentsPerKm(path, route.Summary.LengthM, globalConfig.ExposureRadiusM, exposureSince())
+       }
+       if agg := p.RiskAggregation; agg != "" && agg != aggregateLength {
+           layer := p.Layer
+           if layer == nil {
+               layer = r.activeLayer()
+           }
+           route.Risk = r.aggregateRisk(edges, layer.risk, agg, globalConfig.WalkingSpeedMPS)
+       }
+       if stats != nil {
+           stats.SummaryMS = msSince(began)
+       }
+       if alpha == 0 && reference == nil {
+           reference = &route
+       }
+       if reference != nil {
+           route.compareTo(*reference)
+       }
+       emit(route)
    }
    
-   if len(routes) == 0 {
-       return nil, fmt.Errorf("no valid routes found")
+   if found == 0 {
+       if truncated {
+           return true, context.DeadlineExceeded
+       }
+       return false, fmt.Errorf("no valid routes found")
+   }
+   if scope := scopeFromContext(ctx); scope != nil {
+       scope.routes += found
    }
    
-   return routes, nil
+   return truncated, nil
 }
 
-func (r *RiskAwareRouter) reconstructPath(cameFrom map[Point]Point, current Point) ([]Point, float64, float64, error) {
-   path := []Point{current}
+func (r *RiskAwareRouter) reconstructPath(s *searchState, current int32, risk []float64) ([]Point, []int32, float64, float64, error) {
+   g := r.G
+   path := []Point{g.Nodes[current]}
+   var edges []int32
    totalDist := 0.0
    totalRisk := 0.0
 
    for {
-       prev, exists := cameFrom[current]
-       if !exists {
+       e := s.cameFrom[current]
+       if e < 0 {
            break
        }
 
-       path = append([]Point{prev}, path...)
-       edge := r.G.Edges[prev][current]
-       totalDist += edge.Distance
-       totalRisk += edge.RiskScore * edge.Distance
+       prev := g.source(e)
+       path = append([]Point{g.Nodes[prev]}, path...)
+       edges = append([]int32{e}, edges...)
+       totalDist += g.dist[e]
+       totalRisk += risk[e] * g.dist[e]
        current = prev
    }
 
@@ -347,105 +947,535 @@ func (r *RiskAwareRouter) reconstructPath(cameFrom map[Point]Point, current Poin
        avgRisk = totalRisk / totalDist
    }
 
-   return path, totalDist, avgRisk, nil
+   return path, edges, totalDist, avgRisk, nil
 }
 
 func (r *RiskAwareRouter) heuristic(a, b Point) float64 {
    return math.Sqrt(math.Pow(a.X-b.X, 2) + math.Pow(a.Y-b.Y, 2))
 }
 
-func (r *RiskAwareRouter) calculateEdgeWeight(edge Edge, alpha float64) float64 {
-   cacheKey := fmt.Sprintf("%v-%v-%f", edge.Start, edge.End, alpha)
-   if weight, ok := r.weightCache.Load(cacheKey); ok {
-       return weight.(float64)
-   }
+// routeRequest is the body of POST /route.
+type routeRequest struct {
+    // Each end is given either as start_x/start_y (x being the
+    // longitude) or as start, a {"lat", "lon"} object or a GeoJSON
+    // [lon, lat] position; likewise for end.
+    StartX *float64    `json:"start_x"`
+    StartY *float64    `json:"start_y"`
+    EndX   *float64    `json:"end_x"`
+    EndY   *float64    `json:"end_y"`
+    Start  *Coordinate `json:"start"`
+    End    *Coordinate `json:"end"`
+    // CRS is the coordinate reference system of the request's x/y
+    // points and positions and of the points in the answer, "EPSG:4326"
+    // or "EPSG:3857"; the config's crs applies when it is omitted.
+    CRS string `json:"crs"`
+    // Clamp moves points that are just outside the serving bounds
+    // (within the configured tolerance) onto the bounds edge.
+    Clamp bool `json:"clamp"`
+    // Preset names a server-configured bundle of routing parameters
+    // that replaces the tenant's default alphas.
+    Preset string `json:"preset"`
+    // RiskVersion pins a risk layer from GET /risk-layers; the
+    // X-Risk-Version header does the same.
+    RiskVersion string `json:"risk_version"`
+    // RiskWeights adjusts the weights of named risk components, each
+    // within the bounds /capabilities lists, e.g. {"traffic": 0}.
+    RiskWeights map[string]float64 `json:"risk_weights"`
+    // HeuristicWeight trades optimality for speed on long routes;
+    // the config's heuristic_weight applies when it is omitted.
+    HeuristicWeight *float64 `json:"heuristic_weight" schema:"minimum=1"`
+    // RiskAggregation picks how route risk is computed: "length"
+    // (length-weighted mean), "mean", "max" or "exposure"; the config's
+    // risk_aggregation applies when it is omitted.
+    RiskAggregation string `json:"risk_aggregation"`
+    // Debug adds search statistics per route and phase timings, and
+    // bypasses the response cache.
+    Debug bool `json:"debug"`
+    // Anonymous, like a DNT or Sec-GPC header, keeps the request out of
+    // recordings, the response cache and saved routes.
+    Anonymous bool `json:"anonymous"`
+    // Fields picks the fields of each route to answer with, e.g.
+    // "distance,risk,alpha" to leave out the path; ?fields= does the
+    // same. Every field is answered when it is omitted.
+    Fields string `json:"fields"`
+    // History adds the answer to the route history of the user an
+    // X-User-Token names, listed by GET /me/routes. Like saved routes,
+    // anonymous requests and privacy mode keep it out.
+    History bool `json:"history"`
+    // MinDissimilarity keeps the routes apart: each must have at least
+    // that share of its length, within [0, 1), off the routes of the
+    // alphas before it. Alphas whose route cannot be steered far enough
+    // away are left out of the answer.
+    MinDissimilarity float64 `json:"min_dissimilarity" schema:"minimum=0"`
+    // MainStreets biases every route toward main streets, which have more
+    // foot traffic and lighting, even where side streets are shorter.
+    // It needs the server's road attributes; see /capabilities.
+    MainStreets bool `json:"main_streets"`
+    // Layers turns the server's network layers, such as campus paths or
+    // skyways, on or off by name, e.g. {"tunnels": false}; the others
+    // stay as configured. /capabilities lists them.
+    Layers map[string]bool `json:"layers"`
+    // DepartAt, an RFC 3339 time and now by default, picks the risk
+    // calendar rules routes are scored with. Pinning a risk version
+    // leaves the calendar out.
+    DepartAt string `json:"depart_at"`
+    // Collapse, on by default, answers routes of neighbouring alphas
+    // whose paths share at least the config's route_similarity of their
+    // length once, with the alpha_range they cover; false answers a route
+    // per alpha. Streamed answers are never collapsed.
+    Collapse *bool `json:"collapse"`
+}
 
-   normDistance := edge.Distance / r.G.maxDist
-   weight := ((1 - alpha) * normDistance + alpha*edge.RiskScore) * r.G.maxDist
-   r.weightCache.Store(cacheKey, weight)
-   return weight
+// routeResponse is the body of a POST /route answer.
+type routeResponse struct {
+    RouteID string         `json:"route_id"`
+    Routes  []fieldedRoute `json:"routes"`
+    routeSummary
+    // Truncated is set when some alphas ran out of time and are
+    // missing from Routes.
+    Truncated bool          `json:"truncated"`
+    Debug     *requestDebug `json:"debug,omitempty"`
 }
 
+// routeSummary is everything in a route response but its routes.
+type routeSummary struct {
+    Center      Point           `json:"center"`
+    StartPoint  Point           `json:"start"`
+    EndPoint    Point           `json:"end"`
+    Snap        SnapDiagnostics `json:"snap"`
+    Preset      string          `json:"preset,omitempty"`
+    RiskVersion string          `json:"risk_version"`
+    // Calendar names the risk calendar rules in effect at the departure.
+    Calendar []string `json:"calendar,omitempty"`
+    // CRS is the coordinate reference system of every point in the
+    // answer.
+    CRS string `json:"crs"`
+    // RiskAggregation is how the routes' risk was computed.
+    RiskAggregation string `json:"risk_aggregation"`
+    // SuboptimalityBound is how many times the best route's cost each
+    // returned route may cost; 1 means every route is optimal.
+    SuboptimalityBound float64 `json:"suboptimality_bound"`
+    // StaleRiskData is set when the risk data has gone longer than
+    // max_risk_staleness_hours without a refresh.
+    StaleRiskData *staleRiskData `json:"stale_risk_data,omitempty"`
+}
+
+// handleRouteRequest serves POST /route. With ?stream=true or an Accept
+// header of application/x-ndjson the routes are streamed as they are
+// found, fastest first; see streamRoutes.
 func handleRouteRequest(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    ctx := r.Context()
+
+    var req routeRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeBadRequest(w, err.Error())
         return
     }
 
-    // Set a timeout for the request
-    ctx := r.Context()
-    var cancelCtx context.CancelFunc
-    ctx, cancelCtx = context.WithTimeout(ctx, 30*time.Second)
-    defer cancelCtx()
+    tenant := tenantFromContext(r.Context())
+    router := tenant.Router()
+
+    crs := globalConfig.CRS
+    if req.CRS != "" {
+        var err error
+        if crs, err = canonicalCRS(req.CRS); err != nil {
+            writeBadRequest(w, err.Error())
+            return
+        }
+    }
+    start, err := requestPoint("start", req.StartX, req.StartY, req.Start, crs)
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    end, err := requestPoint("end", req.EndX, req.EndY, req.End, crs)
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    if !prewarming(ctx) {
+        if until, refused := globalScrapers.observe(tenant.ID, clientIP(r), start, end, time.Now()); refused {
+            tenant.metrics.throttled.Add(1)
+            writeScraping(w, until, time.Now())
+            return
+        }
+    }
+    alphas := tenant.Alphas
+    params := routeParams{
+        HeuristicWeight: globalConfig.HeuristicWeight,
+        EllipseFactor:   globalConfig.SearchEllipseFactor,
+        ArcFlags:        true,
+    }
+    if req.HeuristicWeight != nil {
+        if hw := *req.HeuristicWeight; hw < 1 || hw > maxHeuristicWeight {
+            writeBadRequest(w, fmt.Sprintf("heuristic_weight must be within [1, %d]", maxHeuristicWeight))
+            return
+        }
+        params.HeuristicWeight = *req.HeuristicWeight
+    }
+    if req.MinDissimilarity < 0 || req.MinDissimilarity >= 1 {
+        writeBadRequest(w, "min_dissimilarity must be within [0, 1)")
+        return
+    }
+    params.MinDissimilarity = req.MinDissimilarity
+    if req.MainStreets && router.attrs == nil {
+        writeBadRequest(w, "main_streets needs road attributes, which this server has not loaded")
+        return
+    }
+    params.MainStreets = req.MainStreets
+    disabled, err := layersOff(globalConfig.NetworkLayers, req.Layers)
+    if err != nil {
+        writeAPIError(w, http.StatusBadRequest, APIError{
+            Code:    "unknown_layer",
+            Message: err.Error(),
+            Details: map[string]interface{}{"layers": networkLayerInfos(globalConfig.NetworkLayers)},
+        })
+        return
+    }
+    params.LayersOff = layerMask(globalConfig.NetworkLayers, disabled)
+    params.RiskAggregation = globalConfig.RiskAggregation
+    if req.RiskAggregation != "" {
+        if err := checkRiskAggregation(req.RiskAggregation); err != nil {
+            writeBadRequest(w, err.Error())
+            return
+        }
+        params.RiskAggregation = req.RiskAggregation
+    }
+    if req.Preset != "" {
+        preset, ok := globalConfig.Presets[req.Preset]
+        if !ok {
+            writeAPIError(w, http.StatusBadRequest, APIError{
+                Code:    "unknown_preset",
+                Message: fmt.Sprintf("unknown preset %q", req.Preset),
+                Details: map[string]interface{}{"presets": presetNames(globalConfig.Presets)},
+            })
+            return
+        }
+        alphas = preset.Alphas
+        params.MaxEdgeRisk = preset.MaxEdgeRisk
+    }
+    alphas = referenceAlphas(alphas)
+
+    params.Layer = router.activeLayer()
+    if version := req.RiskVersion; version != "" || r.Header.Get("X-Risk-Version") != "" {
+        if version == "" {
+            version = r.Header.Get("X-Risk-Version")
+        }
+        layer, ok := router.layers.get(version)
+        if !ok {
+            writeAPIError(w, http.StatusBadRequest, APIError{
+                Code:    "unknown_risk_version",
+                Message: fmt.Sprintf("unknown risk layer version %q", version),
+                Details: map[string]interface{}{"versions": router.layers.versions()},
+            })
+            return
+        }
+        params.Layer = layer
+    }
+    if len(req.RiskWeights) > 0 {
+        if req.RiskVersion != "" || r.Header.Get("X-Risk-Version") != "" {
+            writeBadRequest(w, "give either a risk version or risk_weights, not both")
+            return
+        }
+        layer, err := router.weightedLayer(req.RiskWeights)
+        if err != nil {
+            writeAPIError(w, http.StatusBadRequest, APIError{
+                Code:    "invalid_risk_weights",
+                Message: err.Error(),
+                Details: map[string]interface{}{"components": router.composed.list()},
+            })
+            return
+        }
+        params.Layer = layer
+    }
+    var calendar []string
+    if req.RiskVersion == "" && r.Header.Get("X-Risk-Version") == "" {
+        departAt := time.Now()
+        if req.DepartAt != "" {
+            if departAt, err = time.Parse(time.RFC3339, req.DepartAt); err != nil {
+                writeBadRequest(w, fmt.Sprintf("depart_at: %v", err))
+                return
+            }
+        }
+        params.Layer, calendar = router.calendarLayer(params.Layer, departAt)
+    }
 
-    var req struct {
-        StartX float64 `json:"start_x"`
-        StartY float64 `json:"start_y"`
-        EndX   float64 `json:"end_x"`
-        EndY   float64 `json:"end_y"`
+    fields, err := requestFields(r, req.Fields)
+    if err != nil {
+        writeUnknownField(w, err)
+        return
+    }
+    var user string
+    if req.History {
+        var ok bool
+        user, ok, err = userFromRequest(r)
+        if err == nil && !ok {
+            err = errors.New("history needs an X-User-Token")
+        }
+        if err != nil {
+            writeAPIError(w, http.StatusUnauthorized, APIError{Code: "unauthorized", Message: err.Error()})
+            return
+        }
     }
 
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+    clamp, mainStreets := 0.0, 0.0
+    if req.Clamp {
+        clamp = 1
+    }
+    if params.MainStreets {
+        mainStreets = 1
+    }
+    similarity := globalConfig.RouteSimilarity
+    if req.Collapse != nil && !*req.Collapse {
+        similarity = 0
+    }
+    l := localizerFor(r)
+    stale := tenant.riskStaleness(time.Now())
+    staleKey := ""
+    if stale != nil {
+        // A response cached while the data was fresh lacks the warning.
+        staleKey = "stale"
+        if !prewarming(ctx) {
+            tenant.metrics.staleRisk.Add(1)
+        }
+    }
+    etag := routeETag(router.G, params.Layer.Version+router.closed.load().version()+params.RiskAggregation+crs+strings.Join(fields, ",")+l.Language+strings.Join(disabled, ",")+staleKey, alphas, start.X, start.Y, end.X, end.Y, clamp, params.MaxEdgeRisk, params.HeuristicWeight, similarity, params.MinDissimilarity, mainStreets)
+    if refuseUnsignedStream(w, r) {
+        return
+    }
+    if etagMatches(r, etag) {
+        writeNotModified(w, etag)
+        return
+    }
+    if req.Anonymous {
+        markAnonymous(r)
+    }
+    anonymous := anonymousRequest(r)
+    if prewarmEnabled(globalConfig) && !anonymous && !prewarming(ctx) {
+        tenant.od.record(start, end, globalConfig.Prewarm.CellM)
+    }
+    stream := wantsStream(r)
+    var debug *requestDebug
+    if req.Debug {
+        params.Debug = true
+        _, cached := router.routes.get(etag, time.Now())
+        debug = &requestDebug{ResponseCached: cached}
+    } else if body, ok := router.routes.get(etag, time.Now()); ok && !stream && !anonymous && !req.History {
+        writeRouteResponse(w, etag, body)
         return
     }
 
-    start := Point{X: req.StartX, Y: req.StartY}
-    end := Point{X: req.EndX, Y: req.EndY}
-    alphas := []float64{0.00, 0.25, 0.50, 0.75}
+    began := time.Now()
+    var snap SnapDiagnostics
+    if snap.Start, err = router.snapChecked(start, "start", req.Clamp); err != nil {
+        writeOutOfBounds(w, err)
+        return
+    }
+    if snap.End, err = router.snapChecked(end, "end", req.Clamp); err != nil {
+        writeOutOfBounds(w, err)
+        return
+    }
+
+    if debug != nil {
+        debug.SnapMS = msSince(began)
+        began = time.Now()
+    }
+
+    summary := routeSummary{
+        Center: Point{
+            X: (start.X + end.X) / 2,
+            Y: (start.Y + end.Y) / 2,
+        },
+        StartPoint:         start,
+        EndPoint:           end,
+        Snap:               snap,
+        Preset:             req.Preset,
+        RiskVersion:        params.Layer.Version,
+        Calendar:           calendar,
+        CRS:                crs,
+        RiskAggregation:    params.RiskAggregation,
+        SuboptimalityBound: max(params.HeuristicWeight, 1),
+        StaleRiskData:      stale,
+    }
+    save := func(routes []Route) string {
+        if globalConfig.PrivacyMode || anonymous || prewarming(ctx) {
+            return ""
+        }
+        saved := &savedRoute{
+            Tenant:           tenant.ID,
+            CreatedAt:        time.Now().UTC(),
+            Start:            start,
+            End:              end,
+            Clamp:            req.Clamp,
+            Preset:           req.Preset,
+            Alphas:           alphas,
+            MaxEdgeRisk:      params.MaxEdgeRisk,
+            HeuristicWeight:  params.HeuristicWeight,
+            RiskAggregation:  params.RiskAggregation,
+            MinDissimilarity: params.MinDissimilarity,
+            MainStreets:      params.MainStreets,
+            LayersOff:        disabled,
+            GraphVersion:     router.G.Version,
+            RiskVersion:      params.Layer.Version,
+            Routes:           routes,
+        }
+        id := saveRoute(ctx, saved)
+        if id != "" && user != "" {
+            if err := globalStorage.addHistory(ctx, user, saved); err != nil {
+                reportWarning(map[string]string{"component": "storage"}, "adding route %s to a history: %v", id, err)
+            }
+        }
+        return id
+    }
+    if stream {
+        streamRoutes(w, r, router, summary, alphas, params, fields, save)
+        return
+    }
 
-    // Use the global router instance
-    routes, err := globalRouter.calculateRoutes(start, end, alphas)
+    routes, truncated, err := router.routesBetween(ctx, snap.Start, snap.End, alphas, params)
+    if errors.Is(err, context.Canceled) {
+        // The client went away; there is nobody to answer.
+        tenant.metrics.cancelled.Add(1)
+        return
+    }
+    if errors.Is(err, context.DeadlineExceeded) {
+        writeAPIError(w, http.StatusGatewayTimeout, APIError{Code: "timeout", Message: "route search timed out"})
+        return
+    }
+    if errors.Is(err, errNotConnected) {
+        writeNotConnected(w, router, snap)
+        return
+    }
+    if debug != nil {
+        debug.SearchMS = msSince(began)
+    }
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        writeAPIError(w, http.StatusInternalServerError, APIError{Code: "no_route", Message: err.Error()})
         return
     }
 
-    center := Point{
-        X: (start.X + end.X) / 2,
-        Y: (start.Y + end.Y) / 2,
+    routeID := save(routes)
+    if similarity > 0 {
+        routes = collapseRoutes(routes, similarity)
+    }
+    labelRoutes(routes, l)
+    for i := range routes {
+        routes[i] = routes[i].inCRS(crs)
+    }
+    response := routeResponse{
+        RouteID:      routeID,
+        Routes:       selectFields(routes, fields),
+        routeSummary: summary.inCRS(crs),
+        Truncated:    truncated,
+        Debug:        debug,
     }
 
-    response := struct {
-        Routes     []Route `json:"routes"`
-        Center     Point   `json:"center"`
-        StartPoint Point   `json:"start"`
-        EndPoint   Point   `json:"end"`
-    }{
-        Routes:     routes,
-        Center:     center,
-        StartPoint: start,
-        EndPoint:   end,
+    if ctx.Err() != nil {
+        tenant.metrics.cancelled.Add(1)
+        return
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    if err := json.NewEncoder(w).Encode(response); err != nil {
+    var body bytes.Buffer
+    if err := json.NewEncoder(&body).Encode(response); err != nil {
         log.Printf("Failed to encode response: %v", err)
+        writeAPIError(w, http.StatusInternalServerError, APIError{Code: "internal", Message: "failed to encode response"})
+        return
+    }
+    if truncated || debug != nil {
+        // A partial or debug answer must not be served again for the
+        // same request.
+        writeRouteResponse(w, "", body.Bytes())
+        return
     }
+    if !globalConfig.PrivacyMode && !anonymous {
+        router.routes.put(etag, body.Bytes(), time.Now())
+    }
+    writeRouteResponse(w, etag, body.Bytes())
+}
+
+func writeRouteResponse(w http.ResponseWriter, etag string, body []byte) {
+    w.Header().Set("Content-Type", "application/json")
+    if etag != "" {
+        w.Header().Set("ETag", etag)
+    }
+    w.Header().Set("Cache-Control", "private, no-cache")
+    signResponse(w, body)
+    w.Write(body)
 }
 
 func main() {
-    // Initialize the router once at startup
-    if err := initializeRouter(); err != nil {
+    if len(os.Args) > 1 {
+        if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    var err error
+    globalConfig, err = loadConfig()
+    if err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+    globalProxies, _ = parseTrustedProxies(globalConfig.TrustedProxies)
+    globalSearchWorkers = newSearchWorkers(globalConfig)
+    globalStorage, err = openStorage(globalConfig)
+    if err != nil {
+        log.Fatalf("Failed to open storage: %v", err)
+    }
+    globalNotifiers, err = newNotifiers(globalConfig.Push)
+    if err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+    globalReporter, err = newErrorReporter(globalConfig.ErrorReportingDSN, globalConfig.ErrorSampleRate)
+    if err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+
+    // Initialize the tenants' routers once at startup
+    if err := initializeTenants(); err != nil {
         log.Fatalf("Failed to initialize router: %v", err)
     }
 
-    port := os.Getenv("PORT")
-    if port == "" {
-        port = "8080"
+    globalScheduler, err = newScheduler(globalConfig)
+    if err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
     }
+    globalScheduler.start()
 
-    // Create a custom server with timeouts
-    server := &http.Server{
-        Addr:         ":" + port,
-        ReadTimeout:  30 * time.Second,
-        WriteTimeout: 30 * time.Second,
-        IdleTimeout:  60 * time.Second,
+    globalRecorder, err = newRequestRecorder(globalConfig.RecordPath, globalConfig.RecordSamplePercent)
+    if err != nil {
+        log.Fatalf("Failed to open request recording: %v", err)
     }
 
-    // Set up routes with CORS
-    http.HandleFunc("/route", enableCors(handleRouteRequest))
+    globalShadow = newShadowForwarder(globalConfig.ShadowTarget)
+    globalSigner, err = newResponseSigner(globalConfig.ResponseSigning)
+    if err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+    globalScrapers, err = newScrapeDetector(globalConfig.Scraping)
+    if err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+    globalAudit, err = newAuditLog(globalConfig.AuditLog)
+    if err != nil {
+        log.Fatalf("Failed to open audit log: %v", err)
+    }
+    globalEvents, err = newEventConsumer(globalConfig.EventBusURL, globalConfig.EventBusTopic)
+    if err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    if globalEvents != nil {
+        globalJobs.goJob("events", alwaysRestart, func() { globalEvents.run(ctx) })
+    }
+    globalJobs.goJob("monitors", alwaysRestart, globalMonitors.run)
 
-    log.Printf("Server starting on port %s", port)
-    log.Fatal(server.ListenAndServe())
-}
\ No newline at end of file
+    filter, err := newIPFilter(globalConfig)
+    if err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+    if err := serve(ctx, newServers(globalConfig, filter)); err != nil {
+        log.Fatal(err)
+    }
+}
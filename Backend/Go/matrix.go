@@ -0,0 +1,200 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+)
+
+// defaultMatrixAlpha is the risk weight used when a matrix request does
+// not set one.
+const defaultMatrixAlpha = 0.5
+
+// MatrixCell is the best route from one source to one destination.
+type MatrixCell struct {
+    Destination int     `json:"destination"`
+    Found       bool    `json:"found"`
+    Distance    float64 `json:"distance"`
+    Risk        float64 `json:"risk"`
+
+    // cost is the route's cost at the searched alpha.
+    cost float64
+}
+
+// MatrixRow holds every destination's cell for one source.
+type MatrixRow struct {
+    Source int          `json:"source"`
+    Snap   SnapResult   `json:"snap"`
+    Cells  []MatrixCell `json:"cells"`
+}
+
+// distancesFrom runs one Dijkstra search from source until every target is
+// settled and returns a cell per target, in order.
+func (r *RiskAwareRouter) distancesFrom(ctx context.Context, source int32, targets []int32, alpha float64) ([]MatrixCell, error) {
+    g := r.G
+    layer := r.activeLayer()
+    weights := r.weightsFor(layer, alpha)
+    closed := r.closed.load()
+    release, err := globalSearchWorkers.acquire(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+    s := r.searches.get()
+    defer r.searches.put(s)
+
+    pending := make(map[int32]int, len(targets))
+    for _, t := range targets {
+        pending[t]++
+    }
+
+    s.relax(source, 0, -1)
+    s.frontier.push(source, 0)
+    expanded := 0
+    if scope := scopeFromContext(ctx); scope != nil {
+        defer func() { scope.nodesExpanded += expanded }()
+    }
+    for s.frontier.Len() > 0 && len(pending) > 0 {
+        if expanded%cancelCheckInterval == 0 {
+            if err := ctx.Err(); err != nil {
+                return nil, err
+            }
+        }
+        current := s.frontier.pop()
+        expanded++
+        delete(pending, current)
+
+        lo, hi := g.edgeRange(current)
+        for e := lo; e < hi; e++ {
+            if closed.closed(e) {
+                continue
+            }
+            next := g.targets[e]
+            if newCost := s.cost[current] + weights[e]; newCost < s.cost[next] {
+                s.relax(next, newCost, e)
+                s.frontier.push(next, newCost)
+            }
+        }
+    }
+
+    cells := make([]MatrixCell, len(targets))
+    for j, t := range targets {
+        cells[j].Destination = j
+        if t != source && s.cameFrom[t] < 0 {
+            continue
+        }
+        _, _, distance, risk, _ := r.reconstructPath(s, t, layer.risk)
+        cells[j].Found = true
+        cells[j].Distance = distance
+        cells[j].Risk = risk
+        cells[j].cost = s.cost[t]
+    }
+    return cells, nil
+}
+
+// matrixRequest is the body of POST /matrix.
+type matrixRequest struct {
+    Sources      [][2]float64 `json:"sources" schema:"required"`
+    Destinations [][2]float64 `json:"destinations" schema:"required"`
+    Alpha        *float64     `json:"alpha" schema:"minimum=0,maximum=1"`
+    Clamp        bool         `json:"clamp"`
+}
+
+// handleMatrix serves POST /matrix: the best route between every source and
+// every destination at one alpha. With ?stream=true or an Accept header of
+// application/x-ndjson, rows are written as NDJSON as each source
+// finishes, so clients can consume them early and the server holds one row
+// at a time.
+func handleMatrix(w http.ResponseWriter, r *http.Request) {
+    var req matrixRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    if len(req.Sources) == 0 || len(req.Destinations) == 0 {
+        writeBadRequest(w, "sources and destinations must not be empty")
+        return
+    }
+    if max := globalConfig.Limits.MaxMatrixSize; len(req.Sources) > max || len(req.Destinations) > max {
+        writeBadRequest(w, fmt.Sprintf("at most %d sources and %d destinations are allowed", max, max))
+        return
+    }
+    alpha := defaultMatrixAlpha
+    if req.Alpha != nil {
+        alpha = *req.Alpha
+    }
+    if alpha < 0 || alpha > 1 {
+        writeBadRequest(w, "alpha must be within [0, 1]")
+        return
+    }
+
+    router := tenantFromContext(r.Context()).Router()
+    sources := make([]SnapResult, len(req.Sources))
+    for i, c := range req.Sources {
+        snap, err := router.snapChecked(Point{X: c[0], Y: c[1]}, fmt.Sprintf("sources[%d]", i), req.Clamp)
+        if err != nil {
+            writeOutOfBounds(w, err)
+            return
+        }
+        sources[i] = snap
+    }
+    destinations := make([]SnapResult, len(req.Destinations))
+    targets := make([]int32, len(req.Destinations))
+    for j, c := range req.Destinations {
+        snap, err := router.snapChecked(Point{X: c[0], Y: c[1]}, fmt.Sprintf("destinations[%d]", j), req.Clamp)
+        if err != nil {
+            writeOutOfBounds(w, err)
+            return
+        }
+        destinations[j] = snap
+        targets[j] = snap.node
+    }
+
+    ctx := r.Context()
+    if refuseUnsignedStream(w, r) {
+        return
+    }
+    if wantsStream(r) {
+        w.Header().Set("Content-Type", "application/x-ndjson")
+        enc := json.NewEncoder(w)
+        flusher, _ := w.(http.Flusher)
+        for i, src := range sources {
+            cells, err := router.distancesFrom(ctx, src.node, targets, alpha)
+            if err != nil {
+                if !errors.Is(err, context.Canceled) {
+                    enc.Encode(map[string]APIError{"error": {Code: "timeout", Message: err.Error()}})
+                }
+                return
+            }
+            if err := enc.Encode(MatrixRow{Source: i, Snap: src, Cells: cells}); err != nil {
+                return
+            }
+            if flusher != nil {
+                flusher.Flush()
+            }
+        }
+        return
+    }
+
+    rows := make([]MatrixRow, len(sources))
+    for i, src := range sources {
+        cells, err := router.distancesFrom(ctx, src.node, targets, alpha)
+        if errors.Is(err, context.Canceled) {
+            return
+        }
+        if err != nil {
+            writeAPIError(w, http.StatusGatewayTimeout, APIError{Code: "timeout", Message: "matrix computation timed out"})
+            return
+        }
+        rows[i] = MatrixRow{Source: i, Snap: src, Cells: cells}
+    }
+
+    response := struct {
+        Alpha        float64      `json:"alpha"`
+        Rows         []MatrixRow  `json:"rows"`
+        Destinations []SnapResult `json:"destinations"`
+    }{alpha, rows, destinations}
+    writeSignedJSON(w, response, "matrix")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+    "context"
+    "net/http"
+)
+
+// statusRecorder captures the status code and body size written by a
+// handler so middleware can account for the response afterwards.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+    bytes  int
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+    return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+    s.status = status
+    s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+    n, err := s.ResponseWriter.Write(b)
+    s.bytes += n
+    return n, err
+}
+
+func (s *statusRecorder) Flush() {
+    if f, ok := s.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+// requestScope carries facts learned while serving a request back out to
+// the middleware wrapping it, which only sees the outer request context.
+type requestScope struct {
+    tenant   *Tenant
+    clientIP string
+    // routes and nodesExpanded measure the searches run for the request.
+    routes        int
+    nodesExpanded int
+    // anonymous is set when the request asked not to be tracked.
+    anonymous bool
+}
+
+type scopeContextKey struct{}
+
+// withScope attaches a fresh requestScope to the request.
+func withScope(r *http.Request) (*http.Request, *requestScope) {
+    if s := scopeFromContext(r.Context()); s != nil {
+        return r, s
+    }
+    s := &requestScope{}
+    return r.WithContext(context.WithValue(r.Context(), scopeContextKey{}, s)), s
+}
+
+func scopeFromContext(ctx context.Context) *requestScope {
+    s, _ := ctx.Value(scopeContextKey{}).(*requestScope)
+    return s
+}
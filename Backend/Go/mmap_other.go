@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// mapFile reads the whole file on platforms without mmap support.
+func mapFile(path string) ([]byte, error) {
+    return os.ReadFile(path)
+}
+
+func adviseWillNeed(data []byte) {}
+
+func unmapFile(data []byte) error { return nil }
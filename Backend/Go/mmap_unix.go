@@ -0,0 +1,40 @@
+//go:build unix
+
+package main
+
+import (
+    "os"
+    "syscall"
+)
+
+// mapFile maps path read-only and shared, so every process serving the
+// same file shares one copy of its pages.
+func mapFile(path string) ([]byte, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    info, err := f.Stat()
+    if err != nil {
+        return nil, err
+    }
+    if info.Size() == 0 {
+        return nil, nil
+    }
+    return syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func adviseWillNeed(data []byte) {
+    if len(data) > 0 {
+        syscall.Madvise(data, syscall.MADV_WILLNEED)
+    }
+}
+
+func unmapFile(data []byte) error {
+    if len(data) == 0 {
+        return nil
+    }
+    return syscall.Munmap(data)
+}
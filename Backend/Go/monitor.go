@@ -0,0 +1,442 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// maxMonitorsPerUser bounds how many routes a user may monitor.
+const maxMonitorsPerUser = 20
+
+// monitorDebounce is how long a data change waits before monitored routes
+// are checked, so a burst of events leads to one check.
+const monitorDebounce = 10 * time.Second
+
+// routeMonitor watches one route of a user's saved route: when the risk of
+// its path on current data rises more than Threshold above Baseline, or
+// the path is closed or gone, the user is alerted, at WebhookURL if set
+// and on their notification channels, with the route now recommended at
+// the same alpha.
+type routeMonitor struct {
+    ID         string    `json:"monitor_id"`
+    Tenant     string    `json:"-"`
+    User       string    `json:"-"`
+    RouteID    string    `json:"route_id"`
+    Alpha      float64   `json:"alpha"`
+    Threshold  float64   `json:"threshold"`
+    WebhookURL string    `json:"webhook_url,omitempty"`
+    CreatedAt  time.Time `json:"created_at"`
+    // Baseline is the risk alerts are measured from: the path's risk
+    // when the monitor was created or last alerted.
+    Baseline      float64    `json:"baseline_risk"`
+    LastRisk      float64    `json:"last_risk"`
+    LastCheckedAt *time.Time `json:"last_checked_at,omitempty"`
+    LastAlertAt   *time.Time `json:"last_alert_at,omitempty"`
+    Alerts        int        `json:"alerts"`
+    // Blocked is why the route cannot be walked, once alerted, so that
+    // a lasting closure alerts only once.
+    Blocked   string `json:"blocked,omitempty"`
+    LastError string `json:"last_error,omitempty"`
+
+    // Saved is the watched route, kept with the monitor so it outlives
+    // the saved route's eviction.
+    Saved *savedRoute `json:"-"`
+}
+
+// watched returns the monitored route of m's saved route.
+func (m *routeMonitor) watched() (Route, bool) {
+    for _, rt := range m.Saved.Routes {
+        if rt.Alpha == m.Alpha {
+            return rt, true
+        }
+    }
+    return Route{}, false
+}
+
+// monitorAlert is the detail of a route monitor alert notification.
+type monitorAlert struct {
+    MonitorID string  `json:"monitor_id"`
+    RouteID   string  `json:"route_id"`
+    Alpha     float64 `json:"alpha"`
+    // Reason is "risk_increased", "closed" when a road on the path was
+    // closed, or "gone" when the road network no longer has the path.
+    Reason      string    `json:"reason"`
+    Baseline    float64   `json:"baseline_risk"`
+    Risk        float64   `json:"risk"`
+    Threshold   float64   `json:"threshold"`
+    CheckedAt   time.Time `json:"checked_at"`
+    Alternative *Route    `json:"alternative,omitempty"`
+}
+
+// pathEdges returns the edges a path found on r's graph takes, or false
+// when the graph no longer has one of its steps.
+func (r *RiskAwareRouter) pathEdges(path []Point) ([]int32, bool) {
+    g := r.G
+    edges := make([]int32, 0, len(path))
+    for i := 0; i+1 < len(path); i++ {
+        a, okA := g.nodeAt(path[i])
+        b, okB := g.nodeAt(path[i+1])
+        if !okA || !okB {
+            return nil, false
+        }
+        e, ok := g.edgeBetween(a, b)
+        if !ok {
+            return nil, false
+        }
+        edges = append(edges, e)
+    }
+    return edges, true
+}
+
+// pathRisk is the risk of a saved path on r's current data, measured as
+// its route's risk was, and why it cannot be walked, if it cannot:
+// "closed" or "gone".
+func (r *RiskAwareRouter) pathRisk(saved *savedRoute, path []Point) (float64, string) {
+    edges, ok := r.pathEdges(path)
+    if !ok {
+        return 0, "gone"
+    }
+    closed := r.closed.load()
+    for _, e := range edges {
+        if closed.closed(e) {
+            return 0, "closed"
+        }
+    }
+    risk := r.activeLayer().risk
+    if agg := saved.RiskAggregation; agg != "" && agg != aggregateLength {
+        return r.aggregateRisk(edges, risk, agg, globalConfig.WalkingSpeedMPS), ""
+    }
+    total, dist := 0.0, 0.0
+    for _, e := range edges {
+        total += risk[e] * r.G.dist[e]
+        dist += r.G.dist[e]
+    }
+    if dist == 0 {
+        return 0, ""
+    }
+    return total / dist, ""
+}
+
+type monitorRequest struct {
+    // RouteID names a saved route of the caller's tenant.
+    RouteID string `json:"route_id" schema:"required"`
+    // Alpha picks the route to watch; the safest (largest alpha) one by
+    // default.
+    Alpha *float64 `json:"alpha"`
+    // Threshold is how far the route's risk may rise before an alert;
+    // 0.05 by default.
+    Threshold *float64 `json:"threshold" schema:"minimum=0"`
+    // WebhookURL is sent each alert as a JSON POST, besides the caller's
+    // notification channels for route_monitor; one of them is needed.
+    WebhookURL string `json:"webhook_url"`
+}
+
+// handleMonitors serves /me/monitors: GET lists the caller's monitors and
+// how their last checks went, and POST starts watching a saved route.
+func handleMonitors(w http.ResponseWriter, r *http.Request) {
+    if r.Method == http.MethodGet {
+        writeMonitors(w, r)
+        return
+    }
+    tenant := tenantFromContext(r.Context())
+    user := userFromContext(r)
+    var req monitorRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    if req.WebhookURL != "" {
+        if err := checkWebhookURL(req.WebhookURL); err != nil {
+            writeBadRequest(w, err.Error())
+            return
+        }
+    } else {
+        channels, err := userChannels(r.Context(), tenant.ID, user, topicRouteMonitor)
+        if err != nil {
+            writeAPIError(w, http.StatusInternalServerError, APIError{Code: "storage", Message: err.Error()})
+            return
+        }
+        if len(channels) == 0 {
+            writeBadRequest(w, "a webhook_url is needed unless /me/notifications has channels for "+topicRouteMonitor)
+            return
+        }
+    }
+    existing, err := globalStorage.monitors(r.Context(), tenant.ID, user)
+    if err != nil {
+        writeAPIError(w, http.StatusInternalServerError, APIError{Code: "storage", Message: err.Error()})
+        return
+    }
+    if len(existing) >= maxMonitorsPerUser {
+        writeAPIError(w, http.StatusConflict, APIError{
+            Code:    "too_many_monitors",
+            Message: fmt.Sprintf("at most %d routes may be monitored", maxMonitorsPerUser),
+        })
+        return
+    }
+    saved, ok := loadSavedRoute(w, r, req.RouteID, tenant.ID)
+    if !ok {
+        return
+    }
+
+    m := &routeMonitor{
+        Tenant:     tenant.ID,
+        User:       user,
+        RouteID:    saved.ID,
+        Threshold:  materialRiskChange,
+        WebhookURL: req.WebhookURL,
+        CreatedAt:  time.Now().UTC(),
+        Saved:      saved,
+    }
+    for _, rt := range saved.Routes {
+        m.Alpha = max(m.Alpha, rt.Alpha)
+    }
+    if req.Alpha != nil {
+        m.Alpha = *req.Alpha
+    }
+    if req.Threshold != nil {
+        m.Threshold = *req.Threshold
+    }
+    watched, ok := m.watched()
+    if !ok {
+        writeBadRequest(w, fmt.Sprintf("route %s has no route at alpha %v", saved.ID, m.Alpha))
+        return
+    }
+    risk, reason := tenant.Router().pathRisk(saved, watched.Path)
+    if reason != "" {
+        writeAPIError(w, http.StatusConflict, APIError{Code: "route_" + reason, Message: "the route cannot be walked on the current road network"})
+        return
+    }
+    m.Baseline, m.LastRisk = risk, risk
+
+    var b [8]byte
+    rand.Read(b[:])
+    m.ID = hex.EncodeToString(b[:])
+    if err := globalStorage.addMonitor(r.Context(), m); err != nil {
+        writeAPIError(w, http.StatusInternalServerError, APIError{Code: "storage", Message: err.Error()})
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    if err := json.NewEncoder(w).Encode(m); err != nil {
+        log.Printf("Failed to encode monitor: %v", err)
+    }
+}
+
+func writeMonitors(w http.ResponseWriter, r *http.Request) {
+    tenant := tenantFromContext(r.Context())
+    monitors, err := globalStorage.monitors(r.Context(), tenant.ID, userFromContext(r))
+    if err != nil {
+        writeAPIError(w, http.StatusInternalServerError, APIError{Code: "storage", Message: err.Error()})
+        return
+    }
+    response := struct {
+        Monitors []*routeMonitor `json:"monitors"`
+    }{Monitors: []*routeMonitor{}}
+    response.Monitors = append(response.Monitors, monitors...)
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode monitors: %v", err)
+    }
+}
+
+// handleDeleteMonitor serves DELETE /me/monitors/{id}.
+func handleDeleteMonitor(w http.ResponseWriter, r *http.Request) {
+    tenant := tenantFromContext(r.Context())
+    id := r.PathValue("id")
+    err := globalStorage.deleteMonitor(r.Context(), tenant.ID, userFromContext(r), id)
+    if errors.Is(err, errNotFound) {
+        writeAPIError(w, http.StatusNotFound, APIError{Code: "not_found", Message: "unknown monitor " + id})
+        return
+    }
+    if err != nil {
+        writeAPIError(w, http.StatusInternalServerError, APIError{Code: "storage", Message: err.Error()})
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// routeMonitors runs the monitor checks: on the route_monitors schedule,
+// and shortly after live data changes.
+type routeMonitors struct {
+    wakeup   chan struct{}
+    checking sync.Mutex
+}
+
+var globalMonitors = &routeMonitors{wakeup: make(chan struct{}, 1)}
+
+// wake asks for a check soon; wakes before it starts are merged.
+func (m *routeMonitors) wake() {
+    select {
+    case m.wakeup <- struct{}{}:
+    default:
+    }
+}
+
+// run checks the monitors monitorDebounce after each wake until shutdown.
+func (m *routeMonitors) run() {
+    for {
+        select {
+        case <-globalJobs.stopping():
+            return
+        case <-m.wakeup:
+        }
+        select {
+        case <-globalJobs.stopping():
+            return
+        case <-time.After(monitorDebounce):
+        }
+        if err := m.checkAll(time.Now()); err != nil {
+            reportWarning(map[string]string{"component": "monitors"}, "checking route monitors: %v", err)
+        }
+    }
+}
+
+// checkAll checks every monitor once; overlapping calls wait their turn.
+func (m *routeMonitors) checkAll(now time.Time) error {
+    m.checking.Lock()
+    defer m.checking.Unlock()
+    ctx := withSearchClass(context.Background(), classBatch)
+    monitors, err := globalStorage.allMonitors(ctx)
+    if err != nil {
+        return err
+    }
+    for _, mon := range monitors {
+        tenant, ok := globalTenants.byID[mon.Tenant]
+        if !ok {
+            continue
+        }
+        m.check(ctx, tenant.Router(), mon, now)
+        // A monitor deleted while it was checked stays deleted.
+        if err := globalStorage.updateMonitor(ctx, mon); err != nil && !errors.Is(err, errNotFound) {
+            return err
+        }
+    }
+    return nil
+}
+
+// check measures mon's route on router's current data and alerts when it
+// got riskier than allowed. After a delivered alert the new risk becomes
+// the baseline; an undelivered one is retried at the next check.
+func (m *routeMonitors) check(ctx context.Context, router *RiskAwareRouter, mon *routeMonitor, now time.Time) {
+    mon.LastCheckedAt = &now
+    mon.LastError = ""
+    watched, ok := mon.watched()
+    if !ok {
+        mon.LastError = fmt.Sprintf("no route at alpha %v", mon.Alpha)
+        return
+    }
+    risk, reason := router.pathRisk(mon.Saved, watched.Path)
+    mon.LastRisk = risk
+    switch {
+    case reason != "" && reason == mon.Blocked:
+        return
+    case reason == "" && mon.Blocked != "":
+        // Reopened: measure from here on.
+        mon.Blocked, mon.Baseline = "", risk
+        return
+    case reason == "" && risk-mon.Baseline <= mon.Threshold:
+        return
+    }
+    if reason == "" {
+        reason = "risk_increased"
+    }
+    alert := monitorAlert{
+        MonitorID: mon.ID,
+        RouteID:   mon.RouteID,
+        Alpha:     mon.Alpha,
+        Reason:    reason,
+        Baseline:  mon.Baseline,
+        Risk:      risk,
+        Threshold: mon.Threshold,
+        CheckedAt: now.UTC(),
+    }
+    if alternative, err := monitorAlternative(ctx, router, mon); err == nil {
+        alert.Alternative = &alternative
+    } else {
+        mon.LastError = fmt.Sprintf("no alternative: %v", err)
+    }
+    if err := deliverAlert(ctx, mon, alert); err != nil {
+        mon.LastError = err.Error()
+        reportWarning(map[string]string{"component": "monitors", "tenant": mon.Tenant}, "alert for monitor %s not delivered: %v", mon.ID, err)
+        return
+    }
+    if reason == "risk_increased" {
+        mon.Baseline = risk
+    } else {
+        mon.Blocked = reason
+    }
+    mon.LastAlertAt = &now
+    mon.Alerts++
+}
+
+// monitorAlternative searches mon's route request again on router's
+// current data, at the monitored alpha.
+func monitorAlternative(ctx context.Context, router *RiskAwareRouter, mon *routeMonitor) (Route, error) {
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+    saved := mon.Saved
+    start, err := router.snapChecked(saved.Start, "start", saved.Clamp)
+    if err != nil {
+        return Route{}, err
+    }
+    end, err := router.snapChecked(saved.End, "end", saved.Clamp)
+    if err != nil {
+        return Route{}, err
+    }
+    routes, _, err := router.routesBetween(ctx, start, end, []float64{mon.Alpha}, savedParams(saved))
+    if err != nil {
+        return Route{}, err
+    }
+    if len(routes) == 0 {
+        return Route{}, errors.New("search ran out of time")
+    }
+    return routes[0], nil
+}
+
+// deliverAlert sends alert to the monitor's webhook and the user's
+// channels for route monitor alerts.
+func deliverAlert(ctx context.Context, mon *routeMonitor, alert monitorAlert) error {
+    channels, err := userChannels(ctx, mon.Tenant, mon.User, topicRouteMonitor)
+    if err != nil {
+        return err
+    }
+    if mon.WebhookURL != "" {
+        channels = append(channels, notificationChannel{Kind: "webhook", Address: mon.WebhookURL})
+    }
+    note := notification{
+        Topic: topicRouteMonitor,
+        Title: "Your route got riskier",
+        Body:  fmt.Sprintf("Its risk rose from %.2f to %.2f.", alert.Baseline, alert.Risk),
+        Data:  alert,
+    }
+    if alert.Reason != "risk_increased" {
+        note.Title, note.Body = "Your route is blocked", "A road on it is closed or no longer mapped."
+    }
+    if alert.Alternative != nil {
+        note.Body += " A new route is recommended."
+    }
+    return globalNotifiers.deliver(ctx, channels, note)
+}
+
+func checkRouteMonitors(now time.Time) error {
+    return globalMonitors.checkAll(now)
+}
+
+// dataChanged starts the work that follows a change to r's risk or roads:
+// hub trees are rebuilt and monitored routes checked.
+func dataChanged(r *RiskAwareRouter) {
+    globalJobs.goJob("hubs.refresh", noRestart, func() {
+        if err := r.refreshHubs(context.Background()); err != nil {
+            reportWarning(map[string]string{"component": "hubs"}, "hub trees not refreshed: %v", err)
+        }
+    })
+    globalMonitors.wake()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "strconv"
+
+    "risk-router/geo"
+)
+
+const (
+    defaultNearestK = 5
+    maxNearestK     = 50
+    // maxNearestOutsideM is how far outside the serving bounds a query
+    // point may lie.
+    maxNearestOutsideM = 5000
+)
+
+// NodeMatch is a graph node near a query point.
+type NodeMatch struct {
+    Point     Point   `json:"point"`
+    DistanceM float64 `json:"distance_m"`
+    Degree    int     `json:"degree"`
+}
+
+// EdgeMatch is a road segment near a query point, with the point on the
+// segment a snap would land on.
+type EdgeMatch struct {
+    Name      string  `json:"name"`
+    Start     Point   `json:"start"`
+    End       Point   `json:"end"`
+    RiskScore float64 `json:"risk_score"`
+    Nearest   Point   `json:"nearest_point"`
+    DistanceM float64 `json:"distance_m"`
+}
+
+// nearestNodes returns the k nodes closest to p, nearest first.
+func (r *RiskAwareRouter) nearestNodes(p Point, k int) []NodeMatch {
+    hits := r.G.nodeIndex.nearest(p, k, cellSizeM(p.Y), func(id int32) float64 {
+        return geo.Haversine(p, r.G.Nodes[id])
+    })
+    matches := make([]NodeMatch, 0, len(hits))
+    for _, hit := range hits {
+        matches = append(matches, NodeMatch{
+            Point:     r.G.Nodes[hit.id],
+            DistanceM: hit.dist,
+            Degree:    r.G.degree(hit.id),
+        })
+    }
+    return matches
+}
+
+// nearestEdges returns the k road segments closest to p, nearest first.
+// Each undirected segment is reported once.
+func (r *RiskAwareRouter) nearestEdges(p Point, k int) []EdgeMatch {
+    hits := r.G.segmentIndex.nearest(p, k, cellSizeM(p.Y), func(e int32) float64 {
+        return geo.DistanceToSegment(p, r.G.Nodes[r.G.source(e)], r.G.Nodes[r.G.targets[e]])
+    })
+    matches := make([]EdgeMatch, 0, len(hits))
+    for _, hit := range hits {
+        seg := r.G.edge(r.G.source(hit.id), hit.id)
+        matches = append(matches, EdgeMatch{
+            Name:      seg.Name,
+            Start:     seg.Start,
+            End:       seg.End,
+            RiskScore: seg.RiskScore,
+            Nearest:   geo.ProjectOnSegment(p, seg.Start, seg.End),
+            DistanceM: hit.dist,
+        })
+    }
+    return matches
+}
+
+func handleNearest(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    x, errX := strconv.ParseFloat(query.Get("x"), 64)
+    y, errY := strconv.ParseFloat(query.Get("y"), 64)
+    if errX != nil || errY != nil || math.IsNaN(x+y) || math.IsInf(x+y, 0) {
+        writeBadRequest(w, "x and y query parameters must be numbers")
+        return
+    }
+
+    k := defaultNearestK
+    if v := query.Get("k"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 || n > maxNearestK {
+            writeBadRequest(w, fmt.Sprintf("k must be an integer between 1 and %d", maxNearestK))
+            return
+        }
+        k = n
+    }
+
+    router := tenantFromContext(r.Context()).Router()
+    p := Point{X: x, Y: y}
+    if !isInBounds(p, padBounds(router.Bounds, maxNearestOutsideM)) {
+        _, err := router.checkBounds(p, "query", false)
+        writeOutOfBounds(w, err)
+        return
+    }
+    response := struct {
+        Query Point       `json:"query"`
+        Nodes []NodeMatch `json:"nodes"`
+        Edges []EdgeMatch `json:"edges"`
+    }{
+        Query: p,
+        Nodes: router.nearestNodes(p, k),
+        Edges: router.nearestEdges(p, k),
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode nearest response: %v", err)
+    }
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "risk-router/geo"
+)
+
+// TestNearestFarFromData checks that a point far outside the index is
+// answered quickly, by the node a full scan would pick.
+func TestNearestFarFromData(t *testing.T) {
+    router := fixtureTenant(t).Router()
+    for _, p := range []Point{{X: 0, Y: 0}, {X: -87.66, Y: 89.99}, {X: -77.66, Y: 41.87}} {
+        begin := time.Now()
+        got := router.nearestNodes(p, 1)
+        if elapsed := time.Since(begin); elapsed > time.Second {
+            t.Errorf("%v took %v", p, elapsed)
+        }
+        best := 0
+        for id, node := range router.G.Nodes {
+            if geo.Haversine(p, node) < geo.Haversine(p, router.G.Nodes[best]) {
+                best = id
+            }
+        }
+        if len(got) != 1 || got[0].Point != router.G.Nodes[best] {
+            t.Errorf("nearest to %v = %+v, want %v", p, got, router.G.Nodes[best])
+        }
+    }
+}
+
+func TestHandleNearestRejects(t *testing.T) {
+    tenant := fixtureTenant(t)
+    cases := []struct {
+        query, code string
+    }{
+        {"x=NaN&y=41.87", "invalid_request"},
+        {"x=-87.66&y=Inf", "invalid_request"},
+        {"x=-87.66", "invalid_request"},
+        {"x=0&y=0", "out_of_bounds"},
+        {"x=41.87&y=-87.66", "coordinates_swapped"},
+        {"x=-87.66&y=41.87&k=51", "invalid_request"},
+    }
+    for _, c := range cases {
+        w := httptest.NewRecorder()
+        handleNearest(w, tenantRequest(tenant, http.MethodGet, "/nearest?"+c.query, ""))
+        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"`+c.code+`"`) {
+            t.Errorf("%s: status %d, body %s; want 400 %s", c.query, w.Code, w.Body, c.code)
+        }
+    }
+
+    w := httptest.NewRecorder()
+    handleNearest(w, tenantRequest(tenant, http.MethodGet, "/nearest?x=-87.66&y=41.87&k=2", ""))
+    if w.Code != http.StatusOK || strings.Count(w.Body.String(), `"distance_m"`) != 4 {
+        t.Errorf("status %d, body %s; want 2 nodes and 2 edges", w.Code, w.Body)
+    }
+}
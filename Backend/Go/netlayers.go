@@ -0,0 +1,205 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "os"
+    "slices"
+    "sort"
+
+    "risk-router/geo"
+)
+
+// maxNetworkLayers bounds the layers an edge's uint8 layer can tell apart.
+const maxNetworkLayers = 254
+
+// NetworkLayerConfig names a supplementary pedestrian network, such as
+// campus paths, park trails or tunnels and skyways, loaded from GeoJSON
+// into the graph alongside the roads. Its segments join the roads where
+// they share coordinates; ConnectWithinM also connects each of its
+// features' ends to the nearest road node within that many meters.
+// Requests may turn each layer on or off, and get it as Enabled says by
+// default.
+type NetworkLayerConfig struct {
+    Name           string  `json:"name"`
+    Path           string  `json:"path"`
+    Enabled        bool    `json:"enabled"`
+    ConnectWithinM float64 `json:"connect_within_m"`
+}
+
+func checkNetworkLayers(layers []NetworkLayerConfig) error {
+    if len(layers) > maxNetworkLayers {
+        return fmt.Errorf("network_layers: at most %d layers, got %d", maxNetworkLayers, len(layers))
+    }
+    seen := make(map[string]bool)
+    for i, l := range layers {
+        if l.Name == "" || l.Path == "" {
+            return fmt.Errorf("network_layers[%d]: name and path must be set", i)
+        }
+        if seen[l.Name] {
+            return fmt.Errorf("network_layers[%d]: duplicate name %q", i, l.Name)
+        }
+        seen[l.Name] = true
+        if l.ConnectWithinM < 0 {
+            return fmt.Errorf("network_layers[%d]: connect_within_m must not be negative, got %v", i, l.ConnectWithinM)
+        }
+    }
+    return nil
+}
+
+// addNetworkLayers adds the layers' segments to graph, which holds the
+// road network and is not indexed yet. Layer i is tagged i+1.
+func addNetworkLayers(graph *Graph, layers []NetworkLayerConfig, clip *Bounds) error {
+    if len(layers) == 0 {
+        return nil
+    }
+    roads := make([]Point, 0, len(graph.Edges))
+    for p := range graph.Edges {
+        roads = append(roads, p)
+    }
+    sort.Slice(roads, func(i, j int) bool { return pointLess(roads[i], roads[j]) })
+    // A layer segment with the same ends as a road is kept beside it, not
+    // merged into it, so turning the layer off leaves the road as loaded.
+    // The roads' weights stay as loaded too: maxDist, which scales
+    // distance against risk, remains the roads' own.
+    policy, maxDist := graph.duplicatePolicy, graph.maxDist
+    graph.duplicatePolicy = duplicateParallel
+    for i, cfg := range layers {
+        graph.loadingLayer = uint8(i + 1)
+        connectors, err := addNetworkLayer(graph, cfg, roads, clip)
+        if err != nil {
+            return fmt.Errorf("network layer %s: %v", cfg.Name, err)
+        }
+        graph.layers++
+        if connectors > 0 {
+            log.Printf("Connected network layer %s to the roads with %d connectors", cfg.Name, connectors)
+        }
+    }
+    graph.loadingLayer, graph.duplicatePolicy = 0, policy
+    if maxDist > 0 {
+        graph.maxDist = maxDist
+    }
+    return nil
+}
+
+// addNetworkLayer adds one layer's LineString features and returns how
+// many connectors it added. roads are the road network's nodes, sorted.
+func addNetworkLayer(graph *Graph, cfg NetworkLayerConfig, roads []Point, clip *Bounds) (int, error) {
+    file, err := os.ReadFile(cfg.Path)
+    if err != nil {
+        return 0, err
+    }
+    var geojsonData struct {
+        CRS      interface{}       `json:"crs"`
+        Features []json.RawMessage `json:"features"`
+    }
+    if err := json.Unmarshal(file, &geojsonData); err != nil {
+        return 0, err
+    }
+    features, err := parseFeatures(geojsonData.Features)
+    if err != nil {
+        return 0, err
+    }
+    crs, err := sourceCRS(geojsonData.CRS, features, graph.sourceCRS)
+    if err != nil {
+        return 0, err
+    }
+    added, connectors := 0, 0
+    for _, feature := range features {
+        segments, _ := featureSegments(feature, clip, crs)
+        for _, s := range segments {
+            if graph.blockedSegment(s.Start, s.End) {
+                graph.blockedSegments++
+                continue
+            }
+            graph.AddEdge(s.Start, s.End, s.Distance, s.RiskScore, s.Name)
+            added++
+        }
+        if len(segments) == 0 || cfg.ConnectWithinM == 0 {
+            continue
+        }
+        // Connectors take the risk and name of the segment they extend.
+        first, last := segments[0], segments[len(segments)-1]
+        for _, end := range []struct {
+            at  Point
+            seg Edge
+        }{{first.Start, first}, {last.End, last}} {
+            if road, ok := nearestRoad(roads, end.at, cfg.ConnectWithinM); ok && road != end.at {
+                distance := math.Hypot(road.X-end.at.X, road.Y-end.at.Y)
+                graph.AddEdge(end.at, road, distance, end.seg.RiskScore, end.seg.Name)
+                connectors++
+            }
+        }
+    }
+    if added == 0 {
+        return 0, fmt.Errorf("%s has no segments inside the load bounds", cfg.Path)
+    }
+    return connectors, nil
+}
+
+// nearestRoad returns the road node nearest p within radiusM meters.
+// roads are sorted by X, so only the band of longitudes within reach is
+// scanned.
+func nearestRoad(roads []Point, p Point, radiusM float64) (Point, bool) {
+    band := radiusM / (geo.MetersPerDegreeLat * max(math.Cos(p.Y*math.Pi/180), 0.01))
+    i := sort.Search(len(roads), func(i int) bool { return roads[i].X >= p.X-band })
+    best, bestM := Point{}, math.Inf(1)
+    for ; i < len(roads) && roads[i].X <= p.X+band; i++ {
+        if d := geo.Haversine(p, roads[i]); d <= radiusM && d < bestM {
+            best, bestM = roads[i], d
+        }
+    }
+    return best, !math.IsInf(bestM, 1)
+}
+
+// layersOff names the layers a request turns off, from the on or off it
+// gives by name and the configured defaults.
+func layersOff(layers []NetworkLayerConfig, requested map[string]bool) ([]string, error) {
+    for name := range requested {
+        if !slices.ContainsFunc(layers, func(l NetworkLayerConfig) bool { return l.Name == name }) {
+            return nil, fmt.Errorf("unknown network layer %q", name)
+        }
+    }
+    var off []string
+    for _, l := range layers {
+        on, ok := requested[l.Name]
+        if !ok {
+            on = l.Enabled
+        }
+        if !on {
+            off = append(off, l.Name)
+        }
+    }
+    return off, nil
+}
+
+// layerMask marks the layers named off by their tag, for searches to skip
+// their edges; nil when none is. Names no longer configured are ignored.
+func layerMask(layers []NetworkLayerConfig, off []string) []bool {
+    var mask []bool
+    for i, l := range layers {
+        if slices.Contains(off, l.Name) {
+            if mask == nil {
+                mask = make([]bool, len(layers)+1)
+            }
+            mask[i+1] = true
+        }
+    }
+    return mask
+}
+
+// networkLayerInfo describes a layer in /capabilities.
+type networkLayerInfo struct {
+    Name    string `json:"name"`
+    Enabled bool   `json:"enabled"`
+}
+
+func networkLayerInfos(layers []NetworkLayerConfig) []networkLayerInfo {
+    infos := make([]networkLayerInfo, len(layers))
+    for i, l := range layers {
+        infos[i] = networkLayerInfo{Name: l.Name, Enabled: l.Enabled}
+    }
+    return infos
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+// shortcutLayer writes a layer that retraces the first block of E 40 St
+// with no risk and cuts straight across the fixture network.
+func shortcutLayer(t *testing.T) NetworkLayerConfig {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "shortcut.geojson")
+    layer := `{"type": "FeatureCollection", "features": [
+{"type": "Feature", "properties": {"name": "Campus path", "risk_score": 0}, "geometry": {"type": "LineString", "coordinates": [[-87.66, 41.87], [-87.65678, 41.87045]]}},
+{"type": "Feature", "properties": {"name": "Diagonal", "risk_score": 0}, "geometry": {"type": "LineString", "coordinates": [[-87.66, 41.87], [-87.65678, 41.88286]]}}
+]}`
+    if err := os.WriteFile(path, []byte(layer), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    return NetworkLayerConfig{Name: "shortcut", Path: path, Enabled: true}
+}
+
+func TestNetworkLayerKeepsRoads(t *testing.T) {
+    graph := NewGraph()
+    if err := loadRoadNetwork(fixtureNetwork, graph, nil); err != nil {
+        t.Fatal(err)
+    }
+    a, b := Point{X: -87.66, Y: 41.87}, Point{X: -87.65678, Y: 41.87045}
+    road, maxDist := graph.Edges[a][b], graph.maxDist
+    if err := addNetworkLayers(graph, []NetworkLayerConfig{shortcutLayer(t)}, nil); err != nil {
+        t.Fatal(err)
+    }
+    edges := graph.Edges[a][b]
+    if len(edges) != 2 || edges[0] != road[0] || edges[1].Layer != 1 || edges[1].RiskScore != 0 {
+        t.Errorf("edges %v -> %v = %+v, want the road %+v and the layer's path beside it", a, b, edges, road)
+    }
+    if graph.maxDist != maxDist {
+        t.Errorf("maxDist = %v, want the roads' %v", graph.maxDist, maxDist)
+    }
+    if graph.duplicatePolicy != duplicateMinRisk {
+        t.Errorf("duplicate policy left at %q", graph.duplicatePolicy)
+    }
+}
+
+// TestNetworkLayerOff checks that a route with the layer turned off is
+// the route over the roads alone.
+func TestNetworkLayerOff(t *testing.T) {
+    route := func(tenant *Tenant, body string) []interface{} {
+        t.Helper()
+        w := httptest.NewRecorder()
+        handleRouteRequest(w, tenantRequest(tenant, http.MethodPost, "/route", body))
+        if w.Code != http.StatusOK {
+            t.Fatalf("status = %d: %s", w.Code, w.Body)
+        }
+        var resp struct {
+            Routes []interface{} `json:"routes"`
+        }
+        if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+            t.Fatal(err)
+        }
+        return resp.Routes
+    }
+    const trip = `"start": {"lat": 41.87, "lon": -87.66}, "end": {"lat": 41.88286, "lon": -87.65678}`
+    roadsOnly := route(fixtureTenant(t), `{`+trip+`}`)
+
+    tenant := fixtureTenant(t)
+    globalConfig.NetworkLayers = []NetworkLayerConfig{shortcutLayer(t)}
+    router, err := NewRiskAwareRouter(fixtureNetwork, &CrimeData{}, RouterOptions{NetworkLayers: globalConfig.NetworkLayers})
+    if err != nil {
+        t.Fatal(err)
+    }
+    tenant.router.Store(router)
+
+    if off := route(tenant, `{`+trip+`, "layers": {"shortcut": false}}`); !reflect.DeepEqual(off, roadsOnly) {
+        t.Errorf("with the layer off:\n%v\nwant the roads' routes\n%v", off, roadsOnly)
+    }
+    if on := route(tenant, `{`+trip+`}`); reflect.DeepEqual(on, roadsOnly) {
+        t.Error("with the layer on, routes did not take the shortcut")
+    }
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "slices"
+    "sort"
+)
+
+// Risk normalization strategies, named by RiskLayerMetadata.Normalization.
+// Routing assumes risk in [0, 1]; these map other scales into it.
+const (
+    normalizeNone       = "none"
+    normalizeMinMax     = "minmax"
+    normalizePercentile = "percentile"
+    normalizeZScore     = "zscore"
+)
+
+// zScoreClamp is how many standard deviations from the mean the z-score
+// strategy keeps apart; scores beyond it map to 0 or 1.
+const zScoreClamp = 3
+
+func checkNormalization(strategy string) error {
+    switch strategy {
+    case "", normalizeNone, normalizeMinMax, normalizePercentile, normalizeZScore:
+        return nil
+    }
+    return fmt.Errorf("unknown risk normalization %q (want %s, %s, %s or %s)",
+        strategy, normalizeNone, normalizeMinMax, normalizePercentile, normalizeZScore)
+}
+
+// riskNormalizer maps raw risk scores into [0, 1] using the distribution
+// of the scores it was fitted to. Layers keep theirs so live updates to
+// them are scaled like the scores they were loaded with.
+type riskNormalizer struct {
+    strategy  string
+    min, max  float64
+    mean, std float64
+    sorted    []float64
+}
+
+// fitNormalizer fits strategy to raw, returning nil for no normalization.
+func fitNormalizer(strategy string, raw []float64) *riskNormalizer {
+    if strategy == "" || strategy == normalizeNone || len(raw) == 0 {
+        return nil
+    }
+    n := &riskNormalizer{strategy: strategy}
+    switch strategy {
+    case normalizeMinMax:
+        n.min, n.max = slices.Min(raw), slices.Max(raw)
+    case normalizePercentile:
+        n.sorted = slices.Clone(raw)
+        slices.Sort(n.sorted)
+    case normalizeZScore:
+        for _, v := range raw {
+            n.mean += v
+        }
+        n.mean /= float64(len(raw))
+        for _, v := range raw {
+            n.std += (v - n.mean) * (v - n.mean)
+        }
+        n.std = math.Sqrt(n.std / float64(len(raw)))
+    }
+    return n
+}
+
+// apply normalizes one score; a nil normalizer leaves it unchanged.
+func (n *riskNormalizer) apply(v float64) float64 {
+    if n == nil {
+        return v
+    }
+    switch n.strategy {
+    case normalizeMinMax:
+        if n.max == n.min {
+            return 0
+        }
+        return math.Max(0, math.Min(1, (v-n.min)/(n.max-n.min)))
+    case normalizePercentile:
+        // The mean rank of v among the fitted scores, ties sharing it.
+        if len(n.sorted) < 2 {
+            return 0
+        }
+        below := sort.SearchFloat64s(n.sorted, v)
+        equal := sort.Search(len(n.sorted), func(i int) bool { return n.sorted[i] > v }) - below
+        rank := float64(below) + float64(max(equal-1, 0))/2
+        return math.Min(1, rank/float64(len(n.sorted)-1))
+    case normalizeZScore:
+        if n.std == 0 {
+            return 0.5
+        }
+        z := math.Max(-zScoreClamp, math.Min(zScoreClamp, (v-n.mean)/n.std))
+        return (z + zScoreClamp) / (2 * zScoreClamp)
+    }
+    return v
+}
+
+// applyAll normalizes a copy of raw.
+func (n *riskNormalizer) applyAll(raw []float64) []float64 {
+    out := make([]float64, len(raw))
+    for i, v := range raw {
+        out[i] = n.apply(v)
+    }
+    return out
+}
+
+// params are the fitted parameters recorded in the layer's metadata.
+func (n *riskNormalizer) params() map[string]float64 {
+    switch {
+    case n == nil:
+        return nil
+    case n.strategy == normalizeMinMax:
+        return map[string]float64{"min": n.min, "max": n.max}
+    case n.strategy == normalizeZScore:
+        return map[string]float64{"mean": n.mean, "stddev": n.std, "clamp": zScoreClamp}
+    }
+    return map[string]float64{"samples": float64(len(n.sorted))}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "slices"
+    "time"
+
+    "risk-router/geo"
+)
+
+// The topics users may have notifications for.
+const (
+    // topicRouteMonitor is a monitored route that got riskier or closed.
+    topicRouteMonitor = "route_monitor"
+    // topicIncident is an incident reported near a monitored route.
+    topicIncident = "incident"
+    // topicJobs is a refresh or import of the data routes are found on
+    // having finished.
+    topicJobs = "jobs"
+)
+
+var notificationTopics = []string{topicRouteMonitor, topicIncident, topicJobs}
+
+// maxNotificationChannels bounds the devices and webhooks a user may
+// register.
+const maxNotificationChannels = 10
+
+// notification is a message for a user. Push services show Title and
+// Body; webhooks are sent all of it as JSON.
+type notification struct {
+    Topic string `json:"topic"`
+    Title string `json:"title"`
+    Body  string `json:"body"`
+    // Data is the detail an app acts on, such as a monitor alert.
+    Data interface{} `json:"data,omitempty"`
+}
+
+// notifier delivers notifications through one kind of channel.
+type notifier interface {
+    // send delivers n to an address of the notifier's kind: a URL for
+    // webhooks, a device token for push services.
+    send(ctx context.Context, to string, n notification) error
+}
+
+// notificationChannel is somewhere a user is notified: Kind is "webhook",
+// "fcm" or "apns" and Address the URL or device token.
+type notificationChannel struct {
+    Kind    string `json:"kind" schema:"required"`
+    Address string `json:"address" schema:"required"`
+}
+
+// notificationPrefs are where a user is notified, and of what.
+type notificationPrefs struct {
+    Tenant    string                `json:"-"`
+    User      string                `json:"-"`
+    Channels  []notificationChannel `json:"channels"`
+    Topics    []string              `json:"topics"`
+    UpdatedAt time.Time             `json:"updated_at"`
+}
+
+func (p notificationPrefs) wants(topic string) bool {
+    return len(p.Channels) > 0 && slices.Contains(p.Topics, topic)
+}
+
+// notifiers holds a notifier per channel kind the server can deliver to.
+type notifiers struct {
+    byKind map[string]notifier
+}
+
+var globalNotifiers = &notifiers{byKind: map[string]notifier{"webhook": newWebhookNotifier()}}
+
+// newNotifiers sets up webhooks and the push services cfg configures.
+func newNotifiers(cfg PushConfig) (*notifiers, error) {
+    n := &notifiers{byKind: map[string]notifier{"webhook": newWebhookNotifier()}}
+    if cfg.FCMCredentialsFile != "" {
+        fcm, err := newFCMNotifier(cfg.FCMCredentialsFile)
+        if err != nil {
+            return nil, err
+        }
+        n.byKind["fcm"] = fcm
+    }
+    if cfg.APNsKeyFile != "" {
+        apns, err := newAPNsNotifier(cfg)
+        if err != nil {
+            return nil, err
+        }
+        n.byKind["apns"] = apns
+    }
+    return n, nil
+}
+
+// kinds lists the channel kinds n delivers to.
+func (n *notifiers) kinds() []string {
+    kinds := make([]string, 0, len(n.byKind))
+    for kind := range n.byKind {
+        kinds = append(kinds, kind)
+    }
+    slices.Sort(kinds)
+    return kinds
+}
+
+func (n *notifiers) checkChannel(ch notificationChannel) error {
+    if _, ok := n.byKind[ch.Kind]; !ok {
+        return fmt.Errorf("channel kind must be one of %v, got %q", n.kinds(), ch.Kind)
+    }
+    if ch.Kind == "webhook" {
+        return checkWebhookURL(ch.Address)
+    }
+    if ch.Address == "" {
+        return fmt.Errorf("%s channels need a device token", ch.Kind)
+    }
+    return nil
+}
+
+// deliver sends note to every channel, and succeeds if any delivery did.
+func (n *notifiers) deliver(ctx context.Context, channels []notificationChannel, note notification) error {
+    if len(channels) == 0 {
+        return errors.New("no notification channels")
+    }
+    var errs []error
+    for _, ch := range channels {
+        notifier, ok := n.byKind[ch.Kind]
+        if !ok {
+            errs = append(errs, fmt.Errorf("%s notifications are not configured", ch.Kind))
+            continue
+        }
+        if err := notifier.send(ctx, ch.Address, note); err != nil {
+            errs = append(errs, fmt.Errorf("%s: %v", ch.Kind, err))
+        }
+    }
+    if len(errs) == len(channels) {
+        return errors.Join(errs...)
+    }
+    for _, err := range errs {
+        reportWarning(map[string]string{"component": "notifications"}, "notification partly undelivered: %v", err)
+    }
+    return nil
+}
+
+// userChannels returns the channels user wants note's topic on.
+func userChannels(ctx context.Context, tenant, user, topic string) ([]notificationChannel, error) {
+    prefs, err := globalStorage.notificationPrefs(ctx, tenant, user)
+    if err != nil || !prefs.wants(topic) {
+        return nil, err
+    }
+    return prefs.Channels, nil
+}
+
+// notifyUser sends note to user's channels, if they want its topic.
+func notifyUser(ctx context.Context, tenant, user string, note notification) error {
+    channels, err := userChannels(ctx, tenant, user, note.Topic)
+    if err != nil || len(channels) == 0 {
+        return err
+    }
+    return globalNotifiers.deliver(ctx, channels, note)
+}
+
+// notifyInBackground runs notify off the caller's path, warning of what
+// could not be delivered.
+func notifyInBackground(tenant string, notify func(ctx context.Context) error) {
+    globalJobs.goJob("notifications", noRestart, func() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+        defer cancel()
+        if err := notify(ctx); err != nil {
+            reportWarning(map[string]string{"component": "notifications", "tenant": tenant}, "sending notifications: %v", err)
+        }
+    })
+}
+
+// notifyJobDone tells tenant's users who want it, or every tenant's for
+// an empty tenant, that a data job finished.
+func notifyJobDone(tenant, job, detail string) {
+    notifyInBackground(tenant, func(ctx context.Context) error {
+        subscribers, err := globalStorage.notificationSubscribers(ctx, tenant, topicJobs)
+        if err != nil {
+            return err
+        }
+        note := notification{
+            Topic: topicJobs,
+            Title: "Route data updated",
+            Body:  detail,
+            Data:  map[string]string{"job": job},
+        }
+        var errs []error
+        for _, prefs := range subscribers {
+            if err := globalNotifiers.deliver(ctx, prefs.Channels, note); err != nil {
+                errs = append(errs, fmt.Errorf("user %s: %v", prefs.User, err))
+            }
+        }
+        return errors.Join(errs...)
+    })
+}
+
+// notifyIncident tells the users monitoring a route that passes within
+// the exposure radius of an incident about it, once per user.
+func notifyIncident(tenant string, p Point, severity float64) {
+    notifyInBackground(tenant, func(ctx context.Context) error {
+        monitors, err := globalStorage.allMonitors(ctx)
+        if err != nil {
+            return err
+        }
+        notified := make(map[string]bool)
+        var errs []error
+        for _, mon := range monitors {
+            if mon.Tenant != tenant || notified[mon.User] || !mon.passesNear(p, globalConfig.ExposureRadiusM) {
+                continue
+            }
+            notified[mon.User] = true
+            err := notifyUser(ctx, tenant, mon.User, notification{
+                Topic: topicIncident,
+                Title: "Incident on your route",
+                Body:  fmt.Sprintf("An incident was reported within %.0f m of a route you monitor.", globalConfig.ExposureRadiusM),
+                Data: map[string]interface{}{
+                    "monitor_id": mon.ID, "route_id": mon.RouteID,
+                    "x": p.X, "y": p.Y, "severity": severity,
+                },
+            })
+            if err != nil {
+                errs = append(errs, fmt.Errorf("user %s: %v", mon.User, err))
+            }
+        }
+        return errors.Join(errs...)
+    })
+}
+
+// passesNear reports whether the monitored route comes within radiusM
+// meters of p.
+func (m *routeMonitor) passesNear(p Point, radiusM float64) bool {
+    watched, ok := m.watched()
+    if !ok {
+        return false
+    }
+    for i := 0; i+1 < len(watched.Path); i++ {
+        if geo.DistanceToSegment(p, watched.Path[i], watched.Path[i+1]) <= radiusM {
+            return true
+        }
+    }
+    return false
+}
+
+// checkWebhookURL admits http and https URLs to the configured webhook
+// hosts, or to any host when none are configured.
+func checkWebhookURL(raw string) error {
+    u, err := url.Parse(raw)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return fmt.Errorf("webhooks must be an http or https URL")
+    }
+    if hosts := globalConfig.WebhookHosts; len(hosts) > 0 && !slices.Contains(hosts, u.Hostname()) {
+        return fmt.Errorf("webhook host %s is not allowed (allowed: %v)", u.Hostname(), hosts)
+    }
+    return nil
+}
+
+// webhookNotifier POSTs notifications as JSON.
+type webhookNotifier struct {
+    client *http.Client
+}
+
+func newWebhookNotifier() *webhookNotifier {
+    return &webhookNotifier{client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *webhookNotifier) send(ctx context.Context, to string, note notification) error {
+    body, err := json.Marshal(note)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, to, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := n.client.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("webhook answered %s", resp.Status)
+    }
+    return nil
+}
+
+type notificationPrefsRequest struct {
+    Channels []notificationChannel `json:"channels" schema:"required"`
+    // Topics are what the user is notified of; every topic by default.
+    Topics []string `json:"topics"`
+}
+
+// handleNotificationPrefs serves /me/notifications: GET returns where and
+// of what the caller is notified, and PUT replaces it.
+func handleNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+    tenant := tenantFromContext(r.Context())
+    user := userFromContext(r)
+    if r.Method == http.MethodPut {
+        var req notificationPrefsRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeBadRequest(w, err.Error())
+            return
+        }
+        if len(req.Channels) > maxNotificationChannels {
+            writeBadRequest(w, fmt.Sprintf("at most %d channels may be registered", maxNotificationChannels))
+            return
+        }
+        for _, ch := range req.Channels {
+            if err := globalNotifiers.checkChannel(ch); err != nil {
+                writeBadRequest(w, err.Error())
+                return
+            }
+        }
+        if req.Topics == nil {
+            req.Topics = notificationTopics
+        }
+        for _, topic := range req.Topics {
+            if !slices.Contains(notificationTopics, topic) {
+                writeBadRequest(w, fmt.Sprintf("topics must be among %v, got %q", notificationTopics, topic))
+                return
+            }
+        }
+        prefs := notificationPrefs{Tenant: tenant.ID, User: user, Channels: req.Channels, Topics: req.Topics, UpdatedAt: time.Now().UTC()}
+        if err := globalStorage.setNotificationPrefs(r.Context(), prefs); err != nil {
+            writeAPIError(w, http.StatusInternalServerError, APIError{Code: "storage", Message: err.Error()})
+            return
+        }
+    }
+    prefs, err := globalStorage.notificationPrefs(r.Context(), tenant.ID, user)
+    if err != nil {
+        writeAPIError(w, http.StatusInternalServerError, APIError{Code: "storage", Message: err.Error()})
+        return
+    }
+    if prefs.Channels == nil {
+        prefs.Channels = []notificationChannel{}
+    }
+    if prefs.Topics == nil {
+        prefs.Topics = []string{}
+    }
+    response := struct {
+        notificationPrefs
+        // Kinds are the channel kinds this server delivers to.
+        Kinds []string `json:"available_kinds"`
+    }{prefs, globalNotifiers.kinds()}
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode notification preferences: %v", err)
+    }
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// PushConfig configures the push services users may register devices
+// with; each is off until configured.
+type PushConfig struct {
+    // FCMCredentialsFile is a Firebase service account's JSON key, which
+    // sends through the FCM HTTP v1 API to its project.
+    FCMCredentialsFile string `json:"fcm_credentials_file"`
+    // APNsKeyFile is an APNs auth key (.p8), with its key ID, the team
+    // it belongs to and the app's bundle ID as topic. Sandbox sends to
+    // development builds of the app.
+    APNsKeyFile string `json:"apns_key_file"`
+    APNsKeyID   string `json:"apns_key_id"`
+    APNsTeamID  string `json:"apns_team_id"`
+    APNsTopic   string `json:"apns_topic"`
+    APNsSandbox bool   `json:"apns_sandbox"`
+}
+
+func (c PushConfig) validate() error {
+    if c.APNsKeyFile != "" && (c.APNsKeyID == "" || c.APNsTeamID == "" || c.APNsTopic == "") {
+        return errors.New("push.apns_key_file needs push.apns_key_id, push.apns_team_id and push.apns_topic")
+    }
+    return nil
+}
+
+// pushClient is shared by the push services; APNs needs its HTTP/2.
+var pushClient = &http.Client{Timeout: 10 * time.Second}
+
+// signJWT returns a JWT of claims signed by sign, which is given the
+// SHA-256 digest of the signing input.
+func signJWT(header, claims map[string]interface{}, sign func(digest []byte) ([]byte, error)) (string, error) {
+    var parts [2]string
+    for i, v := range []interface{}{header, claims} {
+        data, err := json.Marshal(v)
+        if err != nil {
+            return "", err
+        }
+        parts[i] = base64.RawURLEncoding.EncodeToString(data)
+    }
+    input := parts[0] + "." + parts[1]
+    digest := sha256.Sum256([]byte(input))
+    sig, err := sign(digest[:])
+    if err != nil {
+        return "", err
+    }
+    return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func readPEMKey(path string) (interface{}, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("%s: no PEM key", path)
+    }
+    return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// cachedToken is a bearer token reused until shortly before it expires.
+type cachedToken struct {
+    mu      sync.Mutex
+    token   string
+    expires time.Time
+}
+
+func (c *cachedToken) get(refresh func() (string, time.Time, error)) (string, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.token != "" && time.Until(c.expires) > time.Minute {
+        return c.token, nil
+    }
+    token, expires, err := refresh()
+    if err != nil {
+        return "", err
+    }
+    c.token, c.expires = token, expires
+    return token, nil
+}
+
+// fcmNotifier sends to Android and web devices through Firebase Cloud
+// Messaging.
+type fcmNotifier struct {
+    project     string
+    clientEmail string
+    tokenURI    string
+    key         *rsa.PrivateKey
+    token       cachedToken
+}
+
+func newFCMNotifier(path string) (*fcmNotifier, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("push.fcm_credentials_file: %v", err)
+    }
+    var account struct {
+        ProjectID   string `json:"project_id"`
+        ClientEmail string `json:"client_email"`
+        PrivateKey  string `json:"private_key"`
+        TokenURI    string `json:"token_uri"`
+    }
+    if err := json.Unmarshal(data, &account); err != nil {
+        return nil, fmt.Errorf("push.fcm_credentials_file: %v", err)
+    }
+    block, _ := pem.Decode([]byte(account.PrivateKey))
+    if block == nil || account.ProjectID == "" || account.ClientEmail == "" {
+        return nil, errors.New("push.fcm_credentials_file is not a service account key")
+    }
+    key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    rsaKey, ok := key.(*rsa.PrivateKey)
+    if err != nil || !ok {
+        return nil, errors.New("push.fcm_credentials_file: private_key is not an RSA key")
+    }
+    if account.TokenURI == "" {
+        account.TokenURI = "https://oauth2.googleapis.com/token"
+    }
+    return &fcmNotifier{project: account.ProjectID, clientEmail: account.ClientEmail, tokenURI: account.TokenURI, key: rsaKey}, nil
+}
+
+// accessToken exchanges a service account assertion for an OAuth token.
+func (n *fcmNotifier) accessToken(ctx context.Context) (string, error) {
+    return n.token.get(func() (string, time.Time, error) {
+        now := time.Now()
+        assertion, err := signJWT(
+            map[string]interface{}{"alg": "RS256", "typ": "JWT"},
+            map[string]interface{}{
+                "iss":   n.clientEmail,
+                "scope": "https://www.googleapis.com/auth/firebase.messaging",
+                "aud":   n.tokenURI,
+                "iat":   now.Unix(),
+                "exp":   now.Add(time.Hour).Unix(),
+            },
+            func(digest []byte) ([]byte, error) {
+                return rsa.SignPKCS1v15(rand.Reader, n.key, crypto.SHA256, digest)
+            })
+        if err != nil {
+            return "", time.Time{}, err
+        }
+        form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.tokenURI, strings.NewReader(form.Encode()))
+        if err != nil {
+            return "", time.Time{}, err
+        }
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        var token struct {
+            AccessToken string `json:"access_token"`
+            ExpiresIn   int    `json:"expires_in"`
+        }
+        if err := doPush(req, &token); err != nil {
+            return "", time.Time{}, fmt.Errorf("fcm token: %v", err)
+        }
+        return token.AccessToken, now.Add(time.Duration(token.ExpiresIn) * time.Second), nil
+    })
+}
+
+func (n *fcmNotifier) send(ctx context.Context, to string, note notification) error {
+    token, err := n.accessToken(ctx)
+    if err != nil {
+        return err
+    }
+    // FCM data values are strings; apps decode the detail from JSON.
+    data := map[string]string{"topic": note.Topic}
+    if note.Data != nil {
+        detail, err := json.Marshal(note.Data)
+        if err != nil {
+            return err
+        }
+        data["data"] = string(detail)
+    }
+    message := map[string]interface{}{"message": map[string]interface{}{
+        "token":        to,
+        "notification": map[string]string{"title": note.Title, "body": note.Body},
+        "data":         data,
+    }}
+    body, err := json.Marshal(message)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+        "https://fcm.googleapis.com/v1/projects/"+url.PathEscape(n.project)+"/messages:send", strings.NewReader(string(body)))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Authorization", "Bearer "+token)
+    req.Header.Set("Content-Type", "application/json")
+    return doPush(req, nil)
+}
+
+// apnsNotifier sends to iOS devices through the Apple Push Notification
+// service, authenticating with a token-based auth key.
+type apnsNotifier struct {
+    cfg   PushConfig
+    host  string
+    key   *ecdsa.PrivateKey
+    token cachedToken
+}
+
+func newAPNsNotifier(cfg PushConfig) (*apnsNotifier, error) {
+    key, err := readPEMKey(cfg.APNsKeyFile)
+    if err != nil {
+        return nil, fmt.Errorf("push.apns_key_file: %v", err)
+    }
+    ecKey, ok := key.(*ecdsa.PrivateKey)
+    if !ok {
+        return nil, errors.New("push.apns_key_file is not an EC key")
+    }
+    host := "https://api.push.apple.com"
+    if cfg.APNsSandbox {
+        host = "https://api.sandbox.push.apple.com"
+    }
+    return &apnsNotifier{cfg: cfg, host: host, key: ecKey}, nil
+}
+
+// providerToken is the JWT APNs authenticates requests with. Apple
+// rejects tokens older than an hour, and new ones more often than every
+// 20 minutes.
+func (n *apnsNotifier) providerToken() (string, error) {
+    return n.token.get(func() (string, time.Time, error) {
+        now := time.Now()
+        token, err := signJWT(
+            map[string]interface{}{"alg": "ES256", "kid": n.cfg.APNsKeyID},
+            map[string]interface{}{"iss": n.cfg.APNsTeamID, "iat": now.Unix()},
+            func(digest []byte) ([]byte, error) {
+                r, s, err := ecdsa.Sign(rand.Reader, n.key, digest)
+                if err != nil {
+                    return nil, err
+                }
+                // JWS wants the fixed-size r || s, not ASN.1.
+                sig := make([]byte, 64)
+                r.FillBytes(sig[:32])
+                s.FillBytes(sig[32:])
+                return sig, nil
+            })
+        return token, now.Add(40 * time.Minute), err
+    })
+}
+
+func (n *apnsNotifier) send(ctx context.Context, to string, note notification) error {
+    token, err := n.providerToken()
+    if err != nil {
+        return err
+    }
+    body, err := json.Marshal(map[string]interface{}{
+        "aps":   map[string]interface{}{"alert": map[string]string{"title": note.Title, "body": note.Body}},
+        "topic": note.Topic,
+        "data":  note.Data,
+    })
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.host+"/3/device/"+url.PathEscape(to), strings.NewReader(string(body)))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Authorization", "bearer "+token)
+    req.Header.Set("apns-topic", n.cfg.APNsTopic)
+    req.Header.Set("apns-push-type", "alert")
+    return doPush(req, nil)
+}
+
+// doPush sends req and decodes a successful answer into v, if given.
+func doPush(req *http.Request, v interface{}) error {
+    resp, err := pushClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+        return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(detail)))
+    }
+    if v == nil {
+        return nil
+    }
+    return json.NewDecoder(resp.Body).Decode(v)
+}
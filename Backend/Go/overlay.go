@@ -0,0 +1,395 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    maxOverlays        = 32
+    maxOverlayDuration = 7 * 24 * time.Hour
+)
+
+// riskOverlay is a temporary scenario, such as a parade or a protest,
+// that adds a risk delta to some edges for a time window. Overlays never
+// change the risk layers themselves: searches read an effective layer of
+// the current layer plus every active overlay.
+type riskOverlay struct {
+    Name        string    `json:"name"`
+    Description string    `json:"description,omitempty"`
+    StartsAt    time.Time `json:"starts_at"`
+    ExpiresAt   time.Time `json:"expires_at"`
+    CreatedAt   time.Time `json:"created_at"`
+    Edges       int       `json:"edges"`
+    Active      bool      `json:"active"`
+
+    deltas map[int32]float64
+}
+
+func (o *riskOverlay) activeAt(t time.Time) bool {
+    return !t.Before(o.StartsAt) && t.Before(o.ExpiresAt)
+}
+
+// riskOverlays holds a router's overlays and the effective layer built
+// for the ones active at the last lookup.
+type riskOverlays struct {
+    mu     sync.Mutex
+    byName map[string]*riskOverlay
+
+    key       string
+    effective *riskLayer
+}
+
+// activeLayer is the layer searches use by default: the current risk
+// layer with every active overlay added, clamped to [0, 1]. The effective
+// layer gets its own version, so routes cached or tagged under it are not
+// served once the overlays change.
+func (r *RiskAwareRouter) activeLayer() *riskLayer {
+    base := r.layers.current()
+    o := &r.overlays
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    now := time.Now()
+    active, key := o.active(now)
+    if len(active) == 0 {
+        o.setEffective(r, "", nil)
+        return base
+    }
+    key = base.Version + key
+    if o.effective != nil && o.key == key {
+        return o.effective
+    }
+
+    risk := make([]float64, len(base.risk))
+    copy(risk, base.risk)
+    applyOverlays(risk, active)
+    layer := &riskLayer{
+        Version:  r.G.hashRisk(risk),
+        Metadata: base.Metadata,
+        LoadedAt: now.UTC(),
+        Parent:   base.Version,
+        risk:     risk,
+
+        normalizer: base.normalizer,
+    }
+    r.precomputeLayerWeights(layer, r.weights.alphasFor(base.Version))
+    o.setEffective(r, key, layer)
+    return layer
+}
+
+// active returns the overlays active at now, by name, and a key that
+// changes whenever they do. Expired overlays are dropped here, so they
+// stop applying without a request to remove them. Callers hold o.mu.
+func (o *riskOverlays) active(now time.Time) ([]*riskOverlay, string) {
+    var active []*riskOverlay
+    for name, ov := range o.byName {
+        if !now.Before(ov.ExpiresAt) {
+            delete(o.byName, name)
+            log.Printf("Risk overlay %s expired", name)
+            continue
+        }
+        if ov.activeAt(now) {
+            active = append(active, ov)
+        }
+    }
+    sort.Slice(active, func(i, j int) bool { return active[i].Name < active[j].Name })
+    key := ""
+    for _, ov := range active {
+        key += fmt.Sprintf("|%s@%d", ov.Name, ov.CreatedAt.UnixNano())
+    }
+    return active, key
+}
+
+// applyOverlays adds the deltas of overlays to risk, clamped to [0, 1].
+func applyOverlays(risk []float64, overlays []*riskOverlay) {
+    if len(overlays) == 0 {
+        return
+    }
+    for _, ov := range overlays {
+        for e, d := range ov.deltas {
+            risk[e] += d
+        }
+    }
+    for e := range risk {
+        risk[e] = min(max(risk[e], 0), 1)
+    }
+}
+
+// setEffective replaces the effective layer, dropping the weights of the
+// one it replaces. Callers hold o.mu.
+func (o *riskOverlays) setEffective(r *RiskAwareRouter, key string, layer *riskLayer) {
+    if old := o.effective; old != nil && (layer == nil || old.Version != layer.Version) {
+        r.weights.drop(old.Version)
+    }
+    o.key, o.effective = key, layer
+}
+
+// list returns the overlays not yet expired, by name.
+func (o *riskOverlays) list() []*riskOverlay {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    now := time.Now()
+    overlays := make([]*riskOverlay, 0, len(o.byName))
+    for _, ov := range o.byName {
+        if now.Before(ov.ExpiresAt) {
+            ov.Active = ov.activeAt(now)
+            overlays = append(overlays, ov)
+        }
+    }
+    sort.Slice(overlays, func(i, j int) bool { return overlays[i].Name < overlays[j].Name })
+    return overlays
+}
+
+// overlayGeometry is a GeoJSON geometry: a LineString along the road
+// segments it changes, or a Polygon whose roads it changes.
+type overlayGeometry struct {
+    Type        string      `json:"type" schema:"required"`
+    Coordinates interface{} `json:"coordinates" schema:"required"`
+}
+
+// overlayFeature is a GeoJSON feature whose risk_delta property is added
+// to the risk of the roads it covers.
+type overlayFeature struct {
+    Type       string                 `json:"type"`
+    Properties map[string]interface{} `json:"properties" schema:"required"`
+    Geometry   overlayGeometry        `json:"geometry" schema:"required"`
+}
+
+// overlayRequest is the body of PUT /admin/overlays/{name}. The overlay
+// applies from starts_at (RFC 3339, now by default) until expires_at or
+// for duration_s seconds.
+type overlayRequest struct {
+    Description string           `json:"description"`
+    StartsAt    string           `json:"starts_at"`
+    ExpiresAt   string           `json:"expires_at"`
+    DurationS   float64          `json:"duration_s" schema:"minimum=0"`
+    Features    []overlayFeature `json:"features" schema:"required"`
+}
+
+// window resolves the time window of the request.
+func (req overlayRequest) window(now time.Time) (time.Time, time.Time, error) {
+    starts, expires := now, time.Time{}
+    if req.StartsAt != "" {
+        t, err := time.Parse(time.RFC3339, req.StartsAt)
+        if err != nil {
+            return starts, expires, fmt.Errorf("starts_at: %v", err)
+        }
+        starts = t
+    }
+    switch {
+    case req.ExpiresAt != "" && req.DurationS > 0:
+        return starts, expires, fmt.Errorf("give either expires_at or duration_s, not both")
+    case req.ExpiresAt != "":
+        t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+        if err != nil {
+            return starts, expires, fmt.Errorf("expires_at: %v", err)
+        }
+        expires = t
+    case req.DurationS > 0:
+        expires = starts.Add(time.Duration(req.DurationS * float64(time.Second)))
+    default:
+        return starts, expires, fmt.Errorf("an overlay needs expires_at or duration_s")
+    }
+    if !expires.After(starts) || !expires.After(now) {
+        return starts, expires, fmt.Errorf("the overlay must end after it starts and in the future")
+    }
+    if expires.Sub(starts) > maxOverlayDuration {
+        return starts, expires, fmt.Errorf("an overlay may last at most %v", maxOverlayDuration)
+    }
+    return starts, expires, nil
+}
+
+// overlayDeltas resolves each feature to the edges it covers and sums
+// their risk deltas.
+func (r *RiskAwareRouter) overlayDeltas(features []overlayFeature) (map[int32]float64, error) {
+    deltas := make(map[int32]float64)
+    for i, f := range features {
+        delta, ok := f.Properties["risk_delta"].(float64)
+        if !ok || delta < -1 || delta > 1 {
+            return nil, fmt.Errorf("features[%d]: properties.risk_delta must be a number within [-1, 1]", i)
+        }
+        var edges []int32
+        switch f.Geometry.Type {
+        case "LineString":
+            line, err := coordinatePoints(f.Geometry.Coordinates)
+            if err != nil || len(line) < 2 {
+                return nil, fmt.Errorf("features[%d]: a LineString needs at least two [x, y] coordinates", i)
+            }
+            for j := 0; j+1 < len(line); j++ {
+                segment, err := r.segmentEdges(line[j], line[j+1])
+                if err != nil {
+                    return nil, fmt.Errorf("features[%d]: %v", i, err)
+                }
+                edges = append(edges, segment...)
+            }
+        case "Polygon":
+            rings, _ := f.Geometry.Coordinates.([]interface{})
+            var ring []Point
+            var err error
+            if len(rings) > 0 {
+                ring, err = coordinatePoints(rings[0])
+            }
+            if err != nil || len(ring) < 3 {
+                return nil, fmt.Errorf("features[%d]: a Polygon needs an outer ring of at least three [x, y] coordinates", i)
+            }
+            edges = r.G.edgesTouching(r.G.nodesInPolygon(ring))
+        default:
+            return nil, fmt.Errorf("features[%d]: geometry must be a LineString or a Polygon, not %q", i, f.Geometry.Type)
+        }
+        seen := make(map[int32]bool, len(edges))
+        for _, e := range edges {
+            if !seen[e] {
+                seen[e] = true
+                deltas[e] += delta
+            }
+        }
+    }
+    return deltas, nil
+}
+
+// edgesTouching returns the edges, in both directions, with an end at
+// one of nodes, each once.
+func (g *Graph) edgesTouching(nodes []int32) []int32 {
+    seen := make(map[int32]bool)
+    var edges []int32
+    add := func(e int32) {
+        if !seen[e] {
+            seen[e] = true
+            edges = append(edges, e)
+        }
+    }
+    for _, n := range nodes {
+        lo, hi := g.edgeRange(n)
+        for e := lo; e < hi; e++ {
+            add(e)
+            if back, ok := g.twin(e); ok {
+                add(back)
+            }
+        }
+    }
+    return edges
+}
+
+// coordinatePoints reads a decoded GeoJSON coordinate list.
+func coordinatePoints(v interface{}) ([]Point, error) {
+    list, ok := v.([]interface{})
+    if !ok {
+        return nil, fmt.Errorf("coordinates must be a list")
+    }
+    points := make([]Point, len(list))
+    for i, c := range list {
+        pair, ok := c.([]interface{})
+        if !ok || len(pair) < 2 {
+            return nil, fmt.Errorf("coordinate %d must be [x, y]", i)
+        }
+        x, okX := pair[0].(float64)
+        y, okY := pair[1].(float64)
+        if !okX || !okY {
+            return nil, fmt.Errorf("coordinate %d must be [x, y]", i)
+        }
+        points[i] = Point{X: x, Y: y}
+    }
+    return points, nil
+}
+
+// handleAdminOverlays serves GET /admin/overlays, a tenant's overlays that
+// have not expired.
+func handleAdminOverlays(w http.ResponseWriter, r *http.Request) {
+    tenant, err := tenantByID(r.URL.Query().Get("tenant"))
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    writeOverlays(w, tenant.Router())
+}
+
+// handleOverlay serves /admin/overlays/{name}: PUT adds or replaces the
+// overlay and DELETE removes it before it expires.
+func handleOverlay(w http.ResponseWriter, r *http.Request) {
+    tenant, err := tenantByID(r.URL.Query().Get("tenant"))
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    name := r.PathValue("name")
+    audit := auditFromContext(r.Context())
+    audit.Target = fmt.Sprintf("%s tenant=%s overlay=%s", r.Method, tenant.ID, name)
+    router := tenant.Router()
+    o := &router.overlays
+    if r.Method == http.MethodDelete {
+        o.mu.Lock()
+        ov, ok := o.byName[name]
+        delete(o.byName, name)
+        o.mu.Unlock()
+        if !ok {
+            writeAPIError(w, http.StatusNotFound, APIError{Code: "not_found", Message: "unknown overlay " + name})
+            return
+        }
+        audit.Before = ov
+        dataChanged(router)
+        writeOverlays(w, router)
+        return
+    }
+
+    var req overlayRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    now := time.Now().UTC()
+    starts, expires, err := req.window(now)
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    deltas, err := router.overlayDeltas(req.Features)
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    ov := &riskOverlay{
+        Name:        name,
+        Description: strings.TrimSpace(req.Description),
+        StartsAt:    starts.UTC(),
+        ExpiresAt:   expires.UTC(),
+        CreatedAt:   now,
+        Edges:       len(deltas),
+        deltas:      deltas,
+    }
+
+    o.mu.Lock()
+    if o.byName == nil {
+        o.byName = make(map[string]*riskOverlay)
+    }
+    if old, ok := o.byName[name]; ok {
+        audit.Before = old
+    } else if len(o.byName) >= maxOverlays {
+        o.mu.Unlock()
+        writeBadRequest(w, fmt.Sprintf("at most %d overlays may be registered", maxOverlays))
+        return
+    }
+    o.byName[name] = ov
+    o.mu.Unlock()
+    audit.After = ov
+
+    log.Printf("Risk overlay %s for tenant %s: %d edges from %s until %s", name, tenant.ID, ov.Edges, ov.StartsAt.Format(time.RFC3339), ov.ExpiresAt.Format(time.RFC3339))
+    dataChanged(router)
+    writeOverlays(w, router)
+}
+
+func writeOverlays(w http.ResponseWriter, router *RiskAwareRouter) {
+    response := struct {
+        Overlays    []*riskOverlay `json:"overlays"`
+        RiskVersion string         `json:"risk_version"`
+    }{router.overlays.list(), router.activeLayer().Version}
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode overlays: %v", err)
+    }
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+
+    "risk-router/geo"
+)
+
+// parkingCategory is the POI category of places to park.
+const parkingCategory = "parking"
+
+const (
+    defaultParkWalkAlpha = 0.5
+    defaultMaxWalkM      = 600
+    maxMaxWalkM          = 2000
+    // maxParkingCandidates bounds the parking places, nearest the
+    // destination first, whose walks are searched.
+    maxParkingCandidates = 8
+    // parkingAreaEdges is how many of the streets nearest a parking place
+    // its surroundings' risk is the mean of.
+    parkingAreaEdges = 4
+)
+
+// loadParking adds the parking places of path, if set, to t's POIs.
+func (t *Tenant) loadParking(path string) error {
+    if path == "" {
+        return nil
+    }
+    pois, err := loadPOIs(path, "")
+    if err != nil {
+        return fmt.Errorf("parking_path: %v", err)
+    }
+    for i := range pois {
+        pois[i].Category = parkingCategory
+    }
+    t.pois = append(t.pois, pois...)
+    return nil
+}
+
+// parkWalkRequest is the body of POST /route/park-and-walk.
+type parkWalkRequest struct {
+    Start *Coordinate `json:"start" schema:"required"`
+    End   *Coordinate `json:"end" schema:"required"`
+    // Alpha weighs risk on the walk, and in choosing where to park.
+    Alpha *float64 `json:"alpha" schema:"minimum=0,maximum=1"`
+    // MaxWalkM bounds how far, in a straight line, the parking may be
+    // from the destination.
+    MaxWalkM float64 `json:"max_walk_m" schema:"minimum=0"`
+    Clamp    bool    `json:"clamp"`
+}
+
+// parkingChoice is the parking a park-and-walk trip leaves the car at.
+type parkingChoice struct {
+    Name     string     `json:"name,omitempty"`
+    Location Point      `json:"location"`
+    Snap     SnapResult `json:"snap"`
+    // AreaRisk is the mean risk of the streets around it.
+    AreaRisk float64 `json:"area_risk"`
+    // Candidates counts the parking places weighed.
+    Candidates int `json:"candidates"`
+
+    score float64
+}
+
+// areaRisk is the mean risk, on layer, of the streets nearest p.
+func (r *RiskAwareRouter) areaRisk(p Point, layer *riskLayer) float64 {
+    hits := r.G.segmentIndex.nearest(p, parkingAreaEdges, cellSizeM(p.Y), func(e int32) float64 {
+        return geo.DistanceToSegment(p, r.G.Nodes[r.G.source(e)], r.G.Nodes[r.G.targets[e]])
+    })
+    if len(hits) == 0 {
+        return 0
+    }
+    total := 0.0
+    for _, hit := range hits {
+        total += layer.risk[hit.id]
+    }
+    return total / float64(len(hits))
+}
+
+// chooseParking returns the parking place, among those within maxWalkM of
+// end, whose walk to end costs least at alpha, counting its surroundings
+// as one more street to walk at their mean risk. It returns nil when none
+// is within reach.
+func (r *RiskAwareRouter) chooseParking(ctx context.Context, places []poi, end SnapResult, alpha, maxWalkM float64, lang string) (*parkingChoice, error) {
+    type candidate struct {
+        poi
+        straightM float64
+    }
+    var near []candidate
+    for _, p := range places {
+        if p.Category != parkingCategory {
+            continue
+        }
+        if d := geo.Haversine(p.Location, end.Requested); d <= maxWalkM {
+            near = append(near, candidate{p, d})
+        }
+    }
+    sort.Slice(near, func(i, j int) bool { return near[i].straightM < near[j].straightM })
+    if len(near) > maxParkingCandidates {
+        near = near[:maxParkingCandidates]
+    }
+
+    layer := r.activeLayer()
+    var best *parkingChoice
+    for _, c := range near {
+        snap, err := r.snapChecked(c.Location, "parking", false)
+        if err != nil {
+            continue
+        }
+        cells, err := r.distancesFrom(ctx, snap.node, []int32{end.node}, alpha)
+        if err != nil {
+            return nil, err
+        }
+        if !cells[0].Found {
+            continue
+        }
+        choice := &parkingChoice{
+            Name:     localizedName(c.Names, lang),
+            Location: c.Location,
+            Snap:     snap,
+            AreaRisk: r.areaRisk(c.Location, layer),
+        }
+        choice.score = cells[0].cost + alpha*choice.AreaRisk*r.G.maxDist
+        if best == nil || choice.score < best.score {
+            best = choice
+        }
+    }
+    if best != nil {
+        best.Candidates = len(near)
+    }
+    return best, nil
+}
+
+// walkParams are the search parameters of a walk leg, those of a plain
+// route request.
+func walkParams() routeParams {
+    return routeParams{
+        HeuristicWeight: globalConfig.HeuristicWeight,
+        EllipseFactor:   globalConfig.SearchEllipseFactor,
+        ArcFlags:        true,
+    }
+}
+
+// roadParams are walkParams on the road network alone, without the
+// added pedestrian network layers, for legs on wheels.
+func roadParams() routeParams {
+    var names []string
+    for _, l := range globalConfig.NetworkLayers {
+        names = append(names, l.Name)
+    }
+    p := walkParams()
+    p.LayersOff = layerMask(globalConfig.NetworkLayers, names)
+    return p
+}
+
+// driveParams are the search parameters of a drive leg: roadParams
+// preferring main streets when road attributes are loaded.
+func driveParams() routeParams {
+    p := roadParams()
+    p.MainStreets = true
+    return p
+}
+
+// legRoute is the route of one leg of a trip at alpha, its duration at
+// speedMPS; a leg between stops on the same node is empty.
+func (r *RiskAwareRouter) legRoute(ctx context.Context, from, to SnapResult, alpha float64, params routeParams, speedMPS float64) (Route, error) {
+    if from.node == to.node {
+        return Route{Alpha: alpha}, nil
+    }
+    routes, _, err := r.routesBetween(ctx, from, to, []float64{alpha}, params)
+    if err == nil && len(routes) == 0 {
+        err = context.DeadlineExceeded
+    }
+    if err != nil {
+        return Route{}, err
+    }
+    route := routes[0]
+    route.Summary = r.summarize(route.Path, speedMPS)
+    return route, nil
+}
+
+// handleParkAndWalk serves POST /route/park-and-walk: a drive to the
+// parking near the destination that leaves the safest walk, then that
+// walk. The drive is the shortest by road; the graph knows nothing of
+// turn restrictions, so its path is a guide rather than directions. Each
+// leg has its own risk metrics.
+func handleParkAndWalk(w http.ResponseWriter, r *http.Request) {
+    var req parkWalkRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    if req.Start == nil || req.End == nil {
+        writeBadRequest(w, "start and end are required")
+        return
+    }
+    alpha := defaultParkWalkAlpha
+    if req.Alpha != nil {
+        alpha = *req.Alpha
+    }
+    if alpha < 0 || alpha > 1 {
+        writeBadRequest(w, "alpha must be within [0, 1]")
+        return
+    }
+    maxWalkM := req.MaxWalkM
+    if maxWalkM == 0 {
+        maxWalkM = defaultMaxWalkM
+    }
+    if maxWalkM < 0 || maxWalkM > maxMaxWalkM {
+        writeBadRequest(w, fmt.Sprintf("max_walk_m must be within (0, %d]", maxMaxWalkM))
+        return
+    }
+
+    ctx := r.Context()
+    tenant := tenantFromContext(ctx)
+    router := tenant.Router()
+    var snap SnapDiagnostics
+    var err error
+    if snap.Start, err = router.snapChecked(req.Start.point(), "start", req.Clamp); err != nil {
+        writeOutOfBounds(w, err)
+        return
+    }
+    if snap.End, err = router.snapChecked(req.End.point(), "end", req.Clamp); err != nil {
+        writeOutOfBounds(w, err)
+        return
+    }
+
+    l := localizerFor(r)
+    parking, err := router.chooseParking(ctx, tenant.pois, snap.End, alpha, maxWalkM, l.Language)
+    if errors.Is(err, context.Canceled) {
+        return
+    }
+    if err != nil {
+        writeAPIError(w, http.StatusGatewayTimeout, APIError{Code: "timeout", Message: "choosing the parking timed out"})
+        return
+    }
+    if parking == nil {
+        writeAPIError(w, http.StatusUnprocessableEntity, APIError{
+            Code:    "no_parking",
+            Message: fmt.Sprintf("no parking within %g m of the destination has a walk to it", maxWalkM),
+            Details: map[string]interface{}{"max_walk_m": maxWalkM},
+        })
+        return
+    }
+
+    // The walk is known to connect: its cost chose the parking.
+    drive, err := router.legRoute(ctx, snap.Start, parking.Snap, 0, driveParams(), globalConfig.DrivingSpeedMPS)
+    var walk Route
+    if err == nil {
+        walk, err = router.legRoute(ctx, parking.Snap, snap.End, alpha, walkParams(), globalConfig.WalkingSpeedMPS)
+    }
+    switch {
+    case errors.Is(err, context.Canceled):
+        return
+    case errors.Is(err, errNotConnected):
+        writeNotConnected(w, router, SnapDiagnostics{Start: snap.Start, End: parking.Snap})
+        return
+    case err != nil:
+        writeAPIError(w, http.StatusGatewayTimeout, APIError{Code: "timeout", Message: "route search timed out"})
+        return
+    }
+    writeParkAndWalk(w, alpha, snap, parking, drive, walk)
+}
+
+func writeParkAndWalk(w http.ResponseWriter, alpha float64, snap SnapDiagnostics, parking *parkingChoice, drive, walk Route) {
+    response := struct {
+        Alpha     float64         `json:"alpha"`
+        Snap      SnapDiagnostics `json:"snap"`
+        Parking   *parkingChoice  `json:"parking"`
+        Drive     Route           `json:"drive"`
+        Walk      Route           `json:"walk"`
+        LengthM   float64         `json:"length_m"`
+        DurationS float64         `json:"duration_s"`
+    }{alpha, snap, parking, drive, walk, drive.Summary.LengthM + walk.Summary.LengthM, drive.Summary.DurationS + walk.Summary.DurationS}
+    writeSignedJSON(w, response, "park-and-walk")
+}
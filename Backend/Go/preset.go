@@ -0,0 +1,75 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+)
+
+// routingProfiles are the routing profiles the server can serve.
+var routingProfiles = []string{"default"}
+
+// Preset is a named, server-configured bundle of routing parameters, so
+// clients pick "safest" rather than hard-coding alpha values.
+type Preset struct {
+    Alphas  []float64 `json:"alphas"`
+    Profile string    `json:"profile,omitempty"`
+    // MaxEdgeRisk excludes road segments scoring above it; zero means no
+    // limit.
+    MaxEdgeRisk float64 `json:"max_edge_risk,omitempty"`
+}
+
+func defaultPresets() map[string]Preset {
+    return map[string]Preset{
+        "fastest":    {Alphas: []float64{0}, Profile: "default"},
+        "balanced":   {Alphas: []float64{0.5}, Profile: "default"},
+        "safest":     {Alphas: []float64{0.9}, Profile: "default"},
+        "night-walk": {Alphas: []float64{0.75}, Profile: "default", MaxEdgeRisk: 0.8},
+    }
+}
+
+func (p Preset) validate() error {
+    if len(p.Alphas) == 0 {
+        return fmt.Errorf("at least one alpha is required")
+    }
+    for _, alpha := range p.Alphas {
+        if alpha < 0 || alpha > 1 {
+            return fmt.Errorf("alpha %v outside [0, 1]", alpha)
+        }
+    }
+    if p.Profile != "" && !knownProfile(p.Profile) {
+        return fmt.Errorf("unknown profile %q", p.Profile)
+    }
+    if p.MaxEdgeRisk < 0 || p.MaxEdgeRisk > 1 {
+        return fmt.Errorf("max_edge_risk %v outside [0, 1]", p.MaxEdgeRisk)
+    }
+    return nil
+}
+
+func knownProfile(name string) bool {
+    for _, p := range routingProfiles {
+        if p == name {
+            return true
+        }
+    }
+    return false
+}
+
+// presetNames lists the configured presets in a stable order.
+func presetNames(presets map[string]Preset) []string {
+    names := make([]string, 0, len(presets))
+    for name := range presets {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// presetAlphas collects every alpha used by a preset, for precomputing
+// edge weights.
+func presetAlphas(presets map[string]Preset) []float64 {
+    var alphas []float64
+    for _, p := range presets {
+        alphas = append(alphas, p.Alphas...)
+    }
+    return alphas
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+
+    "risk-router/geo"
+)
+
+// PrewarmConfig tunes the route_prewarm task, which precomputes the most
+// requested origin/destination pairs into the route cache so the morning
+// rush finds it warm.
+type PrewarmConfig struct {
+    // TopN is how many of each tenant's busiest cell pairs are
+    // precomputed; 0 turns the tally and the task off.
+    TopN int `json:"top_n"`
+    // CellM is the size of the grid cells requests are tallied by.
+    CellM float64 `json:"cell_m"`
+    // HoldHours is how long precomputed responses stay cached, however
+    // short the route cache TTL.
+    HoldHours float64 `json:"hold_hours"`
+}
+
+func defaultPrewarmConfig() PrewarmConfig {
+    return PrewarmConfig{TopN: 100, CellM: 250, HoldHours: 6}
+}
+
+func (c PrewarmConfig) validate() error {
+    if c.TopN < 0 {
+        return fmt.Errorf("prewarm.top_n must not be negative, got %d", c.TopN)
+    }
+    if c.CellM <= 0 {
+        return fmt.Errorf("prewarm.cell_m must be positive, got %v", c.CellM)
+    }
+    if c.HoldHours < 0 {
+        return fmt.Errorf("prewarm.hold_hours must not be negative, got %v", c.HoldHours)
+    }
+    return nil
+}
+
+// prewarmEnabled reports whether route requests are tallied for the
+// route_prewarm task: there must be a cache to warm, and privacy mode
+// keeps no coordinates.
+func prewarmEnabled(cfg Config) bool {
+    return cfg.Prewarm.TopN > 0 && cfg.RouteCacheEntries > 0 && !cfg.PrivacyMode
+}
+
+const (
+    // maxODCells bounds the cell pairs a tenant's tally holds; requests
+    // between new pairs are not counted once it is full.
+    maxODCells = 100000
+    // maxODExact bounds the exact pairs kept per cell pair.
+    maxODExact = 8
+)
+
+// odCells is an origin and a destination grid cell, as row and column.
+type odCells struct {
+    from, to [2]int32
+}
+
+type odCount struct {
+    requests int
+    // exact counts the exact start and end points requested, since a
+    // cached response only answers the very same coordinates.
+    exact map[[2]Point]int
+}
+
+// odTally counts a tenant's route requests by origin and destination
+// cell. The zero value is ready to use.
+type odTally struct {
+    mu    sync.Mutex
+    cells map[odCells]*odCount
+}
+
+// odPair is a precomputation candidate: the most requested exact pair of
+// a cell pair, and the requests tallied between the cells.
+type odPair struct {
+    Start, End Point
+    Requests   int
+}
+
+// gridCell returns the row and column of the cellM-meter cell p is in.
+// Columns narrow with the cosine of the row's latitude, so cells stay
+// roughly square.
+func gridCell(p Point, cellM float64) [2]int32 {
+    latStep := cellM / geo.MetersPerDegreeLat
+    row := math.Floor(p.Y / latStep)
+    lonStep := latStep / math.Max(math.Cos((row+0.5)*latStep*math.Pi/180), 0.01)
+    return [2]int32{int32(row), int32(math.Floor(p.X / lonStep))}
+}
+
+func (t *odTally) record(start, end Point, cellM float64) {
+    key := odCells{gridCell(start, cellM), gridCell(end, cellM)}
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.cells == nil {
+        t.cells = make(map[odCells]*odCount)
+    }
+    c, ok := t.cells[key]
+    if !ok {
+        if len(t.cells) >= maxODCells {
+            return
+        }
+        c = &odCount{exact: make(map[[2]Point]int)}
+        t.cells[key] = c
+    }
+    c.requests++
+    pair := [2]Point{start, end}
+    if _, ok := c.exact[pair]; ok || len(c.exact) < maxODExact {
+        c.exact[pair]++
+    }
+}
+
+// top returns the n most requested cell pairs, busiest first, with their
+// most requested exact pair, then halves every count so the tally follows
+// demand as it shifts; pairs halved to nothing are dropped.
+func (t *odTally) top(n int) []odPair {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    pairs := make([]odPair, 0, len(t.cells))
+    for _, c := range t.cells {
+        var best [2]Point
+        bestN := 0
+        for pair, k := range c.exact {
+            if k > bestN || (k == bestN && pointPairLess(pair, best)) {
+                best, bestN = pair, k
+            }
+        }
+        if bestN > 0 {
+            pairs = append(pairs, odPair{Start: best[0], End: best[1], Requests: c.requests})
+        }
+    }
+    sort.Slice(pairs, func(i, j int) bool {
+        if pairs[i].Requests != pairs[j].Requests {
+            return pairs[i].Requests > pairs[j].Requests
+        }
+        return pointPairLess([2]Point{pairs[i].Start, pairs[i].End}, [2]Point{pairs[j].Start, pairs[j].End})
+    })
+    if len(pairs) > n {
+        pairs = pairs[:n]
+    }
+
+    for key, c := range t.cells {
+        c.requests /= 2
+        for pair, k := range c.exact {
+            if k /= 2; k == 0 {
+                delete(c.exact, pair)
+            } else {
+                c.exact[pair] = k
+            }
+        }
+        if c.requests == 0 {
+            delete(t.cells, key)
+        }
+    }
+    return pairs
+}
+
+// pointPairLess orders pairs of points, so ties rank the same every run.
+func pointPairLess(a, b [2]Point) bool {
+    for i := range a {
+        if a[i].X != b[i].X {
+            return a[i].X < b[i].X
+        }
+        if a[i].Y != b[i].Y {
+            return a[i].Y < b[i].Y
+        }
+    }
+    return false
+}
+
+type prewarmContextKey struct{}
+
+// prewarming reports whether ctx is the route_prewarm task's: its
+// requests are cached, but neither tallied nor saved.
+func prewarming(ctx context.Context) bool {
+    return ctx.Value(prewarmContextKey{}) != nil
+}
+
+// discardResponse is the response writer of a precomputed request, which
+// only needs its status and ETag; the body is kept by the route cache.
+type discardResponse struct {
+    header http.Header
+    status int
+}
+
+func (d *discardResponse) Header() http.Header         { return d.header }
+func (d *discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponse) WriteHeader(status int)      { d.status = status }
+
+// prewarmRoute requests the routes between pair as a client asking with
+// the tenant's standard alphas would, so the response is cached under the
+// ETag that client's request has, and returns that ETag.
+func prewarmRoute(ctx context.Context, pair odPair) (string, error) {
+    body, err := json.Marshal(map[string]interface{}{
+        "start": map[string]float64{"lat": pair.Start.Y, "lon": pair.Start.X},
+        "end":   map[string]float64{"lat": pair.End.Y, "lon": pair.End.X},
+    })
+    if err != nil {
+        return "", err
+    }
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/route", bytes.NewReader(body))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    w := &discardResponse{header: make(http.Header), status: http.StatusOK}
+    handleRouteRequest(w, req)
+    if w.status != http.StatusOK {
+        return "", fmt.Errorf("answered %d", w.status)
+    }
+    return w.header.Get("ETag"), nil
+}
+
+// prewarmRoutes precomputes each tenant's busiest origin/destination
+// pairs into its route cache, and holds them there for HoldHours.
+func prewarmRoutes(now time.Time) error {
+    cfg := globalConfig.Prewarm
+    if !prewarmEnabled(globalConfig) {
+        return nil
+    }
+    hold := now.Add(time.Duration(cfg.HoldHours * float64(time.Hour)))
+    var errs []error
+    for _, t := range globalTenants.tenants {
+        pairs := t.od.top(cfg.TopN)
+        ctx := withSearchClass(context.Background(), classBatch)
+        ctx = context.WithValue(ctx, tenantContextKey{}, t)
+        ctx = context.WithValue(ctx, prewarmContextKey{}, true)
+        warmed, failed := 0, 0
+        for _, pair := range pairs {
+            etag, err := prewarmRoute(ctx, pair)
+            if err != nil {
+                failed++
+                continue
+            }
+            if t.Router().routes.hold(etag, hold) {
+                warmed++
+            }
+        }
+        log.Printf("Prewarm: tenant %s: cached %d of the %d busiest origin/destination pairs", t.ID, warmed, len(pairs))
+        if failed > 0 {
+            errs = append(errs, fmt.Errorf("tenant %s: %d of %d pairs failed", t.ID, failed, len(pairs)))
+        }
+    }
+    return errors.Join(errs...)
+}
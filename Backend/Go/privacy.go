@@ -0,0 +1,116 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+)
+
+// redactQuery rounds the numbers in a raw query string, as the recorder
+// does, when privacy mode is on.
+func redactQuery(raw string) string {
+    if !globalConfig.PrivacyMode || raw == "" {
+        return raw
+    }
+    q, err := url.ParseQuery(raw)
+    if err != nil {
+        return ""
+    }
+    return anonymizeQuery(q)
+}
+
+// redactedURI is u's request URI with its query redacted.
+func redactedURI(u *url.URL) string {
+    if q := redactQuery(u.RawQuery); q != "" {
+        return u.EscapedPath() + "?" + q
+    }
+    return u.EscapedPath()
+}
+
+// anonymousRequest reports whether r asked not to be tracked: with a DNT
+// or Sec-GPC header of 1, or a request flag its handler has marked.
+// Anonymous requests are not recorded, do not read or fill the route
+// cache, and are not saved under a route_id.
+func anonymousRequest(r *http.Request) bool {
+    if r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1" {
+        return true
+    }
+    s := scopeFromContext(r.Context())
+    return s != nil && s.anonymous
+}
+
+// markAnonymous makes r anonymous for the rest of its handling.
+func markAnonymous(r *http.Request) {
+    if s := scopeFromContext(r.Context()); s != nil {
+        s.anonymous = true
+    }
+}
+
+// dataRetention says what one part of the server keeps of request
+// coordinates, and for how long.
+type dataRetention struct {
+    Store       string `json:"store"`
+    Coordinates string `json:"coordinates"`
+    Retention   string `json:"retention"`
+}
+
+// retentionPolicy describes every place request coordinates can end up
+// under the running configuration.
+func retentionPolicy(cfg Config) []dataRetention {
+    rounded := fmt.Sprintf("rounded to %d decimal places (about 100 m)", recordPrecision)
+    exact := "exact"
+    if cfg.PrivacyMode {
+        exact = rounded
+    }
+    policy := []dataRetention{
+        {"access_log", exact + " in query strings; request bodies are not logged", "as long as the operator keeps access logs"},
+    }
+    if cfg.PrivacyMode {
+        policy = append(policy, dataRetention{"saved_routes", "none", "routes are not saved; responses carry no route_id"})
+    } else {
+        policy = append(policy, dataRetention{"saved_routes", "exact start and end", globalStorage.retention()})
+        if cfg.UserJWTSecret != "" {
+            policy = append(policy, dataRetention{"route_history", "exact start and end, per user", fmt.Sprintf("only for requests that ask for it, the most recent %d routes per user, until the user deletes them", maxHistoryRoutes)})
+            policy = append(policy, dataRetention{"route_monitors", "exact start and end, per user", "the monitored route and its webhook URL, until the user deletes the monitor"})
+        }
+    }
+    if cfg.PrivacyMode || cfg.RouteCacheEntries <= 0 {
+        policy = append(policy, dataRetention{"route_cache", "none", "responses are not cached"})
+    } else {
+        policy = append(policy, dataRetention{"route_cache", "exact, in encoded responses", fmt.Sprintf("in memory, up to %d responses per tenant for %d s", cfg.RouteCacheEntries, cfg.RouteCacheTTLSeconds)})
+    }
+    if prewarmEnabled(cfg) {
+        policy = append(policy, dataRetention{"route_prewarm", fmt.Sprintf("exact, up to %d pairs per %.0f m origin and destination cells", maxODExact, cfg.Prewarm.CellM), "in memory, counted per tenant; counts halve each time route_prewarm runs until they reach zero"})
+    }
+    if cfg.RecordPath != "" && cfg.RecordSamplePercent > 0 {
+        policy = append(policy, dataRetention{"request_recording", rounded, fmt.Sprintf("%v%% of route and nearest requests, appended to a file the operator keeps", cfg.RecordSamplePercent)})
+    }
+    if cfg.Scraping.MaxDistinctPairs > 0 {
+        policy = append(policy, dataRetention{"scraping_detection", fmt.Sprintf("hashed start and end pairs, and %.0f m start cells, per client address", cfg.Scraping.CellM), fmt.Sprintf("in memory for the current %d s window; the addresses of suspected scrapers until restart", cfg.Scraping.WindowSeconds)})
+    }
+    if cfg.ErrorReportingDSN != "" {
+        policy = append(policy, dataRetention{"error_reports", exact + " in query strings", "sent to the operator's error reporting service"})
+    }
+    if cfg.ShadowTarget != "" {
+        policy = append(policy, dataRetention{"shadow_traffic", "exact", "route and nearest requests are forwarded to a candidate instance"})
+    }
+    return policy
+}
+
+// handlePrivacy serves GET /privacy, which documents how request
+// coordinates, personal data since they reveal where people start and
+// end their trips, are logged and retained.
+func handlePrivacy(w http.ResponseWriter, r *http.Request) {
+    response := struct {
+        PrivacyMode       bool            `json:"privacy_mode"`
+        Retention         []dataRetention `json:"retention"`
+        AnonymousRequests string          `json:"anonymous_requests"`
+    }{globalConfig.PrivacyMode, retentionPolicy(globalConfig),
+        "requests with DNT: 1, Sec-GPC: 1 or \"anonymous\": true are not recorded, cached or saved"}
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode privacy policy: %v", err)
+    }
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+    "math"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// quotaLimiter enforces a fixed per-minute request budget.
+type quotaLimiter struct {
+    mu          sync.Mutex
+    limit       int
+    window      time.Duration
+    windowStart time.Time
+    used        int
+}
+
+func newQuotaLimiter(perMinute int) *quotaLimiter {
+    if perMinute <= 0 {
+        return nil
+    }
+    return &quotaLimiter{limit: perMinute, window: time.Minute}
+}
+
+// allow consumes one request from the current window. It reports whether
+// the request fits the budget, how many requests remain and when the window
+// resets. A nil limiter allows everything.
+func (q *quotaLimiter) allow(now time.Time) (ok bool, remaining int, reset time.Time) {
+    if q == nil {
+        return true, 0, time.Time{}
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+
+    if now.Sub(q.windowStart) >= q.window {
+        q.windowStart = now.Truncate(q.window)
+        q.used = 0
+    }
+    reset = q.windowStart.Add(q.window)
+    if q.used >= q.limit {
+        return false, 0, reset
+    }
+    q.used++
+    return true, q.limit - q.used, reset
+}
+
+// writeHeaders tells the client its budget: X-RateLimit-Limit, the
+// requests left in the window (X-RateLimit-Remaining) and when it resets
+// (X-RateLimit-Reset, Unix seconds). Rejected requests also get
+// Retry-After. A nil limiter writes nothing.
+func (q *quotaLimiter) writeHeaders(w http.ResponseWriter, allowed bool, remaining int, reset, now time.Time) {
+    if q == nil {
+        return
+    }
+    h := w.Header()
+    h.Set("X-RateLimit-Limit", strconv.Itoa(q.limit))
+    h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+    h.Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(float64(reset.UnixMilli())/1000)), 10))
+    if !allowed {
+        h.Set("Retry-After", strconv.Itoa(int(math.Ceil(reset.Sub(now).Seconds()))))
+    }
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// Role grants access to admin endpoints. Each role includes the ones below
+// it: viewers read operator state, operators act on it (cache flushes,
+// reloads, closures) and admins change configuration.
+type Role int
+
+const (
+    RoleNone Role = iota
+    RoleViewer
+    RoleOperator
+    RoleAdmin
+)
+
+var roleNames = map[string]Role{
+    "viewer":   RoleViewer,
+    "operator": RoleOperator,
+    "admin":    RoleAdmin,
+}
+
+func (r Role) String() string {
+    for name, role := range roleNames {
+        if role == r {
+            return name
+        }
+    }
+    return "none"
+}
+
+func parseRole(s string) (Role, error) {
+    if role, ok := roleNames[s]; ok {
+        return role, nil
+    }
+    return RoleNone, fmt.Errorf("unknown role %q (want viewer, operator or admin)", s)
+}
+
+// AdminKeyConfig is an admin API key and the role it carries.
+type AdminKeyConfig struct {
+    Name string `json:"name"`
+    Key  string `json:"key"`
+    Role string `json:"role"`
+}
+
+// principal is an authenticated admin caller.
+type principal struct {
+    Name string
+    Role Role
+}
+
+func adminConfigured() bool {
+    return globalConfig.AdminToken != "" || len(globalConfig.AdminKeys) > 0 || globalConfig.JWTSecret != ""
+}
+
+// authenticateAdmin resolves the caller from an X-API-Key header or a
+// bearer credential: a configured admin key, the legacy admin token (which
+// carries the admin role) or an HS256 JWT with "sub" and "role" claims.
+func authenticateAdmin(r *http.Request) (principal, bool) {
+    given := r.Header.Get("X-API-Key")
+    if given == "" {
+        given = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    }
+    if given == "" {
+        return principal{}, false
+    }
+
+    for _, k := range globalConfig.AdminKeys {
+        if subtle.ConstantTimeCompare([]byte(given), []byte(k.Key)) == 1 {
+            role, _ := parseRole(k.Role)
+            return principal{Name: k.Name, Role: role}, true
+        }
+    }
+    if token := globalConfig.AdminToken; token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+        return principal{Name: "admin-token", Role: RoleAdmin}, true
+    }
+    if secret := globalConfig.JWTSecret; secret != "" && strings.Count(given, ".") == 2 {
+        return verifyJWT(given, []byte(secret), time.Now())
+    }
+    return principal{}, false
+}
+
+// jwtClaims are the claims read from a JWT.
+type jwtClaims struct {
+    Sub  string `json:"sub"`
+    Role string `json:"role"`
+    Exp  int64  `json:"exp"`
+}
+
+// parseJWT checks an HS256 token's signature and expiry and reads its
+// claims, which always name a subject. A token without an expiry is
+// refused unless allowNoExpiry.
+func parseJWT(token string, secret []byte, now time.Time, allowNoExpiry bool) (jwtClaims, bool) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return jwtClaims{}, false
+    }
+    var header struct {
+        Alg string `json:"alg"`
+    }
+    if !decodeJWTPart(parts[0], &header) || header.Alg != "HS256" {
+        return jwtClaims{}, false
+    }
+
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte(parts[0] + "." + parts[1]))
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+        return jwtClaims{}, false
+    }
+
+    var claims jwtClaims
+    if !decodeJWTPart(parts[1], &claims) || claims.Sub == "" {
+        return jwtClaims{}, false
+    }
+    if claims.Exp == 0 && !allowNoExpiry || claims.Exp != 0 && now.Unix() >= claims.Exp {
+        return jwtClaims{}, false
+    }
+    return claims, true
+}
+
+// verifyJWT checks an admin token and reads its subject and role.
+func verifyJWT(token string, secret []byte, now time.Time) (principal, bool) {
+    claims, ok := parseJWT(token, secret, now, globalConfig.JWTAllowNoExpiry)
+    if !ok {
+        return principal{}, false
+    }
+    role, err := parseRole(claims.Role)
+    if err != nil {
+        return principal{}, false
+    }
+    return principal{Name: claims.Sub, Role: role}, true
+}
+
+func decodeJWTPart(part string, v interface{}) bool {
+    data, err := base64.RawURLEncoding.DecodeString(part)
+    return err == nil && json.Unmarshal(data, v) == nil
+}
+
+type actorContextKey struct{}
+
+// actorFromContext names the authenticated admin caller, for audit records.
+func actorFromContext(ctx context.Context) string {
+    actor, _ := ctx.Value(actorContextKey{}).(string)
+    return actor
+}
+
+// requireRole guards an admin endpoint, admitting callers whose role is at
+// least the given one.
+func requireRole(role Role, handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !adminConfigured() {
+            writeAPIError(w, http.StatusForbidden, APIError{Code: "admin_disabled", Message: "admin API is disabled"})
+            return
+        }
+        p, ok := authenticateAdmin(r)
+        if !ok {
+            writeAPIError(w, http.StatusUnauthorized, APIError{Code: "unauthorized", Message: "missing or invalid admin credentials"})
+            return
+        }
+        if p.Role < role {
+            writeAPIError(w, http.StatusForbidden, APIError{
+                Code:    "forbidden",
+                Message: fmt.Sprintf("%s role required", role),
+                Details: map[string]interface{}{"role": p.Role.String()},
+            })
+            return
+        }
+        handler(w, r.WithContext(context.WithValue(r.Context(), actorContextKey{}, p.Name)))
+    }
+}
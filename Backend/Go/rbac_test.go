@@ -0,0 +1,146 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+const testJWTSecret = "jwt-test-secret"
+
+// hs256Token makes a token of header and claims signed with secret under
+// HMAC-SHA256, whatever alg the header names.
+func hs256Token(t *testing.T, header, claims map[string]interface{}, secret string) string {
+    t.Helper()
+    part := func(v interface{}) string {
+        data, err := json.Marshal(v)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return base64.RawURLEncoding.EncodeToString(data)
+    }
+    signed := part(header) + "." + part(claims)
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(signed))
+    return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyJWT(t *testing.T) {
+    saved := globalConfig
+    globalConfig = defaultConfig()
+    t.Cleanup(func() { globalConfig = saved })
+    now := time.Unix(1767225600, 0)
+    hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+    claims := func(role string, exp int64) map[string]interface{} {
+        c := map[string]interface{}{"sub": "ana", "role": role}
+        if exp != 0 {
+            c["exp"] = exp
+        }
+        return c
+    }
+    later := now.Add(time.Hour).Unix()
+    valid := hs256Token(t, hs256, claims("operator", later), testJWTSecret)
+    parts := strings.Split(valid, ".")
+
+    cases := []struct {
+        name          string
+        token         string
+        allowNoExpiry bool
+        want          Role
+    }{
+        {"valid", valid, false, RoleOperator},
+        {"alg none", hs256Token(t, map[string]interface{}{"alg": "none"}, claims("admin", later), testJWTSecret), false, RoleNone},
+        {"alg none unsigned", strings.Join([]string{
+            base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)), parts[1], "",
+        }, "."), false, RoleNone},
+        {"alg HS512", hs256Token(t, map[string]interface{}{"alg": "HS512"}, claims("admin", later), testJWTSecret), false, RoleNone},
+        {"alg RS256", hs256Token(t, map[string]interface{}{"alg": "RS256"}, claims("admin", later), testJWTSecret), false, RoleNone},
+        {"no alg", hs256Token(t, map[string]interface{}{}, claims("admin", later), testJWTSecret), false, RoleNone},
+        {"bad signature", hs256Token(t, hs256, claims("operator", later), "another-secret"), false, RoleNone},
+        {"changed claims", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"ana","role":"admin","exp":9999999999}`)) + "." + parts[2], false, RoleNone},
+        {"signature not base64", parts[0] + "." + parts[1] + ".!!", false, RoleNone},
+        {"expired", hs256Token(t, hs256, claims("operator", now.Add(-time.Second).Unix()), testJWTSecret), false, RoleNone},
+        {"expires now", hs256Token(t, hs256, claims("operator", now.Unix()), testJWTSecret), false, RoleNone},
+        {"no expiry", hs256Token(t, hs256, claims("operator", 0), testJWTSecret), false, RoleNone},
+        {"no expiry allowed", hs256Token(t, hs256, claims("operator", 0), testJWTSecret), true, RoleOperator},
+        {"expired with no expiry allowed", hs256Token(t, hs256, claims("operator", now.Add(-time.Second).Unix()), testJWTSecret), true, RoleNone},
+        {"no subject", hs256Token(t, hs256, map[string]interface{}{"role": "admin", "exp": later}, testJWTSecret), false, RoleNone},
+        {"unknown role", hs256Token(t, hs256, claims("root", later), testJWTSecret), false, RoleNone},
+        {"two parts", parts[0] + "." + parts[1], false, RoleNone},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            globalConfig.JWTAllowNoExpiry = c.allowNoExpiry
+            p, ok := verifyJWT(c.token, []byte(testJWTSecret), now)
+            if ok != (c.want != RoleNone) || p.Role != c.want {
+                t.Errorf("verifyJWT = %+v, %v; want role %s", p, ok, c.want)
+            }
+            if ok && p.Name != "ana" {
+                t.Errorf("name = %q, want the subject", p.Name)
+            }
+        })
+    }
+}
+
+func TestRequireRole(t *testing.T) {
+    saved := globalConfig
+    globalConfig = defaultConfig()
+    globalConfig.JWTSecret = testJWTSecret
+    globalConfig.AdminKeys = []AdminKeyConfig{{Name: "dashboard", Key: "viewer-key", Role: "viewer"}}
+    t.Cleanup(func() { globalConfig = saved })
+    token := func(role string, exp time.Time) string {
+        return hs256Token(t, map[string]interface{}{"alg": "HS256"},
+            map[string]interface{}{"sub": "ana", "role": role, "exp": exp.Unix()}, testJWTSecret)
+    }
+    hour := time.Now().Add(time.Hour)
+
+    var actor string
+    handler := requireRole(RoleOperator, func(w http.ResponseWriter, r *http.Request) {
+        actor = actorFromContext(r.Context())
+    })
+    cases := []struct {
+        name   string
+        header string
+        value  string
+        status int
+        code   string
+    }{
+        {"operator token", "Authorization", "Bearer " + token("operator", hour), http.StatusOK, ""},
+        {"admin token", "Authorization", "Bearer " + token("admin", hour), http.StatusOK, ""},
+        {"viewer token", "Authorization", "Bearer " + token("viewer", hour), http.StatusForbidden, "forbidden"},
+        {"viewer key", "X-API-Key", "viewer-key", http.StatusForbidden, "forbidden"},
+        {"expired token", "Authorization", "Bearer " + token("admin", time.Now().Add(-time.Minute)), http.StatusUnauthorized, "unauthorized"},
+        {"unknown key", "X-API-Key", "guess", http.StatusUnauthorized, "unauthorized"},
+        {"no credentials", "", "", http.StatusUnauthorized, "unauthorized"},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            actor = ""
+            r := httptest.NewRequest(http.MethodPost, "/admin/cache/flush", nil)
+            if c.header != "" {
+                r.Header.Set(c.header, c.value)
+            }
+            w := httptest.NewRecorder()
+            handler(w, r)
+            if w.Code != c.status || !strings.Contains(w.Body.String(), c.code) {
+                t.Fatalf("status = %d, body %s; want %d %s", w.Code, w.Body, c.status, c.code)
+            }
+            if c.status == http.StatusOK && actor != "ana" {
+                t.Errorf("actor = %q, want ana", actor)
+            }
+        })
+    }
+
+    globalConfig.JWTSecret, globalConfig.AdminKeys = "", nil
+    w := httptest.NewRecorder()
+    handler(w, httptest.NewRequest(http.MethodPost, "/admin/cache/flush", nil))
+    if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "admin_disabled") {
+        t.Errorf("unconfigured: status = %d, body %s; want 403 admin_disabled", w.Code, w.Body)
+    }
+}
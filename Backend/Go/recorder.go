@@ -0,0 +1,204 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "math/rand"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// recordPrecision is the number of decimal places numbers in recorded
+// requests are rounded to; three places is roughly 100 m of latitude, which
+// keeps traffic realistic without pinning exact addresses.
+const recordPrecision = 3
+
+// recordedRequest is one sampled request as written by the recorder and
+// read back by the replay command. Headers, client addresses and API keys
+// are never recorded.
+type recordedRequest struct {
+    Time      time.Time       `json:"time"`
+    Method    string          `json:"method"`
+    Path      string          `json:"path"`
+    Query     string          `json:"query,omitempty"`
+    Body      json.RawMessage `json:"body,omitempty"`
+    Status    int             `json:"status"`
+    LatencyMS float64         `json:"latency_ms"`
+}
+
+// requestRecorder samples requests to a JSON-lines file. Writes happen on
+// a background goroutine; when it falls behind, samples are dropped rather
+// than slowing requests down.
+type requestRecorder struct {
+    percent float64
+    records chan recordedRequest
+    done    chan struct{}
+
+    mu     sync.RWMutex
+    closed bool
+}
+
+var globalRecorder *requestRecorder
+
+// newRequestRecorder appends samples of percent% of requests to path. It
+// returns nil when recording is disabled.
+func newRequestRecorder(path string, percent float64) (*requestRecorder, error) {
+    if path == "" || percent <= 0 {
+        return nil, nil
+    }
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+    if err != nil {
+        return nil, err
+    }
+    rec := &requestRecorder{percent: percent, records: make(chan recordedRequest, 256), done: make(chan struct{})}
+    safeGo("recorder", alwaysRestart, func() { rec.run(f) })
+    return rec, nil
+}
+
+func (rec *requestRecorder) run(f *os.File) {
+    w := bufio.NewWriter(f)
+    enc := json.NewEncoder(w)
+    enc.SetEscapeHTML(false)
+    for r := range rec.records {
+        if err := enc.Encode(r); err != nil {
+            log.Printf("Recorder write failed: %v", err)
+        }
+        if len(rec.records) == 0 {
+            w.Flush()
+        }
+    }
+    w.Flush()
+    f.Close()
+    close(rec.done)
+}
+
+// send queues a sample, dropping it when the writer is behind or the
+// recorder is closed.
+func (rec *requestRecorder) send(r recordedRequest) {
+    rec.mu.RLock()
+    defer rec.mu.RUnlock()
+    if rec.closed {
+        return
+    }
+    select {
+    case rec.records <- r:
+    default:
+    }
+}
+
+// close stops sampling and waits, until ctx is done, for the queued
+// samples to be written out.
+func (rec *requestRecorder) close(ctx context.Context) error {
+    rec.mu.Lock()
+    if !rec.closed {
+        rec.closed = true
+        close(rec.records)
+    }
+    rec.mu.Unlock()
+    select {
+    case <-rec.done:
+        return nil
+    case <-ctx.Done():
+        return fmt.Errorf("%d recorded requests not written: %v", len(rec.records), ctx.Err())
+    }
+}
+
+func (rec *requestRecorder) sampled() bool {
+    return rec != nil && rand.Float64()*100 < rec.percent
+}
+
+// withRecording samples requests to the global recorder.
+func withRecording(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        rec := globalRecorder
+        if !rec.sampled() {
+            handler(w, r)
+            return
+        }
+
+        body, err := io.ReadAll(r.Body)
+        if err != nil {
+            writeBadRequest(w, err.Error())
+            return
+        }
+        r.Body = io.NopCloser(bytes.NewReader(body))
+
+        r, _ = withScope(r)
+        start := time.Now()
+        sw := newStatusRecorder(w)
+        handler(sw, r)
+        if anonymousRequest(r) {
+            return
+        }
+
+        rec.send(recordedRequest{
+            Time:      start.UTC(),
+            Method:    r.Method,
+            Path:      r.URL.Path,
+            Query:     anonymizeQuery(r.URL.Query()),
+            Body:      anonymizeBody(body),
+            Status:    sw.status,
+            LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+        })
+    }
+}
+
+func roundRecorded(f float64) float64 {
+    scale := math.Pow(10, recordPrecision)
+    return math.Round(f*scale) / scale
+}
+
+func anonymizeQuery(q url.Values) string {
+    for key, values := range q {
+        for i, v := range values {
+            if f, err := strconv.ParseFloat(v, 64); err == nil {
+                values[i] = strconv.FormatFloat(roundRecorded(f), 'f', -1, 64)
+            }
+        }
+        q[key] = values
+    }
+    return q.Encode()
+}
+
+// anonymizeBody rounds every number in a JSON body. Bodies that are not
+// JSON are dropped.
+func anonymizeBody(body []byte) json.RawMessage {
+    if len(bytes.TrimSpace(body)) == 0 {
+        return nil
+    }
+    var v interface{}
+    if err := json.Unmarshal(body, &v); err != nil {
+        return nil
+    }
+    out, err := json.Marshal(roundNumbers(v))
+    if err != nil {
+        return nil
+    }
+    return out
+}
+
+func roundNumbers(v interface{}) interface{} {
+    switch v := v.(type) {
+    case float64:
+        return roundRecorded(v)
+    case map[string]interface{}:
+        for k, e := range v {
+            v[k] = roundNumbers(e)
+        }
+    case []interface{}:
+        for i, e := range v {
+            v[i] = roundNumbers(e)
+        }
+    }
+    return v
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "runtime/debug"
+    "time"
+)
+
+// withRecovery turns a panicking handler into a 500 response and reports
+// the panic with its stack and request context.
+func withRecovery(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        r, scope := withScope(r)
+        rec := newStatusRecorder(w)
+        defer func() {
+            p := recover()
+            if p == nil {
+                return
+            }
+            if p == http.ErrAbortHandler {
+                panic(p)
+            }
+            reportRequestError(r, scope.tenant, fmt.Sprintf("panic: %v", p), string(debug.Stack()))
+            if rec.bytes == 0 {
+                writeAPIError(rec, http.StatusInternalServerError, APIError{Code: "internal", Message: "internal server error"})
+            }
+        }()
+        next.ServeHTTP(rec, r)
+    })
+}
+
+// restartPolicy says whether a background goroutine that panicked is run
+// again. Restarts wait Backoff, doubled after each panic up to a minute,
+// and reset once the function has run a minute without panicking.
+type restartPolicy struct {
+    Restart bool
+    Backoff time.Duration
+}
+
+var (
+    noRestart     = restartPolicy{}
+    alwaysRestart = restartPolicy{Restart: true, Backoff: time.Second}
+)
+
+// safeGo runs fn on its own goroutine under policy. A panic is reported
+// with its stack, tagged with name, instead of crashing the process.
+func safeGo(name string, policy restartPolicy, fn func()) {
+    go policy.run(name, fn, nil)
+}
+
+// run calls fn until it returns without panicking, the policy gives up or
+// stop is closed.
+func (p restartPolicy) run(name string, fn func(), stop <-chan struct{}) {
+    backoff := p.Backoff
+    for {
+        start := time.Now()
+        if !runRecovered(name, fn) || !p.Restart {
+            return
+        }
+        if time.Since(start) > time.Minute {
+            backoff = p.Backoff
+        }
+        log.Printf("Restarting %s in %v", name, backoff)
+        select {
+        case <-stop:
+            return
+        case <-time.After(backoff):
+        }
+        backoff = min(backoff*2, time.Minute)
+    }
+}
+
+// runRecovered calls fn and reports whether it panicked.
+func runRecovered(name string, fn func()) (panicked bool) {
+    defer func() {
+        if p := recover(); p != nil {
+            panicked = true
+            globalReporter.report(errorEvent{
+                Level:   "error",
+                Message: fmt.Sprintf("panic in %s: %v", name, p),
+                Tags:    withReleaseTags(map[string]string{"goroutine": name}),
+                Stack:   string(debug.Stack()),
+            })
+        }
+    }()
+    fn()
+    return false
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "sort"
+    "time"
+)
+
+// runReplay re-sends recorded requests to a target server, reporting
+// latency and every request whose status differs from the recording. With
+// -baseline, each request is also sent there and the response bodies are
+// compared, for regression testing a candidate build against a known one.
+func runReplay(args []string) error {
+    fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+    in := fs.String("in", "", "recording written by the request recorder")
+    target := fs.String("target", "http://localhost:8080", "server to replay against")
+    baseline := fs.String("baseline", "", "optional server whose responses the target must match")
+    apiKey := fs.String("api-key", "", "API key sent with every request")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if *in == "" {
+        return fmt.Errorf("usage: replay -in recording.jsonl [-target URL] [-baseline URL] [-api-key KEY]")
+    }
+
+    f, err := os.Open(*in)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    client := &http.Client{Timeout: 60 * time.Second}
+    var latencies []time.Duration
+    var total, failed, statusDiffs, bodyDiffs int
+
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+    for scanner.Scan() {
+        var rec recordedRequest
+        if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+            return fmt.Errorf("line %d: %v", total+1, err)
+        }
+        total++
+
+        status, body, latency, err := replayOne(client, *target, *apiKey, rec)
+        if err != nil {
+            failed++
+            fmt.Printf("%s %s: %v\n", rec.Method, rec.Path, err)
+            continue
+        }
+        latencies = append(latencies, latency)
+        if status != rec.Status {
+            statusDiffs++
+            fmt.Printf("%s %s %s: status %d, recorded %d\n", rec.Method, rec.Path, rec.Body, status, rec.Status)
+        }
+
+        if *baseline != "" {
+            baseStatus, baseBody, _, err := replayOne(client, *baseline, *apiKey, rec)
+            if err != nil {
+                failed++
+                fmt.Printf("%s %s: baseline: %v\n", rec.Method, rec.Path, err)
+                continue
+            }
+            if baseStatus != status || !sameJSON(baseBody, body) {
+                bodyDiffs++
+                fmt.Printf("%s %s %s: response differs from baseline\n", rec.Method, rec.Path, rec.Body)
+            }
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return err
+    }
+
+    fmt.Printf("replayed %d requests: %d failed, %d status changes", total, failed, statusDiffs)
+    if *baseline != "" {
+        fmt.Printf(", %d baseline divergences", bodyDiffs)
+    }
+    fmt.Println()
+    printLatencies(latencies)
+    return nil
+}
+
+func replayOne(client *http.Client, target, apiKey string, rec recordedRequest) (int, []byte, time.Duration, error) {
+    url := target + rec.Path
+    if rec.Query != "" {
+        url += "?" + rec.Query
+    }
+    req, err := http.NewRequest(rec.Method, url, bytes.NewReader(rec.Body))
+    if err != nil {
+        return 0, nil, 0, err
+    }
+    if len(rec.Body) > 0 {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    if apiKey != "" {
+        req.Header.Set("X-API-Key", apiKey)
+    }
+
+    start := time.Now()
+    resp, err := client.Do(req)
+    if err != nil {
+        return 0, nil, 0, err
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(resp.Body)
+    return resp.StatusCode, body, time.Since(start), err
+}
+
+// volatileFields are top-level response fields that legitimately differ
+// between two servers answering the same request.
+var volatileFields = []string{"route_id"}
+
+// sameJSON compares two JSON documents structurally, ignoring formatting
+// and volatile fields.
+func sameJSON(a, b []byte) bool {
+    var va, vb interface{}
+    if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+        return bytes.Equal(a, b)
+    }
+    for _, v := range []interface{}{va, vb} {
+        if m, ok := v.(map[string]interface{}); ok {
+            for _, f := range volatileFields {
+                delete(m, f)
+            }
+        }
+    }
+    ca, _ := json.Marshal(va)
+    cb, _ := json.Marshal(vb)
+    return bytes.Equal(ca, cb)
+}
+
+// printLatencies reports the p50, p90, p99 and maximum of latencies.
+func printLatencies(latencies []time.Duration) {
+    if len(latencies) == 0 {
+        return
+    }
+    sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+    pct := func(p float64) time.Duration {
+        return latencies[int(p*float64(len(latencies)-1))]
+    }
+    fmt.Printf("latency p50 %v  p90 %v  p99 %v  max %v\n",
+        pct(0.50), pct(0.90), pct(0.99), latencies[len(latencies)-1])
+}
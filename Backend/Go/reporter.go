@@ -0,0 +1,209 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    mathrand "math/rand"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+)
+
+// release identifies the build in error reports; set it with
+// -ldflags "-X main.release=v1.2.3".
+var release = "dev"
+
+// errorEvent is an error or warning that needs an operator's attention.
+type errorEvent struct {
+    Level   string // "error" or "warning"
+    Message string
+    Tags    map[string]string
+    Request *http.Request
+    Stack   string
+}
+
+// errorReporter ships error events somewhere an operator will see them.
+type errorReporter interface {
+    report(ev errorEvent)
+}
+
+// logReporter writes events to the process log. It is the default.
+type logReporter struct{}
+
+func (logReporter) report(ev errorEvent) {
+    prefix := "Error"
+    if ev.Level == "warning" {
+        prefix = "Warning"
+    }
+    if ev.Request != nil {
+        log.Printf("%s: %s (%s %s)", prefix, ev.Message, ev.Request.Method, ev.Request.URL.Path)
+    } else {
+        log.Printf("%s: %s", prefix, ev.Message)
+    }
+    if ev.Stack != "" {
+        log.Print(ev.Stack)
+    }
+}
+
+// sentryReporter posts events to a Sentry-compatible store endpoint. Events
+// are sent in the background and dropped if the queue is full; every event
+// is also logged.
+type sentryReporter struct {
+    storeURL   string
+    auth       string
+    sampleRate float64
+    client     *http.Client
+    events     chan []byte
+    done       chan struct{}
+
+    mu     sync.RWMutex
+    closed bool
+}
+
+// newSentryReporter parses a DSN of the form
+// https://<key>@<host>/<project>.
+func newSentryReporter(dsn string, sampleRate float64) (*sentryReporter, error) {
+    u, err := url.Parse(dsn)
+    if err != nil || u.User == nil || u.Host == "" {
+        return nil, fmt.Errorf("invalid error reporting DSN")
+    }
+    project := strings.Trim(u.Path, "/")
+    if project == "" {
+        return nil, fmt.Errorf("error reporting DSN has no project")
+    }
+    s := &sentryReporter{
+        storeURL:   fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+        auth:       fmt.Sprintf("Sentry sentry_version=7, sentry_client=pict/%s, sentry_key=%s", release, u.User.Username()),
+        sampleRate: sampleRate,
+        client:     &http.Client{Timeout: 10 * time.Second},
+        events:     make(chan []byte, 64),
+        done:       make(chan struct{}),
+    }
+    safeGo("error reporter", alwaysRestart, s.run)
+    return s, nil
+}
+
+func (s *sentryReporter) report(ev errorEvent) {
+    logReporter{}.report(ev)
+    if mathrand.Float64() >= s.sampleRate {
+        return
+    }
+
+    var id [16]byte
+    rand.Read(id[:])
+    payload := map[string]interface{}{
+        "event_id":  hex.EncodeToString(id[:]),
+        "timestamp": time.Now().UTC().Format(time.RFC3339),
+        "level":     ev.Level,
+        "platform":  "go",
+        "logger":    "risk-router",
+        "release":   release,
+        "message":   map[string]string{"formatted": ev.Message},
+        "tags":      ev.Tags,
+    }
+    if ev.Request != nil {
+        payload["request"] = map[string]interface{}{
+            "url":          ev.Request.URL.Path,
+            "method":       ev.Request.Method,
+            "query_string": redactQuery(ev.Request.URL.RawQuery),
+        }
+    }
+    if ev.Stack != "" {
+        payload["extra"] = map[string]string{"stack": ev.Stack}
+    }
+    body, err := json.Marshal(payload)
+    if err != nil {
+        return
+    }
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    if s.closed {
+        return
+    }
+    select {
+    case s.events <- body:
+    default:
+    }
+}
+
+// close stops queueing events and waits, until ctx is done, for the
+// queued ones to be sent; later events are only logged.
+func (s *sentryReporter) close(ctx context.Context) error {
+    s.mu.Lock()
+    if !s.closed {
+        s.closed = true
+        close(s.events)
+    }
+    s.mu.Unlock()
+    select {
+    case <-s.done:
+        return nil
+    case <-ctx.Done():
+        return fmt.Errorf("%d error events not sent: %v", len(s.events), ctx.Err())
+    }
+}
+
+func (s *sentryReporter) run() {
+    for body := range s.events {
+        req, err := http.NewRequest(http.MethodPost, s.storeURL, bytes.NewReader(body))
+        if err != nil {
+            continue
+        }
+        req.Header.Set("Content-Type", "application/json")
+        req.Header.Set("X-Sentry-Auth", s.auth)
+        resp, err := s.client.Do(req)
+        if err != nil {
+            log.Printf("Error reporter: %v", err)
+            continue
+        }
+        resp.Body.Close()
+        if resp.StatusCode >= 300 {
+            log.Printf("Error reporter: store returned %s", resp.Status)
+        }
+    }
+    close(s.done)
+}
+
+var globalReporter errorReporter = logReporter{}
+
+// newErrorReporter picks the Sentry reporter when a DSN is configured.
+func newErrorReporter(dsn string, sampleRate float64) (errorReporter, error) {
+    if dsn == "" {
+        return logReporter{}, nil
+    }
+    return newSentryReporter(dsn, sampleRate)
+}
+
+// reportWarning reports a condition that degraded the service without
+// failing it, such as input data the loader had to skip.
+func reportWarning(tags map[string]string, format string, args ...interface{}) {
+    globalReporter.report(errorEvent{Level: "warning", Message: fmt.Sprintf(format, args...), Tags: withReleaseTags(tags)})
+}
+
+// reportRequestError reports an error raised while serving r, tagged with
+// the tenant's data versions when the tenant is known.
+func reportRequestError(r *http.Request, t *Tenant, message, stack string) {
+    tags := map[string]string{}
+    if t != nil {
+        tags["tenant"] = t.ID
+        router := t.Router()
+        tags["graph_version"] = router.G.Version
+        tags["risk_version"] = router.activeLayer().Version
+    }
+    globalReporter.report(errorEvent{Level: "error", Message: message, Tags: withReleaseTags(tags), Request: r, Stack: stack})
+}
+
+func withReleaseTags(tags map[string]string) map[string]string {
+    if tags == nil {
+        tags = map[string]string{}
+    }
+    tags["release"] = release
+    return tags
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+
+    "risk-router/geo"
+)
+
+// Ways to aggregate per-edge risk into a route's risk, selected by the
+// risk_aggregation request field or config.
+const (
+    // aggregateLength is the mean risk weighted by edge length.
+    aggregateLength = "length"
+    // aggregateMean is the unweighted mean risk of the route's edges.
+    aggregateMean = "mean"
+    // aggregateMax is the risk of the route's riskiest edge.
+    aggregateMax = "max"
+    // aggregateExposure sums risk times the seconds spent walking each
+    // edge, so longer routes accumulate more.
+    aggregateExposure = "exposure"
+)
+
+func checkRiskAggregation(method string) error {
+    switch method {
+    case "", aggregateLength, aggregateMean, aggregateMax, aggregateExposure:
+        return nil
+    }
+    return fmt.Errorf("unknown risk aggregation %q (want %s, %s, %s or %s)",
+        method, aggregateLength, aggregateMean, aggregateMax, aggregateExposure)
+}
+
+// aggregateRisk recomputes the risk of a path found on r's graph, as the
+// edges it takes, with method, reading edge risk from risk and walking at
+// speedMPS.
+func (r *RiskAwareRouter) aggregateRisk(edges []int32, risk []float64, method string, speedMPS float64) float64 {
+    g := r.G
+    total, weight, peak := 0.0, 0.0, 0.0
+    for _, e := range edges {
+        meters := geo.Haversine(g.Nodes[g.source(e)], g.Nodes[g.targets[e]])
+        switch method {
+        case aggregateMean:
+            total += risk[e]
+        case aggregateMax:
+            peak = max(peak, risk[e])
+        case aggregateExposure:
+            total += risk[e] * meters / speedMPS
+        default:
+            total += risk[e] * meters
+            weight += meters
+        }
+    }
+    switch method {
+    case aggregateMean:
+        if len(edges) == 0 {
+            return 0
+        }
+        return total / float64(len(edges))
+    case aggregateMax:
+        return peak
+    case aggregateExposure:
+        return total
+    }
+    if weight == 0 {
+        return 0
+    }
+    return total / weight
+}
+
+// edgeBetween returns the ID of the first edge from node a to node b. A
+// node's edges are sorted by target, so it is a binary search.
+func (g *Graph) edgeBetween(a, b int32) (int32, bool) {
+    lo, hi := g.edgeRange(a)
+    i := lo + int32(sort.Search(int(hi-lo), func(i int) bool { return g.targets[lo+int32(i)] >= b }))
+    if i < hi && g.targets[i] == b {
+        return i, true
+    }
+    return 0, false
+}
+
+// parallelRank returns how many parallel edges between the same nodes
+// come before e.
+func (g *Graph) parallelRank(e int32) int32 {
+    first, _ := g.edgeBetween(g.source(e), g.targets[e])
+    return e - first
+}
+
+// twin returns the edge running e's segment the other way. Parallel edges
+// are stored in the same order in both directions, so it is the one of
+// the same rank.
+func (g *Graph) twin(e int32) (int32, bool) {
+    from, to := g.source(e), g.targets[e]
+    back, ok := g.edgeBetween(to, from)
+    if !ok {
+        return 0, false
+    }
+    back += g.parallelRank(e)
+    if _, hi := g.edgeRange(to); back >= hi || g.targets[back] != from {
+        return 0, false
+    }
+    return back, true
+}
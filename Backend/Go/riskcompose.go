@@ -0,0 +1,287 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// maxComposedLayers bounds the layers kept for request-adjusted weights.
+const maxComposedLayers = 8
+
+// RiskComponentConfig names one layer of a composed risk layer, such as
+// crime, lighting or traffic collisions. Its risk_score properties are
+// read like a risk layer's; an empty path takes the road network's own
+// scores, and a source of "collisions" scores roads from the crash data
+// in the collisions config instead. Requests may move the weight within
+// [min_weight, max_weight], which default to the weight itself.
+type RiskComponentConfig struct {
+    Name      string  `json:"name"`
+    Path      string  `json:"path"`
+    Source    string  `json:"source"`
+    Weight    float64 `json:"weight"`
+    MinWeight float64 `json:"min_weight"`
+    MaxWeight float64 `json:"max_weight"`
+    RiskLayerMetadata
+}
+
+// weightBounds returns the weights requests may choose from.
+func (c RiskComponentConfig) weightBounds() (float64, float64) {
+    if c.MinWeight == 0 && c.MaxWeight == 0 {
+        return c.Weight, c.Weight
+    }
+    return c.MinWeight, c.MaxWeight
+}
+
+func checkRiskComponents(components []RiskComponentConfig, collisions CollisionConfig) error {
+    seen := make(map[string]bool)
+    ownScores, total := false, 0.0
+    for i, c := range components {
+        if c.Name == "" {
+            return fmt.Errorf("risk_components[%d]: name must be set", i)
+        }
+        if seen[c.Name] {
+            return fmt.Errorf("risk_components[%d]: duplicate name %q", i, c.Name)
+        }
+        seen[c.Name] = true
+        switch c.Source {
+        case "":
+        case collisionsSource:
+            if c.Path != "" || collisions.Path == "" {
+                return fmt.Errorf("risk_components[%d]: a collisions component takes no path and needs collisions.path", i)
+            }
+        default:
+            return fmt.Errorf("risk_components[%d]: unknown source %q (available: %s)", i, c.Source, collisionsSource)
+        }
+        if c.Path == "" && c.Source == "" {
+            if ownScores {
+                return fmt.Errorf("risk_components[%d]: only one component may use the road network's own scores", i)
+            }
+            ownScores = true
+        }
+        lo, hi := c.weightBounds()
+        if lo < 0 || lo > c.Weight || c.Weight > hi {
+            return fmt.Errorf("risk_components[%d]: need 0 <= min_weight <= weight <= max_weight, got %v <= %v <= %v", i, lo, c.Weight, hi)
+        }
+        if err := checkNormalization(c.Normalization); err != nil {
+            return fmt.Errorf("risk_components[%d]: %v", i, err)
+        }
+        total += c.Weight
+    }
+    if len(components) > 0 && total <= 0 {
+        return fmt.Errorf("risk_components: the weights must not all be zero")
+    }
+    return nil
+}
+
+// riskComponent is a loaded component with its per-edge risk.
+type riskComponent struct {
+    Name      string  `json:"name"`
+    Source    string  `json:"source,omitempty"`
+    Weight    float64 `json:"weight"`
+    MinWeight float64 `json:"min_weight"`
+    MaxWeight float64 `json:"max_weight"`
+
+    risk []float64
+}
+
+// composedLayers holds the router's risk components and the layers built
+// for request-adjusted weights, oldest first. Components are replaced
+// wholesale when one is rescored.
+type composedLayers struct {
+    mu         sync.Mutex
+    components []riskComponent
+    keys       []string
+    layers     map[string]*riskLayer
+}
+
+// list returns the components.
+func (cl *composedLayers) list() []riskComponent {
+    cl.mu.Lock()
+    defer cl.mu.Unlock()
+    return cl.components
+}
+
+// loadRiskComponents reads every component onto the router's edges and
+// promotes their weighted mean, at the configured weights, to the current
+// layer. The road network's own layer stays pinnable.
+func (r *RiskAwareRouter) loadRiskComponents(configs []RiskComponentConfig, collisions CollisionConfig) error {
+    base := r.layers.current()
+    components := make([]riskComponent, len(configs))
+    for i, c := range configs {
+        lo, hi := c.weightBounds()
+        components[i] = riskComponent{Name: c.Name, Source: c.Source, Weight: c.Weight, MinWeight: lo, MaxWeight: hi, risk: base.risk}
+        switch {
+        case c.Source == collisionsSource:
+            risk, err := loadCollisionRisk(r.G, collisions)
+            if err != nil {
+                return fmt.Errorf("risk component %s: %v", c.Name, err)
+            }
+            components[i].risk = risk
+        case c.Path != "":
+            layer, err := loadRiskLayer(r.G, base, RiskLayerConfig{Path: c.Path, RiskLayerMetadata: c.RiskLayerMetadata})
+            if err != nil {
+                return fmt.Errorf("risk component %s: %v", c.Name, err)
+            }
+            components[i].risk = layer.risk
+        }
+    }
+    r.composed.components = components
+    r.layers.promote(composeLayer(r.G, components, defaultWeights(components), base))
+    return nil
+}
+
+func defaultWeights(components []riskComponent) map[string]float64 {
+    weights := make(map[string]float64, len(components))
+    for _, c := range components {
+        weights[c.Name] = c.Weight
+    }
+    return weights
+}
+
+// setComponentRisk replaces the risk of the components from source and
+// promotes the recomposed layer in place of the current one. Layers built
+// for adjusted weights are dropped, to be rebuilt from the new scores.
+func (r *RiskAwareRouter) setComponentRisk(source string, risk []float64) *riskLayer {
+    cl := &r.composed
+    cl.mu.Lock()
+    components := append([]riskComponent(nil), cl.components...)
+    for i := range components {
+        if components[i].Source == source {
+            components[i].risk = risk
+        }
+    }
+    cl.components = components
+    for _, key := range cl.keys {
+        r.weights.drop(cl.layers[key].Version)
+    }
+    cl.keys, cl.layers = nil, nil
+    cl.mu.Unlock()
+
+    current := r.layers.current()
+    layer := composeLayer(r.G, components, defaultWeights(components), current)
+    if layer.Version == current.Version {
+        return current
+    }
+    layer.Parent = current.Version
+    r.precomputeLayerWeights(layer, r.weights.alphasFor(current.Version))
+    if replaced := r.layers.promote(layer); replaced != nil {
+        r.weights.drop(replaced.Version)
+    }
+    dataChanged(r)
+    return layer
+}
+
+// composeLayer builds the weighted mean of components at weights.
+func composeLayer(g *Graph, components []riskComponent, weights map[string]float64, parent *riskLayer) *riskLayer {
+    risk := make([]float64, len(parent.risk))
+    total := 0.0
+    for _, c := range components {
+        w := weights[c.Name]
+        if w == 0 {
+            continue
+        }
+        total += w
+        for e, v := range c.risk {
+            risk[e] += w * v
+        }
+    }
+    for e := range risk {
+        risk[e] /= total
+    }
+    metadata := parent.Metadata
+    metadata.Model = map[string]interface{}{"risk_weights": weights}
+    return &riskLayer{
+        Version:    g.hashRisk(risk),
+        Metadata:   metadata,
+        LoadedAt:   time.Now().UTC(),
+        risk:       risk,
+        normalizer: parent.normalizer,
+    }
+}
+
+// weightedLayer is the layer for a request that adjusts component
+// weights: the configured weights with adjust applied, each within its
+// operator-set bounds, plus the active overlays. Requests at the
+// configured weights get the active layer, live risk updates included.
+func (r *RiskAwareRouter) weightedLayer(adjust map[string]float64) (*riskLayer, error) {
+    components := r.composed.list()
+    if len(components) == 0 {
+        return nil, fmt.Errorf("risk weights cannot be adjusted: no risk components are configured")
+    }
+    weights := make(map[string]float64, len(components))
+    for _, c := range components {
+        weights[c.Name] = c.Weight
+    }
+    names := make([]string, 0, len(adjust))
+    for name := range adjust {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        w := adjust[name]
+        found := false
+        for _, c := range components {
+            if c.Name != name {
+                continue
+            }
+            found = true
+            if w < c.MinWeight || w > c.MaxWeight {
+                return nil, fmt.Errorf("risk_weights.%s must be within [%v, %v], got %v", name, c.MinWeight, c.MaxWeight, w)
+            }
+        }
+        if !found {
+            return nil, fmt.Errorf("unknown risk component %q", name)
+        }
+        weights[name] = w
+    }
+
+    var key strings.Builder
+    changed, total := false, 0.0
+    for _, c := range components {
+        fmt.Fprintf(&key, "%s=%v;", c.Name, weights[c.Name])
+        changed = changed || weights[c.Name] != c.Weight
+        total += weights[c.Name]
+    }
+    if total <= 0 {
+        return nil, fmt.Errorf("risk_weights must not all be zero")
+    }
+    if !changed {
+        return r.activeLayer(), nil
+    }
+
+    o := &r.overlays
+    o.mu.Lock()
+    active, overlayKey := o.active(time.Now())
+    o.mu.Unlock()
+    key.WriteString(overlayKey)
+
+    cl := &r.composed
+    cl.mu.Lock()
+    defer cl.mu.Unlock()
+    if layer, ok := cl.layers[key.String()]; ok {
+        return layer, nil
+    }
+    parent := r.layers.current()
+    layer := composeLayer(r.G, cl.components, weights, parent)
+    if len(active) > 0 {
+        applyOverlays(layer.risk, active)
+        layer.Version = r.G.hashRisk(layer.risk)
+    }
+    layer.Parent = parent.Version
+    r.precomputeLayerWeights(layer, r.weights.alphasFor(parent.Version))
+    if cl.layers == nil {
+        cl.layers = make(map[string]*riskLayer)
+    }
+    cl.layers[key.String()] = layer
+    cl.keys = append(cl.keys, key.String())
+    if len(cl.keys) > maxComposedLayers {
+        oldest := cl.keys[0]
+        cl.keys = cl.keys[1:]
+        r.weights.drop(cl.layers[oldest].Version)
+        delete(cl.layers, oldest)
+    }
+    return layer, nil
+}
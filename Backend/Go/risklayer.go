@@ -0,0 +1,246 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// RiskLayerMetadata describes where a risk layer came from.
+type RiskLayerMetadata struct {
+    // SourceFrom and SourceTo bound the dates of the incident data the
+    // layer was derived from.
+    SourceFrom string `json:"source_from,omitempty"`
+    SourceTo   string `json:"source_to,omitempty"`
+    // Model holds the parameters of the model that scored the layer.
+    Model map[string]interface{} `json:"model,omitempty"`
+    // Normalization maps the layer's raw scores into [0, 1] when loaded:
+    // "none" (the default), "minmax", "percentile" or "zscore" (clamped
+    // to three standard deviations). The parameters fitted to the scores
+    // are recorded alongside it.
+    Normalization       string             `json:"normalization,omitempty"`
+    NormalizationParams map[string]float64 `json:"normalization_params,omitempty"`
+}
+
+// RiskLayerConfig names a GeoJSON road network whose risk_score properties
+// form an additional, pinnable risk layer over the served roads.
+type RiskLayerConfig struct {
+    Path string `json:"path"`
+    RiskLayerMetadata
+}
+
+// riskLayer is one version of the per-edge risk scores, indexed like the
+// graph's edge arrays.
+type riskLayer struct {
+    Version  string
+    Metadata RiskLayerMetadata
+    LoadedAt time.Time
+    // Parent is the version a live risk update was applied to, empty for
+    // layers loaded from files.
+    Parent string
+    risk   []float64
+    // normalizer scales live updates like the scores the layer was
+    // loaded with.
+    normalizer *riskNormalizer
+}
+
+// riskLayers is a router's history of risk layers. The first is the one
+// shipped with the road network and is used unless a request pins another.
+type riskLayers struct {
+    mu        sync.RWMutex
+    layers    []*riskLayer
+    byVersion map[string]*riskLayer
+    // pending counts incidents imported since the current layer was
+    // built; the layer is dirty while it is non-zero.
+    pending int
+}
+
+// markDirty records n incidents the current layer does not yet reflect.
+func (l *riskLayers) markDirty(n int) {
+    l.mu.Lock()
+    l.pending += n
+    l.mu.Unlock()
+}
+
+func (l *riskLayers) add(layer *riskLayer) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.byVersion == nil {
+        l.byVersion = make(map[string]*riskLayer)
+    }
+    if _, ok := l.byVersion[layer.Version]; ok {
+        return
+    }
+    l.layers = append(l.layers, layer)
+    l.byVersion[layer.Version] = layer
+}
+
+// promote makes layer current. A current layer derived by a live update
+// is replaced rather than kept, so a stream of updates does not grow the
+// history; the replaced layer is returned so its weights can be dropped.
+func (l *riskLayers) promote(layer *riskLayer) (replaced *riskLayer) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if _, ok := l.byVersion[layer.Version]; ok {
+        return nil
+    }
+    if old := l.layers[0]; old.Parent != "" {
+        delete(l.byVersion, old.Version)
+        l.layers[0] = layer
+        replaced = old
+    } else {
+        l.layers = append([]*riskLayer{layer}, l.layers...)
+    }
+    l.byVersion[layer.Version] = layer
+    return replaced
+}
+
+func (l *riskLayers) current() *riskLayer {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+    return l.layers[0]
+}
+
+func (l *riskLayers) get(version string) (*riskLayer, bool) {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+    layer, ok := l.byVersion[version]
+    return layer, ok
+}
+
+func (l *riskLayers) versions() []string {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+    versions := make([]string, len(l.layers))
+    for i, layer := range l.layers {
+        versions[i] = layer.Version
+    }
+    return versions
+}
+
+// hashRisk fingerprints per-edge risk scores over g's topology.
+func (g *Graph) hashRisk(risk []float64) string {
+    h := sha256.New()
+    for id := range g.Nodes {
+        lo, hi := g.edgeRange(int32(id))
+        for e := lo; e < hi; e++ {
+            writeFloats(h, float64(id), float64(g.targets[e]), risk[e])
+        }
+    }
+    return shortHash(h)
+}
+
+// loadRiskLayer reads the risk scores of cfg.Path onto g's edges,
+// normalizing them as cfg says. Edges the file does not cover keep their
+// risk in the base layer.
+func loadRiskLayer(g *Graph, base *riskLayer, cfg RiskLayerConfig) (*riskLayer, error) {
+    source := NewGraph()
+    source.duplicatePolicy = duplicateParallel
+    source.memoryBudget = globalConfig.graphMemoryBudget()
+    if err := loadRoadNetwork(cfg.Path, source, nil); err != nil {
+        return nil, err
+    }
+
+    risk := make([]float64, len(base.risk))
+    var covered []int32
+    var raw []float64
+    for id := range g.Nodes {
+        from := g.Nodes[id]
+        lo, hi := g.edgeRange(int32(id))
+        for e := lo; e < hi; e++ {
+            // Parallel edges match by the order they were loaded in; a
+            // single scored segment covers all of them.
+            if edges := source.Edges[from][g.Nodes[g.targets[e]]]; len(edges) > 0 {
+                covered = append(covered, e)
+                raw = append(raw, edges[min(int(g.parallelRank(e)), len(edges)-1)].RiskScore)
+            } else {
+                risk[e] = base.risk[e]
+            }
+        }
+    }
+    matched := len(covered)
+    normalizer := fitNormalizer(cfg.Normalization, raw)
+    for i, e := range covered {
+        risk[e] = normalizer.apply(raw[i])
+    }
+    if matched == 0 {
+        return nil, fmt.Errorf("%s shares no road segments with the served network", cfg.Path)
+    }
+    if matched < len(risk) {
+        reportWarning(map[string]string{"dataset": cfg.Path}, "risk layer %s covers %d of %d edges; the rest keep their base risk", cfg.Path, matched, len(risk))
+    }
+
+    metadata := cfg.RiskLayerMetadata
+    metadata.NormalizationParams = normalizer.params()
+    return &riskLayer{
+        Version:    g.hashRisk(risk),
+        Metadata:   metadata,
+        LoadedAt:   time.Now().UTC(),
+        risk:       risk,
+        normalizer: normalizer,
+    }, nil
+}
+
+// updateRisk sets the risk of edges on a copy of the current layer and
+// promotes it, precomputing weights for the alphas the old layer served.
+// The raw value is normalized like the current layer's scores.
+func (r *RiskAwareRouter) updateRisk(edges []int32, value float64) *riskLayer {
+    parent := r.layers.current()
+    value = parent.normalizer.apply(value)
+    risk := make([]float64, len(parent.risk))
+    copy(risk, parent.risk)
+    for _, e := range edges {
+        risk[e] = value
+    }
+    layer := &riskLayer{
+        Version:  r.G.hashRisk(risk),
+        Metadata: parent.Metadata,
+        LoadedAt: time.Now().UTC(),
+        Parent:   parent.Version,
+        risk:     risk,
+
+        normalizer: parent.normalizer,
+    }
+    if layer.Version == parent.Version {
+        return parent
+    }
+    r.precomputeLayerWeights(layer, r.weights.alphasFor(parent.Version))
+    if replaced := r.layers.promote(layer); replaced != nil {
+        r.weights.drop(replaced.Version)
+    }
+    return layer
+}
+
+type riskLayerInfo struct {
+    Version  string            `json:"version"`
+    Current  bool              `json:"current"`
+    Parent   string            `json:"derived_from,omitempty"`
+    LoadedAt time.Time         `json:"loaded_at"`
+    Metadata RiskLayerMetadata `json:"metadata"`
+}
+
+// handleRiskLayers serves GET /risk-layers, the tenant's risk layer history.
+func handleRiskLayers(w http.ResponseWriter, r *http.Request) {
+    layers := &tenantFromContext(r.Context()).Router().layers
+    layers.mu.RLock()
+    infos := make([]riskLayerInfo, len(layers.layers))
+    for i, l := range layers.layers {
+        infos[i] = riskLayerInfo{Version: l.Version, Current: i == 0, Parent: l.Parent, LoadedAt: l.LoadedAt, Metadata: l.Metadata}
+    }
+    pending := layers.pending
+    layers.mu.RUnlock()
+
+    w.Header().Set("Content-Type", "application/json")
+    response := struct {
+        Layers           []riskLayerInfo `json:"layers"`
+        Dirty            bool            `json:"dirty"`
+        PendingIncidents int             `json:"pending_incidents"`
+    }{infos, pending > 0, pending}
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode risk layers: %v", err)
+    }
+}
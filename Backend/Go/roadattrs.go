@@ -0,0 +1,202 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+)
+
+// edgeAttrs describes the street an edge is on: its road class in the low
+// bits and flags for street lighting and businesses above them.
+type edgeAttrs uint8
+
+// Road classes, from footpaths and service roads up to the main roads.
+const (
+    classMinor edgeAttrs = iota
+    classResidential
+    classTertiary
+    classSecondary
+    classPrimary
+
+    classMask edgeAttrs = 7
+)
+
+const (
+    attrLit edgeAttrs = 8 << iota
+    attrBusinesses
+    // attrProtectedLane marks a cycle track or a bike lane kept apart from
+    // traffic.
+    attrProtectedLane
+)
+
+// protectedCycleways are the OSM cycleway values of lanes kept apart
+// from traffic.
+var protectedCycleways = map[string]bool{"track": true, "separate": true, "opposite_track": true}
+
+// highwayClasses maps OSM highway tags to road classes; other tags are
+// minor.
+var highwayClasses = map[string]edgeAttrs{
+    "motorway": classPrimary, "trunk": classPrimary, "primary": classPrimary,
+    "motorway_link": classPrimary, "trunk_link": classPrimary, "primary_link": classPrimary,
+    "secondary": classSecondary, "secondary_link": classSecondary,
+    "tertiary": classTertiary, "tertiary_link": classTertiary,
+    "residential": classResidential, "living_street": classResidential,
+    "unclassified": classResidential, "pedestrian": classResidential,
+}
+
+func (a edgeAttrs) class() edgeAttrs { return a & classMask }
+
+// arterial reports whether the edge is on a main street, tertiary or up.
+func (a edgeAttrs) arterial() bool { return a.class() >= classTertiary }
+
+// attrsOf reads a road feature's highway, lit, businesses and cycleway
+// properties. lit is "yes" or another OSM value for lit at night, or a
+// boolean; businesses counts the open storefronts along the street, or is
+// a boolean. A highway of cycleway, or a cycleway (or cycleway:left,
+// :right or :both) of track or separate, is a protected lane.
+func attrsOf(properties map[string]interface{}) edgeAttrs {
+    var a edgeAttrs
+    if highway, ok := properties["highway"].(string); ok {
+        a = highwayClasses[highway]
+        if highway == "cycleway" {
+            a |= attrProtectedLane
+        }
+    }
+    for _, key := range []string{"cycleway", "cycleway:left", "cycleway:right", "cycleway:both"} {
+        if v, _ := properties[key].(string); protectedCycleways[v] {
+            a |= attrProtectedLane
+        }
+    }
+    switch lit := properties["lit"].(type) {
+    case bool:
+        if lit {
+            a |= attrLit
+        }
+    case string:
+        if lit != "no" && lit != "" && lit != "disused" {
+            a |= attrLit
+        }
+    }
+    switch n := properties["businesses"].(type) {
+    case bool:
+        if n {
+            a |= attrBusinesses
+        }
+    case float64:
+        if n > 0 {
+            a |= attrBusinesses
+        }
+    }
+    return a
+}
+
+// loadRoadAttributes reads the road attributes of the GeoJSON road
+// network at path onto g's edges, matching segments by their ends like
+// risk layers. declaredCRS is the configured road network CRS, if any.
+func loadRoadAttributes(g *Graph, path, declaredCRS string) ([]edgeAttrs, error) {
+    file, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var geojsonData struct {
+        CRS      interface{}       `json:"crs"`
+        Features []json.RawMessage `json:"features"`
+    }
+    if err := json.Unmarshal(file, &geojsonData); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    features, err := parseFeatures(geojsonData.Features)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    crs, err := sourceCRS(geojsonData.CRS, features, declaredCRS)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+
+    attrs := make([]edgeAttrs, len(g.targets))
+    matched := 0
+    for _, feature := range features {
+        segments, reason := featureSegments(feature, nil, crs)
+        if reason != "" {
+            continue
+        }
+        properties, _ := feature.(map[string]interface{})["properties"].(map[string]interface{})
+        a := attrsOf(properties)
+        for _, seg := range segments {
+            from, ok := g.nodeAt(seg.Start)
+            to, ok2 := g.nodeAt(seg.End)
+            if !ok || !ok2 {
+                continue
+            }
+            matched += g.setAttrs(attrs, from, to, a) + g.setAttrs(attrs, to, from, a)
+        }
+    }
+    if matched == 0 {
+        return nil, fmt.Errorf("%s shares no road segments with the served network", path)
+    }
+    if matched < len(attrs) {
+        reportWarning(map[string]string{"dataset": path}, "road attributes %s cover %d of %d edges; the rest count as unlit minor roads", path, matched, len(attrs))
+    }
+    return attrs, nil
+}
+
+// setAttrs sets a on the edges from one node to another, returning how
+// many there are.
+func (g *Graph) setAttrs(attrs []edgeAttrs, from, to int32, a edgeAttrs) int {
+    e, ok := g.edgeBetween(from, to)
+    if !ok {
+        return 0
+    }
+    _, hi := g.edgeRange(from)
+    n := 0
+    for ; e < hi && g.targets[e] == to; e++ {
+        attrs[e] = a
+        n++
+    }
+    return n
+}
+
+// RouteMix is the share of a route's length, in percent, on main streets,
+// on lit streets, past businesses and on protected bike lanes.
+type RouteMix struct {
+    ArterialPct      float64 `json:"arterial_pct"`
+    LitPct           float64 `json:"lit_pct"`
+    BusinessesPct    float64 `json:"businesses_pct"`
+    ProtectedLanePct float64 `json:"protected_lane_pct"`
+}
+
+// routeMix returns the mix of a route's edges, or nil when no road
+// attributes are loaded.
+func (r *RiskAwareRouter) routeMix(edges []int32) *RouteMix {
+    if r.attrs == nil || len(edges) == 0 {
+        return nil
+    }
+    var total, arterial, lit, businesses, protected float64
+    for _, e := range edges {
+        d := r.G.dist[e]
+        total += d
+        a := r.attrs[e]
+        if a.arterial() {
+            arterial += d
+        }
+        if a&attrLit != 0 {
+            lit += d
+        }
+        if a&attrBusinesses != 0 {
+            businesses += d
+        }
+        if a&attrProtectedLane != 0 {
+            protected += d
+        }
+    }
+    if total == 0 {
+        return nil
+    }
+    return &RouteMix{
+        ArterialPct:      arterial / total * 100,
+        LitPct:           lit / total * 100,
+        BusinessesPct:    businesses / total * 100,
+        ProtectedLanePct: protected / total * 100,
+    }
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "container/list"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// routeCache keeps encoded route responses keyed by their ETag. Entries are
+// evicted least-recently-used once maxEntries is reached, and expire after
+// ttl. A nil routeCache caches nothing.
+type routeCache struct {
+    mu         sync.Mutex
+    maxEntries int
+    ttl        time.Duration
+    order      *list.List
+    entries    map[string]*list.Element
+    bytes      int64
+
+    hits   atomic.Int64
+    misses atomic.Int64
+    // warmed, warmedUsed and warmedHits count the responses the
+    // route_prewarm task held, those of them requested at least once, and
+    // the hits on them.
+    warmed     atomic.Int64
+    warmedUsed atomic.Int64
+    warmedHits atomic.Int64
+}
+
+type routeCacheEntry struct {
+    key     string
+    body    []byte
+    expires time.Time
+    // warmed is set on responses the route_prewarm task held, and used
+    // once one of them is requested.
+    warmed, used bool
+}
+
+// newRouteCache returns a cache of up to maxEntries responses, or nil when
+// maxEntries is not positive.
+func newRouteCache(maxEntries int, ttl time.Duration) *routeCache {
+    if maxEntries <= 0 {
+        return nil
+    }
+    return &routeCache{
+        maxEntries: maxEntries,
+        ttl:        ttl,
+        order:      list.New(),
+        entries:    make(map[string]*list.Element),
+    }
+}
+
+func (c *routeCache) get(key string, now time.Time) ([]byte, bool) {
+    if c == nil {
+        return nil, false
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    el, ok := c.entries[key]
+    if ok && c.ttl > 0 && now.After(el.Value.(*routeCacheEntry).expires) {
+        c.remove(el)
+        ok = false
+    }
+    if !ok {
+        c.misses.Add(1)
+        return nil, false
+    }
+    c.hits.Add(1)
+    entry := el.Value.(*routeCacheEntry)
+    if entry.warmed {
+        c.warmedHits.Add(1)
+        if !entry.used {
+            entry.used = true
+            c.warmedUsed.Add(1)
+        }
+    }
+    c.order.MoveToFront(el)
+    return entry.body, true
+}
+
+func (c *routeCache) put(key string, body []byte, now time.Time) {
+    if c == nil {
+        return
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if el, ok := c.entries[key]; ok {
+        c.remove(el)
+    }
+    c.entries[key] = c.order.PushFront(&routeCacheEntry{key: key, body: body, expires: now.Add(c.ttl)})
+    c.bytes += int64(len(body))
+    for c.order.Len() > c.maxEntries {
+        c.remove(c.order.Back())
+    }
+}
+
+// hold keeps the response cached under key until at least until, and
+// counts it as warmed; it reports whether there was such a response.
+func (c *routeCache) hold(key string, until time.Time) bool {
+    if c == nil {
+        return false
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    el, ok := c.entries[key]
+    if !ok {
+        return false
+    }
+    entry := el.Value.(*routeCacheEntry)
+    if entry.expires.Before(until) {
+        entry.expires = until
+    }
+    if !entry.warmed {
+        entry.warmed = true
+        c.warmed.Add(1)
+    }
+    return true
+}
+
+// sweep drops the expired entries, which would otherwise hold memory until
+// read or evicted.
+func (c *routeCache) sweep(now time.Time) {
+    if c == nil || c.ttl <= 0 {
+        return
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for el := c.order.Back(); el != nil; {
+        prev := el.Prev()
+        if now.After(el.Value.(*routeCacheEntry).expires) {
+            c.remove(el)
+        }
+        el = prev
+    }
+}
+
+func (c *routeCache) remove(el *list.Element) {
+    entry := c.order.Remove(el).(*routeCacheEntry)
+    delete(c.entries, entry.key)
+    c.bytes -= int64(len(entry.body))
+}
+
+func (c *routeCache) stats() cacheStats {
+    s := cacheStats{Name: "routes"}
+    if c == nil {
+        return s
+    }
+    c.mu.Lock()
+    s.Entries = c.order.Len()
+    s.Bytes = c.bytes
+    c.mu.Unlock()
+    s.setHits(c.hits.Load(), c.misses.Load())
+    if warmed := c.warmed.Load(); warmed > 0 {
+        s.Prewarm = &prewarmStats{Warmed: warmed, Used: c.warmedUsed.Load(), Hits: c.warmedHits.Load()}
+        s.Prewarm.UsedRate = float64(s.Prewarm.Used) / float64(warmed)
+    }
+    return s
+}
+
+func (c *routeCache) flush() {
+    if c == nil {
+        return
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.order.Init()
+    c.entries = make(map[string]*list.Element)
+    c.bytes = 0
+}
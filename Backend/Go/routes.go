@@ -0,0 +1,230 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// middleware wraps a handler with cross-cutting behaviour.
+type middleware func(http.HandlerFunc) http.HandlerFunc
+
+// chain wraps h in mws, the first listed outermost.
+func chain(h http.HandlerFunc, mws ...middleware) http.HandlerFunc {
+    for i := len(mws) - 1; i >= 0; i-- {
+        h = mws[i](h)
+    }
+    return h
+}
+
+// route is one endpoint: the methods it answers, how long it may run and
+// the middleware it needs beyond its group's.
+type route struct {
+    Pattern    string
+    Methods    []string
+    Handler    http.HandlerFunc
+    Timeout    time.Duration
+    Middleware []middleware
+    // Body is a zero value of the request body type, whose generated
+    // JSON Schema is published and enforced.
+    Body interface{}
+}
+
+// routeGroup shares middleware between routes, such as CORS for the public
+// API or role checks for operators.
+type routeGroup struct {
+    Middleware []middleware
+    Routes     []route
+}
+
+// defaultRouteTimeout bounds handlers that do not set their own timeout.
+const defaultRouteTimeout = 10 * time.Second
+
+// apiRoutes is every endpoint, for serving on a single port.
+func apiRoutes() []routeGroup {
+    return []routeGroup{publicRoutes(), adminRoutes()}
+}
+
+// publicRoutes are the routing endpoints clients call.
+func publicRoutes() routeGroup {
+    return routeGroup{
+        Middleware: []middleware{enableCors},
+        Routes: []route{
+            {Pattern: "/route", Methods: []string{http.MethodPost}, Handler: handleRouteRequest, Timeout: 30 * time.Second,
+                Middleware: []middleware{withRecording, withShadow, withTenant}, Body: routeRequest{}},
+            {Pattern: "/capabilities", Methods: []string{http.MethodGet}, Handler: handleCapabilities,
+                Middleware: []middleware{withTenant}},
+            {Pattern: "/nearest", Methods: []string{http.MethodGet}, Handler: handleNearest,
+                Middleware: []middleware{withRecording, withShadow, withTenant}},
+            {Pattern: "/route/stops", Methods: []string{http.MethodPost}, Handler: handleStops, Timeout: 60 * time.Second,
+                Middleware: []middleware{withTenant}, Body: stopsRequest{}},
+            {Pattern: "/route/park-and-walk", Methods: []string{http.MethodPost}, Handler: handleParkAndWalk, Timeout: 30 * time.Second,
+                Middleware: []middleware{withTenant}, Body: parkWalkRequest{}},
+            {Pattern: "/route/bike-share", Methods: []string{http.MethodPost}, Handler: handleBikeShare, Timeout: 30 * time.Second,
+                Middleware: []middleware{withTenant}, Body: bikeShareRequest{}},
+            {Pattern: "/matrix", Methods: []string{http.MethodPost}, Handler: handleMatrix, Timeout: 60 * time.Second,
+                Middleware: []middleware{withTenant, batchSearches}, Body: matrixRequest{}},
+            {Pattern: "/corridor", Methods: []string{http.MethodPost}, Handler: handleCorridor,
+                Middleware: []middleware{withTenant}, Body: corridorRequest{}},
+            {Pattern: "/safety/batch", Methods: []string{http.MethodPost}, Handler: handleSafetyBatch, Timeout: 60 * time.Second,
+                Middleware: []middleware{withTenant}, Body: safetyBatchRequest{}},
+            {Pattern: "/privacy", Methods: []string{http.MethodGet}, Handler: handlePrivacy},
+            {Pattern: "/ready", Methods: []string{http.MethodGet}, Handler: handleReady},
+            {Pattern: "/.well-known/jwks.json", Methods: []string{http.MethodGet}, Handler: handleJWKS},
+            {Pattern: "/schemas", Methods: []string{http.MethodGet}, Handler: handleSchemas},
+            {Pattern: "/schemas/{name...}", Methods: []string{http.MethodGet}, Handler: handleSchemas},
+            {Pattern: "/risk-layers", Methods: []string{http.MethodGet}, Handler: handleRiskLayers,
+                Middleware: []middleware{withTenant}},
+            {Pattern: "/pois", Methods: []string{http.MethodGet}, Handler: handlePOIs,
+                Middleware: []middleware{withTenant}},
+            {Pattern: "/routes/{id}", Methods: []string{http.MethodGet}, Handler: handleSavedRoute,
+                Middleware: []middleware{withTenant}},
+            {Pattern: "/routes/{id}/export", Methods: []string{http.MethodGet}, Handler: handleExportRoute,
+                Middleware: []middleware{withTenant}},
+            {Pattern: "/me/routes", Methods: []string{http.MethodGet}, Handler: handleMyRoutes,
+                Middleware: []middleware{withTenant, withUser}},
+            {Pattern: "/me/routes/{id}", Methods: []string{http.MethodDelete}, Handler: handleDeleteMyRoute,
+                Middleware: []middleware{withTenant, withUser}},
+            {Pattern: "/me/monitors", Methods: []string{http.MethodGet, http.MethodPost}, Handler: handleMonitors,
+                Middleware: []middleware{withTenant, withUser}, Body: monitorRequest{}},
+            {Pattern: "/me/notifications", Methods: []string{http.MethodGet, http.MethodPut}, Handler: handleNotificationPrefs,
+                Middleware: []middleware{withTenant, withUser}, Body: notificationPrefsRequest{}},
+            {Pattern: "/me/monitors/{id}", Methods: []string{http.MethodDelete}, Handler: handleDeleteMonitor,
+                Middleware: []middleware{withTenant, withUser}},
+            {Pattern: "/routes/{id}/recompute", Methods: []string{http.MethodPost}, Handler: handleRecomputeRoute, Timeout: 30 * time.Second,
+                Middleware: []middleware{withTenant}},
+        },
+    }
+}
+
+// adminRoutes are the operator endpoints, which may be served on their
+// own port.
+func adminRoutes() routeGroup {
+    return routeGroup{
+        Routes: []route{
+            {Pattern: "/admin/tenants", Methods: []string{http.MethodGet}, Handler: handleAdminTenants,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/tenants/{id}", Methods: []string{http.MethodGet}, Handler: handleAdminTenants,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/dashboard", Methods: []string{http.MethodGet}, Handler: handleAdminDashboard,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/dashboard/series", Methods: []string{http.MethodGet}, Handler: handleAdminDashboardSeries,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/caches", Methods: []string{http.MethodGet}, Handler: handleAdminCaches,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/caches/flush", Methods: []string{http.MethodPost}, Handler: handleAdminCacheFlush,
+                Middleware: []middleware{withRole(RoleOperator), audited("caches.flush")}, Body: cacheFlushRequest{}},
+            {Pattern: "/admin/crime/import", Methods: []string{http.MethodPost}, Handler: handleCrimeImport, Timeout: 5 * time.Minute,
+                Middleware: []middleware{withRole(RoleOperator), audited("crime.import")}},
+            {Pattern: "/admin/events", Methods: []string{http.MethodGet}, Handler: handleAdminEvents,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/hubs", Methods: []string{http.MethodGet}, Handler: handleAdminHubs,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/hubs/{name}", Methods: []string{http.MethodPut, http.MethodDelete}, Handler: handleHub, Timeout: 5 * time.Minute,
+                Middleware: []middleware{withRole(RoleOperator), audited("hubs.update")}, Body: hubRequest{}},
+            {Pattern: "/admin/graph", Methods: []string{http.MethodGet}, Handler: handleAdminGraph,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/graph/export", Methods: []string{http.MethodGet}, Handler: handleAdminGraphExport, Timeout: 5 * time.Minute,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/graph/diff", Methods: []string{http.MethodPost}, Handler: handleAdminGraphDiff, Timeout: 5 * time.Minute,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/graph/reload", Methods: []string{http.MethodPost}, Handler: handleAdminGraphReload, Timeout: 10 * time.Minute,
+                Middleware: []middleware{withRole(RoleOperator), audited("graph.reload")}},
+            {Pattern: "/admin/overlays", Methods: []string{http.MethodGet}, Handler: handleAdminOverlays,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/overlays/{name}", Methods: []string{http.MethodPut, http.MethodDelete}, Handler: handleOverlay,
+                Middleware: []middleware{withRole(RoleOperator), audited("overlays.update")}, Body: overlayRequest{}},
+            {Pattern: "/admin/shadow", Methods: []string{http.MethodGet}, Handler: handleAdminShadow,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/schedule", Methods: []string{http.MethodGet}, Handler: handleAdminSchedule,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/search-workers", Methods: []string{http.MethodGet}, Handler: handleAdminSearchWorkers,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/scrapers", Methods: []string{http.MethodGet}, Handler: handleAdminScrapers,
+                Middleware: []middleware{withRole(RoleViewer)}},
+            {Pattern: "/admin/selftest", Methods: []string{http.MethodGet}, Handler: handleAdminSelftest, Timeout: 5 * time.Minute,
+                Middleware: []middleware{withRole(RoleViewer)}},
+        },
+    }
+}
+
+// registerRoutes adds every route to mux in order. Each handler runs
+// inside its group's middleware, then method checking, then its own
+// middleware, then body validation, then its timeout.
+func registerRoutes(mux *http.ServeMux, groups []routeGroup) {
+    for _, g := range groups {
+        for _, rt := range g.Routes {
+            timeout := rt.Timeout
+            if timeout == 0 {
+                timeout = defaultRouteTimeout
+            }
+            mws := append([]middleware{}, g.Middleware...)
+            mws = append(mws, allowMethods(rt.Methods...))
+            mws = append(mws, rt.Middleware...)
+            if rt.Body != nil {
+                mws = append(mws, validBody(schemaOf(rt.Body)))
+            }
+            mws = append(mws, withTimeout(timeout))
+            mux.HandleFunc(rt.Pattern, chain(rt.Handler, mws...))
+        }
+    }
+}
+
+// allowMethods rejects requests with other methods with 405 and an Allow
+// header.
+func allowMethods(methods ...string) middleware {
+    allow := strings.Join(methods, ", ")
+    return func(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            for _, m := range methods {
+                if r.Method == m {
+                    next(w, r)
+                    return
+                }
+            }
+            w.Header().Set("Allow", allow)
+            writeMethodNotAllowed(w)
+        }
+    }
+}
+
+// withTimeout gives the handler a context that expires after d, or by the
+// caller's deadline when that comes first, so searches, which budget by
+// the context, never outlast the gateway waiting for them. A request whose
+// deadline has already passed is not served.
+func withTimeout(d time.Duration) middleware {
+    return func(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            now := time.Now()
+            deadline := now.Add(d)
+            caller, ok, err := callerDeadline(r, now)
+            if err != nil {
+                writeBadRequest(w, err.Error())
+                return
+            }
+            if ok && !caller.After(now) {
+                writeAPIError(w, http.StatusGatewayTimeout, APIError{Code: "deadline_exceeded", Message: "the request's deadline has passed"})
+                return
+            }
+            if ok && caller.Before(deadline) {
+                deadline = caller
+            }
+            ctx, cancel := context.WithDeadline(r.Context(), deadline)
+            defer cancel()
+            next(w, r.WithContext(ctx))
+        }
+    }
+}
+
+func withRole(role Role) middleware {
+    return func(next http.HandlerFunc) http.HandlerFunc {
+        return requireRole(role, next)
+    }
+}
+
+func audited(action string) middleware {
+    return func(next http.HandlerFunc) http.HandlerFunc {
+        return withAudit(action, next)
+    }
+}
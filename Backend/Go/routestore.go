@@ -0,0 +1,244 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "math"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// A recomputed route changed materially when it no longer exists, its
+// distance moved by more than materialDistanceChange (relative) or its
+// average risk by more than materialRiskChange (absolute). A different path
+// of near-equal cost is reported but is not material.
+const (
+    materialDistanceChange = 0.05
+    materialRiskChange     = 0.05
+)
+
+// savedRoute is an issued route together with the request that produced it
+// and the data versions it was computed on, so it stays resolvable after
+// the graph or risk layer is refreshed.
+type savedRoute struct {
+    ID               string    `json:"route_id"`
+    Tenant           string    `json:"-"`
+    CreatedAt        time.Time `json:"created_at"`
+    Start            Point     `json:"start"`
+    End              Point     `json:"end"`
+    Clamp            bool      `json:"clamp,omitempty"`
+    Preset           string    `json:"preset,omitempty"`
+    Alphas           []float64 `json:"alphas"`
+    MaxEdgeRisk      float64   `json:"max_edge_risk,omitempty"`
+    HeuristicWeight  float64   `json:"heuristic_weight,omitempty"`
+    RiskAggregation  string    `json:"risk_aggregation,omitempty"`
+    MinDissimilarity float64   `json:"min_dissimilarity,omitempty"`
+    MainStreets      bool      `json:"main_streets,omitempty"`
+    LayersOff        []string  `json:"layers_off,omitempty"`
+    GraphVersion     string    `json:"graph_version"`
+    RiskVersion      string    `json:"risk_version"`
+    Routes           []Route   `json:"routes"`
+}
+
+// routeStore keeps the most recent maxEntries issued routes in memory,
+// evicting the oldest first; it holds the routes of memory storage.
+type routeStore struct {
+    mu         sync.Mutex
+    maxEntries int
+    byID       map[string]*savedRoute
+    order      []string
+}
+
+func newRouteStore(maxEntries int) *routeStore {
+    return &routeStore{maxEntries: maxEntries, byID: make(map[string]*savedRoute)}
+}
+
+// save stores r under its ID.
+func (s *routeStore) save(r *savedRoute) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.byID[r.ID] = r
+    s.order = append(s.order, r.ID)
+    for len(s.order) > s.maxEntries {
+        delete(s.byID, s.order[0])
+        s.order = s.order[1:]
+    }
+}
+
+// get returns the route with the given ID if it belongs to tenant.
+func (s *routeStore) get(id, tenant string) (*savedRoute, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    r, ok := s.byID[id]
+    if !ok || r.Tenant != tenant {
+        return nil, false
+    }
+    return r, true
+}
+
+// saveRoute assigns r an ID and stores it, returning the ID, or "" when
+// storage failed; the route is answered either way.
+func saveRoute(ctx context.Context, r *savedRoute) string {
+    var b [8]byte
+    rand.Read(b[:])
+    r.ID = hex.EncodeToString(b[:])
+    if err := globalStorage.saveRoute(ctx, r); err != nil {
+        reportWarning(map[string]string{"component": "storage"}, "saving route %s: %v", r.ID, err)
+        return ""
+    }
+    return r.ID
+}
+
+// loadSavedRoute returns tenant's saved route with id, or answers 404, or
+// 500 when storage failed.
+func loadSavedRoute(w http.ResponseWriter, r *http.Request, id, tenant string) (*savedRoute, bool) {
+    saved, err := globalStorage.route(r.Context(), id, tenant)
+    if errors.Is(err, errNotFound) {
+        writeAPIError(w, http.StatusNotFound, APIError{Code: "not_found", Message: "unknown route " + id})
+        return nil, false
+    }
+    if err != nil {
+        writeAPIError(w, http.StatusInternalServerError, APIError{Code: "storage", Message: err.Error()})
+        return nil, false
+    }
+    return saved, true
+}
+
+// handleSavedRoute serves GET /routes/{id}.
+func handleSavedRoute(w http.ResponseWriter, r *http.Request) {
+    tenant := tenantFromContext(r.Context())
+    saved, ok := loadSavedRoute(w, r, r.PathValue("id"), tenant.ID)
+    if !ok {
+        return
+    }
+
+    writeSignedJSON(w, saved, "saved route")
+}
+
+type routeChange struct {
+    Alpha          float64 `json:"alpha"`
+    Found          bool    `json:"found"`
+    PathChanged    bool    `json:"path_changed"`
+    DistanceChange float64 `json:"distance_change"`
+    RiskChange     float64 `json:"risk_change"`
+    Material       bool    `json:"material"`
+}
+
+// savedParams are the search parameters a saved route was found with.
+func savedParams(saved *savedRoute) routeParams {
+    return routeParams{
+        MaxEdgeRisk:      saved.MaxEdgeRisk,
+        HeuristicWeight:  saved.HeuristicWeight,
+        RiskAggregation:  saved.RiskAggregation,
+        MinDissimilarity: saved.MinDissimilarity,
+        MainStreets:      saved.MainStreets,
+        LayersOff:        layerMask(globalConfig.NetworkLayers, saved.LayersOff),
+        EllipseFactor:    globalConfig.SearchEllipseFactor,
+        ArcFlags:         true,
+    }
+}
+
+// handleRecomputeRoute serves POST /routes/{id}/recompute: it reruns a
+// saved route's request on the current data and reports, per alpha,
+// whether the result changed materially.
+func handleRecomputeRoute(w http.ResponseWriter, r *http.Request) {
+    tenant := tenantFromContext(r.Context())
+    saved, ok := loadSavedRoute(w, r, r.PathValue("id"), tenant.ID)
+    if !ok {
+        return
+    }
+    router := tenant.Router()
+
+    start, err := router.snapChecked(saved.Start, "start", saved.Clamp)
+    if err != nil {
+        writeOutOfBounds(w, err)
+        return
+    }
+    end, err := router.snapChecked(saved.End, "end", saved.Clamp)
+    if err != nil {
+        writeOutOfBounds(w, err)
+        return
+    }
+    routes, truncated, err := router.routesBetween(r.Context(), start, end, saved.Alphas, savedParams(saved))
+    if errors.Is(err, context.Canceled) {
+        return
+    }
+    if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+        // No alpha found a path any more: every saved route changed.
+        routes, err = nil, nil
+    }
+    if err != nil {
+        writeAPIError(w, http.StatusGatewayTimeout, APIError{Code: "timeout", Message: "route search timed out"})
+        return
+    }
+
+    changes, changed := compareRoutes(saved.Routes, routes)
+    response := struct {
+        RouteID string        `json:"route_id"`
+        Saved   versionInfo   `json:"saved_versions"`
+        Current versionInfo   `json:"current_versions"`
+        Changed bool          `json:"changed"`
+        Alphas  []routeChange `json:"alphas"`
+        Routes  []Route       `json:"routes"`
+        // Truncated alphas ran out of time and are reported as changed.
+        Truncated bool `json:"truncated"`
+    }{
+        RouteID: saved.ID,
+        Saved:   versionInfo{Graph: saved.GraphVersion, RiskLayer: saved.RiskVersion},
+        Current: versionInfo{Graph: router.G.Version, RiskLayer: router.activeLayer().Version},
+        Changed: changed,
+        Alphas:  changes,
+        Routes:  routes,
+
+        Truncated: truncated,
+    }
+
+    writeSignedJSON(w, response, "recomputed route")
+}
+
+// compareRoutes matches saved and current routes by alpha and reports
+// whether any of them changed materially.
+func compareRoutes(saved, current []Route) ([]routeChange, bool) {
+    byAlpha := make(map[float64]Route, len(current))
+    for _, r := range current {
+        byAlpha[r.Alpha] = r
+    }
+
+    var changes []routeChange
+    changed := false
+    for _, old := range saved {
+        c := routeChange{Alpha: old.Alpha}
+        now, ok := byAlpha[old.Alpha]
+        if !ok {
+            c.PathChanged = true
+            c.Material = true
+        } else {
+            c.Found = true
+            c.PathChanged = !samePath(old.Path, now.Path)
+            if old.Distance > 0 {
+                c.DistanceChange = (now.Distance - old.Distance) / old.Distance
+            }
+            c.RiskChange = now.Risk - old.Risk
+            c.Material = math.Abs(c.DistanceChange) > materialDistanceChange ||
+                math.Abs(c.RiskChange) > materialRiskChange
+        }
+        changed = changed || c.Material
+        changes = append(changes, c)
+    }
+    return changes, changed
+}
+
+func samePath(a, b []Point) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "slices"
+    "strings"
+)
+
+// wantsStream reports whether the client asked for an NDJSON stream, with
+// ?stream=true or an Accept header of application/x-ndjson.
+func wantsStream(r *http.Request) bool {
+    return r.URL.Query().Get("stream") == "true" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// routeStreamLine is one line of a streamed route response: a "start"
+// line with the summary, a "route" line per route as its search finishes,
+// then "done" with the saved route's ID, or "error".
+type routeStreamLine struct {
+    Type string `json:"type"`
+    *routeSummary
+    Route     *fieldedRoute `json:"route,omitempty"`
+    RouteID   string        `json:"route_id,omitempty"`
+    Truncated *bool         `json:"truncated,omitempty"`
+    Error     *APIError     `json:"error,omitempty"`
+}
+
+// streamRoutes answers a route request as NDJSON, searching the alphas in
+// ascending order so the shortest route (alpha 0) reaches the client first
+// and safer alternatives follow. Streamed answers bypass the response
+// cache.
+func streamRoutes(w http.ResponseWriter, r *http.Request, router *RiskAwareRouter, summary routeSummary, alphas []float64, p routeParams, fields []string, save func([]Route) string) {
+    ctx := r.Context()
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    enc := json.NewEncoder(w)
+    flusher, _ := w.(http.Flusher)
+    send := func(line routeStreamLine) {
+        if enc.Encode(line) == nil && flusher != nil {
+            flusher.Flush()
+        }
+    }
+
+    answered := summary.inCRS(summary.CRS)
+    send(routeStreamLine{Type: "start", routeSummary: &answered})
+    var routes []Route
+    truncated, err := router.eachRoute(ctx, summary.Snap.Start, summary.Snap.End, slices.Sorted(slices.Values(alphas)), p, func(route Route) {
+        routes = append(routes, route)
+        answer := fieldedRoute{route.inCRS(summary.CRS), fields}
+        send(routeStreamLine{Type: "route", Route: &answer})
+    })
+    switch {
+    case errors.Is(err, context.Canceled):
+        tenantFromContext(ctx).metrics.cancelled.Add(1)
+    case errors.Is(err, errNotConnected):
+        send(routeStreamLine{Type: "error", Error: &APIError{Code: "not_connected", Message: err.Error()}})
+    case errors.Is(err, context.DeadlineExceeded):
+        send(routeStreamLine{Type: "error", Error: &APIError{Code: "timeout", Message: "route search timed out"}})
+    case err != nil:
+        send(routeStreamLine{Type: "error", Error: &APIError{Code: "no_route", Message: err.Error()}})
+    default:
+        send(routeStreamLine{Type: "done", RouteID: save(routes), Truncated: &truncated})
+    }
+}
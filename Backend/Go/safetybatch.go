@@ -0,0 +1,127 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+)
+
+// safetyPolyline is one existing route to score, such as a bus line or a
+// school walking route, named by the caller's id.
+type safetyPolyline struct {
+    ID   string       `json:"id"`
+    Path [][2]float64 `json:"path" schema:"required"`
+}
+
+// safetyBatchRequest is the body of POST /safety/batch.
+type safetyBatchRequest struct {
+    Polylines []safetyPolyline `json:"polylines" schema:"required"`
+    SliceM    float64          `json:"slice_m" schema:"minimum=0"`
+}
+
+// safetyScore is the risk of one polyline. Error is set, and the metrics
+// left empty, when the polyline does not follow the road network.
+type safetyScore struct {
+    ID             string         `json:"id"`
+    LengthM        float64        `json:"length_m"`
+    Risk           float64        `json:"risk"`
+    MaxRisk        float64        `json:"max_risk"`
+    IncidentsPerKm float64        `json:"incidents_per_km"`
+    Hotspot        *CorridorSlice `json:"hotspot,omitempty"`
+    Error          string         `json:"error,omitempty"`
+}
+
+// scorePolyline measures path against layer: the length-weighted mean and
+// the maximum risk of the road it follows, the recent incidents per km and
+// the riskiest slice of sliceM meters.
+func (r *RiskAwareRouter) scorePolyline(path []Point, layer *riskLayer, sliceM float64) (safetyScore, error) {
+    var score safetyScore
+    if len(path) < 2 {
+        return score, fmt.Errorf("a polyline needs at least two points")
+    }
+    pieces, err := r.pathPieces(path, layer)
+    if err != nil {
+        return score, err
+    }
+    score.LengthM = pathLengthM(pieces)
+    weighted := 0.0
+    for _, p := range pieces {
+        weighted += p.risk * p.lengthM
+        score.MaxRisk = max(score.MaxRisk, p.risk)
+    }
+    if score.LengthM > 0 {
+        score.Risk = weighted / score.LengthM
+    }
+    if r.CrimeData != nil {
+        score.IncidentsPerKm = r.CrimeData.incidentsPerKm(path, score.LengthM, globalConfig.ExposureRadiusM, exposureSince())
+    }
+    for _, s := range corridorSlices(pieces, sliceM, 0) {
+        if score.Hotspot == nil || s.Risk > score.Hotspot.Risk {
+            s.Polygon = nil
+            score.Hotspot = &s
+        }
+    }
+    return score, nil
+}
+
+// handleSafetyBatch serves POST /safety/batch: risk metrics for many
+// existing polylines at once, for planners auditing infrastructure. Each
+// polyline is scored on its own, so one that leaves the road network is
+// reported in its error field without failing the batch.
+func handleSafetyBatch(w http.ResponseWriter, r *http.Request) {
+    var req safetyBatchRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    if len(req.Polylines) == 0 {
+        writeBadRequest(w, "polylines must not be empty")
+        return
+    }
+    if max := globalConfig.Limits.MaxSafetyBatch; len(req.Polylines) > max {
+        writeBadRequest(w, fmt.Sprintf("at most %d polylines are allowed", max))
+        return
+    }
+    if req.SliceM == 0 {
+        req.SliceM = defaultCorridorSliceM
+    }
+    if req.SliceM < minCorridorSliceM {
+        writeBadRequest(w, fmt.Sprintf("slice_m must be at least %g", minCorridorSliceM))
+        return
+    }
+
+    router := tenantFromContext(r.Context()).Router()
+    layer := router.activeLayer()
+    scores := make([]safetyScore, len(req.Polylines))
+    for i, pl := range req.Polylines {
+        if err := r.Context().Err(); err != nil {
+            writeAPIError(w, http.StatusGatewayTimeout, APIError{Code: "timeout", Message: fmt.Sprintf("safety batch timed out after %d of %d polylines", i, len(req.Polylines))})
+            return
+        }
+        path := make([]Point, len(pl.Path))
+        for j, c := range pl.Path {
+            path[j] = Point{X: c[0], Y: c[1]}
+        }
+        score, err := router.scorePolyline(path, layer, req.SliceM)
+        if err != nil {
+            score = safetyScore{Error: err.Error()}
+        }
+        score.ID = pl.ID
+        if score.ID == "" {
+            score.ID = fmt.Sprint(i)
+        }
+        scores[i] = score
+    }
+
+    response := struct {
+        RiskVersion string        `json:"risk_version"`
+        SliceM      float64       `json:"slice_m"`
+        Results     []safetyScore `json:"results"`
+    }{layer.Version, req.SliceM, scores}
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode safety batch: %v", err)
+    }
+}
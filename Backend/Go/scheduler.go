@@ -0,0 +1,370 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math/rand"
+    "net/http"
+    "slices"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// ScheduleConfig overrides when a background task runs: its cron
+// expression, whether it runs at all, and up to how many seconds each run
+// is randomly delayed, so replicas do not all refresh at once.
+type ScheduleConfig struct {
+    Cron          string `json:"cron"`
+    Enabled       *bool  `json:"enabled"`
+    JitterSeconds int    `json:"jitter_seconds"`
+}
+
+// scheduledTask is background work the scheduler runs on a schedule.
+type scheduledTask struct {
+    name        string
+    description string
+    // defaults is the schedule the task runs on unless configured.
+    defaults func(cfg Config) ScheduleConfig
+    run      func(now time.Time) error
+}
+
+var scheduledTasks = []scheduledTask{
+    {
+        name:        "route_cache_cleanup",
+        description: "drops expired responses from the route caches",
+        defaults: func(cfg Config) ScheduleConfig {
+            return ScheduleConfig{Cron: "*/5 * * * *", Enabled: boolPtr(cfg.RouteCacheEntries > 0)}
+        },
+        run: sweepRouteCaches,
+    },
+    {
+        name:        "collisions_refresh",
+        description: "rescores the collisions risk component from the crash file",
+        defaults: func(cfg Config) ScheduleConfig {
+            s := ScheduleConfig{Cron: "@hourly", Enabled: boolPtr(false)}
+            if cfg.Collisions.RefreshSeconds > 0 {
+                s.Cron = fmt.Sprintf("@every %ds", cfg.Collisions.RefreshSeconds)
+                s.Enabled = boolPtr(hasCollisionsComponent(cfg.RiskComponents))
+            }
+            return s
+        },
+        run: refreshCollisions,
+    },
+    {
+        name:        "hubs_warmup",
+        description: "rebuilds hub trees gone stale, such as when an overlay starts or expires",
+        defaults: func(cfg Config) ScheduleConfig {
+            return ScheduleConfig{Cron: "* * * * *", Enabled: boolPtr(true)}
+        },
+        run: warmHubs,
+    },
+    {
+        name:        "analytics_rollup",
+        description: "logs each tenant's request counts since the last rollup",
+        defaults: func(cfg Config) ScheduleConfig {
+            return ScheduleConfig{Cron: "@hourly", Enabled: boolPtr(false)}
+        },
+        run: rollUpTenantMetrics,
+    },
+    {
+        name:        "route_monitors",
+        description: "checks monitored routes for risk increases and alerts their users",
+        defaults: func(cfg Config) ScheduleConfig {
+            return ScheduleConfig{Cron: "*/15 * * * *", Enabled: boolPtr(true)}
+        },
+        run: checkRouteMonitors,
+    },
+    {
+        name:        "route_prewarm",
+        description: "precomputes the busiest origin/destination pairs into the route caches before the morning rush",
+        defaults: func(cfg Config) ScheduleConfig {
+            return ScheduleConfig{Cron: "0 5 * * *", Enabled: boolPtr(prewarmEnabled(cfg))}
+        },
+        run: prewarmRoutes,
+    },
+    {
+        name:        "risk_freshness",
+        description: "warns when a tenant's risk layer goes longer than max_risk_staleness_hours without a refresh",
+        defaults: func(cfg Config) ScheduleConfig {
+            return ScheduleConfig{Cron: "*/5 * * * *", Enabled: boolPtr(cfg.MaxRiskStalenessHours > 0)}
+        },
+        run: checkRiskFreshness,
+    },
+    {
+        name:        "bike_share_refresh",
+        description: "fetches the docks and live availability of each tenant's bike-share feed",
+        defaults: func(cfg Config) ScheduleConfig {
+            return ScheduleConfig{Cron: fmt.Sprintf("@every %ds", cfg.BikeShare.RefreshSeconds), Enabled: boolPtr(bikeShareEnabled(cfg))}
+        },
+        run: refreshBikeShare,
+    },
+}
+
+func boolPtr(b bool) *bool {
+    return &b
+}
+
+// resolveSchedule applies the configured overrides to t's defaults.
+func resolveSchedule(cfg Config, t scheduledTask) (ScheduleConfig, *cronSchedule, error) {
+    s := t.defaults(cfg)
+    if c, ok := cfg.Schedule[t.name]; ok {
+        if c.Cron != "" {
+            s.Cron = c.Cron
+        }
+        if c.Enabled != nil {
+            s.Enabled = c.Enabled
+        }
+        s.JitterSeconds = c.JitterSeconds
+    }
+    cron, err := parseCron(s.Cron)
+    if err != nil {
+        return s, nil, fmt.Errorf("schedule.%s: %v", t.name, err)
+    }
+    if s.JitterSeconds < 0 {
+        return s, nil, fmt.Errorf("schedule.%s: jitter_seconds must not be negative, got %d", t.name, s.JitterSeconds)
+    }
+    return s, cron, nil
+}
+
+func checkSchedule(cfg Config) error {
+    names := make([]string, len(scheduledTasks))
+    for i, t := range scheduledTasks {
+        names[i] = t.name
+        if _, _, err := resolveSchedule(cfg, t); err != nil {
+            return err
+        }
+    }
+    for name := range cfg.Schedule {
+        if !slices.Contains(names, name) {
+            return fmt.Errorf("schedule: unknown task %q (available: %s)", name, strings.Join(names, ", "))
+        }
+    }
+    return nil
+}
+
+// taskStatus is a task's schedule and run metrics, for the admin listing.
+type taskStatus struct {
+    Name           string     `json:"name"`
+    Description    string     `json:"description"`
+    Cron           string     `json:"cron"`
+    Enabled        bool       `json:"enabled"`
+    JitterSeconds  int        `json:"jitter_seconds"`
+    Runs           int64      `json:"runs"`
+    Failures       int64      `json:"failures"`
+    Running        bool       `json:"running"`
+    LastRun        *time.Time `json:"last_run,omitempty"`
+    LastDurationMS float64    `json:"last_duration_ms"`
+    LastError      string     `json:"last_error,omitempty"`
+    NextRun        *time.Time `json:"next_run,omitempty"`
+}
+
+type taskState struct {
+    task   scheduledTask
+    cron   *cronSchedule
+    jitter time.Duration
+    status taskStatus
+}
+
+// scheduler runs the scheduled tasks, each on its own background job so
+// shutdown waits for a run in progress. A task's runs never overlap.
+type scheduler struct {
+    mu    sync.Mutex
+    tasks []*taskState
+}
+
+var globalScheduler *scheduler
+
+func newScheduler(cfg Config) (*scheduler, error) {
+    s := &scheduler{}
+    for _, t := range scheduledTasks {
+        sc, cron, err := resolveSchedule(cfg, t)
+        if err != nil {
+            return nil, err
+        }
+        s.tasks = append(s.tasks, &taskState{
+            task:   t,
+            cron:   cron,
+            jitter: time.Duration(sc.JitterSeconds) * time.Second,
+            status: taskStatus{
+                Name:          t.name,
+                Description:   t.description,
+                Cron:          sc.Cron,
+                Enabled:       *sc.Enabled,
+                JitterSeconds: sc.JitterSeconds,
+            },
+        })
+    }
+    if err := s.restore(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// restore carries the tasks' run counters over from storage, so they
+// count every run rather than those since the last restart.
+func (s *scheduler) restore() error {
+    stored, err := globalStorage.taskStatuses(context.Background())
+    if err != nil {
+        return fmt.Errorf("restoring task history: %v", err)
+    }
+    for _, st := range stored {
+        for _, ts := range s.tasks {
+            if ts.status.Name == st.Name {
+                ts.status.Runs = st.Runs
+                ts.status.Failures = st.Failures
+                ts.status.LastRun = st.LastRun
+                ts.status.LastDurationMS = st.LastDurationMS
+                ts.status.LastError = st.LastError
+            }
+        }
+    }
+    return nil
+}
+
+// start runs every enabled task on its schedule until shutdown.
+func (s *scheduler) start() {
+    for _, ts := range s.tasks {
+        if ts.status.Enabled {
+            globalJobs.goJob("schedule."+ts.task.name, alwaysRestart, func() { s.loop(ts) })
+        }
+    }
+}
+
+func (s *scheduler) loop(ts *taskState) {
+    for {
+        next := ts.cron.next(time.Now())
+        if next.IsZero() {
+            return
+        }
+        if ts.jitter > 0 {
+            next = next.Add(time.Duration(rand.Int63n(int64(ts.jitter))))
+        }
+        s.mu.Lock()
+        ts.status.NextRun = &next
+        s.mu.Unlock()
+
+        timer := time.NewTimer(time.Until(next))
+        select {
+        case <-globalJobs.stopping():
+            timer.Stop()
+            return
+        case <-timer.C:
+        }
+        s.runTask(ts)
+    }
+}
+
+// runTask runs ts once and records how it went. A failure is reported
+// and the task runs again at its next time.
+func (s *scheduler) runTask(ts *taskState) {
+    start := time.Now()
+    s.mu.Lock()
+    ts.status.Running = true
+    s.mu.Unlock()
+
+    var err error
+    if runRecovered("schedule."+ts.task.name, func() { err = ts.task.run(start) }) {
+        err = errors.New("panicked")
+    }
+
+    s.mu.Lock()
+    ts.status.Running = false
+    ts.status.Runs++
+    ts.status.LastRun = &start
+    ts.status.LastDurationMS = float64(time.Since(start).Microseconds()) / 1000
+    ts.status.LastError = ""
+    if err != nil {
+        ts.status.Failures++
+        ts.status.LastError = err.Error()
+        reportWarning(map[string]string{"task": ts.task.name}, "scheduled task %s failed: %v", ts.task.name, err)
+    }
+    status := ts.status
+    s.mu.Unlock()
+    if err := globalStorage.saveTaskStatus(context.Background(), status); err != nil {
+        reportWarning(map[string]string{"component": "storage"}, "saving task %s history: %v", ts.task.name, err)
+    }
+}
+
+func (s *scheduler) list() []taskStatus {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    list := make([]taskStatus, len(s.tasks))
+    for i, ts := range s.tasks {
+        list[i] = ts.status
+    }
+    return list
+}
+
+// handleAdminSchedule serves GET /admin/schedule, the scheduled tasks with
+// their schedules and run metrics.
+func handleAdminSchedule(w http.ResponseWriter, r *http.Request) {
+    response := struct {
+        Tasks []taskStatus `json:"tasks"`
+    }{globalScheduler.list()}
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode schedule: %v", err)
+    }
+}
+
+func sweepRouteCaches(now time.Time) error {
+    for _, t := range globalTenants.tenants {
+        t.Router().routes.sweep(now)
+    }
+    return nil
+}
+
+func refreshCollisions(now time.Time) error {
+    var errs []error
+    for _, t := range globalTenants.tenants {
+        refreshed, err := t.Router().refreshCollisions(globalConfig.Collisions)
+        if err != nil {
+            errs = append(errs, fmt.Errorf("tenant %s: %v", t.ID, err))
+        }
+        if refreshed {
+            notifyJobDone(t.ID, "collisions_refresh", "Crash data was refreshed.")
+        }
+    }
+    return errors.Join(errs...)
+}
+
+func warmHubs(now time.Time) error {
+    var errs []error
+    for _, t := range globalTenants.tenants {
+        router := t.Router()
+        if router.hubs.stale(router.activeLayer(), router.closed.load()) {
+            if err := router.refreshHubs(context.Background()); err != nil {
+                errs = append(errs, fmt.Errorf("tenant %s: %v", t.ID, err))
+            }
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// rollupBaseline holds each tenant's metrics at the last rollup. Only the
+// analytics_rollup task touches it, and its runs never overlap.
+var rollupBaseline = map[string]tenantMetricsSnapshot{}
+
+func rollUpTenantMetrics(now time.Time) error {
+    ids := make([]string, 0, len(globalTenants.tenants))
+    byID := make(map[string]*Tenant)
+    for _, t := range globalTenants.tenants {
+        ids = append(ids, t.ID)
+        byID[t.ID] = t
+    }
+    sort.Strings(ids)
+    for _, id := range ids {
+        m := byID[id].metrics.snapshot()
+        last := rollupBaseline[id]
+        log.Printf("Rollup: tenant %s: %d requests, %d client errors, %d server errors, %d throttled, %d cancelled, %d on stale risk data",
+            id, m.Requests-last.Requests, m.ClientErrors-last.ClientErrors, m.ServerErrors-last.ServerErrors,
+            m.Throttled-last.Throttled, m.Cancelled-last.Cancelled, m.StaleRisk-last.StaleRisk)
+        rollupBaseline[id] = m
+    }
+    return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// jsonSchema is the subset of JSON Schema (draft 2020-12) that request
+// bodies use. Schemas are generated from the Go request types, so the
+// published and enforced schema is always the one the handler decodes.
+type jsonSchema struct {
+    Schema               string                 `json:"$schema,omitempty"`
+    Type                 interface{}            `json:"type,omitempty"`
+    Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+    Required             []string               `json:"required,omitempty"`
+    AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+    Items                *jsonSchema            `json:"items,omitempty"`
+    MinItems             *int                   `json:"minItems,omitempty"`
+    MaxItems             *int                   `json:"maxItems,omitempty"`
+    Minimum              *float64               `json:"minimum,omitempty"`
+    Maximum              *float64               `json:"maximum,omitempty"`
+}
+
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// schemaOf generates the schema of the type of v. Struct fields are named
+// by their json tags and may carry a schema tag of comma-separated
+// "required", "minimum=N" and "maximum=N".
+func schemaOf(v interface{}) *jsonSchema {
+    s := schemaForType(reflect.TypeOf(v))
+    s.Schema = jsonSchemaDialect
+    return s
+}
+
+// schemaProvider is implemented by types whose JSON form is not the one
+// their Go type implies, such as types with their own UnmarshalJSON.
+type schemaProvider interface {
+    jsonSchema() *jsonSchema
+}
+
+var schemaProviderType = reflect.TypeOf((*schemaProvider)(nil)).Elem()
+
+func schemaForType(t reflect.Type) *jsonSchema {
+    if t.Kind() != reflect.Pointer && t.Implements(schemaProviderType) {
+        return reflect.Zero(t).Interface().(schemaProvider).jsonSchema()
+    }
+    switch t.Kind() {
+    case reflect.Pointer:
+        s := schemaForType(t.Elem())
+        switch types := s.Type.(type) {
+        case string:
+            s.Type = []string{types, "null"}
+        case []string:
+            s.Type = append(types, "null")
+        }
+        return s
+    case reflect.Struct:
+        s := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}, AdditionalProperties: false}
+        addFields(s, t)
+        return s
+    case reflect.Map:
+        return &jsonSchema{Type: "object", AdditionalProperties: schemaForType(t.Elem())}
+    case reflect.Slice:
+        return &jsonSchema{Type: "array", Items: schemaForType(t.Elem())}
+    case reflect.Array:
+        n := t.Len()
+        return &jsonSchema{Type: "array", Items: schemaForType(t.Elem()), MinItems: &n, MaxItems: &n}
+    case reflect.Bool:
+        return &jsonSchema{Type: "boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return &jsonSchema{Type: "integer"}
+    case reflect.Float32, reflect.Float64:
+        return &jsonSchema{Type: "number"}
+    case reflect.String:
+        return &jsonSchema{Type: "string"}
+    }
+    return &jsonSchema{}
+}
+
+func addFields(s *jsonSchema, t reflect.Type) {
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        tag, hasTag := f.Tag.Lookup("json")
+        name, _, _ := strings.Cut(tag, ",")
+        if f.Anonymous && !hasTag && f.Type.Kind() == reflect.Struct {
+            addFields(s, f.Type)
+            continue
+        }
+        if !f.IsExported() || name == "-" {
+            continue
+        }
+        if name == "" {
+            name = f.Name
+        }
+        prop := schemaForType(f.Type)
+        for _, opt := range strings.Split(f.Tag.Get("schema"), ",") {
+            key, val, _ := strings.Cut(opt, "=")
+            n, _ := strconv.ParseFloat(val, 64)
+            switch key {
+            case "required":
+                s.Required = append(s.Required, name)
+            case "minimum":
+                prop.Minimum = &n
+            case "maximum":
+                prop.Maximum = &n
+            }
+        }
+        s.Properties[name] = prop
+    }
+}
+
+// fieldError is one schema violation, located by a JSONPath such as
+// $.sources[2][0].
+type fieldError struct {
+    Path    string `json:"path"`
+    Message string `json:"message"`
+}
+
+// validate appends every violation of s by the decoded value v at path.
+func (s *jsonSchema) validate(v interface{}, path string, errs *[]fieldError) {
+    fail := func(format string, args ...interface{}) {
+        *errs = append(*errs, fieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+    }
+    if !s.allows(jsonType(v)) {
+        fail("must be %s, not %s", s.typeNames(), withArticle(jsonType(v)))
+        return
+    }
+    switch v := v.(type) {
+    case map[string]interface{}:
+        for _, name := range s.Required {
+            if _, ok := v[name]; !ok {
+                *errs = append(*errs, fieldError{Path: path + "." + name, Message: "is required"})
+            }
+        }
+        names := make([]string, 0, len(v))
+        for name := range v {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            child := path + "." + name
+            if prop, ok := s.Properties[name]; ok {
+                prop.validate(v[name], child, errs)
+            } else if extra, ok := s.AdditionalProperties.(*jsonSchema); ok {
+                extra.validate(v[name], child, errs)
+            } else if s.AdditionalProperties == false {
+                *errs = append(*errs, fieldError{Path: child, Message: "is not a known field"})
+            }
+        }
+    case []interface{}:
+        if s.MinItems != nil && len(v) < *s.MinItems {
+            fail("must have at least %d items", *s.MinItems)
+        }
+        if s.MaxItems != nil && len(v) > *s.MaxItems {
+            fail("must have at most %d items", *s.MaxItems)
+        }
+        if s.Items != nil {
+            for i, item := range v {
+                s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), errs)
+            }
+        }
+    case json.Number:
+        n, _ := v.Float64()
+        if s.Minimum != nil && n < *s.Minimum {
+            fail("must be at least %g", *s.Minimum)
+        }
+        if s.Maximum != nil && n > *s.Maximum {
+            fail("must be at most %g", *s.Maximum)
+        }
+    }
+}
+
+// jsonType names the JSON type of a value decoded with UseNumber.
+func jsonType(v interface{}) string {
+    switch v := v.(type) {
+    case nil:
+        return "null"
+    case bool:
+        return "boolean"
+    case string:
+        return "string"
+    case json.Number:
+        if _, err := v.Int64(); err == nil {
+            return "integer"
+        }
+        return "number"
+    case []interface{}:
+        return "array"
+    case map[string]interface{}:
+        return "object"
+    }
+    return "unknown"
+}
+
+func (s *jsonSchema) allows(typ string) bool {
+    for _, name := range s.types() {
+        if name == typ || name == "number" && typ == "integer" {
+            return true
+        }
+    }
+    return s.Type == nil
+}
+
+func (s *jsonSchema) types() []string {
+    switch t := s.Type.(type) {
+    case string:
+        return []string{t}
+    case []string:
+        return t
+    }
+    return nil
+}
+
+// typeNames lists the allowed types for a message, e.g. "a number or a
+// null". It must not write into s.types(), which may be the schema's own.
+func (s *jsonSchema) typeNames() string {
+    var names []string
+    for _, name := range s.types() {
+        names = append(names, withArticle(name))
+    }
+    return strings.Join(names, " or ")
+}
+
+func withArticle(typ string) string {
+    switch typ {
+    case "null":
+        return typ
+    case "array", "object", "integer":
+        return "an " + typ
+    }
+    return "a " + typ
+}
+
+// validBody rejects requests whose JSON body does not match schema with
+// 400 and the path of every violation, then hands the body on unread. An
+// empty body is checked as {}, and requests without a body (GET, DELETE)
+// pass through.
+func validBody(schema *jsonSchema) middleware {
+    return func(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+                next(w, r)
+                return
+            }
+            body, err := io.ReadAll(r.Body)
+            if err != nil {
+                writeBadRequest(w, err.Error())
+                return
+            }
+            r.Body = io.NopCloser(bytes.NewReader(body))
+
+            var doc interface{} = map[string]interface{}{}
+            if len(bytes.TrimSpace(body)) > 0 {
+                dec := json.NewDecoder(bytes.NewReader(body))
+                dec.UseNumber()
+                if err := dec.Decode(&doc); err != nil {
+                    writeBadRequest(w, "invalid JSON: "+err.Error())
+                    return
+                }
+            }
+            var errs []fieldError
+            schema.validate(doc, "$", &errs)
+            if len(errs) > 0 {
+                writeAPIError(w, http.StatusBadRequest, APIError{
+                    Code:    "invalid_request",
+                    Message: "Request body does not match the schema",
+                    Details: map[string]interface{}{"errors": errs},
+                })
+                return
+            }
+            next(w, r)
+        }
+    }
+}
+
+// handleSchemas serves GET /schemas, the request body schema of every
+// endpoint that takes one, keyed by "METHOD /pattern", and GET
+// /schemas/{name...} for one endpoint by its pattern without the leading
+// slash, e.g. /schemas/route or /schemas/admin/hubs/{name}.
+func handleSchemas(w http.ResponseWriter, r *http.Request) {
+    schemas := map[string]*jsonSchema{}
+    byName := map[string]*jsonSchema{}
+    for _, g := range apiRoutes() {
+        for _, rt := range g.Routes {
+            if rt.Body == nil {
+                continue
+            }
+            s := schemaOf(rt.Body)
+            for _, m := range rt.Methods {
+                if m != http.MethodGet && m != http.MethodDelete {
+                    schemas[m+" "+rt.Pattern] = s
+                }
+            }
+            byName[strings.TrimPrefix(rt.Pattern, "/")] = s
+        }
+    }
+
+    var response interface{} = schemas
+    if name := r.PathValue("name"); name != "" {
+        s, ok := byName[name]
+        if !ok {
+            writeAPIError(w, http.StatusNotFound, APIError{Code: "not_found", Message: "unknown schema " + name})
+            return
+        }
+        response = s
+    }
+    w.Header().Set("Content-Type", "application/schema+json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode schemas: %v", err)
+    }
+}
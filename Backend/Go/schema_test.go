@@ -0,0 +1,192 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// validate runs body through the validation of body type v, answering
+// what the next handler would have read, or the rejection.
+func validate(t *testing.T, v interface{}, method, body string) (*httptest.ResponseRecorder, string, bool) {
+    t.Helper()
+    var read string
+    called := false
+    next := func(w http.ResponseWriter, r *http.Request) {
+        called = true
+        b, err := io.ReadAll(r.Body)
+        if err != nil {
+            t.Fatal(err)
+        }
+        read = string(b)
+    }
+    w := httptest.NewRecorder()
+    validBody(schemaOf(v))(next)(w, httptest.NewRequest(method, "/", strings.NewReader(body)))
+    return w, read, called
+}
+
+func TestValidBodyRejects(t *testing.T) {
+    cases := []struct {
+        name string
+        body interface{}
+        json string
+        want []fieldError
+    }{
+        {"unknown field", routeRequest{}, `{"colour": "red"}`,
+            []fieldError{{"$.colour", "is not a known field"}}},
+        {"string field", routeRequest{}, `{"crs": 4326}`,
+            []fieldError{{"$.crs", "must be a string, not an integer"}}},
+        {"boolean field", routeRequest{}, `{"debug": "yes"}`,
+            []fieldError{{"$.debug", "must be a boolean, not a string"}}},
+        {"minimum", routeRequest{}, `{"heuristic_weight": 0.5}`,
+            []fieldError{{"$.heuristic_weight", "must be at least 1"}}},
+        {"optional field not nullable", routeRequest{}, `{"min_dissimilarity": null}`,
+            []fieldError{{"$.min_dissimilarity", "must be a number, not null"}}},
+        {"map value", routeRequest{}, `{"risk_weights": {"traffic": "high"}}`,
+            []fieldError{{"$.risk_weights.traffic", "must be a number, not a string"}}},
+        {"map", routeRequest{}, `{"layers": ["tunnels"]}`,
+            []fieldError{{"$.layers", "must be an object, not an array"}}},
+        {"coordinate type", routeRequest{}, `{"start": "41.87,-87.66"}`,
+            []fieldError{{"$.start", "must be an object or an array or null, not a string"}}},
+        {"coordinate position", routeRequest{}, `{"end": [-87.66, 41.87, 12]}`,
+            []fieldError{{"$.end", "must have at most 2 items"}}},
+        {"coordinate object", routeRequest{}, `{"start": {"lat": 41.87, "alt": 12}}`,
+            []fieldError{{"$.start.lon", "is required"}, {"$.start.alt", "is not a known field"}}},
+        {"required", matrixRequest{}, `{}`,
+            []fieldError{{"$.sources", "is required"}, {"$.destinations", "is required"}}},
+        {"empty body", matrixRequest{}, ``,
+            []fieldError{{"$.sources", "is required"}, {"$.destinations", "is required"}}},
+        {"maximum", matrixRequest{}, `{"sources": [], "destinations": [], "alpha": 1.5}`,
+            []fieldError{{"$.alpha", "must be at most 1"}}},
+        {"short pair", matrixRequest{}, `{"sources": [[-87.66]], "destinations": []}`,
+            []fieldError{{"$.sources[0]", "must have at least 2 items"}}},
+        {"pair item", matrixRequest{}, `{"sources": [], "destinations": [[-87.66, 41.87], ["x", 41.87]]}`,
+            []fieldError{{"$.destinations[1][0]", "must be a number, not a string"}}},
+        {"nested struct", notificationPrefsRequest{}, `{"channels": [{"kind": "webhook"}], "topics": [7]}`,
+            []fieldError{{"$.channels[0].address", "is required"}, {"$.topics[0]", "must be a string, not an integer"}}},
+        {"not an object", hubRequest{}, `[1, 2]`,
+            []fieldError{{"$", "must be an object, not an array"}}},
+        {"every violation", hubRequest{}, `{"x": "1", "z": 0}`,
+            []fieldError{{"$.y", "is required"}, {"$.x", "must be a number, not a string"}, {"$.z", "is not a known field"}}},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            w, _, called := validate(t, c.body, http.MethodPost, c.json)
+            if called {
+                t.Fatal("the handler ran")
+            }
+            if w.Code != http.StatusBadRequest {
+                t.Fatalf("status = %d, want 400", w.Code)
+            }
+            var resp struct {
+                Error struct {
+                    Details struct {
+                        Errors []fieldError `json:"errors"`
+                    } `json:"details"`
+                } `json:"error"`
+            }
+            if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+                t.Fatal(err)
+            }
+            if got := resp.Error.Details.Errors; !reflect.DeepEqual(got, c.want) {
+                t.Errorf("errors = %+v, want %+v", got, c.want)
+            }
+        })
+    }
+}
+
+// TestValidBodyErrorShape pins the error body clients parse.
+func TestValidBodyErrorShape(t *testing.T) {
+    w, _, _ := validate(t, hubRequest{}, http.MethodPut, `{"x": 1, "y": 2, "z": 3}`)
+    if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+        t.Errorf("Content-Type = %q", ct)
+    }
+    want := `{"error":{"code":"invalid_request","message":"Request body does not match the schema",` +
+        `"details":{"errors":[{"path":"$.z","message":"is not a known field"}]}}}`
+    if got := strings.TrimSpace(w.Body.String()); got != want {
+        t.Errorf("body = %s\nwant   %s", got, want)
+    }
+
+    // Invalid JSON is rejected without field errors.
+    w, _, called := validate(t, hubRequest{}, http.MethodPut, `{"x": 1,`)
+    var resp map[string]map[string]interface{}
+    if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+        t.Fatal(err)
+    }
+    if called || w.Code != http.StatusBadRequest || resp["error"]["code"] != "invalid_request" ||
+        !strings.HasPrefix(resp["error"]["message"].(string), "invalid JSON") || resp["error"]["details"] != nil {
+        t.Errorf("invalid JSON: status %d, body %s", w.Code, w.Body)
+    }
+}
+
+// TestValidBodyReused checks that rejections leave the schema as it was,
+// since one schema serves every request to a route.
+func TestValidBodyReused(t *testing.T) {
+    check := validBody(schemaOf(routeRequest{}))(func(http.ResponseWriter, *http.Request) {})
+    var bodies []string
+    for i := 0; i < 2; i++ {
+        w := httptest.NewRecorder()
+        check(w, httptest.NewRequest(http.MethodPost, "/route", strings.NewReader(`{"start": 1, "alpha_step": "x"}`)))
+        bodies = append(bodies, w.Body.String())
+    }
+    if bodies[0] != bodies[1] {
+        t.Errorf("second rejection = %s, first %s", bodies[1], bodies[0])
+    }
+}
+
+func TestValidBodyAccepts(t *testing.T) {
+    cases := []struct {
+        name   string
+        body   interface{}
+        method string
+        json   string
+    }{
+        {"points", routeRequest{}, http.MethodPost,
+            `{"start": {"lat": 41.87, "lon": -87.66}, "end": [-87.65678, 41.88286], "heuristic_weight": 1.5, "risk_weights": {"traffic": 0}}`},
+        {"x/y", routeRequest{}, http.MethodPost, `{"start_x": -87.66, "start_y": 41.87, "end_x": -87.65, "end_y": 41.88, "start": null}`},
+        {"integer as number", matrixRequest{}, http.MethodPost, `{"sources": [[-87, 41]], "destinations": [], "alpha": 1}`},
+        {"no body", routeRequest{}, http.MethodPost, ``},
+        {"GET", matrixRequest{}, http.MethodGet, `not even JSON`},
+        {"DELETE", hubRequest{}, http.MethodDelete, ``},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            w, read, called := validate(t, c.body, c.method, c.json)
+            if !called {
+                t.Fatalf("rejected with %d: %s", w.Code, w.Body)
+            }
+            if read != c.json {
+                t.Errorf("handler read %q, want the body unchanged", read)
+            }
+        })
+    }
+}
+
+// TestSchemasPublished checks that /schemas publishes the schema the
+// route enforces.
+func TestSchemasPublished(t *testing.T) {
+    w := httptest.NewRecorder()
+    r := httptest.NewRequest(http.MethodGet, "/schemas/matrix", nil)
+    r.SetPathValue("name", "matrix")
+    handleSchemas(w, r)
+    want, err := json.Marshal(schemaOf(matrixRequest{}))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := bytes.TrimSpace(w.Body.Bytes()); !bytes.Equal(got, want) {
+        t.Errorf("status %d, published %s\nwant %s", w.Code, got, want)
+    }
+
+    w = httptest.NewRecorder()
+    r = httptest.NewRequest(http.MethodGet, "/schemas/nope", nil)
+    r.SetPathValue("name", "nope")
+    handleSchemas(w, r)
+    if w.Code != http.StatusNotFound {
+        t.Errorf("unknown schema: status %d", w.Code)
+    }
+}
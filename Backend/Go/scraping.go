@@ -0,0 +1,286 @@
+package main
+
+import (
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "hash/fnv"
+    "log"
+    "math"
+    "net"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// The actions taken on a suspected scraper.
+const (
+    scrapeFlag     = "flag"
+    scrapeThrottle = "throttle"
+)
+
+// ScrapingConfig sets the heuristics that suspect a client of scanning the
+// city, most likely to copy the risk model: asking routes between more
+// than MaxDistinctPairs distinct start and end pairs in WindowSeconds,
+// with starts spread over at least MinOriginCells cells of CellM meters,
+// so a client asking many routes in one neighbourhood is not suspected.
+type ScrapingConfig struct {
+    // MaxDistinctPairs is 0 to turn detection off.
+    MaxDistinctPairs int     `json:"max_distinct_pairs"`
+    WindowSeconds    int     `json:"window_seconds"`
+    MinOriginCells   int     `json:"min_origin_cells"`
+    CellM            float64 `json:"cell_m"`
+    // Action is "flag", which only reports suspects, or "throttle", which
+    // also refuses their route requests for ThrottleSeconds.
+    Action          string `json:"action"`
+    ThrottleSeconds int    `json:"throttle_seconds"`
+    // Exempt are the CIDRs (or addresses) of clients never suspected,
+    // such as the operator's own batch jobs.
+    Exempt []string `json:"exempt"`
+}
+
+func defaultScrapingConfig() ScrapingConfig {
+    return ScrapingConfig{
+        MaxDistinctPairs: 1000,
+        WindowSeconds:    60,
+        MinOriginCells:   50,
+        CellM:            500,
+        Action:           scrapeFlag,
+        ThrottleSeconds:  600,
+    }
+}
+
+func (c ScrapingConfig) validate() error {
+    if c.MaxDistinctPairs < 0 {
+        return fmt.Errorf("scraping.max_distinct_pairs must not be negative, got %d", c.MaxDistinctPairs)
+    }
+    if c.WindowSeconds <= 0 {
+        return fmt.Errorf("scraping.window_seconds must be positive, got %d", c.WindowSeconds)
+    }
+    if c.MinOriginCells < 0 {
+        return fmt.Errorf("scraping.min_origin_cells must not be negative, got %d", c.MinOriginCells)
+    }
+    if c.CellM <= 0 {
+        return fmt.Errorf("scraping.cell_m must be positive, got %v", c.CellM)
+    }
+    if c.Action != scrapeFlag && c.Action != scrapeThrottle {
+        return fmt.Errorf("scraping.action must be %q or %q, got %q", scrapeFlag, scrapeThrottle, c.Action)
+    }
+    if c.Action == scrapeThrottle && c.ThrottleSeconds <= 0 {
+        return fmt.Errorf("scraping.throttle_seconds must be positive, got %d", c.ThrottleSeconds)
+    }
+    if _, err := parseNets(c.Exempt); err != nil {
+        return fmt.Errorf("scraping.exempt %v", err)
+    }
+    return nil
+}
+
+const (
+    // maxScrapeClients bounds the clients tracked in a window; clients
+    // beyond it go unwatched until the next.
+    maxScrapeClients = 10000
+    // maxScrapeSuspects bounds the suspects reported, the least recently
+    // flagged making way for new ones.
+    maxScrapeSuspects = 1000
+)
+
+// scrapeClient is a client as the detector tells them apart: by address
+// within a tenant, since a tenant's clients share its API key.
+type scrapeClient struct {
+    tenant, addr string
+}
+
+// scrapeWindow is what a client asked for in the current window. Pairs
+// are kept hashed: telling them apart needs no coordinates.
+type scrapeWindow struct {
+    pairs   map[uint64]bool
+    origins map[[2]int32]bool
+    flagged bool
+}
+
+// scrapeSuspect is a client flagged in at least one window.
+type scrapeSuspect struct {
+    Tenant       string    `json:"tenant"`
+    Client       string    `json:"client"`
+    FirstFlagged time.Time `json:"first_flagged"`
+    LastFlagged  time.Time `json:"last_flagged"`
+    // Windows counts the windows the client was flagged in, and the peaks
+    // are the most it asked for in one of them.
+    Windows         int        `json:"windows"`
+    PeakPairs       int        `json:"peak_distinct_pairs"`
+    PeakOriginCells int        `json:"peak_origin_cells"`
+    ThrottledUntil  *time.Time `json:"throttled_until,omitempty"`
+    RefusedRequests int64      `json:"refused_requests"`
+}
+
+// scrapeDetector watches route requests for clients scanning the city. A
+// nil detector watches nothing.
+type scrapeDetector struct {
+    cfg    ScrapingConfig
+    exempt []*net.IPNet
+
+    mu          sync.Mutex
+    windowStart time.Time
+    windows     map[scrapeClient]*scrapeWindow
+    suspects    map[scrapeClient]*scrapeSuspect
+}
+
+var globalScrapers *scrapeDetector
+
+// newScrapeDetector returns nil when detection is off.
+func newScrapeDetector(cfg ScrapingConfig) (*scrapeDetector, error) {
+    if cfg.MaxDistinctPairs <= 0 {
+        return nil, nil
+    }
+    exempt, err := parseNets(cfg.Exempt)
+    if err != nil {
+        return nil, fmt.Errorf("scraping.exempt %v", err)
+    }
+    return &scrapeDetector{
+        cfg:      cfg,
+        exempt:   exempt,
+        windows:  make(map[scrapeClient]*scrapeWindow),
+        suspects: make(map[scrapeClient]*scrapeSuspect),
+    }, nil
+}
+
+// observe counts a route request of client between start and end, and
+// reports until when the client's requests are refused, if they are.
+func (d *scrapeDetector) observe(tenant, addr string, start, end Point, now time.Time) (time.Time, bool) {
+    if d == nil {
+        return time.Time{}, false
+    }
+    if ip := net.ParseIP(addr); ip != nil && containsIP(d.exempt, ip) {
+        return time.Time{}, false
+    }
+    c := scrapeClient{tenant, addr}
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    if s, ok := d.suspects[c]; ok && s.ThrottledUntil != nil && now.Before(*s.ThrottledUntil) {
+        s.RefusedRequests++
+        return *s.ThrottledUntil, true
+    }
+    window := time.Duration(d.cfg.WindowSeconds) * time.Second
+    if now.Sub(d.windowStart) >= window {
+        d.windowStart = now.Truncate(window)
+        d.windows = make(map[scrapeClient]*scrapeWindow)
+    }
+    w, ok := d.windows[c]
+    if !ok {
+        if len(d.windows) >= maxScrapeClients {
+            return time.Time{}, false
+        }
+        w = &scrapeWindow{pairs: make(map[uint64]bool), origins: make(map[[2]int32]bool)}
+        d.windows[c] = w
+    }
+    // Past ten times the threshold the counts say nothing more.
+    if len(w.pairs) < 10*d.cfg.MaxDistinctPairs {
+        w.pairs[pairHash(start, end)] = true
+        w.origins[gridCell(start, d.cfg.CellM)] = true
+    }
+    if len(w.pairs) <= d.cfg.MaxDistinctPairs || len(w.origins) < d.cfg.MinOriginCells {
+        return time.Time{}, false
+    }
+    s := d.flag(c, w, now)
+    if d.cfg.Action != scrapeThrottle {
+        return time.Time{}, false
+    }
+    if s.ThrottledUntil == nil || !now.Before(*s.ThrottledUntil) {
+        until := now.Add(time.Duration(d.cfg.ThrottleSeconds) * time.Second)
+        s.ThrottledUntil = &until
+    }
+    s.RefusedRequests++
+    return *s.ThrottledUntil, true
+}
+
+func pairHash(start, end Point) uint64 {
+    h := fnv.New64a()
+    var b [8]byte
+    for _, v := range [4]float64{start.X, start.Y, end.X, end.Y} {
+        binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+        h.Write(b[:])
+    }
+    return h.Sum64()
+}
+
+// flag records that c went over the thresholds in the current window.
+func (d *scrapeDetector) flag(c scrapeClient, w *scrapeWindow, now time.Time) *scrapeSuspect {
+    s, ok := d.suspects[c]
+    if !ok {
+        if len(d.suspects) >= maxScrapeSuspects {
+            d.evictSuspect()
+        }
+        s = &scrapeSuspect{Tenant: c.tenant, Client: c.addr, FirstFlagged: now}
+        d.suspects[c] = s
+    }
+    s.LastFlagged = now
+    s.PeakPairs = max(s.PeakPairs, len(w.pairs))
+    s.PeakOriginCells = max(s.PeakOriginCells, len(w.origins))
+    if !w.flagged {
+        w.flagged = true
+        s.Windows++
+        reportWarning(map[string]string{"component": "scraping", "tenant": c.tenant},
+            "client %s asked for routes between %d distinct pairs from %d cells within %d s; suspected of scraping (%s)",
+            c.addr, len(w.pairs), len(w.origins), d.cfg.WindowSeconds, d.cfg.Action)
+    }
+    return s
+}
+
+func (d *scrapeDetector) evictSuspect() {
+    var oldest scrapeClient
+    var oldestAt time.Time
+    for c, s := range d.suspects {
+        if oldestAt.IsZero() || s.LastFlagged.Before(oldestAt) {
+            oldest, oldestAt = c, s.LastFlagged
+        }
+    }
+    delete(d.suspects, oldest)
+}
+
+// report returns the suspects, most recently flagged first.
+func (d *scrapeDetector) report() []scrapeSuspect {
+    if d == nil {
+        return []scrapeSuspect{}
+    }
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    report := make([]scrapeSuspect, 0, len(d.suspects))
+    for _, s := range d.suspects {
+        entry := *s
+        if entry.ThrottledUntil != nil {
+            until := *entry.ThrottledUntil
+            entry.ThrottledUntil = &until
+        }
+        report = append(report, entry)
+    }
+    sort.Slice(report, func(i, j int) bool { return report[i].LastFlagged.After(report[j].LastFlagged) })
+    return report
+}
+
+// writeScraping refuses a request of a client throttled until until.
+func writeScraping(w http.ResponseWriter, until, now time.Time) {
+    retry := int(math.Ceil(until.Sub(now).Seconds()))
+    w.Header().Set("Retry-After", strconv.Itoa(retry))
+    writeAPIError(w, http.StatusTooManyRequests, APIError{
+        Code:    "scraping_suspected",
+        Message: "too many distinct routes across the city were requested; try again later",
+        Details: map[string]interface{}{"retry_after_seconds": retry},
+    })
+}
+
+// handleAdminScrapers serves GET /admin/scrapers, the clients suspected
+// of scraping and the heuristics they were caught by.
+func handleAdminScrapers(w http.ResponseWriter, r *http.Request) {
+    response := struct {
+        Enabled  bool            `json:"enabled"`
+        Config   ScrapingConfig  `json:"config"`
+        Suspects []scrapeSuspect `json:"suspects"`
+    }{globalScrapers != nil, globalConfig.Scraping, globalScrapers.report()}
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode scrapers: %v", err)
+    }
+}
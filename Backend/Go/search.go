@@ -0,0 +1,219 @@
+package main
+
+import (
+    "math"
+    "sync"
+)
+
+// heapArity is the fan-out of nodeHeap. A 4-ary heap halves the depth of a
+// binary one and keeps each node's children in one or two cache lines.
+const heapArity = 4
+
+// cancelCheckInterval is how many node expansions findPath makes between
+// checks of its context.
+const cancelCheckInterval = 256
+
+// nodeHeap is an indexed 4-ary min-heap of node IDs ordered by priority,
+// ties broken by ID so searches are deterministic. pos maps each node ID to
+// its slot in the heap (or -1), so a node is queued at most once and an
+// improved cost is applied in place with decrease-key.
+type nodeHeap struct {
+    ids  []int32
+    prio []float64
+    pos  []int32
+}
+
+func newNodeHeap(n int) nodeHeap {
+    pos := make([]int32, n)
+    for i := range pos {
+        pos[i] = -1
+    }
+    return nodeHeap{pos: pos}
+}
+
+func (h *nodeHeap) Len() int { return len(h.ids) }
+
+func (h *nodeHeap) less(i, j int) bool {
+    if h.prio[i] != h.prio[j] {
+        return h.prio[i] < h.prio[j]
+    }
+    return h.ids[i] < h.ids[j]
+}
+
+func (h *nodeHeap) swap(i, j int) {
+    h.ids[i], h.ids[j] = h.ids[j], h.ids[i]
+    h.prio[i], h.prio[j] = h.prio[j], h.prio[i]
+    h.pos[h.ids[i]] = int32(i)
+    h.pos[h.ids[j]] = int32(j)
+}
+
+// push queues id with priority p, or lowers its priority if it is already
+// queued with a higher one.
+func (h *nodeHeap) push(id int32, p float64) {
+    if i := h.pos[id]; i >= 0 {
+        if p < h.prio[i] {
+            h.prio[i] = p
+            h.up(int(i))
+        }
+        return
+    }
+    h.ids = append(h.ids, id)
+    h.prio = append(h.prio, p)
+    h.pos[id] = int32(len(h.ids) - 1)
+    h.up(len(h.ids) - 1)
+}
+
+// pop removes and returns the node with the lowest priority.
+func (h *nodeHeap) pop() int32 {
+    last := len(h.ids) - 1
+    h.swap(0, last)
+    id := h.ids[last]
+    h.ids = h.ids[:last]
+    h.prio = h.prio[:last]
+    h.pos[id] = -1
+    h.down(0)
+    return id
+}
+
+func (h *nodeHeap) up(i int) {
+    for i > 0 {
+        parent := (i - 1) / heapArity
+        if !h.less(i, parent) {
+            return
+        }
+        h.swap(i, parent)
+        i = parent
+    }
+}
+
+func (h *nodeHeap) down(i int) {
+    n := len(h.ids)
+    for {
+        first := i*heapArity + 1
+        if first >= n {
+            return
+        }
+        best := first
+        for c := first + 1; c < first+heapArity && c < n; c++ {
+            if h.less(c, best) {
+                best = c
+            }
+        }
+        if !h.less(best, i) {
+            return
+        }
+        h.swap(i, best)
+        i = best
+    }
+}
+
+// clear empties the heap, leaving pos ready for the next search.
+func (h *nodeHeap) clear() {
+    for _, id := range h.ids {
+        h.pos[id] = -1
+    }
+    h.ids = h.ids[:0]
+    h.prio = h.prio[:0]
+}
+
+// searchState is the per-search scratch space of findPath, sized to the
+// graph and recycled through a pool so a search allocates nothing up front.
+type searchState struct {
+    frontier nodeHeap
+    // cost is the best known cost to each node, +Inf if unreached.
+    cost []float64
+    // cameFrom is the edge each reached node was reached by, -1 if none.
+    cameFrom []int32
+    // touched lists the nodes whose cost was set, for reset.
+    touched []int32
+}
+
+func newSearchState(n int) *searchState {
+    s := &searchState{
+        frontier: newNodeHeap(n),
+        cost:     make([]float64, n),
+        cameFrom: make([]int32, n),
+    }
+    for i := range s.cost {
+        s.cost[i] = math.Inf(1)
+        s.cameFrom[i] = -1
+    }
+    return s
+}
+
+// relax records cost c reaching id by edge e.
+func (s *searchState) relax(id int32, c float64, e int32) {
+    if math.IsInf(s.cost[id], 1) {
+        s.touched = append(s.touched, id)
+    }
+    s.cost[id] = c
+    s.cameFrom[id] = e
+}
+
+func (s *searchState) reset() {
+    s.frontier.clear()
+    for _, id := range s.touched {
+        s.cost[id] = math.Inf(1)
+        s.cameFrom[id] = -1
+    }
+    s.touched = s.touched[:0]
+}
+
+// searchPool hands out searchStates sized to one graph.
+type searchPool struct {
+    pool sync.Pool
+}
+
+func newSearchPool(nodes int) *searchPool {
+    return &searchPool{pool: sync.Pool{
+        New: func() any { return newSearchState(nodes) },
+    }}
+}
+
+func (p *searchPool) get() *searchState { return p.pool.Get().(*searchState) }
+
+func (p *searchPool) put(s *searchState) {
+    s.reset()
+    p.pool.Put(s)
+}
+
+// growBackward runs Dijkstra from root over reversed edges, skipping closed
+// ones. Afterwards s holds every node's cost to reach root and, in
+// cameFrom, the first edge of its shortest path there.
+func growBackward(g *Graph, s *searchState, root int32, weights []float64, reverse []int32, closed *closureSet) {
+    s.relax(root, 0, -1)
+    s.frontier.push(root, 0)
+    for s.frontier.Len() > 0 {
+        v := s.frontier.pop()
+        lo, hi := g.edgeRange(v)
+        for e := lo; e < hi; e++ {
+            // u reaches v over in, the opposite of e.
+            in := reverse[e]
+            if in < 0 || closed.closed(in) {
+                continue
+            }
+            u := g.targets[e]
+            if c := s.cost[v] + weights[in]; c < s.cost[u] {
+                s.relax(u, c, in)
+                s.frontier.push(u, c)
+            }
+        }
+    }
+}
+
+// reverseEdges maps each edge u->v to its twin v->u, or -1. It is built
+// on first use.
+func (r *RiskAwareRouter) reverseEdges() []int32 {
+    r.reverseOnce.Do(func() {
+        g := r.G
+        reverse := make([]int32, len(g.targets))
+        for e := range reverse {
+            reverse[e] = -1
+            if back, ok := g.twin(int32(e)); ok {
+                reverse[e] = back
+            }
+        }
+        r.reverse = reverse
+    })
+    return r.reverse
+}
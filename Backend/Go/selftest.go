@@ -0,0 +1,220 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "slices"
+    "strings"
+    "time"
+)
+
+// CanaryConfig is a route the self-test at /admin/selftest expects the
+// router to answer, between points in degrees.
+type CanaryConfig struct {
+    Name string `json:"name"`
+    // Tenant is the tenant asked; the default one without tenants.
+    Tenant string     `json:"tenant"`
+    Start  Coordinate `json:"start"`
+    End    Coordinate `json:"end"`
+    // Alphas are the risk weights searched, the tenant's by default.
+    Alphas []float64 `json:"alphas"`
+    // DistanceM, when set, is the expected length of the shortest route,
+    // which may be off by up to TolerancePct percent.
+    DistanceM    float64 `json:"distance_m"`
+    TolerancePct float64 `json:"tolerance_pct"`
+}
+
+func checkCanaries(canaries []CanaryConfig, tenants []TenantConfig) error {
+    ids := map[string]bool{}
+    for _, t := range tenants {
+        ids[t.ID] = true
+    }
+    names := map[string]bool{}
+    for i, c := range canaries {
+        if c.Name == "" {
+            return fmt.Errorf("canaries[%d]: name must be set", i)
+        }
+        if names[c.Name] {
+            return fmt.Errorf("canaries: %q is named twice", c.Name)
+        }
+        names[c.Name] = true
+        switch {
+        case len(tenants) == 0 && c.Tenant != "" && c.Tenant != defaultTenantID:
+            return fmt.Errorf("canary %s: tenant %q is not configured", c.Name, c.Tenant)
+        case len(tenants) > 0 && !ids[c.Tenant]:
+            return fmt.Errorf("canary %s: tenant %q is not configured", c.Name, c.Tenant)
+        }
+        if c.DistanceM < 0 || c.TolerancePct < 0 {
+            return fmt.Errorf("canary %s: distance_m and tolerance_pct must not be negative", c.Name)
+        }
+        for _, a := range c.Alphas {
+            if a < 0 || a > 1 {
+                return fmt.Errorf("canary %s: alphas must be within [0, 1], got %v", c.Name, a)
+            }
+        }
+    }
+    return nil
+}
+
+// canaryTimeout bounds the searches of one canary.
+const canaryTimeout = 30 * time.Second
+
+// canaryCheck is one property asserted of a canary's routes.
+type canaryCheck struct {
+    Name    string `json:"name"`
+    Passed  bool   `json:"passed"`
+    Message string `json:"message,omitempty"`
+}
+
+type canaryRoute struct {
+    Alpha     float64 `json:"alpha"`
+    DistanceM float64 `json:"distance_m"`
+    Risk      float64 `json:"risk"`
+}
+
+type canaryResult struct {
+    Name   string        `json:"name"`
+    Tenant string        `json:"tenant"`
+    Passed bool          `json:"passed"`
+    Checks []canaryCheck `json:"checks"`
+    Routes []canaryRoute `json:"routes,omitempty"`
+    MS     float64       `json:"ms"`
+}
+
+// runCanary searches c's routes as a route request would, with the risk
+// the search weighs rather than any configured aggregation, and checks them:
+// that every alpha finds one, that the shortest is as long as expected,
+// and that raising alpha never makes a route riskier nor shorter.
+func runCanary(ctx context.Context, c CanaryConfig) (result canaryResult) {
+    began := time.Now()
+    result = canaryResult{Name: c.Name, Tenant: c.Tenant}
+    if result.Tenant == "" {
+        result.Tenant = defaultTenantID
+    }
+    check := func(name string, err error) {
+        ch := canaryCheck{Name: name, Passed: err == nil}
+        if err != nil {
+            ch.Message = err.Error()
+        }
+        result.Checks = append(result.Checks, ch)
+    }
+    defer func() {
+        result.Passed = true
+        for _, ch := range result.Checks {
+            result.Passed = result.Passed && ch.Passed
+        }
+        result.MS = msSince(began)
+    }()
+
+    tenant, err := tenantByID(result.Tenant)
+    if err != nil {
+        check("solvable", err)
+        return result
+    }
+    alphas := c.Alphas
+    if len(alphas) == 0 {
+        alphas = tenant.Alphas
+    }
+    alphas = referenceAlphas(alphas)
+    slices.Sort(alphas)
+    routes, err := canaryRoutes(ctx, tenant.Router(), c, alphas)
+    if err == nil && len(routes) < len(alphas) {
+        err = fmt.Errorf("found routes for %d of %d alphas", len(routes), len(alphas))
+    }
+    check("solvable", err)
+    if err != nil {
+        return result
+    }
+    for _, rt := range routes {
+        result.Routes = append(result.Routes, canaryRoute{Alpha: rt.Alpha, DistanceM: rt.Summary.LengthM, Risk: rt.Risk})
+    }
+
+    if c.DistanceM > 0 {
+        var err error
+        got := routes[0].Summary.LengthM
+        if off := math.Abs(got-c.DistanceM) / c.DistanceM * 100; off > c.TolerancePct {
+            err = fmt.Errorf("shortest route is %.0f m, %.1f%% off the expected %.0f m (tolerance %v%%)", got, off, c.DistanceM, c.TolerancePct)
+        }
+        check("distance", err)
+    }
+    check("risk_monotonic", monotonicRisk(routes))
+    return result
+}
+
+func canaryRoutes(ctx context.Context, router *RiskAwareRouter, c CanaryConfig, alphas []float64) ([]Route, error) {
+    ctx, cancel := context.WithTimeout(ctx, canaryTimeout)
+    defer cancel()
+    start, err := router.snapChecked(c.Start.point(), "start", false)
+    if err != nil {
+        return nil, err
+    }
+    end, err := router.snapChecked(c.End.point(), "end", false)
+    if err != nil {
+        return nil, err
+    }
+    params := routeParams{
+        HeuristicWeight: globalConfig.HeuristicWeight,
+        EllipseFactor:   globalConfig.SearchEllipseFactor,
+        ArcFlags:        true,
+    }
+    routes, _, err := router.routesBetween(ctx, start, end, alphas, params)
+    if errors.Is(err, errNotConnected) {
+        return nil, errors.New("start and end are not connected")
+    }
+    return routes, err
+}
+
+// monotonicEpsilon absorbs floating-point noise between costs that are
+// equal.
+const monotonicEpsilon = 1e-9
+
+// monotonicRisk checks that routes, by rising alpha, get no riskier and
+// no shorter: weighing risk more should only trade distance for safety.
+func monotonicRisk(routes []Route) error {
+    for i := 1; i < len(routes); i++ {
+        prev, cur := routes[i-1], routes[i]
+        if cur.Risk > prev.Risk*(1+monotonicEpsilon)+monotonicEpsilon {
+            return fmt.Errorf("alpha %v route is riskier than alpha %v's: %.4g > %.4g", cur.Alpha, prev.Alpha, cur.Risk, prev.Risk)
+        }
+        if cur.Distance < prev.Distance*(1-monotonicEpsilon)-monotonicEpsilon {
+            return fmt.Errorf("alpha %v route is shorter than alpha %v's: %.0f m < %.0f m", cur.Alpha, prev.Alpha, cur.Summary.LengthM, prev.Summary.LengthM)
+        }
+    }
+    return nil
+}
+
+// handleAdminSelftest serves GET /admin/selftest, which runs the
+// configured canary routes and reports which of their checks passed. It
+// answers 503 when any failed, so uptime checks need only the status.
+func handleAdminSelftest(w http.ResponseWriter, r *http.Request) {
+    response := struct {
+        Passed   bool           `json:"passed"`
+        Time     time.Time      `json:"time"`
+        Canaries []canaryResult `json:"canaries"`
+    }{Passed: true, Time: time.Now().UTC(), Canaries: []canaryResult{}}
+    var failed []string
+    for _, c := range globalConfig.Canaries {
+        result := runCanary(r.Context(), c)
+        if !result.Passed {
+            response.Passed = false
+            failed = append(failed, c.Name)
+        }
+        response.Canaries = append(response.Canaries, result)
+    }
+    if !response.Passed {
+        reportWarning(map[string]string{"component": "selftest"}, "self-test failed for canaries %s", strings.Join(failed, ", "))
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    if !response.Passed {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode self-test: %v", err)
+    }
+}
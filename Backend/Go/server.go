@@ -0,0 +1,128 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// shutdownGrace is how long in-flight requests, then background jobs and
+// queued recordings and error reports, get to finish once the process is
+// asked to stop.
+const shutdownGrace = 30 * time.Second
+
+// writeSlack is how long past the longest route timeout a server still
+// writes, for the answer or error a handler sends once its time is up.
+const writeSlack = 30 * time.Second
+
+// writeTimeout is the write deadline for a server mounting groups, which
+// must not cut off a route before its own timeout does.
+func writeTimeout(groups []routeGroup) time.Duration {
+    longest := defaultRouteTimeout
+    for _, g := range groups {
+        for _, rt := range g.Routes {
+            longest = max(longest, rt.Timeout)
+        }
+    }
+    return longest + writeSlack
+}
+
+// newServers builds the listeners for cfg: one serving every endpoint, or,
+// with an admin port, a public one and an admin one. Each has its own
+// handler stack and timeouts, behind the same IP filter; admin requests such as crime imports stream
+// large bodies and run for minutes. A server's write deadline outlasts the
+// longest route timeout it serves.
+func newServers(cfg Config, filter *ipFilter) []*http.Server {
+    logger := newAccessLogger(cfg.AccessLogFormat, cfg.AccessLogSampleRate)
+
+    groups := apiRoutes()
+    if cfg.AdminPort != "" {
+        groups = []routeGroup{publicRoutes()}
+    }
+    public := http.NewServeMux()
+    registerRoutes(public, groups)
+    servers := []*http.Server{{
+        Addr:         ":" + cfg.Port,
+        Handler:      withOpsStats(globalOps, withAccessLog(logger, withRecovery(withIPFilter(filter, public)))),
+        ReadTimeout:  30 * time.Second,
+        WriteTimeout: writeTimeout(groups),
+        IdleTimeout:  60 * time.Second,
+    }}
+
+    if cfg.AdminPort != "" {
+        admin := http.NewServeMux()
+        adminGroups := []routeGroup{adminRoutes()}
+        registerRoutes(admin, adminGroups)
+        servers = append(servers, &http.Server{
+            Addr:              ":" + cfg.AdminPort,
+            Handler:           withOpsStats(globalOps, withAccessLog(logger, withRecovery(withIPFilter(filter, admin)))),
+            ReadHeaderTimeout: 10 * time.Second,
+            WriteTimeout:      writeTimeout(adminGroups),
+            IdleTimeout:       60 * time.Second,
+        })
+    }
+    return servers
+}
+
+// serve runs servers until one fails or ctx is cancelled, then shuts them
+// all down, letting in-flight requests finish within shutdownGrace. Only
+// then does it drain: background jobs are refused and waited for, and the
+// recorder and error reporter write out what they have queued, within
+// what is left of the grace period.
+func serve(ctx context.Context, servers []*http.Server) error {
+    errs := make(chan error, len(servers))
+    for i, s := range servers {
+        name := "public"
+        if i > 0 {
+            name = "admin"
+        }
+        log.Printf("Server starting on port %s (%s)", s.Addr[1:], name)
+        go func() {
+            if err := s.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+                errs <- err
+            }
+        }()
+    }
+
+    var err error
+    select {
+    case <-ctx.Done():
+        log.Printf("Shutting down")
+    case err = <-errs:
+    }
+
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+    defer cancel()
+    for _, s := range servers {
+        if shutdownErr := s.Shutdown(shutdownCtx); shutdownErr != nil {
+            log.Printf("Shutdown of %s: %v", s.Addr, shutdownErr)
+        }
+    }
+    drain(shutdownCtx)
+    return err
+}
+
+// drain stops the work that outlives requests. Servers must already be
+// shut down, so nothing new is queued behind it.
+func drain(ctx context.Context) {
+    if left := globalJobs.drain(ctx); len(left) > 0 {
+        log.Printf("Shutdown: gave up waiting for background jobs: %s", strings.Join(left, ", "))
+    }
+    if globalRecorder != nil {
+        if err := globalRecorder.close(ctx); err != nil {
+            log.Printf("Shutdown: %v", err)
+        }
+    }
+    if s, ok := globalReporter.(*sentryReporter); ok {
+        if err := s.close(ctx); err != nil {
+            log.Printf("Shutdown: %v", err)
+        }
+    }
+    if err := globalStorage.close(); err != nil {
+        log.Printf("Shutdown: %v", err)
+    }
+    log.Printf("Shutdown complete")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+// TestServerWriteTimeouts checks that the server serving a route does not
+// cut off its answer before the route's own timeout, on one port or with
+// an admin port.
+func TestServerWriteTimeouts(t *testing.T) {
+    timeouts := map[string]time.Duration{}
+    for _, g := range apiRoutes() {
+        for _, rt := range g.Routes {
+            timeouts[rt.Pattern] = max(rt.Timeout, defaultRouteTimeout)
+        }
+    }
+    cases := []struct {
+        pattern   string
+        adminPort bool
+    }{
+        {"/admin/graph/reload", true},
+        {"/admin/graph/reload", false},
+        {"/admin/crime/import", false},
+        {"/route", true},
+        {"/route/stops", false},
+        {"/route/stops", true},
+        {"/safety/batch", false},
+        {"/safety/batch", true},
+        {"/matrix", false},
+        {"/matrix", true},
+    }
+    for _, c := range cases {
+        timeout, ok := timeouts[c.pattern]
+        if !ok {
+            t.Fatalf("no route %s", c.pattern)
+        }
+        cfg := Config{Port: "8080"}
+        if c.adminPort {
+            cfg.AdminPort = "8081"
+        }
+        servers := newServers(cfg, nil)
+        server := servers[0]
+        if c.adminPort && strings.HasPrefix(c.pattern, "/admin/") {
+            server = servers[1]
+        }
+        if server.WriteTimeout <= timeout {
+            t.Errorf("%s (admin port %v): write timeout %v, route timeout %v", c.pattern, c.adminPort, server.WriteTimeout, timeout)
+        }
+    }
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "log"
+    "net/http"
+    "sync/atomic"
+    "time"
+)
+
+// maxShadowInFlight bounds concurrent shadow requests; copies beyond it are
+// dropped so a slow candidate cannot build up load on the primary.
+const maxShadowInFlight = 32
+
+// shadowForwarder mirrors requests to a candidate instance and compares
+// its responses with the ones served, off the request path.
+type shadowForwarder struct {
+    target   string
+    client   *http.Client
+    inFlight chan struct{}
+    metrics  shadowMetrics
+}
+
+type shadowMetrics struct {
+    sent     atomic.Int64
+    matched  atomic.Int64
+    diverged atomic.Int64
+    failed   atomic.Int64
+    dropped  atomic.Int64
+}
+
+type shadowMetricsSnapshot struct {
+    Target   string `json:"target"`
+    Sent     int64  `json:"sent"`
+    Matched  int64  `json:"matched"`
+    Diverged int64  `json:"diverged"`
+    Failed   int64  `json:"failed"`
+    Dropped  int64  `json:"dropped"`
+}
+
+var globalShadow *shadowForwarder
+
+// newShadowForwarder returns nil when no candidate is configured.
+func newShadowForwarder(target string) *shadowForwarder {
+    if target == "" {
+        return nil
+    }
+    return &shadowForwarder{
+        target:   target,
+        client:   &http.Client{Timeout: 30 * time.Second},
+        inFlight: make(chan struct{}, maxShadowInFlight),
+    }
+}
+
+// captureWriter keeps a copy of the response body alongside the status.
+type captureWriter struct {
+    *statusRecorder
+    body bytes.Buffer
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+    c.body.Write(b)
+    return c.statusRecorder.Write(b)
+}
+
+// withShadow serves the request as usual, then replays it against the
+// shadow candidate in the background and compares the two responses.
+func withShadow(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        shadow := globalShadow
+        if shadow == nil || r.Method == http.MethodOptions {
+            handler(w, r)
+            return
+        }
+
+        body, err := io.ReadAll(r.Body)
+        if err != nil {
+            writeBadRequest(w, err.Error())
+            return
+        }
+        r.Body = io.NopCloser(bytes.NewReader(body))
+
+        cw := &captureWriter{statusRecorder: newStatusRecorder(w)}
+        handler(cw, r)
+
+        select {
+        case shadow.inFlight <- struct{}{}:
+        default:
+            shadow.metrics.dropped.Add(1)
+            return
+        }
+        req, err := http.NewRequest(r.Method, shadow.target+r.URL.RequestURI(), bytes.NewReader(body))
+        if err != nil {
+            <-shadow.inFlight
+            shadow.metrics.failed.Add(1)
+            return
+        }
+        // The candidate authenticates a signed request as this instance
+        // did; its nonce cache is its own, so the nonce is fresh there.
+        for _, h := range []string{
+            "Content-Type", "Authorization", "X-API-Key",
+            hmacKeyIDHeader, hmacTimestampHeader, hmacNonceHeader, hmacSignatureHeader,
+        } {
+            if v := r.Header.Get(h); v != "" {
+                req.Header.Set(h, v)
+            }
+        }
+        status, respBody := cw.status, cw.body.Bytes()
+        if !globalJobs.goJob("shadow.compare", noRestart, func() { shadow.compare(req, status, respBody) }) {
+            <-shadow.inFlight
+        }
+    }
+}
+
+func (s *shadowForwarder) compare(req *http.Request, status int, body []byte) {
+    defer func() { <-s.inFlight }()
+    s.metrics.sent.Add(1)
+
+    resp, err := s.client.Do(req)
+    if err != nil {
+        s.metrics.failed.Add(1)
+        return
+    }
+    defer resp.Body.Close()
+    candidate, err := io.ReadAll(resp.Body)
+    if err != nil {
+        s.metrics.failed.Add(1)
+        return
+    }
+
+    if resp.StatusCode == status && sameJSON(body, candidate) {
+        s.metrics.matched.Add(1)
+        return
+    }
+    s.metrics.diverged.Add(1)
+    log.Printf("Shadow divergence on %s %s: primary %d, candidate %d", req.Method, req.URL.Path, status, resp.StatusCode)
+}
+
+// handleAdminShadow serves GET /admin/shadow with the comparison counters.
+func handleAdminShadow(w http.ResponseWriter, r *http.Request) {
+    s := globalShadow
+    if s == nil {
+        writeAPIError(w, http.StatusNotFound, APIError{Code: "shadow_disabled", Message: "shadow mode is not configured"})
+        return
+    }
+
+    response := shadowMetricsSnapshot{
+        Target:   s.target,
+        Sent:     s.metrics.sent.Load(),
+        Matched:  s.metrics.matched.Load(),
+        Diverged: s.metrics.diverged.Load(),
+        Failed:   s.metrics.failed.Load(),
+        Dropped:  s.metrics.dropped.Load(),
+    }
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode shadow metrics: %v", err)
+    }
+}
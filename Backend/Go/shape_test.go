@@ -0,0 +1,74 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "math"
+    "os"
+    "path/filepath"
+    "slices"
+    "testing"
+)
+
+// TestRoutesKeepStreetShape routes along a curved street, from GeoJSON
+// and from the binary graph, and checks that the path passes through
+// every vertex of the street rather than cutting across the curve.
+func TestRoutesKeepStreetShape(t *testing.T) {
+    var curve []Point
+    for i := 0; i <= 12; i++ {
+        angle := math.Pi * float64(i) / 12
+        curve = append(curve, Point{X: -87.64 + 0.004*math.Cos(angle), Y: 41.88 + 0.004*math.Sin(angle)})
+    }
+    coordinates := make([][2]float64, len(curve))
+    for i, p := range curve {
+        coordinates[i] = [2]float64{p.X, p.Y}
+    }
+    geojson, err := json.Marshal(map[string]interface{}{
+        "type": "FeatureCollection",
+        "features": []interface{}{map[string]interface{}{
+            "type":       "Feature",
+            "properties": map[string]interface{}{"name": "Crescent Drive", "risk_score": 0.2},
+            "geometry":   map[string]interface{}{"type": "LineString", "coordinates": coordinates},
+        }},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    dir := t.TempDir()
+    geojsonPath := filepath.Join(dir, "crescent.geojson")
+    if err := os.WriteFile(geojsonPath, geojson, 0o644); err != nil {
+        t.Fatal(err)
+    }
+
+    graph := NewGraph()
+    if err := loadRoadNetwork(geojsonPath, graph, &chicagoBounds); err != nil {
+        t.Fatal(err)
+    }
+    graph.index()
+    binaryPath := filepath.Join(dir, "crescent.bin")
+    f, err := os.Create(binaryPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := graph.WriteBinary(f); err != nil {
+        t.Fatal(err)
+    }
+    f.Close()
+
+    for _, path := range []string{geojsonPath, binaryPath} {
+        router, err := NewRiskAwareRouter(path, &CrimeData{}, RouterOptions{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        routes, err := router.calculateRoutes(context.Background(), curve[0], curve[len(curve)-1], []float64{0, 1})
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, route := range routes {
+            if !slices.Equal(route.Path, curve) {
+                t.Errorf("%s, alpha %g: path %v, want every vertex of the street %v", filepath.Base(path), route.Alpha, route.Path, curve)
+            }
+        }
+        router.G.Close()
+    }
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math/big"
+    "net/http"
+)
+
+// ResponseSigningConfig signs route responses, so consumers making safety
+// decisions on them can tell they were not altered on the way. KeyFile is
+// the deployment's PKCS #8 PEM private key: P-256 (signing ES256), RSA
+// (RS256) or Ed25519 (EdDSA). KeyID names it in signatures and in the
+// key set at /.well-known/jwks.json.
+type ResponseSigningConfig struct {
+    KeyFile string `json:"key_file"`
+    KeyID   string `json:"key_id"`
+}
+
+func (c ResponseSigningConfig) validate() error {
+    if c.KeyFile != "" && c.KeyID == "" {
+        return errors.New("response_signing.key_file needs response_signing.key_id")
+    }
+    return nil
+}
+
+// signatureHeader carries the detached JWS of a response body.
+const signatureHeader = "X-JWS-Signature"
+
+// responseSigner makes detached JWS (RFC 7515 appendix F) over response
+// bodies, with the unencoded payload option of RFC 7797: the signed bytes
+// are the body exactly as sent.
+type responseSigner struct {
+    alg  string
+    kid  string
+    sign func(input []byte) ([]byte, error)
+    jwk  map[string]string
+    // protected is the encoded protected header, the same for every
+    // response.
+    protected string
+}
+
+var globalSigner *responseSigner
+
+// newResponseSigner returns nil when signing is not configured.
+func newResponseSigner(cfg ResponseSigningConfig) (*responseSigner, error) {
+    if cfg.KeyFile == "" {
+        return nil, nil
+    }
+    key, err := readPEMKey(cfg.KeyFile)
+    if err != nil {
+        return nil, fmt.Errorf("response_signing.key_file: %v", err)
+    }
+    s := &responseSigner{kid: cfg.KeyID}
+    switch key := key.(type) {
+    case *ecdsa.PrivateKey:
+        if key.Curve != elliptic.P256() {
+            return nil, errors.New("response_signing.key_file: EC keys must be on P-256")
+        }
+        s.alg = "ES256"
+        s.sign = func(input []byte) ([]byte, error) {
+            digest := sha256.Sum256(input)
+            r, sv, err := ecdsa.Sign(rand.Reader, key, digest[:])
+            if err != nil {
+                return nil, err
+            }
+            // JWS wants the fixed-size r || s, not ASN.1.
+            sig := make([]byte, 64)
+            r.FillBytes(sig[:32])
+            sv.FillBytes(sig[32:])
+            return sig, nil
+        }
+        x, y := make([]byte, 32), make([]byte, 32)
+        key.X.FillBytes(x)
+        key.Y.FillBytes(y)
+        s.jwk = map[string]string{"kty": "EC", "crv": "P-256", "x": b64(x), "y": b64(y)}
+    case *rsa.PrivateKey:
+        s.alg = "RS256"
+        s.sign = func(input []byte) ([]byte, error) {
+            digest := sha256.Sum256(input)
+            return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+        }
+        s.jwk = map[string]string{"kty": "RSA", "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+    case ed25519.PrivateKey:
+        s.alg = "EdDSA"
+        s.sign = func(input []byte) ([]byte, error) {
+            return ed25519.Sign(key, input), nil
+        }
+        s.jwk = map[string]string{"kty": "OKP", "crv": "Ed25519", "x": b64(key.Public().(ed25519.PublicKey))}
+    default:
+        return nil, fmt.Errorf("response_signing.key_file: unsupported key type %T", key)
+    }
+    s.jwk["kid"], s.jwk["alg"], s.jwk["use"] = s.kid, s.alg, "sig"
+
+    header, err := json.Marshal(map[string]interface{}{"alg": s.alg, "kid": s.kid, "b64": false, "crit": []string{"b64"}})
+    if err != nil {
+        return nil, err
+    }
+    s.protected = b64(header)
+    return s, nil
+}
+
+func b64(b []byte) string {
+    return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// detached returns the JWS over body with its payload left out:
+// "protected..signature". The signing input is the protected header, a
+// dot and the body's bytes.
+func (s *responseSigner) detached(body []byte) (string, error) {
+    input := make([]byte, 0, len(s.protected)+1+len(body))
+    input = append(append(append(input, s.protected...), '.'), body...)
+    sig, err := s.sign(input)
+    if err != nil {
+        return "", err
+    }
+    return s.protected + ".." + b64(sig), nil
+}
+
+// signResponse sets the signature header for body, which must be written
+// unchanged. Responses go out unsigned, with a warning, if signing fails.
+func signResponse(w http.ResponseWriter, body []byte) {
+    if globalSigner == nil {
+        return
+    }
+    jws, err := globalSigner.detached(body)
+    if err != nil {
+        reportWarning(map[string]string{"component": "signing"}, "signing a response: %v", err)
+        return
+    }
+    w.Header().Set(signatureHeader, jws)
+}
+
+// writeSignedJSON encodes v as the response body and signs it; what
+// names the response in the log should encoding fail.
+func writeSignedJSON(w http.ResponseWriter, v interface{}, what string) {
+    var body bytes.Buffer
+    if err := json.NewEncoder(&body).Encode(v); err != nil {
+        log.Printf("Failed to encode %s: %v", what, err)
+        writeAPIError(w, http.StatusInternalServerError, APIError{Code: "internal", Message: "failed to encode " + what})
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    signResponse(w, body.Bytes())
+    w.Write(body.Bytes())
+}
+
+// refuseUnsignedStream answers, and reports, a request for a stream when
+// responses are signed: a body written as it is computed cannot carry a
+// signature header over it.
+func refuseUnsignedStream(w http.ResponseWriter, r *http.Request) bool {
+    if globalSigner == nil || !wantsStream(r) {
+        return false
+    }
+    writeAPIError(w, http.StatusNotAcceptable, APIError{
+        Code:    "stream_unsigned",
+        Message: "responses are signed, which streamed responses cannot be; ask without stream=true or application/x-ndjson",
+    })
+    return true
+}
+
+// handleJWKS serves GET /.well-known/jwks.json, the public key responses
+// are signed with; the set is empty when they are not.
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+    keys := []map[string]string{}
+    if globalSigner != nil {
+        keys = append(keys, globalSigner.jwk)
+    }
+    w.Header().Set("Content-Type", "application/jwk-set+json")
+    w.Header().Set("Cache-Control", "public, max-age=3600")
+    if err := json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys}); err != nil {
+        log.Printf("Failed to encode key set: %v", err)
+    }
+}
+
+// signingAlg is the algorithm responses are signed with, if they are.
+func signingAlg() string {
+    if globalSigner == nil {
+        return ""
+    }
+    return globalSigner.alg
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "fmt"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// useSigner signs responses with key for the test's duration.
+func useSigner(t *testing.T, key interface{}) {
+    t.Helper()
+    der, err := x509.MarshalPKCS8PrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(t.TempDir(), "key.pem")
+    if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    signer, err := newResponseSigner(ResponseSigningConfig{KeyFile: path, KeyID: "test-key"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    saved := globalSigner
+    globalSigner = signer
+    t.Cleanup(func() { globalSigner = saved })
+}
+
+// verifyResponse checks the detached JWS of a response against the key
+// set /.well-known/jwks.json publishes, as a consumer would.
+func verifyResponse(t *testing.T, w *httptest.ResponseRecorder) {
+    t.Helper()
+    if w.Code != http.StatusOK {
+        t.Fatalf("status = %d: %s", w.Code, w.Body)
+    }
+    if err := verifySignature(w); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func verifySignature(w *httptest.ResponseRecorder) error {
+    jws := w.Header().Get(signatureHeader)
+    protected, sig, ok := strings.Cut(jws, "..")
+    if !ok {
+        return fmt.Errorf("%s = %q, want a detached JWS", signatureHeader, jws)
+    }
+    rawHeader, err := base64.RawURLEncoding.DecodeString(protected)
+    if err != nil {
+        return err
+    }
+    var header struct {
+        Alg  string   `json:"alg"`
+        Kid  string   `json:"kid"`
+        B64  *bool    `json:"b64"`
+        Crit []string `json:"crit"`
+    }
+    if err := json.Unmarshal(rawHeader, &header); err != nil {
+        return err
+    }
+    if header.B64 == nil || *header.B64 || len(header.Crit) != 1 || header.Crit[0] != "b64" {
+        return fmt.Errorf("protected header = %+v, want an unencoded payload", header)
+    }
+
+    keys := httptest.NewRecorder()
+    handleJWKS(keys, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+    var set struct {
+        Keys []map[string]string `json:"keys"`
+    }
+    if err := json.Unmarshal(keys.Body.Bytes(), &set); err != nil {
+        return err
+    }
+    var jwk map[string]string
+    for _, k := range set.Keys {
+        if k["kid"] == header.Kid {
+            jwk = k
+        }
+    }
+    if jwk == nil || jwk["alg"] != header.Alg {
+        return fmt.Errorf("no key %q for %s in %v", header.Kid, header.Alg, set.Keys)
+    }
+    field := func(name string) []byte {
+        b, _ := base64.RawURLEncoding.DecodeString(jwk[name])
+        return b
+    }
+
+    input := append([]byte(protected+"."), w.Body.Bytes()...)
+    signature, err := base64.RawURLEncoding.DecodeString(sig)
+    if err != nil {
+        return err
+    }
+    digest := sha256.Sum256(input)
+    var valid bool
+    switch header.Alg {
+    case "ES256":
+        pub := ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(field("x")), Y: new(big.Int).SetBytes(field("y"))}
+        valid = len(signature) == 64 &&
+            ecdsa.Verify(&pub, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+    case "RS256":
+        pub := rsa.PublicKey{N: new(big.Int).SetBytes(field("n")), E: int(new(big.Int).SetBytes(field("e")).Int64())}
+        valid = rsa.VerifyPKCS1v15(&pub, crypto.SHA256, digest[:], signature) == nil
+    case "EdDSA":
+        valid = ed25519.Verify(ed25519.PublicKey(field("x")), input, signature)
+    default:
+        return fmt.Errorf("unexpected alg %s", header.Alg)
+    }
+    if !valid {
+        return fmt.Errorf("%s signature does not verify against the published key", header.Alg)
+    }
+    return nil
+}
+
+func TestSignedResponseVerifies(t *testing.T) {
+    ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, edKey, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for name, key := range map[string]interface{}{"ES256": ecKey, "RS256": rsaKey, "EdDSA": edKey} {
+        t.Run(name, func(t *testing.T) {
+            useSigner(t, key)
+            w := httptest.NewRecorder()
+            writeSignedJSON(w, map[string]float64{"risk": 0.25}, "test")
+            verifyResponse(t, w)
+
+            // A changed body no longer verifies.
+            tampered := httptest.NewRecorder()
+            writeSignedJSON(tampered, map[string]float64{"risk": 0.25}, "test")
+            tampered.Body.Reset()
+            tampered.Body.WriteString(`{"risk":0.01}` + "\n")
+            if verifySignature(tampered) == nil {
+                t.Error("a tampered body verified")
+            }
+        })
+    }
+}
+
+// TestRouteResponsesSigned checks that every endpoint answering routes
+// signs them.
+func TestRouteResponsesSigned(t *testing.T) {
+    tenant := fixtureTenant(t)
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    useSigner(t, key)
+
+    cases := []struct {
+        name    string
+        handler http.HandlerFunc
+        target  string
+        body    string
+    }{
+        {"route", handleRouteRequest, "/route",
+            `{"start": {"lat": 41.87, "lon": -87.66}, "end": {"lat": 41.88286, "lon": -87.65678}}`},
+        {"matrix", handleMatrix, "/matrix",
+            `{"sources": [[-87.66, 41.87]], "destinations": [[-87.65678, 41.88286], [-87.65967, 41.87286]]}`},
+        {"stops", handleStops, "/route/stops",
+            `{"stops": [{"lat": 41.87, "lon": -87.66}, {"lat": 41.88286, "lon": -87.65678}, {"lat": 41.87286, "lon": -87.65967}]}`},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            w := httptest.NewRecorder()
+            c.handler(w, tenantRequest(tenant, http.MethodPost, c.target, c.body))
+            verifyResponse(t, w)
+        })
+    }
+}
+
+func TestSignedStreamsRefused(t *testing.T) {
+    tenant := fixtureTenant(t)
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    useSigner(t, key)
+
+    for _, c := range []struct {
+        handler http.HandlerFunc
+        target  string
+        body    string
+    }{
+        {handleRouteRequest, "/route?stream=true",
+            `{"start": {"lat": 41.87, "lon": -87.66}, "end": {"lat": 41.88286, "lon": -87.65678}}`},
+        {handleMatrix, "/matrix?stream=true",
+            `{"sources": [[-87.66, 41.87]], "destinations": [[-87.65678, 41.88286]]}`},
+    } {
+        w := httptest.NewRecorder()
+        c.handler(w, tenantRequest(tenant, http.MethodPost, c.target, c.body))
+        if w.Code != http.StatusNotAcceptable || !strings.Contains(w.Body.String(), "stream_unsigned") {
+            t.Errorf("%s: status = %d, body %s; want 406 stream_unsigned", c.target, w.Code, w.Body)
+        }
+    }
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+
+    "risk-router/geo"
+)
+
+// SnapResult describes how a requested coordinate was attached to the graph.
+type SnapResult struct {
+    Requested Point   `json:"requested"`
+    Snapped   Point   `json:"snapped"`
+    DistanceM float64 `json:"distance_m"`
+    Warning   string  `json:"warning,omitempty"`
+    // ClampedTo is set when the requested point was outside the serving
+    // bounds and was moved onto them before snapping.
+    ClampedTo *Point `json:"clamped_to,omitempty"`
+
+    node int32
+}
+
+// SnapDiagnostics reports the snapping of both ends of a route request.
+type SnapDiagnostics struct {
+    Start SnapResult `json:"start"`
+    End   SnapResult `json:"end"`
+}
+
+// snap attaches p to its nearest graph node. Snaps longer than the router's
+// warning threshold usually mean the point is in a park, on the lake or
+// otherwise away from any mapped road, so they carry a warning.
+func (r *RiskAwareRouter) snap(p Point, label string) SnapResult {
+    node := r.findNearestNode(p)
+    nearest := r.G.Nodes[node]
+    result := SnapResult{
+        Requested: p,
+        Snapped:   nearest,
+        DistanceM: geo.Haversine(p, nearest),
+        node:      node,
+    }
+    if r.snapWarningM > 0 && result.DistanceM > r.snapWarningM {
+        result.Warning = fmt.Sprintf("%s point is %.0f m from the nearest road node; routing from that node instead",
+            label, result.DistanceM)
+    }
+    return result
+}
+
+// markClamped records that the snap started from a clamped copy of the
+// requested point.
+func (s *SnapResult) markClamped(requested Point) {
+    if requested == s.Requested {
+        return
+    }
+    clamped := s.Requested
+    s.Requested = requested
+    s.ClampedTo = &clamped
+}
+
+// errNotConnected is returned for routes between nodes on islands of the
+// road network that no path joins.
+var errNotConnected = errors.New("start and end are on parts of the road network that no path connects")
+
+// writeNotConnected answers a route request whose snapped ends lie in
+// different components.
+func writeNotConnected(w http.ResponseWriter, router *RiskAwareRouter, snap SnapDiagnostics) {
+    writeAPIError(w, http.StatusUnprocessableEntity, APIError{
+        Code:    "not_connected",
+        Message: errNotConnected.Error(),
+        Details: map[string]interface{}{
+            "start_component": router.G.component[snap.Start.node],
+            "end_component":   router.G.component[snap.End.node],
+            "snap":            snap,
+        },
+    })
+}
+
+// NoRoadNearError reports a request point farther from every road node
+// than the router's snapping cap, e.g. one across the river.
+type NoRoadNearError struct {
+    Field     string  `json:"field"`
+    Point     Point   `json:"point"`
+    Nearest   Point   `json:"nearest"`
+    DistanceM float64 `json:"distance_m"`
+    MaxSnapM  float64 `json:"max_snap_m"`
+}
+
+func (e *NoRoadNearError) Error() string {
+    return fmt.Sprintf("no road near %s point: the nearest road node is %.0f m away (at most %.0f m)",
+        e.Field, e.DistanceM, e.MaxSnapM)
+}
+
+// snapChecked bounds-checks p, clamping it if allowed, and snaps it. A
+// snap longer than the router's cap yields a *NoRoadNearError.
+func (r *RiskAwareRouter) snapChecked(p Point, label string, clamp bool) (SnapResult, error) {
+    inBounds, err := r.checkBounds(p, label, clamp)
+    if err != nil {
+        return SnapResult{}, err
+    }
+    result := r.snap(inBounds, label)
+    result.markClamped(p)
+    if r.maxSnapM > 0 && result.DistanceM > r.maxSnapM {
+        return result, &NoRoadNearError{
+            Field:     label,
+            Point:     p,
+            Nearest:   result.Snapped,
+            DistanceM: result.DistanceM,
+            MaxSnapM:  r.maxSnapM,
+        }
+    }
+    return result, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+    "math"
+    "sort"
+
+    "risk-router/geo"
+)
+
+// spatialBits is the geohash depth per axis. At 17 bits a cell is roughly
+// 0.0027° x 0.0014°, about 230 m x 150 m at Chicago's latitude.
+const spatialBits = 17
+
+// cellKey is the integer geohash of a cell: longitude and latitude bits
+// interleaved, longitude first, exactly as in the base32 geohash alphabet.
+type cellKey uint64
+
+// spatialBuilder buckets item IDs by geohash cell while an index is being
+// assembled. Points live in a single cell; extended items (edges, polygons)
+// are covered by every cell their bounding box touches.
+type spatialBuilder struct {
+    cells                  map[cellKey][]int32
+    minX, minY, maxX, maxY int64
+}
+
+// spatialIndex is the frozen, flat form of a spatialBuilder: sorted cell
+// keys with the items of keys[i] at items[starts[i]:starts[i+1]]. Being a
+// handful of flat arrays, it can be stored in and served from the binary
+// graph file. It is the one spatial lookup shared by snapping, nearest-road
+// queries and crime/corridor queries.
+type spatialIndex struct {
+    keys   []uint64
+    starts []int32
+    items  []int32
+    // extent is the cell range actually occupied: minX, minY, maxX, maxY.
+    extent [4]int64
+}
+
+func newSpatialBuilder() *spatialBuilder {
+    return &spatialBuilder{
+        cells: make(map[cellKey][]int32),
+        minX:  math.MaxInt64,
+        minY:  math.MaxInt64,
+        maxX:  math.MinInt64,
+        maxY:  math.MinInt64,
+    }
+}
+
+func cellCoords(p Point) (x, y int64) {
+    const n = 1 << spatialBits
+    x = int64(math.Floor((p.X + 180) / 360 * n))
+    y = int64(math.Floor((p.Y + 90) / 180 * n))
+    return min(max(x, 0), n-1), min(max(y, 0), n-1)
+}
+
+func makeCellKey(x, y int64) cellKey {
+    var key uint64
+    for bit := spatialBits - 1; bit >= 0; bit-- {
+        key = key<<2 | uint64(x>>bit&1)<<1 | uint64(y>>bit&1)
+    }
+    return cellKey(key)
+}
+
+// minCellSizeM floors cellSizeM, whose cells narrow to nothing at the
+// poles, where no road network lies.
+const minCellSizeM = 1.0
+
+// cellSizeM returns the smaller side of a cell near latitude lat, which
+// bounds how far apart points in non-adjacent cells can be.
+func cellSizeM(lat float64) float64 {
+    const n = 1 << spatialBits
+    latM := 180.0 / n * geo.MetersPerDegreeLat
+    lonM := 360.0 / n * geo.MetersPerDegreeLat * math.Cos(lat*math.Pi/180)
+    return math.Max(math.Min(latM, lonM), minCellSizeM)
+}
+
+// planarCellSize is the smaller side of a cell in degrees, the bound
+// cellSizeM gives for distances measured in degrees.
+const planarCellSize = 180.0 / (1 << spatialBits)
+
+func (sb *spatialBuilder) insertCell(id int32, x, y int64) {
+    key := makeCellKey(x, y)
+    sb.cells[key] = append(sb.cells[key], id)
+    sb.minX, sb.maxX = min(sb.minX, x), max(sb.maxX, x)
+    sb.minY, sb.maxY = min(sb.minY, y), max(sb.maxY, y)
+}
+
+func (sb *spatialBuilder) insertPoint(id int32, p Point) {
+    x, y := cellCoords(p)
+    sb.insertCell(id, x, y)
+}
+
+// insertBox adds id to every cell the bounding box touches.
+func (sb *spatialBuilder) insertBox(id int32, b Bounds) {
+    x0, y0 := cellCoords(Point{X: b.MinX, Y: b.MinY})
+    x1, y1 := cellCoords(Point{X: b.MaxX, Y: b.MaxY})
+    for x := x0; x <= x1; x++ {
+        for y := y0; y <= y1; y++ {
+            sb.insertCell(id, x, y)
+        }
+    }
+}
+
+// build freezes the builder into a spatialIndex.
+func (sb *spatialBuilder) build() *spatialIndex {
+    idx := &spatialIndex{
+        keys:   make([]uint64, 0, len(sb.cells)),
+        starts: make([]int32, 0, len(sb.cells)+1),
+        extent: [4]int64{sb.minX, sb.minY, sb.maxX, sb.maxY},
+    }
+    for key := range sb.cells {
+        idx.keys = append(idx.keys, uint64(key))
+    }
+    sort.Slice(idx.keys, func(i, j int) bool { return idx.keys[i] < idx.keys[j] })
+    for _, key := range idx.keys {
+        idx.starts = append(idx.starts, int32(len(idx.items)))
+        idx.items = append(idx.items, sb.cells[cellKey(key)]...)
+    }
+    idx.starts = append(idx.starts, int32(len(idx.items)))
+    return idx
+}
+
+// cell returns the items stored in cell (x, y).
+func (idx *spatialIndex) cell(x, y int64) []int32 {
+    key := uint64(makeCellKey(x, y))
+    i := sort.Search(len(idx.keys), func(i int) bool { return idx.keys[i] >= key })
+    if i == len(idx.keys) || idx.keys[i] != key {
+        return nil
+    }
+    return idx.items[idx.starts[i]:idx.starts[i+1]]
+}
+
+// inBox returns the distinct IDs stored in cells covering b, in ascending
+// order. Callers apply their own exact geometry test.
+func (idx *spatialIndex) inBox(b Bounds) []int32 {
+    x0, y0 := cellCoords(Point{X: b.MinX, Y: b.MinY})
+    x1, y1 := cellCoords(Point{X: b.MaxX, Y: b.MaxY})
+    x0, y0 = max(x0, idx.extent[0]), max(y0, idx.extent[1])
+    x1, y1 = min(x1, idx.extent[2]), min(y1, idx.extent[3])
+
+    seen := make(map[int32]bool)
+    var ids []int32
+    for x := x0; x <= x1; x++ {
+        for y := y0; y <= y1; y++ {
+            for _, id := range idx.cell(x, y) {
+                if !seen[id] {
+                    seen[id] = true
+                    ids = append(ids, id)
+                }
+            }
+        }
+    }
+    sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+    return ids
+}
+
+type scoredID struct {
+    id   int32
+    dist float64
+}
+
+// maxNearestRings caps the rings of cells nearest scans. Rings grow with
+// the distance from p, so a point far from the data would cost the square
+// of that distance; past the cap nearest measures every item instead.
+const maxNearestRings = 64
+
+// nearest returns up to k items closest to p under dist, ordered by
+// distance and then ID; cell is the least distance dist can measure across
+// one cell. It scans rings of cells outward from p's cell and stops once
+// no unscanned ring can hold anything closer than the k-th hit.
+func (idx *spatialIndex) nearest(p Point, k int, cell float64, dist func(id int32) float64) []scoredID {
+    if k <= 0 || len(idx.keys) == 0 {
+        return nil
+    }
+    cx, cy := cellCoords(p)
+    maxRing := max(cx-idx.extent[0], idx.extent[2]-cx, cy-idx.extent[1], idx.extent[3]-cy)
+
+    seen := make(map[int32]bool)
+    var found []scoredID
+    visit := func(ids []int32) {
+        for _, id := range ids {
+            if !seen[id] {
+                seen[id] = true
+                found = append(found, scoredID{id: id, dist: dist(id)})
+            }
+        }
+    }
+
+    for ring := int64(0); ring <= maxRing; ring++ {
+        if ring > maxNearestRings {
+            visit(idx.items)
+            sortScored(found)
+            break
+        }
+        if ring == 0 {
+            visit(idx.cell(cx, cy))
+        } else {
+            for d := -ring; d <= ring; d++ {
+                visit(idx.cell(cx+d, cy-ring))
+                visit(idx.cell(cx+d, cy+ring))
+            }
+            for d := -ring + 1; d <= ring-1; d++ {
+                visit(idx.cell(cx-ring, cy+d))
+                visit(idx.cell(cx+ring, cy+d))
+            }
+        }
+        sortScored(found)
+        // Anything in ring+1 or beyond is at least ring cells away.
+        if len(found) >= k && found[k-1].dist <= float64(ring)*cell {
+            break
+        }
+    }
+    if len(found) > k {
+        found = found[:k]
+    }
+    return found
+}
+
+func sortScored(s []scoredID) {
+    sort.Slice(s, func(i, j int) bool {
+        if s[i].dist != s[j].dist {
+            return s[i].dist < s[j].dist
+        }
+        return s[i].id < s[j].id
+    })
+}
+
+// inPolygon returns the IDs whose point lies inside poly.
+func (idx *spatialIndex) inPolygon(poly []Point, pointOf func(id int32) Point) []int32 {
+    var ids []int32
+    for _, id := range idx.inBox(boundsOf(poly)) {
+        if pointInPolygon(pointOf(id), poly) {
+            ids = append(ids, id)
+        }
+    }
+    return ids
+}
+
+// nearPath returns the IDs within radiusM of the polyline path, using
+// distToSegment to measure an item against one segment.
+func (idx *spatialIndex) nearPath(path []Point, radiusM float64, distToSegment func(id int32, a, b Point) float64) []int32 {
+    if len(path) == 1 {
+        path = []Point{path[0], path[0]}
+    }
+    hit := make(map[int32]bool)
+    for i := 0; i+1 < len(path); i++ {
+        a, b := path[i], path[i+1]
+        box := padBounds(boundsOf([]Point{a, b}), radiusM)
+        for _, id := range idx.inBox(box) {
+            if !hit[id] && distToSegment(id, a, b) <= radiusM {
+                hit[id] = true
+            }
+        }
+    }
+    ids := make([]int32, 0, len(hit))
+    for id := range hit {
+        ids = append(ids, id)
+    }
+    sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+    return ids
+}
+
+// nodesInPolygon returns the IDs of the graph nodes inside poly.
+func (g *Graph) nodesInPolygon(poly []Point) []int32 {
+    return g.nodeIndex.inPolygon(poly, func(id int32) Point { return g.Nodes[id] })
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math"
+    "net/http"
+)
+
+// defaultStopsAlpha is the risk weight used when a multi-stop request does
+// not set one.
+const defaultStopsAlpha = 0.5
+
+// maxStopsLimit is the most limits.max_stops may allow: ordering 16 stops
+// already weighs 2^15 subsets of them.
+const maxStopsLimit = 16
+
+// stopsRequest is the body of POST /route/stops. Stops are in degrees; the
+// first is where the trip starts.
+type stopsRequest struct {
+    Stops []Coordinate `json:"stops" schema:"required"`
+    Alpha *float64     `json:"alpha" schema:"minimum=0,maximum=1"`
+    // RoundTrip returns to the first stop after the last; FixedEnd keeps
+    // the last stop last instead.
+    RoundTrip bool `json:"round_trip"`
+    FixedEnd  bool `json:"fixed_end"`
+    Clamp     bool `json:"clamp"`
+}
+
+// stopLeg is the route between two consecutive stops of the trip, named
+// by their index in the request.
+type stopLeg struct {
+    From  int   `json:"from"`
+    To    int   `json:"to"`
+    Route Route `json:"route"`
+}
+
+// bestOrder returns the order to visit the stops of cost, the cost of the
+// best route from each to each, that starts at stop 0 and costs least in
+// total, with that total: Held-Karp dynamic programming over the subsets
+// of the other stops. With roundTrip the trip returns to stop 0, which is
+// counted but not repeated in the order; with fixedEnd it ends at the
+// last stop. The total is infinite when no order connects the stops.
+func bestOrder(cost [][]float64, roundTrip, fixedEnd bool) ([]int, float64) {
+    n := len(cost)
+    var free []int
+    for i := 1; i < n; i++ {
+        if !fixedEnd || i != n-1 {
+            free = append(free, i)
+        }
+    }
+    finish := func(i int) float64 {
+        switch {
+        case fixedEnd:
+            return cost[i][n-1]
+        case roundTrip:
+            return cost[i][0]
+        }
+        return 0
+    }
+    order := []int{0}
+    k := len(free)
+    if k == 0 {
+        if fixedEnd && n > 1 {
+            order = append(order, n-1)
+        }
+        return order, finish(0)
+    }
+
+    // best[mask][j] is the least cost of leaving stop 0, visiting the free
+    // stops in mask and ending at free[j]; prev[mask][j] is the free stop
+    // visited before it, -1 for none.
+    full := 1<<k - 1
+    best := make([][]float64, full+1)
+    prev := make([][]int, full+1)
+    for mask := range best {
+        best[mask] = make([]float64, k)
+        prev[mask] = make([]int, k)
+        for j := range best[mask] {
+            best[mask][j] = math.Inf(1)
+            prev[mask][j] = -1
+        }
+    }
+    for j, s := range free {
+        best[1<<j][j] = cost[0][s]
+    }
+    for mask := 1; mask <= full; mask++ {
+        for j := 0; j < k; j++ {
+            c := best[mask][j]
+            if mask&(1<<j) == 0 || math.IsInf(c, 1) {
+                continue
+            }
+            for next := 0; next < k; next++ {
+                if mask&(1<<next) != 0 {
+                    continue
+                }
+                if nc := c + cost[free[j]][free[next]]; nc < best[mask|1<<next][next] {
+                    best[mask|1<<next][next] = nc
+                    prev[mask|1<<next][next] = j
+                }
+            }
+        }
+    }
+
+    total, last := math.Inf(1), -1
+    for j := 0; j < k; j++ {
+        if c := best[full][j] + finish(free[j]); c < total {
+            total, last = c, j
+        }
+    }
+    if last < 0 {
+        return nil, total
+    }
+    visits := make([]int, k)
+    for i, mask, j := k-1, full, last; j >= 0; i-- {
+        visits[i] = free[j]
+        mask, j = mask&^(1<<j), prev[mask][j]
+    }
+    order = append(order, visits...)
+    if fixedEnd {
+        order = append(order, n-1)
+    }
+    return order, total
+}
+
+// handleStops serves POST /route/stops: the order to visit up to
+// limits.max_stops stops in that costs least at one alpha, and the route
+// of each leg, for trips such as a caregiver's round of visits.
+func handleStops(w http.ResponseWriter, r *http.Request) {
+    var req stopsRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    if max := globalConfig.Limits.MaxStops; len(req.Stops) < 2 || len(req.Stops) > max {
+        writeBadRequest(w, fmt.Sprintf("stops must have between 2 and %d points", max))
+        return
+    }
+    if req.RoundTrip && req.FixedEnd {
+        writeBadRequest(w, "give either round_trip or fixed_end, not both")
+        return
+    }
+    alpha := defaultStopsAlpha
+    if req.Alpha != nil {
+        alpha = *req.Alpha
+    }
+    if alpha < 0 || alpha > 1 {
+        writeBadRequest(w, "alpha must be within [0, 1]")
+        return
+    }
+
+    ctx := r.Context()
+    router := tenantFromContext(ctx).Router()
+    snaps := make([]SnapResult, len(req.Stops))
+    targets := make([]int32, len(req.Stops))
+    for i, c := range req.Stops {
+        snap, err := router.snapChecked(c.point(), fmt.Sprintf("stops[%d]", i), req.Clamp)
+        if err != nil {
+            writeOutOfBounds(w, err)
+            return
+        }
+        snaps[i] = snap
+        targets[i] = snap.node
+    }
+
+    cost := make([][]float64, len(snaps))
+    for i, s := range snaps {
+        cells, err := router.distancesFrom(ctx, s.node, targets, alpha)
+        switch {
+        case errors.Is(err, context.Canceled):
+            return
+        case errors.Is(err, context.DeadlineExceeded):
+            writeAPIError(w, http.StatusGatewayTimeout, APIError{Code: "timeout", Message: "ordering the stops timed out"})
+            return
+        case err != nil:
+            writeAPIError(w, http.StatusInternalServerError, APIError{Code: "no_route", Message: err.Error()})
+            return
+        }
+        cost[i] = make([]float64, len(cells))
+        for j, c := range cells {
+            cost[i][j] = math.Inf(1)
+            if c.Found {
+                cost[i][j] = c.cost
+            }
+        }
+    }
+    order, total := bestOrder(cost, req.RoundTrip, req.FixedEnd)
+    if math.IsInf(total, 1) {
+        for _, s := range snaps[1:] {
+            if !router.G.connected(snaps[0].node, s.node) {
+                writeNotConnected(w, router, SnapDiagnostics{Start: snaps[0], End: s})
+                return
+            }
+        }
+        // Every stop is on the first's part of the network, but closures
+        // cut some off.
+        writeAPIError(w, http.StatusUnprocessableEntity, APIError{
+            Code:    "not_connected",
+            Message: "no order of the stops connects them all by road",
+            Details: map[string]interface{}{"stops": snaps},
+        })
+        return
+    }
+
+    visits := order
+    if req.RoundTrip {
+        visits = append(visits, 0)
+    }
+    // The legs are searched exactly, as the costs that chose the order
+    // were, so they are the routes that cost adds up.
+    legs := make([]stopLeg, 0, len(visits)-1)
+    var path []Point
+    for i := 1; i < len(visits); i++ {
+        from, to := visits[i-1], visits[i]
+        route, err := router.legRoute(ctx, snaps[from], snaps[to], alpha, routeParams{}, globalConfig.WalkingSpeedMPS)
+        switch {
+        case errors.Is(err, context.Canceled):
+            return
+        case errors.Is(err, errNotConnected):
+            writeNotConnected(w, router, SnapDiagnostics{Start: snaps[from], End: snaps[to]})
+            return
+        case errors.Is(err, context.DeadlineExceeded):
+            writeAPIError(w, http.StatusGatewayTimeout, APIError{Code: "timeout", Message: fmt.Sprintf("routing from stop %d to stop %d timed out", from, to)})
+            return
+        case err != nil:
+            writeAPIError(w, http.StatusInternalServerError, APIError{Code: "no_route", Message: err.Error()})
+            return
+        }
+        leg := stopLeg{From: from, To: to, Route: route}
+        if len(path) > 0 && len(leg.Route.Path) > 0 {
+            path = append(path, leg.Route.Path[1:]...)
+        } else {
+            path = append(path, leg.Route.Path...)
+        }
+        legs = append(legs, leg)
+    }
+
+    response := struct {
+        Alpha float64 `json:"alpha"`
+        // Order lists the stops by their index in the request, in the
+        // order to visit them.
+        Order   []int        `json:"order"`
+        Stops   []SnapResult `json:"stops"`
+        Legs    []stopLeg    `json:"legs"`
+        Cost    float64      `json:"cost"`
+        Summary RouteSummary `json:"summary"`
+    }{alpha, order, snaps, legs, total, router.summarize(path, globalConfig.WalkingSpeedMPS)}
+    writeSignedJSON(w, response, "stops")
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "math"
+    "math/rand"
+    "net/http"
+    "net/http/httptest"
+    "slices"
+    "strings"
+    "testing"
+)
+
+// orderCost is what visiting order costs; a round trip returns to the
+// first stop.
+func orderCost(cost [][]float64, order []int, roundTrip bool) float64 {
+    total := 0.0
+    for i := 1; i < len(order); i++ {
+        total += cost[order[i-1]][order[i]]
+    }
+    if roundTrip {
+        total += cost[order[len(order)-1]][order[0]]
+    }
+    return total
+}
+
+// bruteForceOrder tries every order of the stops bestOrder may move.
+func bruteForceOrder(cost [][]float64, roundTrip, fixedEnd bool) float64 {
+    n := len(cost)
+    var free []int
+    for i := 1; i < n; i++ {
+        if !fixedEnd || i != n-1 {
+            free = append(free, i)
+        }
+    }
+    best := math.Inf(1)
+    var permute func(k int)
+    permute = func(k int) {
+        if k == len(free) {
+            order := append([]int{0}, free...)
+            if fixedEnd && n > 1 {
+                order = append(order, n-1)
+            }
+            best = min(best, orderCost(cost, order, roundTrip))
+            return
+        }
+        for i := k; i < len(free); i++ {
+            free[k], free[i] = free[i], free[k]
+            permute(k + 1)
+            free[k], free[i] = free[i], free[k]
+        }
+    }
+    permute(0)
+    return best
+}
+
+func TestBestOrder(t *testing.T) {
+    inf := math.Inf(1)
+    cases := []struct {
+        name                string
+        cost                [][]float64
+        roundTrip, fixedEnd bool
+        order               []int
+        total               float64
+    }{
+        {"one stop", [][]float64{{0}}, false, false, []int{0}, 0},
+        {"two stops", [][]float64{{0, 3}, {4, 0}}, false, false, []int{0, 1}, 3},
+        {"two stops round trip", [][]float64{{0, 3}, {4, 0}}, true, false, []int{0, 1}, 7},
+        {"two stops fixed end", [][]float64{{0, 3}, {4, 0}}, false, true, []int{0, 1}, 3},
+        {"nearest first", [][]float64{
+            {0, 5, 1},
+            {5, 0, 1},
+            {1, 1, 0},
+        }, false, false, []int{0, 2, 1}, 2},
+        {"fixed end", [][]float64{
+            {0, 5, 1},
+            {5, 0, 1},
+            {1, 1, 0},
+        }, false, true, []int{0, 1, 2}, 6},
+        {"one way streets", [][]float64{
+            {0, 1, 9, 9},
+            {9, 0, 1, 9},
+            {9, 9, 0, 1},
+            {1, 9, 9, 0},
+        }, true, false, []int{0, 1, 2, 3}, 4},
+        {"unreachable stop", [][]float64{
+            {0, 1, inf},
+            {1, 0, inf},
+            {inf, inf, 0},
+        }, false, false, nil, inf},
+        {"reachable only one way", [][]float64{
+            {0, 1, 2},
+            {inf, 0, 1},
+            {inf, inf, 0},
+        }, false, false, []int{0, 1, 2}, 2},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            order, total := bestOrder(c.cost, c.roundTrip, c.fixedEnd)
+            if !slices.Equal(order, c.order) || total != c.total {
+                t.Errorf("bestOrder = %v, %v; want %v, %v", order, total, c.order, c.total)
+            }
+        })
+    }
+}
+
+func TestBestOrderMatchesBruteForce(t *testing.T) {
+    rng := rand.New(rand.NewSource(1))
+    for n := 1; n <= 8; n++ {
+        stops := make([]int, n)
+        for i := range stops {
+            stops[i] = i
+        }
+        for trial := 0; trial < 20; trial++ {
+            cost := make([][]float64, n)
+            for i := range cost {
+                cost[i] = make([]float64, n)
+                for j := range cost[i] {
+                    if i != j {
+                        cost[i][j] = float64(rng.Intn(100) + 1)
+                    }
+                }
+            }
+            for _, mode := range []struct{ roundTrip, fixedEnd bool }{{false, false}, {true, false}, {false, true}} {
+                order, total := bestOrder(cost, mode.roundTrip, mode.fixedEnd)
+                if want := bruteForceOrder(cost, mode.roundTrip, mode.fixedEnd); total != want {
+                    t.Fatalf("n=%d %+v: total %v, brute force %v", n, mode, total, want)
+                }
+                if len(order) == 0 || order[0] != 0 || !slices.Equal(slices.Sorted(slices.Values(order)), stops) {
+                    t.Fatalf("n=%d %+v: order %v does not visit each stop once from 0", n, mode, order)
+                }
+                if mode.fixedEnd && order[n-1] != n-1 {
+                    t.Fatalf("n=%d: fixed end order %v", n, order)
+                }
+                if got := orderCost(cost, order, mode.roundTrip); got != total {
+                    t.Fatalf("n=%d %+v: order %v costs %v, reported %v", n, mode, order, got, total)
+                }
+            }
+        }
+    }
+}
+
+// TestBestOrderMaxStops orders as many stops as limits.max_stops may
+// allow: points on a line, visited left to right from the leftmost.
+func TestBestOrderMaxStops(t *testing.T) {
+    rng := rand.New(rand.NewSource(2))
+    at := make([]float64, maxStopsLimit)
+    for i := 1; i < len(at); i++ {
+        at[i] = float64(rng.Intn(1000) + 1)
+    }
+    cost := make([][]float64, len(at))
+    for i := range cost {
+        cost[i] = make([]float64, len(at))
+        for j := range cost[i] {
+            cost[i][j] = math.Abs(at[i] - at[j])
+        }
+    }
+    order, total := bestOrder(cost, false, false)
+    if want := slices.Max(at); total != want {
+        t.Errorf("total = %v, want the line's length %v", total, want)
+    }
+    for i := 1; i < len(order); i++ {
+        if at[order[i]] < at[order[i-1]] {
+            t.Fatalf("order %v doubles back", order)
+        }
+    }
+}
+
+func stopsBody(n int) string {
+    points := []string{
+        `{"lat": 41.87, "lon": -87.66}`,
+        `{"lat": 41.88286, "lon": -87.65678}`,
+        `{"lat": 41.87286, "lon": -87.65967}`,
+        `{"lat": 41.87045, "lon": -87.65678}`,
+        `{"lat": 41.88, "lon": -87.65656}`,
+    }
+    return fmt.Sprintf(`{"stops": [%s]}`, strings.Join(points[:n], ", "))
+}
+
+func TestStopsMaxStops(t *testing.T) {
+    tenant := fixtureTenant(t)
+    globalConfig.Limits.MaxStops = 4
+    for _, c := range []struct {
+        stops int
+        want  int
+    }{{1, http.StatusBadRequest}, {2, http.StatusOK}, {4, http.StatusOK}, {5, http.StatusBadRequest}} {
+        w := httptest.NewRecorder()
+        handleStops(w, tenantRequest(tenant, http.MethodPost, "/route/stops", stopsBody(c.stops)))
+        if w.Code != c.want {
+            t.Errorf("%d stops: status = %d, want %d: %s", c.stops, w.Code, c.want, w.Body)
+        }
+    }
+}
+
+// TestStopsLegsMatchOrder checks that each leg is the route whose cost
+// chose the order.
+func TestStopsLegsMatchOrder(t *testing.T) {
+    tenant := fixtureTenant(t)
+    globalConfig.HeuristicWeight = 2
+    w := httptest.NewRecorder()
+    handleStops(w, tenantRequest(tenant, http.MethodPost, "/route/stops", stopsBody(5)))
+    if w.Code != http.StatusOK {
+        t.Fatalf("status = %d: %s", w.Code, w.Body)
+    }
+    var resp struct {
+        Stops []SnapResult `json:"stops"`
+        Legs  []stopLeg    `json:"legs"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+        t.Fatal(err)
+    }
+    router := tenant.Router()
+    nodes := make([]int32, len(resp.Stops))
+    for i, s := range resp.Stops {
+        nodes[i] = router.findNearestNode(s.Snapped)
+    }
+    for _, leg := range resp.Legs {
+        cells, err := router.distancesFrom(context.Background(), nodes[leg.From], nodes, defaultStopsAlpha)
+        if err != nil {
+            t.Fatal(err)
+        }
+        cell := cells[leg.To]
+        if math.Abs(leg.Route.Distance-cell.Distance) > 1e-12 || math.Abs(leg.Route.Risk-cell.Risk) > 1e-12 {
+            t.Errorf("leg %d -> %d: distance %v risk %v, the order's cost was for distance %v risk %v",
+                leg.From, leg.To, leg.Route.Distance, leg.Route.Risk, cell.Distance, cell.Risk)
+        }
+    }
+}
+
+func TestStopsNotConnected(t *testing.T) {
+    tenant := fixtureTenant(t)
+    body := `{"stops": [{"lat": 41.87, "lon": -87.66}, {"lat": 41.9015, "lon": -87.6}]}`
+    w := httptest.NewRecorder()
+    handleStops(w, tenantRequest(tenant, http.MethodPost, "/route/stops", body))
+    var resp struct {
+        Error struct {
+            Code    string                 `json:"code"`
+            Details map[string]interface{} `json:"details"`
+        } `json:"error"`
+    }
+    json.Unmarshal(w.Body.Bytes(), &resp)
+    if w.Code != http.StatusUnprocessableEntity || resp.Error.Code != "not_connected" || resp.Error.Details["end_component"] == nil {
+        t.Errorf("status = %d, body %s; want 422 not_connected with the components, as /route answers", w.Code, w.Body)
+    }
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "slices"
+    "sync"
+)
+
+// storage keeps the state that outlives a request: saved routes, users'
+// route histories, monitors and notification preferences, the road closures applied from events, and the
+// scheduled tasks' run history.
+// Memory storage loses it on restart; SQL storage keeps it in a database,
+// either one every instance shares or, on a single node, an embedded
+// SQLite file, so state behaves the same in development and production
+// and tests can run against the memory one.
+type storage interface {
+    // saveRoute stores r under its ID.
+    saveRoute(ctx context.Context, r *savedRoute) error
+    // route returns the saved route with id if it belongs to tenant, or
+    // errNotFound.
+    route(ctx context.Context, id, tenant string) (*savedRoute, error)
+    // setClosure records that a road segment was closed or reopened.
+    setClosure(ctx context.Context, c closureRecord) error
+    // closures returns tenant's closed road segments.
+    closures(ctx context.Context, tenant string) ([]closureRecord, error)
+    // addHistory adds r, already saved, to user's route history, which
+    // keeps the most recent maxHistoryRoutes.
+    addHistory(ctx context.Context, user string, r *savedRoute) error
+    // history returns up to limit of user's routes after cursor, newest
+    // first.
+    history(ctx context.Context, tenant, user string, cursor historyCursor, limit int) ([]*savedRoute, error)
+    // deleteHistory removes a route from user's history, or returns
+    // errNotFound.
+    deleteHistory(ctx context.Context, tenant, user, id string) error
+    // addMonitor stores a new route monitor.
+    addMonitor(ctx context.Context, m *routeMonitor) error
+    // updateMonitor stores a monitor's state after a check, or returns
+    // errNotFound if it was deleted.
+    updateMonitor(ctx context.Context, m *routeMonitor) error
+    // monitors returns user's route monitors.
+    monitors(ctx context.Context, tenant, user string) ([]*routeMonitor, error)
+    // allMonitors returns every tenant's route monitors.
+    allMonitors(ctx context.Context) ([]*routeMonitor, error)
+    // deleteMonitor removes one of user's monitors, or returns
+    // errNotFound.
+    deleteMonitor(ctx context.Context, tenant, user, id string) error
+    // notificationPrefs returns user's notification preferences, empty
+    // if they have none.
+    notificationPrefs(ctx context.Context, tenant, user string) (notificationPrefs, error)
+    // setNotificationPrefs replaces a user's notification preferences.
+    setNotificationPrefs(ctx context.Context, p notificationPrefs) error
+    // notificationSubscribers returns the preferences of tenant's users,
+    // or every tenant's for an empty tenant, that want topic.
+    notificationSubscribers(ctx context.Context, tenant, topic string) ([]notificationPrefs, error)
+    // saveTaskStatus records a scheduled task's run counters.
+    saveTaskStatus(ctx context.Context, s taskStatus) error
+    // taskStatuses returns the run counters of every task that has run.
+    taskStatuses(ctx context.Context) ([]taskStatus, error)
+    // retention describes, for /privacy, how long saved routes are kept.
+    retention() string
+    close() error
+}
+
+var errNotFound = errors.New("not found")
+
+var globalStorage storage = newMemoryStorage()
+
+// closureRecord is a closed road segment, by its end points, which
+// outlive the edge IDs of any one graph. From is the lesser end, so a
+// segment and its reverse are one record.
+type closureRecord struct {
+    Tenant string
+    From   Point
+    To     Point
+    Closed bool
+}
+
+func newClosureRecord(tenant string, from, to Point, closed bool) closureRecord {
+    if pointLess(to, from) {
+        from, to = to, from
+    }
+    return closureRecord{Tenant: tenant, From: from, To: to, Closed: closed}
+}
+
+// openStorage opens the storage cfg names.
+func openStorage(cfg Config) (storage, error) {
+    switch cfg.Storage {
+    case "", "memory":
+        return newMemoryStorage(), nil
+    case "postgres":
+        return openSQLStorage(cfg.Storage, cfg.StorageDSN)
+    case "sqlite":
+        path := cfg.StorageDSN
+        if path == "" {
+            path = defaultSQLitePath
+        }
+        return openSQLStorage(cfg.Storage, path)
+    }
+    return nil, fmt.Errorf("unknown storage %q", cfg.Storage)
+}
+
+func checkStorage(kind, dsn string) error {
+    switch kind {
+    case "", "memory", "sqlite":
+        return nil
+    case "postgres":
+        if dsn == "" {
+            return fmt.Errorf("storage %s needs a storage_dsn", kind)
+        }
+        return nil
+    }
+    return fmt.Errorf("storage must be memory, sqlite or postgres, got %q", kind)
+}
+
+// defaultSQLitePath is the SQLite storage file when storage_dsn is unset.
+const defaultSQLitePath = "risk-router.db"
+
+// maxMemoryRoutes is how many saved routes memory storage keeps.
+const maxMemoryRoutes = 10000
+
+// memoryStorage is storage in the process's memory.
+type memoryStorage struct {
+    routes *routeStore
+
+    mu        sync.Mutex
+    closed    map[closureRecord]struct{}
+    tasks     map[string]taskStatus
+    histories map[historyKey][]*savedRoute
+    monitored map[string]*routeMonitor
+    prefs     map[historyKey]notificationPrefs
+}
+
+// historyKey names one user's history, or other state of theirs.
+type historyKey struct {
+    tenant, user string
+}
+
+func newMemoryStorage() *memoryStorage {
+    return &memoryStorage{
+        routes:    newRouteStore(maxMemoryRoutes),
+        closed:    make(map[closureRecord]struct{}),
+        tasks:     make(map[string]taskStatus),
+        histories: make(map[historyKey][]*savedRoute),
+        monitored: make(map[string]*routeMonitor),
+        prefs:     make(map[historyKey]notificationPrefs),
+    }
+}
+
+func (m *memoryStorage) saveRoute(ctx context.Context, r *savedRoute) error {
+    m.routes.save(r)
+    return nil
+}
+
+func (m *memoryStorage) route(ctx context.Context, id, tenant string) (*savedRoute, error) {
+    r, ok := m.routes.get(id, tenant)
+    if !ok {
+        return nil, errNotFound
+    }
+    return r, nil
+}
+
+func (m *memoryStorage) setClosure(ctx context.Context, c closureRecord) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    closed := c.Closed
+    c.Closed = true
+    if closed {
+        m.closed[c] = struct{}{}
+    } else {
+        delete(m.closed, c)
+    }
+    return nil
+}
+
+func (m *memoryStorage) closures(ctx context.Context, tenant string) ([]closureRecord, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    var list []closureRecord
+    for c := range m.closed {
+        if c.Tenant == tenant {
+            list = append(list, c)
+        }
+    }
+    return list, nil
+}
+
+func (m *memoryStorage) addHistory(ctx context.Context, user string, r *savedRoute) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    key := historyKey{r.Tenant, user}
+    routes := append(m.histories[key], r)
+    if len(routes) > maxHistoryRoutes {
+        routes = routes[len(routes)-maxHistoryRoutes:]
+    }
+    m.histories[key] = routes
+    return nil
+}
+
+func (m *memoryStorage) history(ctx context.Context, tenant, user string, cursor historyCursor, limit int) ([]*savedRoute, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    routes := m.histories[historyKey{tenant, user}]
+    var page []*savedRoute
+    for i := len(routes) - 1; i >= 0 && len(page) < limit; i-- {
+        if cursor.after(routes[i]) {
+            page = append(page, routes[i])
+        }
+    }
+    return page, nil
+}
+
+func (m *memoryStorage) deleteHistory(ctx context.Context, tenant, user, id string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    key := historyKey{tenant, user}
+    routes := m.histories[key]
+    for i, r := range routes {
+        if r.ID == id {
+            m.histories[key] = append(routes[:i:i], routes[i+1:]...)
+            return nil
+        }
+    }
+    return errNotFound
+}
+
+func (m *memoryStorage) addMonitor(ctx context.Context, mon *routeMonitor) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    copied := *mon
+    m.monitored[mon.ID] = &copied
+    return nil
+}
+
+func (m *memoryStorage) updateMonitor(ctx context.Context, mon *routeMonitor) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if _, ok := m.monitored[mon.ID]; !ok {
+        return errNotFound
+    }
+    copied := *mon
+    m.monitored[mon.ID] = &copied
+    return nil
+}
+
+func (m *memoryStorage) monitors(ctx context.Context, tenant, user string) ([]*routeMonitor, error) {
+    all, _ := m.allMonitors(ctx)
+    var list []*routeMonitor
+    for _, mon := range all {
+        if mon.Tenant == tenant && mon.User == user {
+            list = append(list, mon)
+        }
+    }
+    return list, nil
+}
+
+func (m *memoryStorage) allMonitors(ctx context.Context) ([]*routeMonitor, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    list := make([]*routeMonitor, 0, len(m.monitored))
+    for _, mon := range m.monitored {
+        copied := *mon
+        list = append(list, &copied)
+    }
+    slices.SortFunc(list, func(a, b *routeMonitor) int { return a.CreatedAt.Compare(b.CreatedAt) })
+    return list, nil
+}
+
+func (m *memoryStorage) deleteMonitor(ctx context.Context, tenant, user, id string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    mon, ok := m.monitored[id]
+    if !ok || mon.Tenant != tenant || mon.User != user {
+        return errNotFound
+    }
+    delete(m.monitored, id)
+    return nil
+}
+
+func (m *memoryStorage) notificationPrefs(ctx context.Context, tenant, user string) (notificationPrefs, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    p, ok := m.prefs[historyKey{tenant, user}]
+    if !ok {
+        return notificationPrefs{Tenant: tenant, User: user}, nil
+    }
+    return p, nil
+}
+
+func (m *memoryStorage) setNotificationPrefs(ctx context.Context, p notificationPrefs) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.prefs[historyKey{p.Tenant, p.User}] = p
+    return nil
+}
+
+func (m *memoryStorage) notificationSubscribers(ctx context.Context, tenant, topic string) ([]notificationPrefs, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    var list []notificationPrefs
+    for _, p := range m.prefs {
+        if (tenant == "" || p.Tenant == tenant) && p.wants(topic) {
+            list = append(list, p)
+        }
+    }
+    return list, nil
+}
+
+func (m *memoryStorage) saveTaskStatus(ctx context.Context, s taskStatus) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.tasks[s.Name] = s
+    return nil
+}
+
+func (m *memoryStorage) taskStatuses(ctx context.Context) ([]taskStatus, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    list := make([]taskStatus, 0, len(m.tasks))
+    for _, s := range m.tasks {
+        list = append(list, s)
+    }
+    return list, nil
+}
+
+func (m *memoryStorage) retention() string {
+    return fmt.Sprintf("in memory, the most recent %d routes, until evicted or restart", m.routes.maxEntries)
+}
+
+func (m *memoryStorage) close() error { return nil }
@@ -0,0 +1,7 @@
+//go:build postgres
+
+package main
+
+// Building with -tags postgres links the pgx driver for postgres storage.
+// The default build leaves it out, though go.mod requires it.
+import _ "github.com/jackc/pgx/v5/stdlib"
@@ -0,0 +1,410 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// sqlDrivers lists, per storage kind, the database/sql drivers that can
+// serve it, preferred first. None is linked by default: build with the
+// kind as a tag, e.g. -tags postgres, to link one.
+var sqlDrivers = map[string][]string{
+    "postgres": {"pgx", "postgres"},
+    "sqlite":   {"sqlite", "sqlite3"},
+}
+
+// sqlitePragmas set up every SQLite connection: readers do not block the
+// writer, and a busy database is waited on rather than failed.
+var sqlitePragmas = []string{
+    "PRAGMA journal_mode = WAL",
+    "PRAGMA busy_timeout = 5000",
+    "PRAGMA synchronous = NORMAL",
+}
+
+// sqlSchema creates the tables, in SQL that PostgreSQL and SQLite both
+// accept. Times are RFC 3339 text and saved routes their JSON.
+var sqlSchema = []string{
+    `CREATE TABLE IF NOT EXISTS saved_routes (
+        id TEXT PRIMARY KEY,
+        tenant TEXT NOT NULL,
+        created_at TEXT NOT NULL,
+        body TEXT NOT NULL
+    )`,
+    `CREATE INDEX IF NOT EXISTS saved_routes_created_at ON saved_routes (created_at)`,
+    `CREATE TABLE IF NOT EXISTS route_history (
+        tenant TEXT NOT NULL,
+        user_id TEXT NOT NULL,
+        route_id TEXT NOT NULL,
+        created_ns BIGINT NOT NULL,
+        body TEXT NOT NULL,
+        PRIMARY KEY (tenant, user_id, route_id)
+    )`,
+    `CREATE INDEX IF NOT EXISTS route_history_created ON route_history (tenant, user_id, created_ns)`,
+    `CREATE TABLE IF NOT EXISTS route_monitors (
+        id TEXT PRIMARY KEY,
+        tenant TEXT NOT NULL,
+        user_id TEXT NOT NULL,
+        created_at TEXT NOT NULL,
+        body TEXT NOT NULL,
+        route TEXT NOT NULL
+    )`,
+    `CREATE INDEX IF NOT EXISTS route_monitors_user ON route_monitors (tenant, user_id)`,
+    `CREATE TABLE IF NOT EXISTS notification_prefs (
+        tenant TEXT NOT NULL,
+        user_id TEXT NOT NULL,
+        body TEXT NOT NULL,
+        PRIMARY KEY (tenant, user_id)
+    )`,
+    `CREATE TABLE IF NOT EXISTS closures (
+        tenant TEXT NOT NULL,
+        from_x DOUBLE PRECISION NOT NULL,
+        from_y DOUBLE PRECISION NOT NULL,
+        to_x DOUBLE PRECISION NOT NULL,
+        to_y DOUBLE PRECISION NOT NULL,
+        closed_at TEXT NOT NULL,
+        PRIMARY KEY (tenant, from_x, from_y, to_x, to_y)
+    )`,
+    `CREATE TABLE IF NOT EXISTS task_runs (
+        name TEXT PRIMARY KEY,
+        runs BIGINT NOT NULL,
+        failures BIGINT NOT NULL,
+        last_run TEXT,
+        last_duration_ms DOUBLE PRECISION NOT NULL,
+        last_error TEXT NOT NULL
+    )`,
+}
+
+// sqlStorage is storage in a SQL database.
+type sqlStorage struct {
+    db   *sql.DB
+    kind string
+}
+
+// openSQLStorage connects to the kind of database at dsn with the first
+// of its drivers linked into the binary and creates any missing tables.
+func openSQLStorage(kind, dsn string) (*sqlStorage, error) {
+    var driver string
+    for _, name := range sqlDrivers[kind] {
+        if slices.Contains(sql.Drivers(), name) {
+            driver = name
+            break
+        }
+    }
+    if driver == "" {
+        return nil, fmt.Errorf("storage %s: this binary has no %s driver; build it with -tags %s", kind, kind, kind)
+    }
+    db, err := sql.Open(driver, dsn)
+    if err != nil {
+        return nil, fmt.Errorf("storage %s: %v", kind, err)
+    }
+    s := &sqlStorage{db: db, kind: kind}
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+    setup := sqlSchema
+    if kind == "sqlite" {
+        // One connection serializes writes, which SQLite allows one of
+        // at a time anyway, and keeps the pragmas in force.
+        db.SetMaxOpenConns(1)
+        setup = append(slices.Clone(sqlitePragmas), sqlSchema...)
+    }
+    for _, stmt := range setup {
+        if _, err := db.ExecContext(ctx, stmt); err != nil {
+            db.Close()
+            return nil, fmt.Errorf("storage %s: creating tables: %v", kind, err)
+        }
+    }
+    return s, nil
+}
+
+// rebind rewrites the ? placeholders of query into the database's own.
+func (s *sqlStorage) rebind(query string) string {
+    if s.kind != "postgres" {
+        return query
+    }
+    var b strings.Builder
+    n := 0
+    for _, c := range query {
+        if c == '?' {
+            n++
+            b.WriteString("$" + strconv.Itoa(n))
+            continue
+        }
+        b.WriteRune(c)
+    }
+    return b.String()
+}
+
+func (s *sqlStorage) exec(ctx context.Context, query string, args ...interface{}) error {
+    _, err := s.db.ExecContext(ctx, s.rebind(query), args...)
+    return err
+}
+
+func (s *sqlStorage) saveRoute(ctx context.Context, r *savedRoute) error {
+    body, err := json.Marshal(r)
+    if err != nil {
+        return err
+    }
+    return s.exec(ctx, `INSERT INTO saved_routes (id, tenant, created_at, body) VALUES (?, ?, ?, ?)`,
+        r.ID, r.Tenant, r.CreatedAt.Format(time.RFC3339Nano), string(body))
+}
+
+func (s *sqlStorage) route(ctx context.Context, id, tenant string) (*savedRoute, error) {
+    var body string
+    err := s.db.QueryRowContext(ctx, s.rebind(`SELECT body FROM saved_routes WHERE id = ? AND tenant = ?`), id, tenant).Scan(&body)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, errNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    r := &savedRoute{Tenant: tenant}
+    if err := json.Unmarshal([]byte(body), r); err != nil {
+        return nil, fmt.Errorf("saved route %s: %v", id, err)
+    }
+    return r, nil
+}
+
+// addHistory stores a copy of r with the user's history, so it outlives
+// the saved route, and drops what is past the history's length.
+func (s *sqlStorage) addHistory(ctx context.Context, user string, r *savedRoute) error {
+    body, err := json.Marshal(r)
+    if err != nil {
+        return err
+    }
+    err = s.exec(ctx, `INSERT INTO route_history (tenant, user_id, route_id, created_ns, body) VALUES (?, ?, ?, ?, ?)`,
+        r.Tenant, user, r.ID, r.CreatedAt.UnixNano(), string(body))
+    if err != nil {
+        return err
+    }
+    return s.exec(ctx, `DELETE FROM route_history WHERE tenant = ? AND user_id = ? AND route_id NOT IN (
+        SELECT route_id FROM route_history WHERE tenant = ? AND user_id = ? ORDER BY created_ns DESC, route_id DESC LIMIT ?)`,
+        r.Tenant, user, r.Tenant, user, maxHistoryRoutes)
+}
+
+func (s *sqlStorage) history(ctx context.Context, tenant, user string, cursor historyCursor, limit int) ([]*savedRoute, error) {
+    cursor = cursor.orMax()
+    rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT body FROM route_history
+        WHERE tenant = ? AND user_id = ? AND (created_ns < ? OR created_ns = ? AND route_id < ?)
+        ORDER BY created_ns DESC, route_id DESC LIMIT ?`),
+        tenant, user, cursor.CreatedNS, cursor.CreatedNS, cursor.ID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var page []*savedRoute
+    for rows.Next() {
+        var body string
+        if err := rows.Scan(&body); err != nil {
+            return nil, err
+        }
+        r := &savedRoute{Tenant: tenant}
+        if err := json.Unmarshal([]byte(body), r); err != nil {
+            return nil, err
+        }
+        page = append(page, r)
+    }
+    return page, rows.Err()
+}
+
+func (s *sqlStorage) deleteHistory(ctx context.Context, tenant, user, id string) error {
+    result, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM route_history WHERE tenant = ? AND user_id = ? AND route_id = ?`), tenant, user, id)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err == nil && n == 0 {
+        return errNotFound
+    }
+    return err
+}
+
+func (s *sqlStorage) addMonitor(ctx context.Context, m *routeMonitor) error {
+    body, err := json.Marshal(m)
+    if err != nil {
+        return err
+    }
+    route, err := json.Marshal(m.Saved)
+    if err != nil {
+        return err
+    }
+    return s.exec(ctx, `INSERT INTO route_monitors (id, tenant, user_id, created_at, body, route) VALUES (?, ?, ?, ?, ?, ?)`,
+        m.ID, m.Tenant, m.User, m.CreatedAt.Format(time.RFC3339Nano), string(body), string(route))
+}
+
+// updateMonitor stores the monitor's state; its route never changes.
+func (s *sqlStorage) updateMonitor(ctx context.Context, m *routeMonitor) error {
+    body, err := json.Marshal(m)
+    if err != nil {
+        return err
+    }
+    result, err := s.db.ExecContext(ctx, s.rebind(`UPDATE route_monitors SET body = ? WHERE id = ?`), string(body), m.ID)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err == nil && n == 0 {
+        return errNotFound
+    }
+    return err
+}
+
+func (s *sqlStorage) monitors(ctx context.Context, tenant, user string) ([]*routeMonitor, error) {
+    return s.queryMonitors(ctx, `SELECT tenant, user_id, body, route FROM route_monitors WHERE tenant = ? AND user_id = ? ORDER BY created_at`, tenant, user)
+}
+
+func (s *sqlStorage) allMonitors(ctx context.Context) ([]*routeMonitor, error) {
+    return s.queryMonitors(ctx, `SELECT tenant, user_id, body, route FROM route_monitors ORDER BY created_at`)
+}
+
+func (s *sqlStorage) queryMonitors(ctx context.Context, query string, args ...interface{}) ([]*routeMonitor, error) {
+    rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var list []*routeMonitor
+    for rows.Next() {
+        var tenant, user, body, route string
+        if err := rows.Scan(&tenant, &user, &body, &route); err != nil {
+            return nil, err
+        }
+        m := &routeMonitor{Tenant: tenant, User: user, Saved: &savedRoute{Tenant: tenant}}
+        if err := json.Unmarshal([]byte(body), m); err != nil {
+            return nil, err
+        }
+        if err := json.Unmarshal([]byte(route), m.Saved); err != nil {
+            return nil, err
+        }
+        list = append(list, m)
+    }
+    return list, rows.Err()
+}
+
+func (s *sqlStorage) deleteMonitor(ctx context.Context, tenant, user, id string) error {
+    result, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM route_monitors WHERE tenant = ? AND user_id = ? AND id = ?`), tenant, user, id)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err == nil && n == 0 {
+        return errNotFound
+    }
+    return err
+}
+
+func (s *sqlStorage) notificationPrefs(ctx context.Context, tenant, user string) (notificationPrefs, error) {
+    p := notificationPrefs{Tenant: tenant, User: user}
+    var body string
+    err := s.db.QueryRowContext(ctx, s.rebind(`SELECT body FROM notification_prefs WHERE tenant = ? AND user_id = ?`), tenant, user).Scan(&body)
+    if errors.Is(err, sql.ErrNoRows) {
+        return p, nil
+    }
+    if err != nil {
+        return p, err
+    }
+    return p, json.Unmarshal([]byte(body), &p)
+}
+
+func (s *sqlStorage) setNotificationPrefs(ctx context.Context, p notificationPrefs) error {
+    body, err := json.Marshal(p)
+    if err != nil {
+        return err
+    }
+    return s.exec(ctx, `INSERT INTO notification_prefs (tenant, user_id, body) VALUES (?, ?, ?)
+        ON CONFLICT (tenant, user_id) DO UPDATE SET body = excluded.body`,
+        p.Tenant, p.User, string(body))
+}
+
+// notificationSubscribers filters by topic after loading, since topics
+// are kept in the preferences' JSON.
+func (s *sqlStorage) notificationSubscribers(ctx context.Context, tenant, topic string) ([]notificationPrefs, error) {
+    rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT tenant, user_id, body FROM notification_prefs WHERE ? = '' OR tenant = ?`), tenant, tenant)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var list []notificationPrefs
+    for rows.Next() {
+        var p notificationPrefs
+        var body string
+        if err := rows.Scan(&p.Tenant, &p.User, &body); err != nil {
+            return nil, err
+        }
+        if err := json.Unmarshal([]byte(body), &p); err != nil {
+            return nil, err
+        }
+        if p.wants(topic) {
+            list = append(list, p)
+        }
+    }
+    return list, rows.Err()
+}
+
+func (s *sqlStorage) setClosure(ctx context.Context, c closureRecord) error {
+    if !c.Closed {
+        return s.exec(ctx, `DELETE FROM closures WHERE tenant = ? AND from_x = ? AND from_y = ? AND to_x = ? AND to_y = ?`,
+            c.Tenant, c.From.X, c.From.Y, c.To.X, c.To.Y)
+    }
+    return s.exec(ctx, `INSERT INTO closures (tenant, from_x, from_y, to_x, to_y, closed_at) VALUES (?, ?, ?, ?, ?, ?)
+        ON CONFLICT (tenant, from_x, from_y, to_x, to_y) DO NOTHING`,
+        c.Tenant, c.From.X, c.From.Y, c.To.X, c.To.Y, time.Now().UTC().Format(time.RFC3339Nano))
+}
+
+func (s *sqlStorage) closures(ctx context.Context, tenant string) ([]closureRecord, error) {
+    rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT from_x, from_y, to_x, to_y FROM closures WHERE tenant = ?`), tenant)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var list []closureRecord
+    for rows.Next() {
+        c := closureRecord{Tenant: tenant, Closed: true}
+        if err := rows.Scan(&c.From.X, &c.From.Y, &c.To.X, &c.To.Y); err != nil {
+            return nil, err
+        }
+        list = append(list, c)
+    }
+    return list, rows.Err()
+}
+
+func (s *sqlStorage) saveTaskStatus(ctx context.Context, t taskStatus) error {
+    var lastRun sql.NullString
+    if t.LastRun != nil {
+        lastRun = sql.NullString{String: t.LastRun.UTC().Format(time.RFC3339Nano), Valid: true}
+    }
+    return s.exec(ctx, `INSERT INTO task_runs (name, runs, failures, last_run, last_duration_ms, last_error) VALUES (?, ?, ?, ?, ?, ?)
+        ON CONFLICT (name) DO UPDATE SET runs = excluded.runs, failures = excluded.failures, last_run = excluded.last_run,
+            last_duration_ms = excluded.last_duration_ms, last_error = excluded.last_error`,
+        t.Name, t.Runs, t.Failures, lastRun, t.LastDurationMS, t.LastError)
+}
+
+func (s *sqlStorage) taskStatuses(ctx context.Context) ([]taskStatus, error) {
+    rows, err := s.db.QueryContext(ctx, `SELECT name, runs, failures, last_run, last_duration_ms, last_error FROM task_runs`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var list []taskStatus
+    for rows.Next() {
+        var t taskStatus
+        var lastRun sql.NullString
+        if err := rows.Scan(&t.Name, &t.Runs, &t.Failures, &lastRun, &t.LastDurationMS, &t.LastError); err != nil {
+            return nil, err
+        }
+        if at, err := time.Parse(time.RFC3339Nano, lastRun.String); lastRun.Valid && err == nil {
+            t.LastRun = &at
+        }
+        list = append(list, t)
+    }
+    return list, rows.Err()
+}
+
+func (s *sqlStorage) retention() string {
+    return fmt.Sprintf("in the %s database, until deleted by the operator", s.kind)
+}
+
+func (s *sqlStorage) close() error { return s.db.Close() }
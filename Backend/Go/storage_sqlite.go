@@ -0,0 +1,8 @@
+//go:build sqlite
+
+package main
+
+// Building with -tags sqlite links a pure Go SQLite driver for sqlite
+// storage, so the binary needs no C toolchain or system library. The
+// default build leaves it out, though go.mod requires it.
+import _ "modernc.org/sqlite"
@@ -0,0 +1,46 @@
+//go:build sqlite
+
+package main
+
+import (
+    "context"
+    "path/filepath"
+    "testing"
+)
+
+func TestSQLiteStorage(t *testing.T) {
+    s, err := openSQLStorage("sqlite", filepath.Join(t.TempDir(), "storage.db"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.close()
+    testStorageRoundTrip(t, s)
+}
+
+// TestSQLiteStorageReopen checks that state outlives the connection, as
+// it must a restart.
+func TestSQLiteStorageReopen(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "storage.db")
+    s, err := openSQLStorage("sqlite", path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c := newClosureRecord("t1", Point{X: 0, Y: 0}, Point{X: 1, Y: 1}, true)
+    if err := s.setClosure(context.Background(), c); err != nil {
+        t.Fatal(err)
+    }
+    s.close()
+
+    s, err = openSQLStorage("sqlite", path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.close()
+    list, err := s.closures(context.Background(), "t1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(list) != 1 || list[0] != c {
+        t.Errorf("closures after reopening = %+v, want [%+v]", list, c)
+    }
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "slices"
+    "testing"
+    "time"
+)
+
+func TestMemoryStorage(t *testing.T) {
+    testStorageRoundTrip(t, newMemoryStorage())
+}
+
+func TestSQLRebind(t *testing.T) {
+    s := &sqlStorage{kind: "postgres"}
+    got := s.rebind(`SELECT body FROM t WHERE a = ? AND b = ?`)
+    if want := `SELECT body FROM t WHERE a = $1 AND b = $2`; got != want {
+        t.Errorf("rebind = %q, want %q", got, want)
+    }
+}
+
+// testStorageRoundTrip stores state of every kind in s and reads it back.
+// Tenants and IDs are unique to the run, so it may use a database other
+// runs left rows in.
+func testStorageRoundTrip(t *testing.T, s storage) {
+    t.Helper()
+    ctx := context.Background()
+    run := fmt.Sprintf("%d", time.Now().UnixNano())
+    tenant, other := "tenant-"+run, "other-"+run
+    created := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    route := func(n int) *savedRoute {
+        return &savedRoute{
+            ID:        fmt.Sprintf("route-%s-%d", run, n),
+            Tenant:    tenant,
+            CreatedAt: created.Add(time.Duration(n) * time.Minute),
+            Start:     Point{X: -87.66, Y: 41.87},
+            End:       Point{X: -87.65678, Y: 41.88286},
+            Alphas:    []float64{0, 0.5},
+        }
+    }
+
+    t.Run("routes", func(t *testing.T) {
+        want := route(0)
+        if err := s.saveRoute(ctx, want); err != nil {
+            t.Fatal(err)
+        }
+        got, err := s.route(ctx, want.ID, tenant)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got.ID != want.ID || got.Tenant != tenant || !got.CreatedAt.Equal(want.CreatedAt) ||
+            got.End != want.End || !slices.Equal(got.Alphas, want.Alphas) {
+            t.Errorf("route = %+v, want %+v", got, want)
+        }
+        if _, err := s.route(ctx, want.ID, other); !errors.Is(err, errNotFound) {
+            t.Errorf("another tenant's route: err = %v, want errNotFound", err)
+        }
+        if _, err := s.route(ctx, "missing-"+run, tenant); !errors.Is(err, errNotFound) {
+            t.Errorf("missing route: err = %v, want errNotFound", err)
+        }
+    })
+
+    t.Run("history", func(t *testing.T) {
+        for n := 1; n <= 3; n++ {
+            if err := s.addHistory(ctx, "ana", route(n)); err != nil {
+                t.Fatal(err)
+            }
+        }
+        page, err := s.history(ctx, tenant, "ana", historyCursor{}, 2)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if ids := routeIDs(page); !slices.Equal(ids, []string{route(3).ID, route(2).ID}) {
+            t.Fatalf("first page = %v", ids)
+        }
+        page, err = s.history(ctx, tenant, "ana", cursorOf(page[1]), 2)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if ids := routeIDs(page); !slices.Equal(ids, []string{route(1).ID}) {
+            t.Errorf("second page = %v", ids)
+        }
+        if page, _ := s.history(ctx, tenant, "bo", historyCursor{}, 10); len(page) != 0 {
+            t.Errorf("another user's history = %v", routeIDs(page))
+        }
+        if err := s.deleteHistory(ctx, tenant, "ana", route(2).ID); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.deleteHistory(ctx, tenant, "ana", route(2).ID); !errors.Is(err, errNotFound) {
+            t.Errorf("deleting twice: err = %v, want errNotFound", err)
+        }
+        page, _ = s.history(ctx, tenant, "ana", historyCursor{}, 10)
+        if ids := routeIDs(page); !slices.Equal(ids, []string{route(3).ID, route(1).ID}) {
+            t.Errorf("after delete = %v", ids)
+        }
+    })
+
+    t.Run("monitors", func(t *testing.T) {
+        m := &routeMonitor{
+            ID:        "monitor-" + run,
+            Tenant:    tenant,
+            User:      "ana",
+            RouteID:   route(0).ID,
+            Alpha:     0.5,
+            Threshold: 0.1,
+            CreatedAt: created,
+            Baseline:  0.2,
+            Saved:     route(0),
+        }
+        if err := s.addMonitor(ctx, m); err != nil {
+            t.Fatal(err)
+        }
+        updated := *m
+        updated.Alerts, updated.LastRisk = 1, 0.4
+        if err := s.updateMonitor(ctx, &updated); err != nil {
+            t.Fatal(err)
+        }
+        list, err := s.monitors(ctx, tenant, "ana")
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(list) != 1 {
+            t.Fatalf("monitors = %d, want 1", len(list))
+        }
+        got := list[0]
+        if got.ID != m.ID || got.Tenant != tenant || got.User != "ana" || got.Alerts != 1 || got.LastRisk != 0.4 ||
+            got.Saved == nil || got.Saved.ID != route(0).ID {
+            t.Errorf("monitor = %+v", got)
+        }
+        all, err := s.allMonitors(ctx)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !slices.ContainsFunc(all, func(a *routeMonitor) bool { return a.ID == m.ID }) {
+            t.Errorf("allMonitors misses %s", m.ID)
+        }
+        if err := s.deleteMonitor(ctx, tenant, "bo", m.ID); !errors.Is(err, errNotFound) {
+            t.Errorf("deleting another user's monitor: err = %v, want errNotFound", err)
+        }
+        if err := s.deleteMonitor(ctx, tenant, "ana", m.ID); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.updateMonitor(ctx, &updated); !errors.Is(err, errNotFound) {
+            t.Errorf("updating a deleted monitor: err = %v, want errNotFound", err)
+        }
+    })
+
+    t.Run("notification prefs", func(t *testing.T) {
+        p, err := s.notificationPrefs(ctx, tenant, "ana")
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(p.Channels) != 0 || p.Tenant != tenant || p.User != "ana" {
+            t.Errorf("unset prefs = %+v", p)
+        }
+        want := notificationPrefs{
+            Tenant:    tenant,
+            User:      "ana",
+            Channels:  []notificationChannel{{Kind: "webhook", Address: "https://example.com/hook"}},
+            Topics:    []string{"route_risk"},
+            UpdatedAt: created,
+        }
+        for _, p := range []notificationPrefs{{Tenant: tenant, User: "ana"}, want, {Tenant: other, User: "bo", Channels: want.Channels, Topics: want.Topics}} {
+            if err := s.setNotificationPrefs(ctx, p); err != nil {
+                t.Fatal(err)
+            }
+        }
+        got, err := s.notificationPrefs(ctx, tenant, "ana")
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !slices.Equal(got.Channels, want.Channels) || !slices.Equal(got.Topics, want.Topics) {
+            t.Errorf("prefs = %+v, want %+v", got, want)
+        }
+        users := func(of, topic string) []string {
+            list, err := s.notificationSubscribers(ctx, of, topic)
+            if err != nil {
+                t.Fatal(err)
+            }
+            var users []string
+            for _, p := range list {
+                if p.Tenant == tenant || p.Tenant == other {
+                    users = append(users, p.Tenant+"/"+p.User)
+                }
+            }
+            slices.Sort(users)
+            return users
+        }
+        if got := users(tenant, "route_risk"); !slices.Equal(got, []string{tenant + "/ana"}) {
+            t.Errorf("tenant's subscribers = %v", got)
+        }
+        if got := users(tenant, "closures"); len(got) != 0 {
+            t.Errorf("subscribers of another topic = %v", got)
+        }
+        all, err := s.notificationSubscribers(ctx, "", "route_risk")
+        if err != nil {
+            t.Fatal(err)
+        }
+        n := 0
+        for _, p := range all {
+            if p.Tenant == tenant || p.Tenant == other {
+                n++
+            }
+        }
+        if n != 2 {
+            t.Errorf("every tenant's subscribers: %d of this run's, want 2", n)
+        }
+    })
+
+    t.Run("closures", func(t *testing.T) {
+        c := newClosureRecord(tenant, Point{X: 1, Y: 2}, Point{X: 0, Y: 1}, true)
+        for i := 0; i < 2; i++ {
+            if err := s.setClosure(ctx, c); err != nil {
+                t.Fatal(err)
+            }
+        }
+        list, err := s.closures(ctx, tenant)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(list) != 1 || list[0] != c {
+            t.Errorf("closures = %+v, want [%+v]", list, c)
+        }
+        if list, _ := s.closures(ctx, other); len(list) != 0 {
+            t.Errorf("another tenant's closures = %+v", list)
+        }
+        c.Closed = false
+        if err := s.setClosure(ctx, c); err != nil {
+            t.Fatal(err)
+        }
+        if list, _ := s.closures(ctx, tenant); len(list) != 0 {
+            t.Errorf("closures after reopening = %+v", list)
+        }
+    })
+
+    t.Run("task statuses", func(t *testing.T) {
+        name := "task-" + run
+        ran := created.Add(time.Hour)
+        for _, st := range []taskStatus{
+            {Name: name, Runs: 1},
+            {Name: name, Runs: 2, Failures: 1, LastRun: &ran, LastDurationMS: 12.5, LastError: "boom"},
+        } {
+            if err := s.saveTaskStatus(ctx, st); err != nil {
+                t.Fatal(err)
+            }
+        }
+        list, err := s.taskStatuses(ctx)
+        if err != nil {
+            t.Fatal(err)
+        }
+        i := slices.IndexFunc(list, func(st taskStatus) bool { return st.Name == name })
+        if i < 0 {
+            t.Fatalf("taskStatuses misses %s", name)
+        }
+        got := list[i]
+        if got.Runs != 2 || got.Failures != 1 || got.LastRun == nil || !got.LastRun.Equal(ran) ||
+            got.LastDurationMS != 12.5 || got.LastError != "boom" {
+            t.Errorf("task status = %+v", got)
+        }
+    })
+}
+
+func routeIDs(routes []*savedRoute) []string {
+    ids := make([]string, len(routes))
+    for i, r := range routes {
+        ids[i] = r.ID
+    }
+    return ids
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "sort"
+
+    "risk-router/geo"
+)
+
+// RouteSummary describes a route's geometry so clients can fit the map to
+// it and show its statistics without walking the path.
+type RouteSummary struct {
+    // BBox is [min lon, min lat, max lon, max lat], as in GeoJSON.
+    BBox         [4]float64 `json:"bbox"`
+    PointCount   int        `json:"point_count"`
+    SegmentCount int        `json:"segment_count"`
+    LengthM      float64    `json:"length_m"`
+    // DurationS is the walking time at the configured speed, or the
+    // driving time on a drive leg.
+    DurationS float64 `json:"duration_s"`
+    // CrossingCount is the intersections the route passes through, where
+    // at least one other road meets it.
+    CrossingCount int `json:"crossing_count"`
+}
+
+// summarize builds the summary of a path found on r's graph, walked at
+// speedMPS meters per second.
+func (r *RiskAwareRouter) summarize(path []Point, speedMPS float64) RouteSummary {
+    s := RouteSummary{PointCount: len(path)}
+    if len(path) == 0 {
+        return s
+    }
+    s.SegmentCount = len(path) - 1
+    b := boundsOf(path)
+    s.BBox = [4]float64{b.MinX, b.MinY, b.MaxX, b.MaxY}
+    s.LengthM = geo.PolylineLength(path)
+    if speedMPS > 0 {
+        s.DurationS = s.LengthM / speedMPS
+    }
+    for i := 1; i < len(path)-1; i++ {
+        if n, ok := r.G.nodeAt(path[i]); ok && r.G.degree(n) > 2 {
+            s.CrossingCount++
+        }
+    }
+    return s
+}
+
+// nodeAt returns the ID of the node at exactly p.
+func (g *Graph) nodeAt(p Point) (int32, bool) {
+    n := sort.Search(len(g.Nodes), func(i int) bool { return !pointLess(g.Nodes[i], p) })
+    if n < len(g.Nodes) && g.Nodes[n] == p {
+        return int32(n), true
+    }
+    return 0, false
+}
+
+// referenceAlphas returns alphas with 0, the shortest route, moved or added
+// to the front, so every answer includes the reference the alternatives
+// are compared with.
+func referenceAlphas(alphas []float64) []float64 {
+    out := []float64{0}
+    for _, a := range alphas {
+        if a != 0 {
+            out = append(out, a)
+        }
+    }
+    return out
+}
+
+// compareTo sets the route's detour and risk reduction, in percent,
+// relative to the reference route.
+func (rt *Route) compareTo(reference Route) {
+    if reference.Summary.LengthM > 0 {
+        rt.DetourPct = (rt.Summary.LengthM - reference.Summary.LengthM) / reference.Summary.LengthM * 100
+    }
+    if reference.Risk > 0 {
+        rt.RiskReductionPct = (reference.Risk - rt.Risk) / reference.Risk * 100
+    }
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const defaultTenantID = "default"
+
+// TenantConfig describes one tenant of a hosted deployment. Every tenant
+// gets its own copy of its dataset, so data loaded for one tenant is never
+// visible to another.
+type TenantConfig struct {
+    ID                string    `json:"id"`
+    APIKeys           []string  `json:"api_keys"`
+    City              string    `json:"city"`
+    RoadNetworkPath   string    `json:"road_network_path"`
+    RequestsPerMinute int       `json:"requests_per_minute"`
+    DefaultAlphas     []float64 `json:"default_alphas"`
+    // HMACKeys are the secrets, by key ID, server-to-server callers sign
+    // requests with instead of sending an API key.
+    HMACKeys map[string]string `json:"hmac_keys"`
+    // CityPack names the city pack the tenant serves, in place of
+    // road_network_path.
+    CityPack string `json:"city_pack"`
+    // GBFSURL is the GBFS feed of the tenant's bike-share docks, in place
+    // of bike_share.feed_url.
+    GBFSURL string `json:"gbfs_url"`
+}
+
+// Tenant is the runtime state of a configured tenant.
+type Tenant struct {
+    ID      string
+    City    string
+    Dataset string
+    Alphas  []float64
+    // sources are the files the tenant's router is built from, and
+    // cityNames and pois what its city pack, if any, adds.
+    sources   dataSources
+    cityNames map[string]string
+    pois      []poi
+    // bikes are the docks of the tenant's bike-share feed, if it has one.
+    bikes *bikeShare
+
+    // router is replaced whole when the road network is reloaded, so a
+    // request keeps the router, and graph, it started with.
+    router    atomic.Pointer[RiskAwareRouter]
+    reloading sync.Mutex
+    quota     *quotaLimiter
+    metrics   tenantMetrics
+    // od tallies route requests for the route_prewarm task.
+    od odTally
+    // riskStale is whether the risk data was last found stale, so only
+    // changes are reported.
+    riskStale atomic.Bool
+}
+
+// Router returns the tenant's current router. Its graph is read-only, so
+// holding it needs no lock.
+func (t *Tenant) Router() *RiskAwareRouter {
+    return t.router.Load()
+}
+
+type tenantMetrics struct {
+    requests     atomic.Int64
+    clientErrors atomic.Int64
+    serverErrors atomic.Int64
+    throttled    atomic.Int64
+    // cancelled counts requests whose client disconnected mid-search.
+    cancelled atomic.Int64
+    // staleRisk counts route responses flagged as computed on stale risk
+    // data.
+    staleRisk atomic.Int64
+}
+
+type tenantMetricsSnapshot struct {
+    Requests     int64 `json:"requests"`
+    ClientErrors int64 `json:"client_errors"`
+    ServerErrors int64 `json:"server_errors"`
+    Throttled    int64 `json:"throttled"`
+    Cancelled    int64 `json:"cancelled"`
+    StaleRisk    int64 `json:"stale_risk_responses"`
+}
+
+func (m *tenantMetrics) snapshot() tenantMetricsSnapshot {
+    return tenantMetricsSnapshot{
+        Requests:     m.requests.Load(),
+        ClientErrors: m.clientErrors.Load(),
+        ServerErrors: m.serverErrors.Load(),
+        Throttled:    m.throttled.Load(),
+        Cancelled:    m.cancelled.Load(),
+        StaleRisk:    m.staleRisk.Load(),
+    }
+}
+
+// TenantRegistry resolves API keys to tenants. Without configured tenants
+// the registry is open: every request belongs to the default tenant and no
+// key is required.
+type TenantRegistry struct {
+    tenants []*Tenant
+    byKey   map[string]*Tenant
+    byID    map[string]*Tenant
+    open    bool
+
+    byHMACKey map[string]hmacKey
+    nonces    nonceCache
+}
+
+var globalTenants *TenantRegistry
+
+// initializeTenants loads every configured tenant, or wraps the global
+// router as the default tenant when none are configured.
+func initializeTenants() error {
+    registry := &TenantRegistry{
+        byKey:     make(map[string]*Tenant),
+        byID:      make(map[string]*Tenant),
+        byHMACKey: make(map[string]hmacKey),
+    }
+
+    packs, err := discoverCityPacks(globalConfig.CityPacksDir)
+    if err != nil {
+        return err
+    }
+    if len(globalConfig.Tenants) == 0 {
+        if len(packs) > 1 {
+            return fmt.Errorf("found %d city packs; configure a tenant with a city_pack for each", len(packs))
+        }
+        tenant := &Tenant{
+            ID:      defaultTenantID,
+            City:    globalConfig.City,
+            Dataset: globalConfig.RoadNetworkPath,
+            Alphas:  globalConfig.DefaultAlphas,
+            sources: globalConfig.dataSources(),
+        }
+        if len(packs) == 1 {
+            if err := tenant.usePack(packs[0]); err != nil {
+                return err
+            }
+        } else if err := tenant.loadParking(globalConfig.ParkingPath); err != nil {
+            return err
+        }
+        tenant.loadBikeShare(globalConfig.BikeShare.FeedURL)
+        if err := initializeRouter(tenant.sources); err != nil {
+            return err
+        }
+        registry.open = true
+        if err := globalRouter.restoreClosures(tenant.ID); err != nil {
+            return err
+        }
+        tenant.router.Store(globalRouter)
+        registry.add(tenant, nil, nil)
+        globalTenants = registry
+        return nil
+    }
+
+    for _, tc := range globalConfig.Tenants {
+        path := tc.RoadNetworkPath
+        if path == "" {
+            path = globalConfig.RoadNetworkPath
+        }
+        alphas := tc.DefaultAlphas
+        if len(alphas) == 0 {
+            alphas = globalConfig.DefaultAlphas
+        }
+        tenant := &Tenant{
+            ID:      tc.ID,
+            City:    tc.City,
+            Dataset: path,
+            Alphas:  alphas,
+            quota:   newQuotaLimiter(tc.RequestsPerMinute),
+            sources: globalConfig.dataSources(),
+        }
+        tenant.sources.RoadNetworkPath = path
+        if tc.CityPack != "" {
+            pack, err := cityPackByID(packs, tc.CityPack)
+            if err == nil {
+                err = tenant.usePack(pack)
+            }
+            if err != nil {
+                return fmt.Errorf("tenant %s: %v", tc.ID, err)
+            }
+        } else if err := tenant.loadParking(globalConfig.ParkingPath); err != nil {
+            return fmt.Errorf("tenant %s: %v", tc.ID, err)
+        }
+        feed := tc.GBFSURL
+        if feed == "" {
+            feed = globalConfig.BikeShare.FeedURL
+        }
+        tenant.loadBikeShare(feed)
+        router, err := buildRouter(tenant.sources, alphas)
+        if err != nil {
+            return fmt.Errorf("tenant %s: %v", tc.ID, err)
+        }
+        if err := router.restoreClosures(tc.ID); err != nil {
+            return fmt.Errorf("tenant %s: %v", tc.ID, err)
+        }
+        tenant.router.Store(router)
+        if tenant.City == "" {
+            tenant.City = globalConfig.City
+        }
+        registry.add(tenant, tc.APIKeys, tc.HMACKeys)
+        log.Printf("Loaded tenant %s from %s", tc.ID, tenant.Dataset)
+    }
+    globalTenants = registry
+    return nil
+}
+
+func (reg *TenantRegistry) add(t *Tenant, keys []string, hmacKeys map[string]string) {
+    reg.tenants = append(reg.tenants, t)
+    reg.byID[t.ID] = t
+    for _, key := range keys {
+        reg.byKey[key] = t
+    }
+    for id, secret := range hmacKeys {
+        reg.byHMACKey[id] = hmacKey{tenant: t, secret: []byte(secret)}
+    }
+}
+
+// lookup resolves the tenant for a request's API key.
+func (reg *TenantRegistry) lookup(key string) (*Tenant, bool) {
+    if reg.open {
+        return reg.tenants[0], true
+    }
+    t, ok := reg.byKey[key]
+    return t, ok
+}
+
+// apiKeyFromRequest reads the caller's key from X-API-Key or a bearer token.
+func apiKeyFromRequest(r *http.Request) string {
+    if key := r.Header.Get("X-API-Key"); key != "" {
+        return key
+    }
+    if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+        return strings.TrimPrefix(auth, "Bearer ")
+    }
+    return ""
+}
+
+type tenantContextKey struct{}
+
+
+// tenantByID resolves a tenant named by an admin operation; an empty ID
+// means the default tenant when the registry is open.
+func tenantByID(id string) (*Tenant, error) {
+    if id == "" {
+        if !globalTenants.open {
+            return nil, fmt.Errorf("a tenant must be named")
+        }
+        id = defaultTenantID
+    }
+    t, ok := globalTenants.byID[id]
+    if !ok {
+        return nil, fmt.Errorf("unknown tenant %s", id)
+    }
+    return t, nil
+}
+
+func tenantFromContext(ctx context.Context) *Tenant {
+    t, _ := ctx.Value(tenantContextKey{}).(*Tenant)
+    return t
+}
+
+// withTenant resolves the calling tenant, by API key or, for a signed
+// request, HMAC key, enforces its quota and records per-tenant metrics
+// before handing the request on.
+func withTenant(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var tenant *Tenant
+        if signedRequest(r) && !globalTenants.open {
+            var err error
+            if tenant, err = globalTenants.verifySigned(w, r, time.Now()); err != nil {
+                var tooLarge *http.MaxBytesError
+                if errors.As(err, &tooLarge) {
+                    writeAPIError(w, http.StatusRequestEntityTooLarge, APIError{
+                        Code:    "body_too_large",
+                        Message: fmt.Sprintf("a signed request's body may be at most %d bytes", tooLarge.Limit),
+                    })
+                    return
+                }
+                writeAPIError(w, http.StatusUnauthorized, APIError{Code: "unauthorized", Message: err.Error()})
+                return
+            }
+        } else {
+            var ok bool
+            if tenant, ok = globalTenants.lookup(apiKeyFromRequest(r)); !ok {
+                writeAPIError(w, http.StatusUnauthorized, APIError{Code: "unauthorized", Message: "missing or unknown API key"})
+                return
+            }
+        }
+
+        if scope := scopeFromContext(r.Context()); scope != nil {
+            scope.tenant = tenant
+        }
+        tenant.metrics.requests.Add(1)
+        now := time.Now()
+        allowed, remaining, reset := tenant.quota.allow(now)
+        tenant.quota.writeHeaders(w, allowed, remaining, reset, now)
+        if !allowed {
+            tenant.metrics.throttled.Add(1)
+            writeAPIError(w, http.StatusTooManyRequests, APIError{
+                Code:    "quota_exceeded",
+                Message: "request quota exceeded",
+                Details: map[string]interface{}{"retry_after_seconds": int(math.Ceil(reset.Sub(now).Seconds()))},
+            })
+            return
+        }
+
+        rec := newStatusRecorder(w)
+        handler(rec, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant)))
+        switch {
+        case rec.status >= 500:
+            tenant.metrics.serverErrors.Add(1)
+        case rec.status >= 400:
+            tenant.metrics.clientErrors.Add(1)
+        }
+    }
+}
+
+type tenantInfo struct {
+    ID                string                `json:"id"`
+    City              string                `json:"city"`
+    Dataset           string                `json:"dataset"`
+    GraphVersion      string                `json:"graph_version"`
+    RiskVersion       string                `json:"risk_version"`
+    Nodes             int                   `json:"nodes"`
+    RequestsPerMinute int                   `json:"requests_per_minute"`
+    DefaultAlphas     []float64             `json:"default_alphas"`
+    Metrics           tenantMetricsSnapshot `json:"metrics"`
+}
+
+func (t *Tenant) info() tenantInfo {
+    perMinute := 0
+    if t.quota != nil {
+        perMinute = t.quota.limit
+    }
+    router := t.Router()
+    return tenantInfo{
+        ID:                t.ID,
+        City:              t.City,
+        Dataset:           t.Dataset,
+        GraphVersion:      router.G.Version,
+        RiskVersion:       router.activeLayer().Version,
+        Nodes:             len(router.G.Nodes),
+        RequestsPerMinute: perMinute,
+        DefaultAlphas:     t.Alphas,
+        Metrics:           t.metrics.snapshot(),
+    }
+}
+
+// handleAdminTenants serves GET /admin/tenants and GET /admin/tenants/{id}.
+func handleAdminTenants(w http.ResponseWriter, r *http.Request) {
+    var response interface{}
+    if id := r.PathValue("id"); id != "" {
+        tenant, ok := globalTenants.byID[id]
+        if !ok {
+            writeAPIError(w, http.StatusNotFound, APIError{Code: "not_found", Message: "unknown tenant " + id})
+            return
+        }
+        response = tenant.info()
+    } else {
+        infos := make([]tenantInfo, 0, len(globalTenants.tenants))
+        for _, t := range globalTenants.tenants {
+            infos = append(infos, t.info())
+        }
+        response = struct {
+            Tenants []tenantInfo `json:"tenants"`
+        }{infos}
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode tenant response: %v", err)
+    }
+}
+
+// reload rebuilds the tenant's router from its dataset and swaps it in;
+// requests already running finish on the old one. Imported crime data
+// carries over. Closures and overlays name the old graph's edges, so
+// they are dropped, and hubs are recomputed in the background.
+func (t *Tenant) reload() (old, loaded *RiskAwareRouter, err error) {
+    t.reloading.Lock()
+    defer t.reloading.Unlock()
+    loaded, err = buildRouter(t.sources, t.Alphas)
+    if err != nil {
+        return nil, nil, err
+    }
+    old = t.Router()
+    loaded.CrimeData = old.CrimeData
+    if err := loaded.restoreClosures(t.ID); err != nil {
+        return nil, nil, err
+    }
+    t.router.Store(loaded)
+    dataChanged(loaded)
+    log.Printf("Reloaded tenant %s from %s: graph %s replaces %s", t.ID, t.Dataset, loaded.G.Version, old.G.Version)
+    notifyJobDone(t.ID, "graph_reload", "The road network was updated.")
+    return old, loaded, nil
+}
+
+// handleAdminGraphReload serves POST /admin/graph/reload, which reloads a
+// tenant's road network from its dataset without a restart.
+func handleAdminGraphReload(w http.ResponseWriter, r *http.Request) {
+    tenant, err := tenantByID(r.URL.Query().Get("tenant"))
+    if err != nil {
+        writeBadRequest(w, err.Error())
+        return
+    }
+    auditFromContext(r.Context()).Target = "tenant=" + tenant.ID
+    began := time.Now()
+    old, loaded, err := tenant.reload()
+    if err != nil {
+        writeAPIError(w, http.StatusUnprocessableEntity, APIError{Code: "reload_failed", Message: err.Error()})
+        return
+    }
+    response := struct {
+        Tenant               string  `json:"tenant"`
+        PreviousGraphVersion string  `json:"previous_graph_version"`
+        GraphVersion         string  `json:"graph_version"`
+        RiskVersion          string  `json:"risk_version"`
+        Nodes                int     `json:"nodes"`
+        LoadMS               float64 `json:"load_ms"`
+    }{tenant.ID, old.G.Version, loaded.G.Version, loaded.activeLayer().Version, len(loaded.G.Nodes), msSince(began)}
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode reload response: %v", err)
+    }
+}
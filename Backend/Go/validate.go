@@ -0,0 +1,222 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "sort"
+
+    "risk-router/geo"
+)
+
+// Severities of validation issues: the loader drops or misreads what an
+// error describes, and loads what a warning describes as it is.
+const (
+    severityError   = "error"
+    severityWarning = "warning"
+)
+
+// validationIssue is one problem in a road network file, located by
+// feature index and, for segment problems, by segment index within it.
+type validationIssue struct {
+    Feature  int         `json:"feature"`
+    Segment  *int        `json:"segment,omitempty"`
+    ID       interface{} `json:"id,omitempty"`
+    Code     string      `json:"code"`
+    Severity string      `json:"severity"`
+    Message  string      `json:"message"`
+}
+
+// validationReport is what validate prints: counts of every issue code
+// and the first issues found.
+type validationReport struct {
+    Path      string            `json:"path"`
+    Features  int               `json:"features"`
+    Segments  int               `json:"segments"`
+    Valid     bool              `json:"valid"`
+    Errors    int               `json:"errors"`
+    Warnings  int               `json:"warnings"`
+    Counts    map[string]int    `json:"counts"`
+    Issues    []validationIssue `json:"issues"`
+    Truncated bool              `json:"truncated,omitempty"`
+
+    maxIssues int
+}
+
+func (rep *validationReport) add(issue validationIssue) {
+    rep.Counts[issue.Code]++
+    if issue.Severity == severityError {
+        rep.Errors++
+    } else {
+        rep.Warnings++
+    }
+    if len(rep.Issues) < rep.maxIssues {
+        rep.Issues = append(rep.Issues, issue)
+    } else {
+        rep.Truncated = true
+    }
+}
+
+// validateRoadNetwork checks GeoJSON data for what the loader cares about:
+// features it would skip, coordinates it cannot read, segments outside
+// clip (unless nil) or shorter than minLengthM, risk scores it would
+// default or misread, and segments repeated with the same ends, of which
+// it keeps one.
+func validateRoadNetwork(data []byte, clip *Bounds, minLengthM float64, maxIssues int) (*validationReport, error) {
+    var geojson map[string]interface{}
+    if err := json.Unmarshal(data, &geojson); err != nil {
+        return nil, err
+    }
+    features, ok := geojson["features"].([]interface{})
+    if !ok {
+        return nil, fmt.Errorf("invalid GeoJSON: no features array")
+    }
+
+    rep := &validationReport{Features: len(features), Counts: map[string]int{}, Issues: []validationIssue{}, maxIssues: maxIssues}
+    seen := make(map[segmentKey][2]int)
+    for i, feature := range features {
+        f, ok := feature.(map[string]interface{})
+        if !ok {
+            rep.add(validationIssue{Feature: i, Code: "not_an_object", Severity: severityError, Message: "feature is not an object"})
+            continue
+        }
+        issue := func(segment *int, code, severity, format string, args ...interface{}) {
+            rep.add(validationIssue{Feature: i, Segment: segment, ID: f["id"], Code: code, Severity: severity, Message: fmt.Sprintf(format, args...)})
+        }
+
+        geometry, ok := f["geometry"].(map[string]interface{})
+        if !ok {
+            issue(nil, "missing_geometry", severityError, "feature has no geometry")
+            continue
+        }
+        if kind, _ := geometry["type"].(string); kind != "LineString" {
+            issue(nil, "not_linestring", severityError, "geometry is a %q, only LineStrings are loaded", kind)
+            continue
+        }
+        coordinates, ok := geometry["coordinates"].([]interface{})
+        if !ok || len(coordinates) < 2 {
+            issue(nil, "too_few_coordinates", severityError, "LineString has fewer than two coordinates")
+            continue
+        }
+
+        properties, _ := f["properties"].(map[string]interface{})
+        switch risk, exists := properties["risk_score"]; {
+        case !exists:
+            issue(nil, "missing_risk_score", severityWarning, "no risk_score; the loader uses 0.5")
+        default:
+            if v, ok := risk.(float64); !ok {
+                issue(nil, "invalid_risk_score", severityError, "risk_score %v is not a number; the loader reads it as 0", risk)
+            } else if v < 0 || v > 1 {
+                issue(nil, "risk_score_out_of_range", severityWarning, "risk_score %v is outside [0, 1]", v)
+            }
+        }
+
+        points := make([]*Point, len(coordinates))
+        for j, c := range coordinates {
+            var x, y float64
+            okX, okY := false, false
+            if pair, ok := c.([]interface{}); ok && len(pair) >= 2 {
+                x, okX = pair[0].(float64)
+                y, okY = pair[1].(float64)
+            }
+            if !okX || !okY {
+                issue(nil, "bad_coordinate", severityError, "coordinate %d is not a pair of numbers; the loader cannot read it", j)
+                continue
+            }
+            if x < -180 || x > 180 || y < -90 || y > 90 {
+                issue(nil, "coordinate_out_of_range", severityError, "coordinate %d (%v, %v) is not a longitude and latitude", j, x, y)
+                continue
+            }
+            points[j] = &Point{X: x, Y: y}
+        }
+
+        for j := 0; j+1 < len(points); j++ {
+            segment := j
+            a, b := points[j], points[j+1]
+            if a == nil || b == nil {
+                // The bad coordinate is already reported.
+                continue
+            }
+            rep.Segments++
+            if clip != nil && !(isInBounds(*a, *clip) && isInBounds(*b, *clip)) {
+                issue(&segment, "outside_load_bounds", severityWarning, "segment is outside the load bounds and will be dropped")
+                continue
+            }
+            length := geo.Haversine(*a, *b)
+            switch {
+            case length == 0:
+                issue(&segment, "zero_length_segment", severityError, "segment starts and ends at the same point; the loader drops it")
+                continue
+            case length < minLengthM:
+                issue(&segment, "short_segment", severityWarning, "segment is %.2f m long, under %v m", length, minLengthM)
+            }
+            key := segmentKey{*a, *b}
+            if pointLess(*b, *a) {
+                key = segmentKey{*b, *a}
+            }
+            if prev, dup := seen[key]; dup {
+                issue(&segment, "duplicate_segment", severityWarning, "same ends as feature %d segment %d; the loader keeps one by the duplicate_edges policy", prev[0], prev[1])
+            }
+            seen[key] = [2]int{i, j}
+        }
+    }
+    rep.Valid = rep.Errors == 0
+    return rep, nil
+}
+
+// runValidate checks a road network file and prints a JSON report. It
+// fails when the report has errors, or warnings too with -strict.
+func runValidate(args []string) error {
+    fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+    bounds := fs.String("bounds", "", `load bounds minX,minY,maxX,maxY, or "all" to keep every segment (default Chicago)`)
+    minLength := fs.Float64("min-length-m", 1, "warn about segments shorter than this, in meters")
+    maxIssues := fs.Int("max-issues", 1000, "list at most this many issues; counts cover them all")
+    strict := fs.Bool("strict", false, "fail on warnings as well as errors")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if fs.NArg() != 1 {
+        return fmt.Errorf("usage: validate [-bounds all|minX,minY,maxX,maxY] [-min-length-m 1] [-max-issues 1000] [-strict] roads.geojson")
+    }
+    clip := &chicagoBounds
+    switch *bounds {
+    case "":
+    case boundsAll:
+        clip = nil
+    default:
+        b, err := parseBounds(*bounds)
+        if err != nil {
+            return err
+        }
+        clip = &b
+    }
+
+    path := fs.Arg(0)
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    rep, err := validateRoadNetwork(data, clip, *minLength, *maxIssues)
+    if err != nil {
+        return fmt.Errorf("%s: %v", path, err)
+    }
+    rep.Path = path
+    if *strict {
+        rep.Valid = rep.Valid && rep.Warnings == 0
+    }
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetIndent("", "  ")
+    if err := enc.Encode(rep); err != nil {
+        return err
+    }
+    if !rep.Valid {
+        codes := make([]string, 0, len(rep.Counts))
+        for code := range rep.Counts {
+            codes = append(codes, code)
+        }
+        sort.Strings(codes)
+        return fmt.Errorf("%s: %d errors, %d warnings (%v)", path, rep.Errors, rep.Warnings, codes)
+    }
+    return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "hash"
+    "math"
+)
+
+// computeVersions fingerprints the indexed graph. The graph version covers
+// topology and edge lengths; the risk version covers risk scores only, so a
+// risk refresh over unchanged roads keeps the graph version stable.
+func (g *Graph) computeVersions() {
+    topo := sha256.New()
+    for id, p := range g.Nodes {
+        writeFloats(topo, p.X, p.Y)
+        lo, hi := g.edgeRange(int32(id))
+        for e := lo; e < hi; e++ {
+            writeFloats(topo, float64(g.targets[e]), g.dist[e])
+        }
+    }
+    g.Version = shortHash(topo)
+    g.RiskVersion = g.hashRisk(g.risk)
+}
+
+func writeFloats(h hash.Hash, values ...float64) {
+    var buf [8]byte
+    for _, v := range values {
+        binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+        h.Write(buf[:])
+    }
+}
+
+func shortHash(h hash.Hash) string {
+    return hex.EncodeToString(h.Sum(nil))[:12]
+}
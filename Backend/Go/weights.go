@@ -0,0 +1,189 @@
+package main
+
+import (
+    "sync"
+    "sync/atomic"
+)
+
+// edgeWeights holds a flat per-edge weight slice for each risk layer and
+// alpha the router serves. The slices for the current layer are filled when
+// the router is built, so the search loop indexes an array instead of
+// computing or caching weights per edge.
+type edgeWeights struct {
+    mu      sync.RWMutex
+    byAlpha map[weightKey][]float64
+
+    hits   atomic.Int64
+    misses atomic.Int64
+}
+
+type weightKey struct {
+    riskVersion string
+    alpha       float64
+    // mainStreets and protectedLanes mark weights with the main-streets
+    // or protected-lanes term added.
+    mainStreets    bool
+    protectedLanes bool
+}
+
+// computeWeights blends distance and the layer's risk for every directed
+// edge of g at the given alpha.
+func computeWeights(g *Graph, layer *riskLayer, alpha float64) []float64 {
+    w := make([]float64, len(g.targets))
+    for e := range w {
+        normDistance := g.dist[e] / g.maxDist
+        w[e] = ((1-alpha)*normDistance + alpha*layer.risk[e]) * g.maxDist
+    }
+    return w
+}
+
+// mainStreetFactor is what an edge's weight is multiplied by to prefer
+// main streets: 1 on primary roads, growing by bias/classPrimary for each
+// class below, so with a bias of 1 the minor roads cost double.
+func mainStreetFactor(a edgeAttrs, bias float64) float64 {
+    return 1 + bias*float64(classPrimary-a.class())/float64(classPrimary)
+}
+
+// protectedLaneFactor is what an edge's weight is multiplied by to prefer
+// protected bike lanes: 1 on them, 1 + bias elsewhere.
+func protectedLaneFactor(a edgeAttrs, bias float64) float64 {
+    if a&attrProtectedLane != 0 {
+        return 1
+    }
+    return 1 + bias
+}
+
+// mainStreetWeights returns the edge weights for alpha on a risk layer
+// with the main-streets term, or the plain ones when the router has no
+// road attributes. Like the plain weights they are computed once and kept.
+func (r *RiskAwareRouter) mainStreetWeights(layer *riskLayer, alpha float64) []float64 {
+    return r.attrWeights(layer, weightKey{layer.Version, alpha, true, false}, func(a edgeAttrs) float64 {
+        return mainStreetFactor(a, globalConfig.MainStreetsBias)
+    })
+}
+
+// protectedLaneWeights is mainStreetWeights with the protected-lanes term.
+func (r *RiskAwareRouter) protectedLaneWeights(layer *riskLayer, alpha float64) []float64 {
+    return r.attrWeights(layer, weightKey{layer.Version, alpha, false, true}, func(a edgeAttrs) float64 {
+        return protectedLaneFactor(a, globalConfig.ProtectedLanesBias)
+    })
+}
+
+// attrWeights returns the weights of key, the plain ones multiplied by
+// each edge's factor of its road attributes.
+func (r *RiskAwareRouter) attrWeights(layer *riskLayer, key weightKey, factor func(edgeAttrs) float64) []float64 {
+    if r.attrs == nil {
+        return r.weightsFor(layer, key.alpha)
+    }
+    r.weights.mu.RLock()
+    w, ok := r.weights.byAlpha[key]
+    r.weights.mu.RUnlock()
+    if ok {
+        r.weights.hits.Add(1)
+        return w
+    }
+    r.weights.misses.Add(1)
+    base := r.weightsFor(layer, key.alpha)
+    w = make([]float64, len(base))
+    for e := range w {
+        w[e] = base[e] * factor(r.attrs[e])
+    }
+    r.weights.mu.Lock()
+    if r.weights.byAlpha == nil {
+        r.weights.byAlpha = make(map[weightKey][]float64)
+    }
+    r.weights.byAlpha[key] = w
+    r.weights.mu.Unlock()
+    return w
+}
+
+// precomputeWeights fills the current layer's weight slices for alphas not
+// already held.
+func (r *RiskAwareRouter) precomputeWeights(alphas []float64) {
+    r.precomputeLayerWeights(r.layers.current(), alphas)
+}
+
+func (r *RiskAwareRouter) precomputeLayerWeights(layer *riskLayer, alphas []float64) {
+    r.weights.mu.Lock()
+    defer r.weights.mu.Unlock()
+    if r.weights.byAlpha == nil {
+        r.weights.byAlpha = make(map[weightKey][]float64, len(alphas))
+    }
+    for _, alpha := range alphas {
+        key := weightKey{layer.Version, alpha, false, false}
+        if _, ok := r.weights.byAlpha[key]; !ok {
+            r.weights.byAlpha[key] = computeWeights(r.G, layer, alpha)
+        }
+    }
+}
+
+// weightsFor returns the edge weights for alpha on a risk layer. A pair
+// outside the precomputed set is computed once and kept.
+func (r *RiskAwareRouter) weightsFor(layer *riskLayer, alpha float64) []float64 {
+    key := weightKey{layer.Version, alpha, false, false}
+    r.weights.mu.RLock()
+    w, ok := r.weights.byAlpha[key]
+    r.weights.mu.RUnlock()
+    if ok {
+        r.weights.hits.Add(1)
+    } else {
+        r.weights.misses.Add(1)
+        r.precomputeLayerWeights(layer, []float64{alpha})
+        r.weights.mu.RLock()
+        w = r.weights.byAlpha[key]
+        r.weights.mu.RUnlock()
+    }
+    return w
+}
+
+// held reports whether weights for alpha on a risk layer are precomputed.
+func (w *edgeWeights) held(version string, alpha float64) bool {
+    w.mu.RLock()
+    defer w.mu.RUnlock()
+    _, ok := w.byAlpha[weightKey{version, alpha, false, false}]
+    return ok
+}
+
+// alphasFor lists the alphas plain weights are held for on a risk layer.
+func (w *edgeWeights) alphasFor(version string) []float64 {
+    w.mu.RLock()
+    defer w.mu.RUnlock()
+    var alphas []float64
+    for key := range w.byAlpha {
+        if key.riskVersion == version && !key.mainStreets {
+            alphas = append(alphas, key.alpha)
+        }
+    }
+    return alphas
+}
+
+// drop releases the weight slices of a risk layer that is no longer served.
+func (w *edgeWeights) drop(version string) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    for key := range w.byAlpha {
+        if key.riskVersion == version {
+            delete(w.byAlpha, key)
+        }
+    }
+}
+
+func (w *edgeWeights) stats() cacheStats {
+    s := cacheStats{Name: "weights"}
+    w.mu.RLock()
+    s.Entries = len(w.byAlpha)
+    for _, ws := range w.byAlpha {
+        s.Bytes += int64(len(ws)) * 8
+    }
+    w.mu.RUnlock()
+    s.setHits(w.hits.Load(), w.misses.Load())
+    return s
+}
+
+// flush drops every weight slice; they are rebuilt on the next search at
+// each layer and alpha.
+func (w *edgeWeights) flush() {
+    w.mu.Lock()
+    w.byAlpha = nil
+    w.mu.Unlock()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "runtime"
+    "sync"
+    "time"
+)
+
+// searchClass is the priority of a search: free workers go to waiting
+// interactive searches before batch ones.
+type searchClass int
+
+const (
+    // classInteractive is a user waiting on a route.
+    classInteractive searchClass = iota
+    // classBatch is matrix requests and background work such as hub
+    // warmup.
+    classBatch
+    numSearchClasses
+)
+
+var searchClassNames = [numSearchClasses]string{"interactive", "batch"}
+
+type searchClassKey struct{}
+
+// withSearchClass returns ctx with its searches run at class.
+func withSearchClass(ctx context.Context, class searchClass) context.Context {
+    return context.WithValue(ctx, searchClassKey{}, class)
+}
+
+// searchClassFrom returns the class of ctx's searches, interactive unless
+// set.
+func searchClassFrom(ctx context.Context) searchClass {
+    if class, ok := ctx.Value(searchClassKey{}).(searchClass); ok {
+        return class
+    }
+    return classInteractive
+}
+
+// batchSearches runs a route's searches in the batch class.
+func batchSearches(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        next(w, r.WithContext(withSearchClass(r.Context(), classBatch)))
+    }
+}
+
+// searchWorkers bounds how many searches run at once. A search holds a
+// worker for its whole run; when one is freed it goes to the oldest
+// waiting interactive search, then to the oldest batch one. Batch
+// searches never hold more than batchMax workers, so the rest are always
+// free for interactive ones. A nil pool runs every search at once.
+type searchWorkers struct {
+    mu       sync.Mutex
+    size     int
+    batchMax int
+    running  [numSearchClasses]int
+    queues   [numSearchClasses][]chan struct{}
+    stats    [numSearchClasses]searchClassStats
+}
+
+// searchClassStats counts one class's use of the pool.
+type searchClassStats struct {
+    Running   int     `json:"running"`
+    Queued    int     `json:"queued"`
+    MaxQueued int     `json:"max_queued"`
+    Started   int64   `json:"started"`
+    Waited    int64   `json:"waited"`
+    Abandoned int64   `json:"abandoned"`
+    WaitMS    float64 `json:"wait_ms"`
+}
+
+var globalSearchWorkers *searchWorkers
+
+// newSearchWorkers sizes a pool from cfg: SearchWorkers workers, by
+// default one per CPU, of which BatchSearchWorkers, by default half,
+// may run batch searches.
+func newSearchWorkers(cfg Config) *searchWorkers {
+    size := cfg.SearchWorkers
+    if size == 0 {
+        size = runtime.GOMAXPROCS(0)
+    }
+    batchMax := cfg.BatchSearchWorkers
+    if batchMax == 0 {
+        batchMax = max(size/2, 1)
+    }
+    return &searchWorkers{size: size, batchMax: min(batchMax, size)}
+}
+
+func checkSearchWorkers(workers, batch int) error {
+    if workers < 0 {
+        return fmt.Errorf("search_workers must not be negative, got %d", workers)
+    }
+    if batch < 0 || workers > 0 && batch > workers {
+        return fmt.Errorf("batch_search_workers must be within [0, search_workers], got %d", batch)
+    }
+    return nil
+}
+
+// free reports whether a search of class could start now.
+func (p *searchWorkers) free(class searchClass) bool {
+    total := 0
+    for _, n := range p.running {
+        total += n
+    }
+    return total < p.size && (class != classBatch || p.running[classBatch] < p.batchMax)
+}
+
+// acquire waits for a worker for a search of ctx's class and returns the
+// function that frees it, or ctx's error if ctx ends first.
+func (p *searchWorkers) acquire(ctx context.Context) (func(), error) {
+    if p == nil {
+        return func() {}, nil
+    }
+    class := searchClassFrom(ctx)
+    release := func() { p.release(class) }
+    p.mu.Lock()
+    if p.free(class) && len(p.queues[classInteractive]) == 0 && len(p.queues[class]) == 0 {
+        p.running[class]++
+        p.stats[class].Started++
+        p.mu.Unlock()
+        return release, nil
+    }
+    ready := make(chan struct{})
+    p.queues[class] = append(p.queues[class], ready)
+    p.stats[class].Waited++
+    p.stats[class].MaxQueued = max(p.stats[class].MaxQueued, len(p.queues[class]))
+    p.mu.Unlock()
+
+    began := time.Now()
+    select {
+    case <-ready:
+        p.mu.Lock()
+        p.stats[class].WaitMS += msSince(began)
+        p.mu.Unlock()
+        return release, nil
+    case <-ctx.Done():
+    }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.stats[class].Abandoned++
+    p.stats[class].WaitMS += msSince(began)
+    for i, q := range p.queues[class] {
+        if q == ready {
+            p.queues[class] = append(p.queues[class][:i], p.queues[class][i+1:]...)
+            return nil, ctx.Err()
+        }
+    }
+    // The worker was handed over as ctx ended; pass it on.
+    p.running[class]--
+    p.dispatch()
+    return nil, ctx.Err()
+}
+
+func (p *searchWorkers) release(class searchClass) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.running[class]--
+    p.dispatch()
+}
+
+// dispatch hands free workers to waiting searches, interactive first.
+func (p *searchWorkers) dispatch() {
+    for class := classInteractive; class < numSearchClasses; {
+        if len(p.queues[class]) == 0 || !p.free(class) {
+            class++
+            continue
+        }
+        close(p.queues[class][0])
+        p.queues[class] = p.queues[class][1:]
+        p.running[class]++
+        p.stats[class].Started++
+    }
+}
+
+// snapshot returns each class's counters by name.
+func (p *searchWorkers) snapshot() map[string]searchClassStats {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    classes := make(map[string]searchClassStats, numSearchClasses)
+    for class, stats := range p.stats {
+        stats.Running = p.running[class]
+        stats.Queued = len(p.queues[class])
+        classes[searchClassNames[class]] = stats
+    }
+    return classes
+}
+
+// handleAdminSearchWorkers serves GET /admin/search-workers, the pool's
+// size and each class's running and queued searches.
+func handleAdminSearchWorkers(w http.ResponseWriter, r *http.Request) {
+    p := globalSearchWorkers
+    response := struct {
+        Workers      int                         `json:"workers"`
+        BatchWorkers int                         `json:"batch_workers"`
+        Classes      map[string]searchClassStats `json:"classes"`
+    }{p.size, p.batchMax, p.snapshot()}
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Printf("Failed to encode search workers: %v", err)
+    }
+}
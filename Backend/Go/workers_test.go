@@ -0,0 +1,293 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "testing"
+    "time"
+)
+
+var (
+    interactiveCtx = context.Background()
+    batchCtx       = withSearchClass(context.Background(), classBatch)
+)
+
+// waitQueued waits until the pool has n searches of class queued.
+func waitQueued(t *testing.T, p *searchWorkers, class searchClass, n int) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        p.mu.Lock()
+        queued := len(p.queues[class])
+        p.mu.Unlock()
+        if queued == n {
+            return
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("%d %s searches queued, want %d", queued, searchClassNames[class], n)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+// acquireAsync acquires a worker on its own goroutine and sends its name
+// once it has one.
+func acquireAsync(p *searchWorkers, ctx context.Context, name string, got chan<- string) <-chan func() {
+    releases := make(chan func(), 1)
+    go func() {
+        release, err := p.acquire(ctx)
+        if err != nil {
+            got <- name + ": " + err.Error()
+            return
+        }
+        got <- name
+        releases <- release
+    }()
+    return releases
+}
+
+func TestSearchWorkersPriority(t *testing.T) {
+    p := &searchWorkers{size: 1, batchMax: 1}
+    hold, err := p.acquire(interactiveCtx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := make(chan string, 3)
+    batch := acquireAsync(p, batchCtx, "batch", got)
+    waitQueued(t, p, classBatch, 1)
+    first := acquireAsync(p, interactiveCtx, "interactive 1", got)
+    waitQueued(t, p, classInteractive, 1)
+    second := acquireAsync(p, interactiveCtx, "interactive 2", got)
+    waitQueued(t, p, classInteractive, 2)
+
+    // Interactive searches go first, oldest first, though the batch one
+    // waited longer.
+    hold()
+    for _, want := range []struct {
+        name    string
+        release <-chan func()
+    }{{"interactive 1", first}, {"interactive 2", second}, {"batch", batch}} {
+        if name := <-got; name != want.name {
+            t.Fatalf("%s got the worker, want %s", name, want.name)
+        }
+        (<-want.release)()
+    }
+    if stats := p.snapshot(); stats["interactive"].Started != 3 || stats["batch"].Started != 1 ||
+        stats["interactive"].Waited != 2 || stats["batch"].Waited != 1 || stats["batch"].MaxQueued != 1 {
+        t.Errorf("stats = %+v", stats)
+    }
+}
+
+func TestSearchWorkersBatchShare(t *testing.T) {
+    p := newSearchWorkers(Config{SearchWorkers: 3, BatchSearchWorkers: 1})
+    releaseBatch, err := p.acquire(batchCtx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := make(chan string, 1)
+    batch := acquireAsync(p, batchCtx, "batch", got)
+    waitQueued(t, p, classBatch, 1)
+
+    // The other two workers stay free for interactive searches.
+    var releases []func()
+    for i := 0; i < 2; i++ {
+        ctx, cancel := context.WithTimeout(interactiveCtx, time.Second)
+        release, err := p.acquire(ctx)
+        cancel()
+        if err != nil {
+            t.Fatalf("interactive search %d: %v", i, err)
+        }
+        releases = append(releases, release)
+    }
+    for _, release := range releases {
+        release()
+    }
+    select {
+    case name := <-got:
+        t.Fatalf("%s started past the batch share", name)
+    default:
+    }
+    releaseBatch()
+    if name := <-got; name != "batch" {
+        t.Fatal(name)
+    }
+    (<-batch)()
+}
+
+func TestSearchWorkersCancelWhileWaiting(t *testing.T) {
+    p := &searchWorkers{size: 1, batchMax: 1}
+    hold, err := p.acquire(interactiveCtx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ctx, cancel := context.WithCancel(interactiveCtx)
+    got := make(chan string, 1)
+    acquireAsync(p, ctx, "waiter", got)
+    waitQueued(t, p, classInteractive, 1)
+    cancel()
+    if name := <-got; name != "waiter: "+context.Canceled.Error() {
+        t.Fatalf("waiter = %q, want it cancelled", name)
+    }
+    waitQueued(t, p, classInteractive, 0)
+
+    deadline, stop := context.WithDeadline(interactiveCtx, time.Now().Add(10*time.Millisecond))
+    defer stop()
+    if _, err := p.acquire(deadline); !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("err = %v, want the deadline", err)
+    }
+
+    // The abandoned waits hold no worker.
+    hold()
+    release, err := p.acquire(interactiveCtx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    release()
+    stats := p.snapshot()["interactive"]
+    if stats.Abandoned != 2 || stats.Running != 0 || stats.Queued != 0 {
+        t.Errorf("stats = %+v", stats)
+    }
+}
+
+// TestSearchWorkersCancelRace cancels waiters as workers are handed to
+// them; a worker handed to a search that gave up must pass on.
+func TestSearchWorkersCancelRace(t *testing.T) {
+    p := &searchWorkers{size: 1, batchMax: 1}
+    for i := 0; i < 200; i++ {
+        hold, err := p.acquire(interactiveCtx)
+        if err != nil {
+            t.Fatal(err)
+        }
+        ctx, cancel := context.WithCancel(interactiveCtx)
+        done := make(chan struct{})
+        go func() {
+            defer close(done)
+            if release, err := p.acquire(ctx); err == nil {
+                release()
+            }
+        }()
+        waitQueued(t, p, classInteractive, 1)
+        go cancel()
+        hold()
+        <-done
+        cancel()
+    }
+    release, err := p.acquire(interactiveCtx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    release()
+    if stats := p.snapshot()["interactive"]; stats.Running != 0 || stats.Queued != 0 {
+        t.Errorf("after the races: %+v", stats)
+    }
+}
+
+func TestSearchWorkersDrain(t *testing.T) {
+    p := newSearchWorkers(Config{SearchWorkers: 3, BatchSearchWorkers: 2})
+    var mu sync.Mutex
+    running, peak, batchPeak, batchRunning := 0, 0, 0, 0
+    var wg sync.WaitGroup
+    for i := 0; i < 40; i++ {
+        ctx, batch := interactiveCtx, i%2 == 0
+        if batch {
+            ctx = batchCtx
+        }
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            release, err := p.acquire(ctx)
+            if err != nil {
+                t.Error(err)
+                return
+            }
+            mu.Lock()
+            running++
+            peak = max(peak, running)
+            if batch {
+                batchRunning++
+                batchPeak = max(batchPeak, batchRunning)
+            }
+            mu.Unlock()
+            time.Sleep(time.Millisecond)
+            mu.Lock()
+            running--
+            if batch {
+                batchRunning--
+            }
+            mu.Unlock()
+            release()
+        }()
+    }
+    wg.Wait()
+    if peak > 3 || batchPeak > 2 {
+        t.Errorf("%d searches ran at once, %d of them batch; want at most 3 and 2", peak, batchPeak)
+    }
+    for name, stats := range p.snapshot() {
+        if stats.Running != 0 || stats.Queued != 0 || stats.Started != 20 {
+            t.Errorf("%s after draining: %+v", name, stats)
+        }
+    }
+}
+
+func TestSearchWorkersNil(t *testing.T) {
+    var p *searchWorkers
+    release, err := p.acquire(batchCtx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    release()
+}
+
+func TestNewSearchWorkers(t *testing.T) {
+    cases := []struct {
+        workers, batch      int
+        wantSize, wantBatch int
+    }{
+        {8, 0, 8, 4},
+        {1, 0, 1, 1},
+        {4, 4, 4, 4},
+        {4, 1, 4, 1},
+    }
+    for _, c := range cases {
+        p := newSearchWorkers(Config{SearchWorkers: c.workers, BatchSearchWorkers: c.batch})
+        if p.size != c.wantSize || p.batchMax != c.wantBatch {
+            t.Errorf("workers %d batch %d: size %d batch %d, want %d and %d", c.workers, c.batch, p.size, p.batchMax, c.wantSize, c.wantBatch)
+        }
+    }
+    if p := newSearchWorkers(Config{}); p.size < 1 || p.batchMax < 1 || p.batchMax > p.size {
+        t.Errorf("default pool: size %d batch %d", p.size, p.batchMax)
+    }
+    for _, bad := range [][2]int{{-1, 0}, {2, 3}, {2, -1}} {
+        if checkSearchWorkers(bad[0], bad[1]) == nil {
+            t.Errorf("checkSearchWorkers(%d, %d) accepted", bad[0], bad[1])
+        }
+    }
+}
+
+// TestSearchWorkersPrunedRerun reruns a search the ellipse pruned on a
+// pool of one worker, which must not wait for a second.
+func TestSearchWorkersPrunedRerun(t *testing.T) {
+    router := fixtureTenant(t).Router()
+    saved := globalSearchWorkers
+    globalSearchWorkers = &searchWorkers{size: 1, batchMax: 1}
+    t.Cleanup(func() { globalSearchWorkers = saved })
+
+    start := router.snap(Point{X: -87.66, Y: 41.87}, "start").node
+    end := router.snap(Point{X: -87.65678, Y: 41.88286}, "end").node
+    for _, ctx := range []context.Context{interactiveCtx, batchCtx} {
+        ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+        stats := &searchStats{}
+        path, _, _, _, err := router.findPath(ctx, start, end, 0.5, routeParams{EllipseFactor: 1, stats: stats})
+        cancel()
+        if err != nil {
+            t.Fatalf("%s: %v", searchClassNames[searchClassFrom(ctx)], err)
+        }
+        if len(path) == 0 || stats.Reruns != 1 {
+            t.Errorf("%d points after %d reruns, want a path after 1", len(path), stats.Reruns)
+        }
+    }
+    if stats := globalSearchWorkers.snapshot(); stats["interactive"].Running != 0 || stats["batch"].Running != 0 {
+        t.Errorf("workers left running: %+v", stats)
+    }
+}